@@ -0,0 +1,244 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"cmp"
+	"context"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// adaptiveSampleRate is the average number of queries made through an
+	// AdaptivePrefixSet per query whose subtree is recorded.
+	adaptiveSampleRate = 64
+
+	// adaptiveSubtreeBits4 and adaptiveSubtreeBits6 are the lengths of the
+	// subtrees whose hits an AdaptivePrefixSet counts, for IPv4 and IPv6
+	// queries respectively.
+	adaptiveSubtreeBits4 = 16
+	adaptiveSubtreeBits6 = 32
+
+	// adaptiveMaxHot is the maximum number of subtrees laid out contiguously
+	// by AdaptivePrefixSet.Optimize.
+	adaptiveMaxHot = 64
+
+	// adaptiveShards is the number of shards over which an
+	// AdaptivePrefixSet spreads its samples.
+	adaptiveShards = 16
+
+	// adaptiveOptimizeSamples is the number of sampled queries after which
+	// an AdaptivePrefixSet optimizes itself.
+	adaptiveOptimizeSamples = 1 << 14
+)
+
+// AdaptivePrefixSet is a PrefixQuerier over an immutable PrefixSet that
+// samples the queries made through it, and periodically re-lays out the
+// PrefixSet so that the nodes of its most frequently queried subtrees are
+// stored contiguously in memory. This is meant to improve cache locality on
+// workloads where most queries fall into a small part of a large PrefixSet.
+// Since a PrefixSet made by a builder is already laid out in walk order, and
+// at most 1024 hot nodes are moved, the gain depends on the workload and the
+// hardware, and may be none; BenchmarkAdaptivePrefixSetEncompasses compares
+// an AdaptivePrefixSet with a plain PrefixSet.
+//
+// An AdaptivePrefixSet re-lays out the PrefixSet by itself, in a background
+// goroutine, after about every million queries. The goroutine exits once the
+// new layout is in place, so there is nothing to start or stop. Optimize and
+// Run re-lay out the PrefixSet on demand or on a schedule as well.
+//
+// Re-laying out the PrefixSet does not change its contents, so queries always
+// return the same results as the PrefixSet provided to
+// NewAdaptivePrefixSet. An AdaptivePrefixSet is safe for concurrent use.
+type AdaptivePrefixSet struct {
+	set atomic.Pointer[PrefixSet]
+
+	// samples is the number of queries sampled.
+	samples atomic.Uint64
+
+	// optimizing is set while an Optimize started by sample is running.
+	optimizing atomic.Bool
+
+	layoutMu sync.Mutex
+	// layout holds the hot subtrees of the current layout, in order of key,
+	// so that Optimize can skip re-laying out the PrefixSet if they have not
+	// changed.
+	layout []key
+
+	// shards hold the number of sampled queries within each subtree since
+	// the last call to Optimize. Samples go to random shards, so that
+	// concurrent queries rarely contend for a lock, however skewed they are.
+	shards [adaptiveShards]adaptiveShard
+}
+
+// adaptiveShard holds a share of the samples of an AdaptivePrefixSet.
+type adaptiveShard struct {
+	mu   sync.Mutex
+	hits map[key]int
+
+	// The padding keeps each shard on a cache line of its own.
+	_ [48]byte
+}
+
+var _ PrefixQuerier = (*AdaptivePrefixSet)(nil)
+
+// NewAdaptivePrefixSet returns an AdaptivePrefixSet that answers queries
+// using s.
+func NewAdaptivePrefixSet(s *PrefixSet) *AdaptivePrefixSet {
+	a := &AdaptivePrefixSet{}
+	a.set.Store(s)
+	return a
+}
+
+// PrefixSet returns the PrefixSet currently used to answer queries, which has
+// the same contents as the one provided to NewAdaptivePrefixSet.
+func (a *AdaptivePrefixSet) PrefixSet() *PrefixSet {
+	return a.set.Load()
+}
+
+// sample records the subtree of k, for one in every adaptiveSampleRate
+// queries on average, and starts an Optimize after every
+// adaptiveOptimizeSamples samples unless one is already running.
+//
+// Queries are chosen with the per-thread random source of math/rand/v2
+// rather than by counting them, so the queries that are not sampled share no
+// state, and those that are contend only for a random shard and a counter.
+func (a *AdaptivePrefixSet) sample(k key) {
+	r := rand.Uint64()
+	if r%adaptiveSampleRate != 0 {
+		return
+	}
+	bits := uint8(adaptiveSubtreeBits6)
+	if k.is4() {
+		bits = 96 + adaptiveSubtreeBits4
+	}
+	sh := &a.shards[r/adaptiveSampleRate%adaptiveShards]
+	sh.mu.Lock()
+	if sh.hits == nil {
+		sh.hits = make(map[key]int)
+	}
+	sh.hits[k.rooted().truncated(min(bits, k.len))]++
+	sh.mu.Unlock()
+	if a.samples.Add(1)%adaptiveOptimizeSamples == 0 && a.optimizing.CompareAndSwap(false, true) {
+		go func() {
+			defer a.optimizing.Store(false)
+			a.Optimize()
+		}()
+	}
+}
+
+// Contains returns true if the set includes the exact Prefix provided.
+func (a *AdaptivePrefixSet) Contains(p netip.Prefix) bool {
+	k := keyFromPrefix(p)
+	a.sample(k)
+	return a.set.Load().tree.contains(k)
+}
+
+// Encompasses returns true if the set includes a Prefix which completely
+// encompasses the provided Prefix.
+func (a *AdaptivePrefixSet) Encompasses(p netip.Prefix) bool {
+	k := keyFromPrefix(p)
+	a.sample(k)
+	return a.set.Load().tree.encompasses(k, false)
+}
+
+// EncompassesStrict returns true if the set includes a Prefix which
+// completely encompasses the provided Prefix. The provided Prefix itself is
+// not considered.
+func (a *AdaptivePrefixSet) EncompassesStrict(p netip.Prefix) bool {
+	k := keyFromPrefix(p)
+	a.sample(k)
+	return a.set.Load().tree.encompasses(k, true)
+}
+
+// OverlapsPrefix returns true if the set includes a Prefix which overlaps the
+// provided Prefix.
+func (a *AdaptivePrefixSet) OverlapsPrefix(p netip.Prefix) bool {
+	k := keyFromPrefix(p)
+	a.sample(k)
+	return p.IsValid() && a.set.Load().tree.overlapsKey(k)
+}
+
+// Optimize re-lays out the PrefixSet according to the queries sampled since
+// the previous call to Optimize, so that the nodes traversed by queries
+// within the most frequently hit subtrees are stored contiguously. If no
+// queries have been sampled, or the most frequently hit subtrees are those
+// of the current layout, Optimize does nothing beyond resetting the samples.
+//
+// Queries made concurrently with Optimize are answered using the previous
+// layout until the new one is complete.
+func (a *AdaptivePrefixSet) Optimize() {
+	hits := make(map[key]int)
+	for i := range a.shards {
+		sh := &a.shards[i]
+		sh.mu.Lock()
+		for k, n := range sh.hits {
+			hits[k] += n
+		}
+		sh.hits = nil
+		sh.mu.Unlock()
+	}
+	if len(hits) == 0 {
+		return
+	}
+
+	// A subtree is hot if it receives at least its share of the queries
+	// among adaptiveMaxHot subtrees, so that there are at most that many,
+	// and subtrees hit only now and then do not change the layout.
+	total := 0
+	for _, n := range hits {
+		total += n
+	}
+	var hot []key
+	for k, n := range hits {
+		if n*adaptiveMaxHot >= total {
+			hot = append(hot, k)
+		}
+	}
+	slices.SortFunc(hot, func(x, y key) int {
+		return cmp.Or(
+			cmp.Compare(x.content.hi, y.content.hi),
+			cmp.Compare(x.content.lo, y.content.lo),
+			cmp.Compare(x.len, y.len),
+		)
+	})
+	a.layoutMu.Lock()
+	defer a.layoutMu.Unlock()
+	if slices.Equal(hot, a.layout) {
+		return
+	}
+	a.layout = hot
+
+	// A node is hot if it is on the path to a hot subtree, or within one.
+	isHot := func(k key) bool {
+		for _, h := range hot {
+			if k.isPrefixOf(h) || h.isPrefixOf(k) {
+				return true
+			}
+		}
+		return false
+	}
+	s := a.set.Load()
+	a.set.Store(&PrefixSet{tree: *s.tree.copyLayout(isHot)})
+}
+
+// Run calls Optimize every interval until ctx is done, in addition to the
+// calls the AdaptivePrefixSet makes by itself. It is intended to be run in
+// its own goroutine.
+func (a *AdaptivePrefixSet) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.Optimize()
+		}
+	}
+}
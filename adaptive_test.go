@@ -0,0 +1,189 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// sampledSubtrees returns the number of subtrees with hits recorded in a.
+func sampledSubtrees(a *AdaptivePrefixSet) int {
+	n := 0
+	for i := range a.shards {
+		a.shards[i].mu.Lock()
+		n += len(a.shards[i].hits)
+		a.shards[i].mu.Unlock()
+	}
+	return n
+}
+
+func TestAdaptivePrefixSet(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	for i := 0; i < 256; i++ {
+		psb.Add(netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i), 0, 0}), 16))
+		psb.Add(netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i), byte(i), 0}), 24))
+	}
+	for _, p := range pfxs("2001:db8::/32", "2001:db8:1::/48", "::1/128") {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+	a := NewAdaptivePrefixSet(ps)
+
+	// Skew the queries towards 10.7.0.0/16.
+	hot := pfx("10.7.7.7/32")
+	for sampledSubtrees(a) == 0 {
+		a.Encompasses(hot)
+	}
+	a.Optimize()
+	if a.PrefixSet() == ps {
+		t.Fatalf("Optimize did not re-lay out the PrefixSet")
+	}
+	if n := sampledSubtrees(a); n != 0 {
+		t.Errorf("hits of %d subtrees not reset by Optimize", n)
+	}
+
+	// The layout is kept while the same subtrees are hot.
+	laidOut := a.PrefixSet()
+	for sampledSubtrees(a) == 0 {
+		a.Encompasses(hot)
+	}
+	a.Optimize()
+	if a.PrefixSet() != laidOut {
+		t.Errorf("Optimize re-laid out the PrefixSet for the same hot subtree")
+	}
+
+	// The nodes on the path to the hot query are allocated contiguously.
+	var path []*tree[uint8]
+	k := keyFromPrefix(hot)
+	a.PrefixSet().tree.walk(k, func(n *tree[uint8]) bool {
+		path = append(path, n)
+		return false
+	})
+	for i := 1; i < len(path); i++ {
+		if d := uintptr(unsafe.Pointer(path[i])) - uintptr(unsafe.Pointer(path[i-1])); d != unsafe.Sizeof(*path[i]) {
+			t.Errorf("hot nodes %v and %v are %d bytes apart", path[i-1].key, path[i].key, d)
+		}
+	}
+
+	// The contents are unchanged, and queries are answered the same way.
+	if got, want := a.PrefixSet().Prefixes(), ps.Prefixes(); !slices.Equal(got, want) {
+		t.Errorf("Prefixes() after Optimize = %v, want %v", got, want)
+	}
+	for _, q := range pfxs(
+		"10.7.7.7/32", "10.7.0.0/16", "10.7.7.0/24", "10.7.8.0/24", "11.0.0.0/8",
+		"10.0.0.0/8", "2001:db8:1:2::/64", "2001:db9::/32", "::1/128", "::/0",
+	) {
+		if got, want := a.Contains(q), ps.Contains(q); got != want {
+			t.Errorf("Contains(%v) = %v, want %v", q, got, want)
+		}
+		if got, want := a.Encompasses(q), ps.Encompasses(q); got != want {
+			t.Errorf("Encompasses(%v) = %v, want %v", q, got, want)
+		}
+		if got, want := a.EncompassesStrict(q), ps.EncompassesStrict(q); got != want {
+			t.Errorf("EncompassesStrict(%v) = %v, want %v", q, got, want)
+		}
+		if got, want := a.OverlapsPrefix(q), ps.OverlapsPrefix(q); got != want {
+			t.Errorf("OverlapsPrefix(%v) = %v, want %v", q, got, want)
+		}
+	}
+}
+
+func TestAdaptivePrefixSetRun(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	psb.Add(pfx("10.0.0.0/8"))
+	a := NewAdaptivePrefixSet(psb.PrefixSet())
+	for sampledSubtrees(a) == 0 {
+		a.Contains(pfx("10.0.0.0/8"))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx, time.Millisecond)
+		close(done)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if sampledSubtrees(a) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Run did not call Optimize")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+}
+
+func TestAdaptivePrefixSetAutomatic(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	psb.Add(pfx("10.0.0.0/8"))
+	psb.Add(pfx("10.1.0.0/16"))
+	ps := psb.PrefixSet()
+	a := NewAdaptivePrefixSet(ps)
+
+	// Queries alone cause the PrefixSet to be re-laid out.
+	for a.samples.Load() < adaptiveOptimizeSamples {
+		a.Encompasses(pfx("10.1.2.0/24"))
+	}
+	for deadline := time.Now().Add(5 * time.Second); a.PrefixSet() == ps; {
+		if time.Now().After(deadline) {
+			t.Fatal("PrefixSet not re-laid out after sampled queries")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got, want := a.PrefixSet().Prefixes(), ps.Prefixes(); !slices.Equal(got, want) {
+		t.Errorf("Prefixes() after re-layout = %v, want %v", got, want)
+	}
+}
+
+func BenchmarkAdaptivePrefixSetEncompasses(b *testing.B) {
+	// A set far larger than the hot part of it.
+	psb := &PrefixSetBuilder{}
+	for i := 0; i < 1<<20; i++ {
+		psb.Add(netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 12), byte(i >> 4), byte(i << 4)}), 28))
+	}
+	s := psb.PrefixSet()
+	r := rand.New(rand.NewPCG(1, 2))
+
+	// Most queries fall within a few /16s scattered across the set.
+	qs := make([]netip.Prefix, 4096)
+	for i := range qs {
+		hi := byte(r.IntN(256))
+		if i%8 != 0 {
+			hi = byte(r.IntN(16) * 16)
+		}
+		qs[i] = netip.PrefixFrom(netip.AddrFrom4([4]byte{10, hi, byte(r.IntN(256)), byte(r.IntN(256))}), 32)
+	}
+
+	b.Run("PrefixSet", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.Encompasses(qs[i%len(qs)])
+		}
+	})
+	a := NewAdaptivePrefixSet(s)
+	for _, q := range qs {
+		for i := 0; i < adaptiveSampleRate; i++ {
+			a.Encompasses(q)
+		}
+	}
+	a.Optimize()
+	b.Run("AdaptivePrefixSet", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			a.Encompasses(qs[i%len(qs)])
+		}
+	})
+	b.Run("AdaptivePrefixSet/Parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				a.Encompasses(qs[i%len(qs)])
+			}
+		})
+	})
+}
@@ -0,0 +1,58 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"hash"
+)
+
+// anonymizeKey returns an anonymized copy of k in which every bit at position
+// keepBits or greater (relative to the start of the address family) has been
+// flipped or not according to a pseudorandom function of the bits preceding
+// it. Because each bit depends only on the original bits before it, Prefixes
+// that share their first n bits are anonymized to Prefixes that also share
+// their first n bits (as in Crypto-PAn).
+func anonymizeKey(k key, mac hash.Hash, keepBits int) key {
+	start := keepBits
+	if k.is4() {
+		start += 96
+	}
+	var buf [17]byte
+	var sum []byte
+	out := k.content
+	for i := max(start, 0); i < int(k.len); i++ {
+		in := k.content.bitsClearedFrom(uint8(i))
+		bePutUint64(buf[:8], in.hi)
+		bePutUint64(buf[8:16], in.lo)
+		buf[16] = byte(i)
+		mac.Reset()
+		mac.Write(buf[:])
+		sum = mac.Sum(sum[:0])
+		if sum[0]&1 == 1 {
+			out = out.xor(uint128{0, 1}.shiftLeft(uint8(127 - i)))
+		}
+	}
+	return newKey(out, 0, k.len)
+}
+
+// Anonymize returns a new PrefixSet in which each Prefix of s has been
+// anonymized using a prefix-preserving scheme keyed by salt: the first
+// keepBits bits of each Prefix are kept, and the remaining bits are replaced
+// in such a way that any two Prefixes sharing their first n bits are mapped to
+// Prefixes that also share their first n bits. Prefix lengths and families are
+// preserved, so the structure of s (nesting, adjacency) is retained.
+//
+// For IPv4 Prefixes, keepBits counts bits of the IPv4 address.
+func (s *PrefixSet) Anonymize(salt []byte, keepBits int) *PrefixSet {
+	mac := hmac.New(sha256.New, salt)
+	ret := &PrefixSetBuilder{}
+	s.tree.walk(key{}, func(n *tree[uint8]) bool {
+		if n.hasValue {
+			ret.insert(anonymizeKey(n.key, mac, keepBits), n.value)
+		}
+		return false
+	})
+	return ret.PrefixSet()
+}
@@ -0,0 +1,71 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestAnonymizeKeyPreservesPrefixes(t *testing.T) {
+	in := pfxs(
+		"10.1.2.0/24",
+		"10.1.2.128/25",
+		"10.1.3.0/24",
+		"10.200.0.0/16",
+		"192.168.0.0/16",
+		"2001:db8::/32",
+		"2001:db8:1::/48",
+		"2001:db9::1/128",
+	)
+	mac := hmac.New(sha256.New, []byte("salt"))
+	const keepBits = 8
+	for _, p := range in {
+		a := keyFromPrefix(p)
+		anonA := anonymizeKey(a, mac, keepBits)
+		got := prefixFromKey(anonA)
+		if got.Bits() != p.Bits() || got.Addr().Is4() != p.Addr().Is4() {
+			t.Errorf("anonymizeKey(%v) = %v, want same length and family", p, got)
+		}
+		kept := uint8(keepBits)
+		if p.Addr().Is4() {
+			kept += 96
+		}
+		if !a.truncated(kept).isPrefixOf(anonA) {
+			t.Errorf("anonymizeKey(%v) = %v, want first %d bits kept", p, got, keepBits)
+		}
+		for _, q := range in {
+			b := keyFromPrefix(q)
+			anonB := anonymizeKey(b, mac, keepBits)
+			if want, got := a.commonPrefixLen(b), anonA.commonPrefixLen(anonB); got != want {
+				t.Errorf(
+					"%v and %v share %d bits, but anonymized %v and %v share %d",
+					p, q, want, prefixFromKey(anonA), prefixFromKey(anonB), got,
+				)
+			}
+		}
+	}
+}
+
+func TestPrefixSetAnonymize(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	for _, p := range pfxs("10.1.2.0/24", "10.1.2.128/25", "2001:db8::/32") {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+	anon := ps.Anonymize([]byte("salt"), 8)
+	if got := len(anon.Prefixes()); got != 3 {
+		t.Errorf("len(anon.Prefixes()) = %d, want 3", got)
+	}
+
+	// Anonymization is deterministic for a given salt
+	if diff := DiffString(anon, ps.Anonymize([]byte("salt"), 8)); diff != "" {
+		t.Errorf("anonymizing twice with the same salt differs:\n%s", diff)
+	}
+
+	// A different salt produces different output
+	if DiffString(anon, ps.Anonymize([]byte("pepper"), 8)) == "" {
+		t.Errorf("anonymizing with different salts produced the same set")
+	}
+}
@@ -0,0 +1,171 @@
+package netipds
+
+import (
+	"bytes"
+	"flag"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var updateAPI = flag.Bool("update-api", false, "update testdata/api.txt")
+
+// exportedAPI returns a sorted description of each exported declaration in
+// the non-test Go files in dir, one per line.
+func exportedAPI(t *testing.T, dir string) []string {
+	fset := token.NewFileSet()
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var api []string
+	node := func(n any) string {
+		var buf bytes.Buffer
+		printer.Fprint(&buf, fset, n)
+		return buf.String()
+	}
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, parser.SkipObjectResolution)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if !d.Name.IsExported() {
+					continue
+				}
+				recv := ""
+				if d.Recv != nil {
+					typ := d.Recv.List[0].Type
+					if star, ok := typ.(*ast.StarExpr); ok {
+						typ = star.X
+					}
+					base := typ
+					if idx, ok := typ.(*ast.IndexExpr); ok {
+						base = idx.X
+					} else if idx, ok := typ.(*ast.IndexListExpr); ok {
+						base = idx.X
+					}
+					if !base.(*ast.Ident).IsExported() {
+						continue
+					}
+					recv = "(" + node(d.Recv.List[0].Type) + ") "
+				}
+				api = append(api, "func "+recv+d.Name.Name+strings.TrimPrefix(node(d.Type), "func"))
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					switch s := spec.(type) {
+					case *ast.TypeSpec:
+						if !s.Name.IsExported() {
+							continue
+						}
+						name := s.Name.Name
+						if s.TypeParams != nil {
+							var params []string
+							for _, p := range s.TypeParams.List {
+								var names []string
+								for _, n := range p.Names {
+									names = append(names, n.Name)
+								}
+								params = append(params, strings.Join(names, ", ")+" "+node(p.Type))
+							}
+							name += "[" + strings.Join(params, ", ") + "]"
+						}
+						switch typ := s.Type.(type) {
+						case *ast.StructType:
+							api = append(api, "type "+name+" struct")
+							api = append(api, exportedFields("type "+name+" struct, ", typ.Fields, node)...)
+						case *ast.InterfaceType:
+							api = append(api, "type "+name+" interface")
+							api = append(api, exportedFields("type "+name+" interface, ", typ.Methods, node)...)
+						default:
+							api = append(api, "type "+name+" "+node(s.Type))
+						}
+					case *ast.ValueSpec:
+						for _, n := range s.Names {
+							if n.IsExported() {
+								api = append(api, d.Tok.String()+" "+n.Name)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	slices.Sort(api)
+	return api
+}
+
+// exportedFields returns a description of each exported field or method in
+// fields, or embedded exported type, prefixed by prefix.
+func exportedFields(prefix string, fields *ast.FieldList, node func(any) string) []string {
+	var ret []string
+	for _, f := range fields.List {
+		if len(f.Names) == 0 {
+			// An embedded type is named by its last identifier, e.g.
+			// sync.Mutex by Mutex.
+			typ := f.Type
+			if star, ok := typ.(*ast.StarExpr); ok {
+				typ = star.X
+			}
+			if sel, ok := typ.(*ast.SelectorExpr); ok {
+				typ = sel.Sel
+			}
+			if id, ok := typ.(*ast.Ident); ok && id.IsExported() {
+				ret = append(ret, prefix+"embedded "+node(f.Type))
+			}
+			continue
+		}
+		for _, n := range f.Names {
+			if !n.IsExported() {
+				continue
+			}
+			if fn, ok := f.Type.(*ast.FuncType); ok && strings.HasSuffix(prefix, "interface, ") {
+				ret = append(ret, prefix+n.Name+strings.TrimPrefix(node(fn), "func"))
+			} else {
+				ret = append(ret, prefix+n.Name+" "+node(f.Type))
+			}
+		}
+	}
+	return ret
+}
+
+// TestAPI checks that the exported API of the package matches
+// testdata/api.txt, so that changes to the public surface are deliberate.
+// Run with -update-api to accept changes.
+func TestAPI(t *testing.T) {
+	got := strings.Join(exportedAPI(t, "."), "\n") + "\n"
+	const golden = "testdata/api.txt"
+	if *updateAPI {
+		if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	wantBytes, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Split(strings.TrimSuffix(string(wantBytes), "\n"), "\n")
+	gotLines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	for _, l := range gotLines {
+		if !slices.Contains(want, l) {
+			t.Errorf("exported API not in %s: %s", golden, l)
+		}
+	}
+	for _, l := range want {
+		if !slices.Contains(gotLines, l) {
+			t.Errorf("API in %s no longer exported: %s", golden, l)
+		}
+	}
+}
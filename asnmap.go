@@ -0,0 +1,93 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"fmt"
+)
+
+// asnKey returns the key representing a single ASN. ASNs are stored in the
+// first 32 bits of the key.
+func asnKey(asn uint32) key {
+	return newKey(uint128{uint64(asn) << 32, 0}, 0, 32)
+}
+
+// asnFromKey returns the first ASN covered by k.
+func asnFromKey(k key) uint32 {
+	return uint32(k.content.hi >> 32)
+}
+
+// ASNMapBuilder builds an immutable ASNMap.
+//
+// The zero value is a valid ASNMapBuilder representing a builder with zero
+// entries.
+//
+// Call ASNMap to obtain an immutable ASNMap from an ASNMapBuilder.
+type ASNMapBuilder[T any] struct {
+	tree tree[T]
+}
+
+// Set associates the provided value with the provided ASN.
+func (m *ASNMapBuilder[T]) Set(asn uint32, value T) {
+	m.tree = *(m.tree.insert(asnKey(asn), value))
+}
+
+// SetRange associates the provided value with every ASN from first to last,
+// inclusive. Entries set for narrower ranges (or single ASNs) within the range
+// take precedence over it on lookup, regardless of insertion order.
+func (m *ASNMapBuilder[T]) SetRange(first, last uint32, value T) error {
+	if last < first {
+		return fmt.Errorf("range end is before range start: %d-%d", first, last)
+	}
+	lo := uint128{uint64(first) << 32, 0}
+	hi := uint128{uint64(last)<<32 | 0xffffffff, ^uint64(0)}
+	// A minimum length of 1 splits the full range in two, since the zero key
+	// can't hold an entry.
+	splitRange(lo, hi, 1, func(k key) {
+		m.tree = *(m.tree.insert(k, value))
+	})
+	return nil
+}
+
+// Remove removes the entry for the provided ASN, if any. Ranges containing
+// the ASN are not affected.
+func (m *ASNMapBuilder[T]) Remove(asn uint32) {
+	m.tree.remove(asnKey(asn))
+}
+
+// ASNMap returns an immutable ASNMap representing the current state of m.
+//
+// The builder remains usable after calling ASNMap.
+func (m *ASNMapBuilder[T]) ASNMap() *ASNMap[T] {
+	return &ASNMap[T]{*m.tree.copy()}
+}
+
+// ASNMap is a map of 32-bit autonomous system numbers to T, supporting
+// values assigned to ranges of ASNs. It is backed by the same radix tree as
+// PrefixMap.
+//
+// Use ASNMapBuilder to construct ASNMaps.
+type ASNMap[T any] struct {
+	tree tree[T]
+}
+
+// Get returns the value associated with the provided ASN. If the ASN was
+// assigned values both individually and via one or more ranges, the value of
+// the narrowest assignment is returned.
+func (m *ASNMap[T]) Get(asn uint32) (T, bool) {
+	_, val, ok := m.tree.parentOf(asnKey(asn), false)
+	return val, ok
+}
+
+// Range returns the narrowest range of ASNs containing the provided ASN that
+// has been assigned a value, along with the value. Ranges added with
+// SetRange are stored as aligned blocks, so the returned range may be a
+// sub-range of the one originally set.
+func (m *ASNMap[T]) Range(asn uint32) (first, last uint32, val T, ok bool) {
+	k, val, ok := m.tree.parentOf(asnKey(asn), false)
+	if !ok {
+		return 0, 0, val, false
+	}
+	first = asnFromKey(k)
+	return first, first | uint32(^uint64(0)>>(32+k.len)), val, true
+}
@@ -0,0 +1,61 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"testing"
+)
+
+func TestASNMap(t *testing.T) {
+	mb := &ASNMapBuilder[string]{}
+	mb.SetRange(64512, 65534, "private")
+	mb.Set(65000, "ours")
+	mb.SetRange(0, 0, "reserved")
+	mb.SetRange(4200000000, 4294967294, "private32")
+	if err := mb.SetRange(10, 9, "bad"); err == nil {
+		t.Errorf("mb.SetRange(10, 9) = nil, want error")
+	}
+	m := mb.ASNMap()
+
+	tests := []struct {
+		asn    uint32
+		want   string
+		wantOK bool
+	}{
+		{0, "reserved", true},
+		{1, "", false},
+		{64511, "", false},
+		{64512, "private", true},
+		{65000, "ours", true},
+		{65001, "private", true},
+		{65534, "private", true},
+		{65535, "", false},
+		{4200000000, "private32", true},
+		{4294967294, "private32", true},
+		{4294967295, "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := m.Get(tt.asn); got != tt.want || ok != tt.wantOK {
+			t.Errorf("m.Get(%d) = (%q, %v), want (%q, %v)", tt.asn, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	if first, last, _, ok := m.Range(65000); !ok || first != 65000 || last != 65000 {
+		t.Errorf("m.Range(65000) = (%d, %d, _, %v), want (65000, 65000, _, true)", first, last, ok)
+	}
+	// 64512-65023 is the largest aligned block containing 64512
+	if first, last, _, ok := m.Range(64512); !ok || first != 64512 || last != 65023 {
+		t.Errorf("m.Range(64512) = (%d, %d, _, %v), want (64512, 65023, _, true)", first, last, ok)
+	}
+
+	all := &ASNMapBuilder[bool]{}
+	all.SetRange(0, 4294967295, true)
+	if _, ok := all.ASNMap().Get(4294967295); !ok {
+		t.Errorf("Get(4294967295) after SetRange(0, 4294967295) = false, want true")
+	}
+
+	mb.Remove(65000)
+	if got, _ := mb.ASNMap().Get(65000); got != "private" {
+		t.Errorf("after Remove, Get(65000) = %q, want %q", got, "private")
+	}
+}
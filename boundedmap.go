@@ -0,0 +1,173 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"container/list"
+	"fmt"
+	"net/netip"
+)
+
+// EvictionPolicy determines which entry a BoundedPrefixMap evicts when an
+// insertion would exceed its capacity.
+type EvictionPolicy int
+
+const (
+	// EvictLRU evicts the least recently used entry. An entry is used when it
+	// is set, or when it is the result of Get or ParentOf.
+	EvictLRU EvictionPolicy = iota
+
+	// EvictMostSpecific evicts the entry whose Prefix has the most bits, as
+	// reported by netip.Prefix.Bits, whatever its address family. Ties are
+	// broken by evicting the least recently used such entry.
+	EvictMostSpecific
+)
+
+// BoundedPrefixMap is a mutable map of netip.Prefix to T that holds at most a
+// fixed number of entries, evicting existing entries according to an
+// EvictionPolicy as needed. It is intended for caches of per-Prefix results.
+//
+// Unlike PrefixMap, BoundedPrefixMap is not safe for concurrent use; even
+// lookups update its internal state.
+//
+// Use NewBoundedPrefixMap to construct a BoundedPrefixMap.
+type BoundedPrefixMap[T any] struct {
+	tree     tree[T]
+	capacity int
+	policy   EvictionPolicy
+
+	// lru orders keys from most to least recently used, and byBits[i] does
+	// the same for the keys of Prefixes with i bits. elems indexes both.
+	lru    *list.List
+	byBits [129]list.List
+	elems  map[key]boundedElems
+}
+
+// boundedElems holds the elements of a key in the lists of a
+// BoundedPrefixMap.
+type boundedElems struct {
+	lru, byBits *list.Element
+}
+
+// NewBoundedPrefixMap returns an empty BoundedPrefixMap that holds at most
+// capacity entries. capacity must be positive.
+func NewBoundedPrefixMap[T any](capacity int, policy EvictionPolicy) *BoundedPrefixMap[T] {
+	if capacity <= 0 {
+		panic(fmt.Sprintf("netipds: invalid BoundedPrefixMap capacity %d", capacity))
+	}
+	return &BoundedPrefixMap[T]{
+		capacity: capacity,
+		policy:   policy,
+		lru:      list.New(),
+		elems:    make(map[key]boundedElems),
+	}
+}
+
+// Len returns the number of entries in m.
+func (m *BoundedPrefixMap[T]) Len() int {
+	return len(m.elems)
+}
+
+// Set associates the provided value with the provided Prefix, evicting
+// another entry if m is full.
+func (m *BoundedPrefixMap[T]) Set(p netip.Prefix, value T) error {
+	if !p.IsValid() {
+		return fmt.Errorf("Prefix is not valid: %v", p)
+	}
+	k := keyFromPrefix(p)
+	if _, ok := m.elems[k]; ok {
+		m.touch(k)
+	} else {
+		if len(m.elems) >= m.capacity {
+			m.evict()
+		}
+		m.elems[k] = boundedElems{
+			lru:    m.lru.PushFront(k),
+			byBits: m.byBits[k.prefixBits()].PushFront(k),
+		}
+	}
+	m.tree = *(m.tree.insert(k, value))
+	return nil
+}
+
+// Get returns the value associated with the exact Prefix provided, if any.
+func (m *BoundedPrefixMap[T]) Get(p netip.Prefix) (T, bool) {
+	k := keyFromPrefix(p)
+	val, ok := m.tree.get(k)
+	if ok {
+		m.touch(k)
+	}
+	return val, ok
+}
+
+// ParentOf returns the longest-prefix ancestor of the Prefix provided, if any.
+// If the Prefix has no ancestors, ParentOf returns zero values and false.
+func (m *BoundedPrefixMap[T]) ParentOf(p netip.Prefix) (netip.Prefix, T, bool) {
+	k, val, ok := m.tree.parentOf(keyFromPrefix(p), false)
+	if !ok {
+		return netip.Prefix{}, val, false
+	}
+	m.touch(k.rooted())
+	return prefixFromKey(k), val, true
+}
+
+// ParentOfStrict is like ParentOf, but excludes the Prefix itself.
+func (m *BoundedPrefixMap[T]) ParentOfStrict(p netip.Prefix) (netip.Prefix, T, bool) {
+	k, val, ok := m.tree.parentOf(keyFromPrefix(p), true)
+	if !ok {
+		return netip.Prefix{}, val, false
+	}
+	m.touch(k.rooted())
+	return prefixFromKey(k), val, true
+}
+
+// Remove removes the provided Prefix from m.
+func (m *BoundedPrefixMap[T]) Remove(p netip.Prefix) error {
+	if !p.IsValid() {
+		return fmt.Errorf("Prefix is not valid: %v", p)
+	}
+	m.removeKey(keyFromPrefix(p))
+	return nil
+}
+
+// PrefixMap returns an immutable PrefixMap representing the current state of
+// m.
+func (m *BoundedPrefixMap[T]) PrefixMap() *PrefixMap[T] {
+	return &PrefixMap[T]{tree: *m.tree.copy()}
+}
+
+// touch marks k as the most recently used key.
+func (m *BoundedPrefixMap[T]) touch(k key) {
+	if e, ok := m.elems[k]; ok {
+		m.lru.MoveToFront(e.lru)
+		m.byBits[k.prefixBits()].MoveToFront(e.byBits)
+	}
+}
+
+// removeKey removes the entry for k from m, if any.
+func (m *BoundedPrefixMap[T]) removeKey(k key) {
+	e, ok := m.elems[k]
+	if !ok {
+		return
+	}
+	m.lru.Remove(e.lru)
+	m.byBits[k.prefixBits()].Remove(e.byBits)
+	delete(m.elems, k)
+	m.tree.remove(k)
+}
+
+// evict removes one entry from m according to m's policy, in constant time.
+func (m *BoundedPrefixMap[T]) evict() {
+	l := m.lru
+	if m.policy == EvictMostSpecific {
+		for i := len(m.byBits) - 1; i >= 0; i-- {
+			if m.byBits[i].Len() > 0 {
+				l = &m.byBits[i]
+				break
+			}
+		}
+	}
+	if e := l.Back(); e != nil {
+		m.removeKey(e.Value.(key))
+	}
+}
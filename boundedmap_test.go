@@ -0,0 +1,126 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestBoundedPrefixMapEviction(t *testing.T) {
+	tests := []struct {
+		policy   EvictionPolicy
+		capacity int
+		set      []netip.Prefix
+		get      []netip.Prefix
+		want     []netip.Prefix
+	}{
+		// No eviction needed
+		{EvictLRU, 2, pfxs("::0/128", "::1/128"), pfxs(), pfxs("::0/128", "::1/128")},
+
+		// Least recently set entry is evicted
+		{EvictLRU, 2, pfxs("::0/128", "::1/128", "::2/128"), pfxs(), pfxs("::1/128", "::2/128")},
+
+		// Get counts as a use
+		{
+			policy:   EvictLRU,
+			capacity: 2,
+			set:      pfxs("::0/128", "::1/128", "::2/128"),
+			get:      pfxs("::0/128"),
+			want:     pfxs("::0/128", "::2/128"),
+		},
+
+		// Updating an existing entry doesn't evict anything
+		{EvictLRU, 2, pfxs("::0/128", "::1/128", "::0/128"), pfxs(), pfxs("::0/128", "::1/128")},
+
+		// Longest prefix is evicted, regardless of recency
+		{
+			policy:   EvictMostSpecific,
+			capacity: 2,
+			set:      pfxs("::0/120", "::0/128", "::0/124"),
+			want:     pfxs("::0/120", "::0/124"),
+		},
+		{
+			policy:   EvictMostSpecific,
+			capacity: 2,
+			set:      pfxs("10.0.0.0/32", "10.0.0.0/8", "10.0.0.0/16"),
+			want:     pfxs("10.0.0.0/8", "10.0.0.0/16"),
+		},
+
+		// Prefix lengths are compared in bits of their own family
+		{
+			policy:   EvictMostSpecific,
+			capacity: 2,
+			set:      pfxs("2001:db8::/64", "10.0.0.0/24", "2001:db8::/32"),
+			want:     pfxs("10.0.0.0/24", "2001:db8::/32"),
+		},
+		{
+			policy:   EvictMostSpecific,
+			capacity: 2,
+			set:      pfxs("10.0.0.0/24", "2001::/16", "10.0.0.0/8"),
+			want:     pfxs("10.0.0.0/8", "2001::/16"),
+		},
+
+		// Ties are broken by recency
+		{
+			policy:   EvictMostSpecific,
+			capacity: 3,
+			set:      pfxs("::0/128", "10.0.0.0/8", "::1/128", "2001:db8::/32"),
+			get:      pfxs("::0/128"),
+			want:     pfxs("::0/128", "10.0.0.0/8", "2001:db8::/32"),
+		},
+	}
+	for _, tt := range tests {
+		m := NewBoundedPrefixMap[bool](tt.capacity, tt.policy)
+		for i, p := range tt.set {
+			m.Set(p, true)
+			// Interleave lookups after the first insertions so they affect
+			// recency before the final insertion triggers eviction.
+			if i == len(tt.set)-2 {
+				for _, g := range tt.get {
+					m.Get(g)
+				}
+			}
+		}
+		if m.Len() > tt.capacity {
+			t.Errorf("m.Len() = %d, want <= %d", m.Len(), tt.capacity)
+		}
+		checkMap(t, wantMap(true, prefixStrings(tt.want)...), m.PrefixMap().ToMap())
+	}
+}
+
+func TestBoundedPrefixMapParentOfTouches(t *testing.T) {
+	m := NewBoundedPrefixMap[int](2, EvictLRU)
+	m.Set(pfx("10.0.0.0/8"), 1)
+	m.Set(pfx("10.1.0.0/16"), 2)
+	if p, v, ok := m.ParentOf(pfx("10.2.3.4/32")); !ok || p != pfx("10.0.0.0/8") || v != 1 {
+		t.Errorf("m.ParentOf(10.2.3.4/32) = (%v, %v, %v), want (10.0.0.0/8, 1, true)", p, v, ok)
+	}
+	m.Set(pfx("10.3.0.0/16"), 3)
+	want := map[netip.Prefix]int{pfx("10.0.0.0/8"): 1, pfx("10.3.0.0/16"): 3}
+	checkMap(t, want, m.PrefixMap().ToMap())
+}
+
+func TestBoundedPrefixMapParentOfStrict(t *testing.T) {
+	m := NewBoundedPrefixMap[int](2, EvictLRU)
+	m.Set(pfx("10.0.0.0/8"), 1)
+	m.Set(pfx("10.1.0.0/16"), 2)
+	if p, v, ok := m.ParentOfStrict(pfx("10.1.0.0/16")); !ok || p != pfx("10.0.0.0/8") || v != 1 {
+		t.Errorf("m.ParentOfStrict(10.1.0.0/16) = (%v, %v, %v), want (10.0.0.0/8, 1, true)", p, v, ok)
+	}
+	if p, _, ok := m.ParentOfStrict(pfx("10.0.0.0/8")); ok {
+		t.Errorf("m.ParentOfStrict(10.0.0.0/8) = %v, want none", p)
+	}
+	// The strict parent is touched, so 10.1.0.0/16 is evicted.
+	m.Set(pfx("10.3.0.0/16"), 3)
+	want := map[netip.Prefix]int{pfx("10.0.0.0/8"): 1, pfx("10.3.0.0/16"): 3}
+	checkMap(t, want, m.PrefixMap().ToMap())
+}
+
+func prefixStrings(ps []netip.Prefix) []string {
+	ret := make([]string, len(ps))
+	for i, p := range ps {
+		ret[i] = p.String()
+	}
+	return ret
+}
@@ -0,0 +1,144 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"net/netip"
+	"slices"
+	"sort"
+)
+
+// LengthBucketedSet is an immutable set of Prefixes that stores its entries
+// in one hash set per Prefix length, in the manner of a TCAM emulation.
+// Longest-prefix queries probe each populated length in descending order.
+//
+// For collections with very few distinct Prefix lengths, this can be faster
+// than the radix tree used by PrefixSet. LengthBucketedSet implements
+// PrefixQuerier with the same semantics as PrefixSet, so the two can be
+// benchmarked against each other without code changes.
+//
+// Use NewLengthBucketedSet to construct a LengthBucketedSet.
+type LengthBucketedSet struct {
+	buckets [129]lengthBucket
+
+	// lens holds the populated key lengths, in descending order.
+	lens []uint8
+}
+
+var _ PrefixQuerier = (*LengthBucketedSet)(nil)
+
+// lengthBucket holds the contents of all keys of a single length.
+type lengthBucket struct {
+	set map[uint128]struct{}
+
+	// sorted holds the same contents as set, in ascending order, for range
+	// queries.
+	sorted []uint128
+}
+
+// NewLengthBucketedSet returns a LengthBucketedSet containing the Prefixes in
+// s.
+func NewLengthBucketedSet(s *PrefixSet) *LengthBucketedSet {
+	ret := &LengthBucketedSet{}
+	s.tree.walk(key{}, func(n *tree[uint8]) bool {
+		if n.hasValue {
+			b := &ret.buckets[n.key.len]
+			if b.set == nil {
+				b.set = make(map[uint128]struct{})
+			}
+			b.set[n.key.content] = struct{}{}
+			b.sorted = append(b.sorted, n.key.content)
+		}
+		return false
+	})
+	for l := 128; l >= 0; l-- {
+		if b := &ret.buckets[l]; b.set != nil {
+			ret.lens = append(ret.lens, uint8(l))
+			// walk visits IPv4 keys in a pass of their own, so a bucket of
+			// a length shared by both families may be out of order.
+			slices.SortFunc(b.sorted, func(x, y uint128) int {
+				switch {
+				case x.less(y):
+					return -1
+				case y.less(x):
+					return 1
+				}
+				return 0
+			})
+		}
+	}
+	return ret
+}
+
+// Size returns the number of Prefixes in s.
+func (s *LengthBucketedSet) Size() int {
+	n := 0
+	for _, l := range s.lens {
+		n += len(s.buckets[l].sorted)
+	}
+	return n
+}
+
+// has returns true if s includes a key of length l with the provided content,
+// truncated to l.
+func (s *LengthBucketedSet) has(content uint128, l uint8) bool {
+	_, ok := s.buckets[l].set[content.bitsClearedFrom(l)]
+	return ok
+}
+
+// Contains returns true if s includes the exact Prefix provided.
+func (s *LengthBucketedSet) Contains(p netip.Prefix) bool {
+	k := keyFromPrefix(p)
+	return s.has(k.content, k.len)
+}
+
+// Encompasses returns true if s includes a Prefix which completely
+// encompasses p.
+func (s *LengthBucketedSet) Encompasses(p netip.Prefix) bool {
+	return s.encompasses(keyFromPrefix(p), false)
+}
+
+// EncompassesStrict is like Encompasses, but p itself is not considered.
+func (s *LengthBucketedSet) EncompassesStrict(p netip.Prefix) bool {
+	return s.encompasses(keyFromPrefix(p), true)
+}
+
+func (s *LengthBucketedSet) encompasses(k key, strict bool) bool {
+	for _, l := range s.lens {
+		if l > k.len || (strict && l == k.len) {
+			continue
+		}
+		if s.has(k.content, l) {
+			return true
+		}
+	}
+	return false
+}
+
+// OverlapsPrefix returns true if s includes a Prefix which overlaps p.
+//
+// Unlike the other queries, finding Prefixes encompassed by p requires a
+// binary search of each bucket longer than p.
+func (s *LengthBucketedSet) OverlapsPrefix(p netip.Prefix) bool {
+	if !p.IsValid() {
+		return false
+	}
+	k := keyFromPrefix(p)
+	if s.encompasses(k, false) {
+		return true
+	}
+	last := k.content.bitsSetFrom(k.len)
+	for _, l := range s.lens {
+		if l <= k.len {
+			break
+		}
+		sorted := s.buckets[l].sorted
+		i := sort.Search(len(sorted), func(i int) bool {
+			return !sorted[i].less(k.content)
+		})
+		if i < len(sorted) && !last.less(sorted[i]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestLengthBucketedSet(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	for _, p := range pfxs(
+		"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "192.168.0.0/24",
+		"192.168.1.0/24", "2001:db8::/32", "2001:db8:1::/48", "::1/128",
+	) {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+	lb := NewLengthBucketedSet(ps)
+
+	if got, want := lb.Size(), ps.tree.size(); got != want {
+		t.Errorf("lb.Size() = %d, want %d", got, want)
+	}
+
+	// LengthBucketedSet must answer every query the same way as PrefixSet.
+	queries := pfxs(
+		"10.0.0.0/8", "10.0.0.0/7", "10.0.0.0/16", "10.1.0.0/16", "10.1.2.0/24",
+		"10.1.2.3/32", "10.1.3.0/24", "10.2.0.0/16", "11.0.0.0/8", "0.0.0.0/1",
+		"192.168.0.0/16", "192.168.0.0/23", "192.168.1.0/24", "192.168.2.0/24",
+		"192.168.1.128/25", "192.0.0.0/8", "128.0.0.0/1",
+		"2001:db8::/32", "2001:db8::/31", "2001:db8:1::/48", "2001:db8:1:2::/64",
+		"2001:db8:2::/48", "2001::/16", "::1/128", "::/127", "::2/128", "8000::/1",
+	)
+	for _, q := range queries {
+		if got, want := lb.Contains(q), ps.Contains(q); got != want {
+			t.Errorf("lb.Contains(%v) = %v, want %v", q, got, want)
+		}
+		if got, want := lb.Encompasses(q), ps.Encompasses(q); got != want {
+			t.Errorf("lb.Encompasses(%v) = %v, want %v", q, got, want)
+		}
+		if got, want := lb.EncompassesStrict(q), ps.EncompassesStrict(q); got != want {
+			t.Errorf("lb.EncompassesStrict(%v) = %v, want %v", q, got, want)
+		}
+		if got, want := lb.OverlapsPrefix(q), ps.OverlapsPrefix(q); got != want {
+			t.Errorf("lb.OverlapsPrefix(%v) = %v, want %v", q, got, want)
+		}
+	}
+}
+
+func BenchmarkLengthBucketedSetEncompasses(b *testing.B) {
+	psb := &PrefixSetBuilder{}
+	for i := 0; i < 1<<16; i++ {
+		psb.Add(netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 24))
+	}
+	ps := psb.PrefixSet()
+	p := pfx("10.1.2.3/32")
+	for _, q := range []struct {
+		name string
+		q    PrefixQuerier
+	}{
+		{"PrefixSet", ps},
+		{"LengthBucketedSet", NewLengthBucketedSet(ps)},
+	} {
+		b.Run(q.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				q.q.Encompasses(p)
+			}
+		})
+	}
+}
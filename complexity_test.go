@@ -0,0 +1,127 @@
+package netipds
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+)
+
+// randomPrefixes returns n random IPv4 and IPv6 Prefixes generated by r.
+func randomPrefixes(r *rand.Rand, n int) []netip.Prefix {
+	ret := make([]netip.Prefix, n)
+	for i := range ret {
+		var a netip.Addr
+		if i%2 == 0 {
+			a = netip.AddrFrom4([4]byte{byte(r.Uint32()), byte(r.Uint32()), byte(r.Uint32()), byte(r.Uint32())})
+		} else {
+			var b [16]byte
+			for j := range b {
+				b[j] = byte(r.Uint32())
+			}
+			a = netip.AddrFrom16(b)
+		}
+		ret[i], _ = a.Prefix(8 + r.IntN(a.BitLen()-7))
+	}
+	return ret
+}
+
+func randomPrefixSet(r *rand.Rand, n int) *PrefixSet {
+	psb := &PrefixSetBuilder{}
+	for _, p := range randomPrefixes(r, n) {
+		psb.Add(p)
+	}
+	return psb.PrefixSet()
+}
+
+// countVisits returns the number of tree nodes visited by fn.
+func countVisits(fn func()) int {
+	n := 0
+	visits = &n
+	defer func() { visits = nil }()
+	fn()
+	return n
+}
+
+// TestComplexity checks the bounds documented in the package comment, by
+// counting the tree nodes each operation visits on inputs of a small and a
+// large size. Each operation returns the number of items it handles: queries
+// for the single-Prefix queries, and Prefixes in its inputs and result for
+// the others. Per item, the count may grow by at most 4 times on 16 times the
+// input, which allows for the growth of a random tree's depth with the
+// logarithm of its size, but not for work that grows with the size of the
+// input (16 times) instead of with the depth of the tree.
+func TestComplexity(t *testing.T) {
+	const small, large = 1 << 10, 1 << 14
+	r := rand.New(rand.NewPCG(1, 2))
+	sets := map[int][2]*PrefixSet{}
+	for _, n := range []int{small, large} {
+		sets[n] = [2]*PrefixSet{randomPrefixSet(r, n), randomPrefixSet(r, n)}
+	}
+	queries := randomPrefixes(r, 256)
+
+	tests := []struct {
+		name string
+		op   func(n int) (items int)
+	}{
+		{"Encompasses", func(n int) int {
+			for _, q := range queries {
+				sets[n][0].Encompasses(q)
+			}
+			return len(queries)
+		}},
+		{"ParentOfAddr", func(n int) int {
+			for _, q := range queries {
+				sets[n][0].ParentOfAddr(q.Addr())
+			}
+			return len(queries)
+		}},
+		{"OverlapsPrefix", func(n int) int {
+			for _, q := range queries {
+				sets[n][0].OverlapsPrefix(q)
+			}
+			return len(queries)
+		}},
+		{"PrefixSetBuilder.Add", func(n int) int {
+			psb := &PrefixSetBuilder{}
+			for _, p := range sets[n][0].Prefixes() {
+				psb.Add(p)
+			}
+			return n
+		}},
+		{"Merge", func(n int) int {
+			psb := &PrefixSetBuilder{}
+			psb.Merge(sets[n][0])
+			psb.Merge(sets[n][1])
+			return 2 * n
+		}},
+		// The intersection of two random sets grows faster than the sets do,
+		// so its size is counted as well.
+		{"Intersect", func(n int) int {
+			psb := &PrefixSetBuilder{}
+			psb.Merge(sets[n][0])
+			psb.Intersect(sets[n][1])
+			return 2*n + psb.PrefixSet().Size()
+		}},
+		{"OverlapsSet", func(n int) int {
+			sets[n][0].OverlapsSet(sets[n][1])
+			return 2 * n
+		}},
+		{"Prefixes", func(n int) int {
+			sets[n][0].Prefixes()
+			return n
+		}},
+	}
+	for _, tt := range tests {
+		var is, il int
+		vs := countVisits(func() { is = tt.op(small) })
+		vl := countVisits(func() { il = tt.op(large) })
+		if vs == 0 {
+			t.Fatalf("%s visited no nodes", tt.name)
+		}
+		ratio := float64(vl) / float64(il) / (float64(vs) / float64(is))
+		if ratio > 4 {
+			t.Errorf("%s visited %.1f times as many nodes per item with %d times the input, want at most 4",
+				tt.name, ratio, large/small)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package netipds
+
+import (
+	"maps"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentReads exercises the read methods of PrefixSet and PrefixMap,
+// including those that derive new structures or cache state, from many
+// goroutines at once. Run it with -race.
+func TestConcurrentReads(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	for i := range 256 {
+		pmb.Set(netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i), 0, 0}), 16), i)
+		pmb.Set(netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i), byte(i), 0}), 24), i)
+	}
+	pmb.Set(pfx("10.0.0.0/8"), -1)
+	pmb.Set(pfx("2001:db8::/32"), -2)
+	pm := pmb.PrefixMap()
+	ps := pm.KeySet()
+	want := pm.ToMap()
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(g), byte(g), 1}), 32)
+			if _, v, ok := pm.ParentOf(q); !ok || v != g {
+				t.Errorf("ParentOf(%v) = %v, %v", q, v, ok)
+			}
+			if !ps.Encompasses(q) || ps.Contains(q) {
+				t.Errorf("unexpected query results for %v", q)
+			}
+			if got := pm.Size(); got != len(want) {
+				t.Errorf("Size() = %d, want %d", got, len(want))
+			}
+			if got := len(ps.Prefixes()); got != len(want) {
+				t.Errorf("len(Prefixes()) = %d, want %d", got, len(want))
+			}
+			d := pm.DescendantsOf(pfx("10.0.0.0/8"))
+			if got := d.Size(); got != len(want)-1 {
+				t.Errorf("DescendantsOf(10.0.0.0/8).Size() = %d, want %d", got, len(want)-1)
+			}
+			for range d.GroupByRoots() {
+			}
+			pm.Filter(ps).AncestorsOf(q).ToMap()
+		}()
+	}
+	wg.Wait()
+}
+
+// TestDerivedMapsDoNotAlias checks that no method of a PrefixMap derived
+// from another, sharing its storage, can modify the original, and that
+// builders do not share storage with the PrefixMaps they build.
+func TestDerivedMapsDoNotAlias(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	for i, p := range pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.0.0/16", "::1/128") {
+		pmb.Set(p, i)
+	}
+	pm := pmb.PrefixMap()
+	want := pm.ToMap()
+	d := pm.DescendantsOf(pfx("10.0.0.0/8"))
+	wantD := d.ToMap()
+
+	fsb := &PrefixSetBuilder{}
+	fsb.Add(pfx("10.1.0.0/16"))
+	filter := fsb.PrefixSet()
+	for _, m := range []*PrefixMap[int]{pm, d} {
+		m.Filter(filter)
+		m.FilterWithMode(filter, FilterExact)
+		m.DescendantsOf(pfx("10.1.0.0/16"), Strict())
+		m.AncestorsOf(pfx("10.1.2.0/24"))
+		m.KeySet()
+		for range m.GroupByRoots() {
+		}
+	}
+
+	// Modifying the builder must not affect the PrefixMaps it built.
+	pmb.Remove(pfx("10.1.0.0/16"))
+	pmb.Subtract(pfx("10.2.0.0/16"))
+	pmb.Set(pfx("10.1.2.0/24"), 100)
+	pmb.Filter(filter)
+
+	if got := pm.ToMap(); !maps.Equal(got, want) {
+		t.Errorf("original map modified: got %v, want %v", got, want)
+	}
+	if got := d.ToMap(); !maps.Equal(got, wantD) {
+		t.Errorf("derived map modified: got %v, want %v", got, wantD)
+	}
+}
@@ -0,0 +1,112 @@
+package netipds
+
+import (
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestCoreImports checks that the reduced API selected by the netipds_core
+// build tag, including its transitive dependencies, avoids finalizers and the
+// host network stack.
+func TestCoreImports(t *testing.T) {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	out, err := exec.Command(goBin, "list", "-tags", "netipds_core", "-deps", ".").Output()
+	if err != nil {
+		t.Fatalf("go list: %v", err)
+	}
+	for _, path := range strings.Fields(string(out)) {
+		if path == "net" || (strings.HasPrefix(path, "net/") && path != "net/netip") {
+			t.Errorf("reduced API depends on %s", path)
+		}
+	}
+
+	ctx := build.Default
+	ctx.BuildTags = append(ctx.BuildTags, "netipds_core")
+	pkg, err := ctx.ImportDir(".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, name := range pkg.GoFiles {
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok && sel.Sel.Name == "SetFinalizer" {
+				t.Errorf("%s: call to SetFinalizer", fset.Position(sel.Pos()))
+			}
+			return true
+		})
+	}
+}
+
+// TestCoreBuild compiles a program using the reduced API with the Go
+// toolchain, and with TinyGo if it is installed.
+func TestCoreBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping compilation in short mode")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	root, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	main := `package main
+
+import (
+	"net/netip"
+
+	"github.com/aromatt/netipds"
+)
+
+func main() {
+	var psb netipds.PrefixSetBuilder
+	psb.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	var pmb netipds.PrefixMapBuilder[uint32]
+	pmb.Set(netip.MustParsePrefix("2001:db8::/32"), 1)
+	s, m := psb.PrefixSet(), pmb.PrefixMap()
+	a := netip.MustParseAddr("2001:db8::1")
+	_, v, ok := m.LookupAddr(a)
+	println(s.ContainsAddr(a), v, ok)
+}
+`
+	files := map[string]string{
+		"go.mod": "module core\n\ngo 1.23\n\nrequire github.com/aromatt/netipds v0.0.0\n\n" +
+			"replace github.com/aromatt/netipds => " + strconv.Quote(root) + "\n",
+		"main.go": main,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compile := func(bin string) {
+		cmd := exec.Command(bin, "build", "-tags", "netipds_core", "-o", filepath.Join(dir, "core"), ".")
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("%s build: %v\n%s", filepath.Base(bin), err, out)
+		}
+	}
+	compile(goBin)
+	tinygo, err := exec.LookPath("tinygo")
+	if err != nil {
+		t.Skip("tinygo command not found")
+	}
+	compile(tinygo)
+}
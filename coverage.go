@@ -0,0 +1,107 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// CoverageMode determines which blocks are marked in a coverage bitmap.
+type CoverageMode int
+
+const (
+	// CoverageFull marks blocks in which every address is covered by the
+	// set, whether by a single Prefix or by several.
+	CoverageFull CoverageMode = iota
+
+	// CoveragePartial marks blocks in which any address is covered by the
+	// set.
+	CoveragePartial
+)
+
+// maxCoverageDepth limits the size of a coverage bitmap to 2^maxCoverageDepth
+// blocks (2 MiB).
+const maxCoverageDepth = 24
+
+// setBits sets n consecutive bits of b, starting at bit i, where bits are
+// numbered from the most significant bit of b[0].
+func setBits(b []byte, i, n int) {
+	for ; n > 0 && i%8 != 0; i, n = i+1, n-1 {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	for ; n >= 8; i, n = i+8, n-8 {
+		b[i/8] = 0xff
+	}
+	for ; n > 0; i, n = i+1, n-1 {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+}
+
+// coverage returns a bitmap of the blocks of length k.len+depth within k,
+// marked according to mode.
+func (t *tree[T]) coverage(k key, depth uint8, mode CoverageMode) []byte {
+	ret := make([]byte, (1<<depth+7)/8)
+	blockLen := k.len + depth
+	// index returns the position within k of the block containing c.
+	index := func(c uint128) int {
+		return int(c.shiftRight(128-blockLen).lo & (1<<depth - 1))
+	}
+	t.walk(k, func(n *tree[T]) bool {
+		switch {
+		case !k.isPrefixOf(n.key):
+			// n is on the path to k.
+			if n.hasValue && n.key.isPrefixOf(k) {
+				setBits(ret, 0, 1<<depth)
+				return true
+			}
+			return false
+		case n.hasValue && n.key.len <= blockLen:
+			setBits(ret, index(n.key.content), 1<<(blockLen-n.key.len))
+			return true
+		case n.key.len < blockLen:
+			return false
+		case mode == CoveragePartial:
+			// All of n's descendants are within the same block as n.
+			if n.hasValue {
+				setBits(ret, index(n.key.content), 1)
+				return true
+			}
+			return false
+		default:
+			// Only the entries beneath n lie within n's block, and none
+			// encompasses it, so whether they cover it depends on them
+			// all.
+			b := n.key.truncated(blockLen)
+			if t.covers(b) {
+				setBits(ret, index(b.content), 1)
+			}
+			return true
+		}
+	})
+	return ret
+}
+
+// CoverageBitmap divides window into blocks of the given Prefix length and
+// returns a bitmap in which bit i is set if the i'th block (in order of
+// address) is covered by s, according to mode. Bit i is bit 7-i%8 of byte i/8,
+// so the first block is the most significant bit of the first byte.
+//
+// CoverageBitmap takes time proportional to the number of Prefixes in s
+// within window, plus the size of the bitmap; this is much faster than
+// querying each block. It returns an error if window is not valid, if length
+// is shorter than window or longer than its address, or if there would be
+// more than 2^24 blocks.
+func (s *PrefixSet) CoverageBitmap(window netip.Prefix, length int, mode CoverageMode) ([]byte, error) {
+	if !window.IsValid() {
+		return nil, fmt.Errorf("Prefix is not valid: %v", window)
+	}
+	if length < window.Bits() || length > window.Addr().BitLen() {
+		return nil, fmt.Errorf("length %d is not within %v", length, window)
+	}
+	depth := length - window.Bits()
+	if depth > maxCoverageDepth {
+		return nil, fmt.Errorf("too many /%d blocks in %v", length, window)
+	}
+	return s.tree.coverage(keyFromPrefix(window), uint8(depth), mode), nil
+}
@@ -0,0 +1,82 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPrefixSetCoverageBitmap(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	for _, p := range pfxs(
+		"10.0.0.0/16", "10.1.0.0/17", "10.1.128.0/17", "10.2.0.0/17", "10.3.4.5/32",
+		"10.255.0.0/15", "2001:db8::/40", "2001:db8:100::/41", "2001:db8:ff00::/48",
+	) {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+
+	tests := []struct {
+		window netip.Prefix
+		length int
+	}{
+		{pfx("10.0.0.0/8"), 16},
+		{pfx("10.0.0.0/8"), 8},
+		{pfx("10.1.0.0/16"), 17},
+		{pfx("10.3.0.0/16"), 32},
+		{pfx("10.254.0.0/15"), 24},
+		{pfx("0.0.0.0/0"), 16},
+		{pfx("2001:db8::/32"), 40},
+		{pfx("2001:db8:100::/40"), 48},
+		{pfx("::/0"), 8},
+		{pfx("2001:db8::/16"), 24},
+	}
+	for _, tt := range tests {
+		for _, mode := range []CoverageMode{CoverageFull, CoveragePartial} {
+			got, err := ps.CoverageBitmap(tt.window, tt.length, mode)
+			if err != nil {
+				t.Errorf("CoverageBitmap(%v, %d, %d) = %v", tt.window, tt.length, mode, err)
+				continue
+			}
+			n := 1 << (tt.length - tt.window.Bits())
+			if len(got) != (n+7)/8 {
+				t.Errorf("CoverageBitmap(%v, %d, %d) has %d bytes, want %d", tt.window, tt.length, mode, len(got), (n+7)/8)
+				continue
+			}
+			// Compare each block with the equivalent query.
+			block := netip.PrefixFrom(tt.window.Masked().Addr(), tt.length)
+			for i := range n {
+				var want bool
+				if mode == CoverageFull {
+					want = ps.EncompassesRange(block.Addr(), lastAddr(block))
+				} else {
+					want = ps.OverlapsPrefix(block)
+				}
+				if bit := got[i/8]&(0x80>>(i%8)) != 0; bit != want {
+					t.Errorf("CoverageBitmap(%v, %d, %d) bit %d (%v) = %v, want %v", tt.window, tt.length, mode, i, block, bit, want)
+				}
+				block = netip.PrefixFrom(lastAddr(block).Next(), tt.length)
+			}
+			for i := n; i < len(got)*8; i++ {
+				if got[i/8]&(0x80>>(i%8)) != 0 {
+					t.Errorf("CoverageBitmap(%v, %d, %d) sets padding bit %d", tt.window, tt.length, mode, i)
+				}
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		window netip.Prefix
+		length int
+	}{
+		{netip.Prefix{}, 8},
+		{pfx("10.0.0.0/8"), 7},
+		{pfx("10.0.0.0/8"), 33},
+		{pfx("2001:db8::/32"), 57},
+	} {
+		if _, err := ps.CoverageBitmap(tt.window, tt.length, CoverageFull); err == nil {
+			t.Errorf("CoverageBitmap(%v, %d) = nil error, want error", tt.window, tt.length)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package netipds
+
+import "net/netip"
+
+// cursor is a position in the order visited by the walk of an immutable
+// tree, implemented with the tree's rankIndex.
+type cursor[T any] struct {
+	t   *tree[T]
+	idx *rankIndex[T]
+
+	// i is the position of the current entry, which is -1 before the first
+	// entry and the number of entries after the last.
+	i int
+
+	// n is the node holding the current entry, or nil if there is none.
+	n *tree[T]
+}
+
+func newCursor[T any](t *tree[T], c *rankCache[T]) cursor[T] {
+	return cursor[T]{t: t, idx: c.get(t), i: -1}
+}
+
+// move positions c at the entry at position i, or before the first or after
+// the last entry if i is out of range, and reports whether there is an entry
+// at position i.
+func (c *cursor[T]) move(i int) bool {
+	c.i = max(-1, min(i, c.idx.counts[c.t]))
+	c.n = c.idx.at(c.t, c.i)
+	return c.n != nil
+}
+
+func (c *cursor[T]) seek(p netip.Prefix) bool {
+	if !p.IsValid() {
+		return c.move(c.idx.counts[c.t])
+	}
+	return c.move(c.idx.lowerBound(c.t, keyFromPrefix(p)))
+}
+
+func (c *cursor[T]) prefix() netip.Prefix {
+	if c.n == nil {
+		return netip.Prefix{}
+	}
+	return prefixFromKey(c.n.key)
+}
+
+// PrefixMapCursor is a movable position among the entries of a PrefixMap, in
+// the order in which they are visited by PrefixMap.WalkPrune (see
+// PrefixSet.Prefixes), so each Prefix comes before its descendants. Unlike an
+// iterator, a cursor can be moved in either direction and repositioned with
+// Seek, e.g. to resume a traversal or to step through m in step with another
+// sorted sequence.
+//
+// A new cursor is positioned before the first entry. Moving a cursor takes
+// time proportional to the length of the Prefixes involved, after an index of
+// m is built on first use (see PrefixSet.At). A PrefixMapCursor is not safe
+// for concurrent use, but any number of cursors may share a PrefixMap.
+type PrefixMapCursor[T any] struct {
+	c cursor[T]
+}
+
+// Cursor returns a new cursor over m, positioned before its first entry.
+func (m *PrefixMap[T]) Cursor() *PrefixMapCursor[T] {
+	return &PrefixMapCursor[T]{c: newCursor(&m.tree, &m.rank)}
+}
+
+// Seek moves c to the first entry whose Prefix is p or is ordered after p,
+// whether or not p is in the map, and reports whether there is such an entry.
+// Host bits in p are ignored. If there is no such entry, or p is not valid, c
+// is positioned after the last entry.
+func (c *PrefixMapCursor[T]) Seek(p netip.Prefix) bool {
+	return c.c.seek(p)
+}
+
+// First moves c to the first entry and reports whether there is one.
+func (c *PrefixMapCursor[T]) First() bool {
+	return c.c.move(0)
+}
+
+// Last moves c to the last entry and reports whether there is one.
+func (c *PrefixMapCursor[T]) Last() bool {
+	return c.c.move(c.c.idx.counts[c.c.t] - 1)
+}
+
+// Next moves c to the next entry and reports whether there is one. If there
+// is not, c is positioned after the last entry.
+func (c *PrefixMapCursor[T]) Next() bool {
+	return c.c.move(c.c.i + 1)
+}
+
+// Prev moves c to the previous entry and reports whether there is one. If
+// there is not, c is positioned before the first entry.
+func (c *PrefixMapCursor[T]) Prev() bool {
+	return c.c.move(c.c.i - 1)
+}
+
+// Valid reports whether c is positioned at an entry.
+func (c *PrefixMapCursor[T]) Valid() bool {
+	return c.c.n != nil
+}
+
+// Prefix returns the Prefix of the current entry, or the zero Prefix if c is
+// not positioned at an entry.
+func (c *PrefixMapCursor[T]) Prefix() netip.Prefix {
+	return c.c.prefix()
+}
+
+// Value returns the value of the current entry, or the zero value if c is not
+// positioned at an entry.
+func (c *PrefixMapCursor[T]) Value() T {
+	if c.c.n == nil {
+		var zero T
+		return zero
+	}
+	return c.c.n.value
+}
+
+// PrefixSetCursor is a movable position among the Prefixes of a PrefixSet, in
+// the order of PrefixSet.Prefixes. See PrefixMapCursor.
+type PrefixSetCursor struct {
+	c cursor[uint8]
+}
+
+// Cursor returns a new cursor over s, positioned before its first Prefix.
+func (s *PrefixSet) Cursor() *PrefixSetCursor {
+	return &PrefixSetCursor{c: newCursor(&s.tree, &s.rank)}
+}
+
+// Seek moves c to the first Prefix in the set that is p or is ordered after
+// p, and reports whether there is one. See PrefixMapCursor.Seek.
+func (c *PrefixSetCursor) Seek(p netip.Prefix) bool {
+	return c.c.seek(p)
+}
+
+// First moves c to the first Prefix and reports whether there is one.
+func (c *PrefixSetCursor) First() bool {
+	return c.c.move(0)
+}
+
+// Last moves c to the last Prefix and reports whether there is one.
+func (c *PrefixSetCursor) Last() bool {
+	return c.c.move(c.c.idx.counts[c.c.t] - 1)
+}
+
+// Next moves c to the next Prefix and reports whether there is one.
+func (c *PrefixSetCursor) Next() bool {
+	return c.c.move(c.c.i + 1)
+}
+
+// Prev moves c to the previous Prefix and reports whether there is one.
+func (c *PrefixSetCursor) Prev() bool {
+	return c.c.move(c.c.i - 1)
+}
+
+// Valid reports whether c is positioned at a Prefix.
+func (c *PrefixSetCursor) Valid() bool {
+	return c.c.n != nil
+}
+
+// Prefix returns the current Prefix, or the zero Prefix if c is not
+// positioned at one.
+func (c *PrefixSetCursor) Prefix() netip.Prefix {
+	return c.c.prefix()
+}
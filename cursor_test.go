@@ -0,0 +1,134 @@
+package netipds
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// keyLess reports whether the entry with key a is visited before the entry
+// with key b by walk.
+func keyLess(a, b key) bool {
+	if ca, cb := orderClass(a), orderClass(b); ca != cb {
+		return ca < cb
+	}
+	common := a.commonPrefixLen(b)
+	if common >= min(a.len, b.len) {
+		return a.len < b.len
+	}
+	zero, _ := a.hasBitZeroAt(common)
+	return zero
+}
+
+func TestPrefixSetCursor(t *testing.T) {
+	sets := [][]netip.Prefix{
+		pfxs(),
+		pfxs("10.0.0.0/8"),
+		pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.0.0/16", "11.0.0.0/8"),
+		pfxs("::/64", "::/1", "10.0.0.0/8", "0.0.0.0/1", "::1/128", "2001:db8::/32", "8000::/1"),
+		pfxs("::ffff:0:0/95", "0.0.0.0/0", "1.2.3.4/32", "::fffe:0:0/96"),
+	}
+	seeks := pfxs(
+		"0.0.0.0/0", "9.0.0.0/8", "10.0.0.0/8", "10.0.0.0/9", "10.1.0.0/15",
+		"10.1.2.0/24", "10.1.3.0/24", "10.128.0.0/9", "12.0.0.0/8", "255.255.255.255/32",
+		"::/0", "::/1", "::/63", "::/65", "::2/128", "::ffff:0:0/95", "::ffff:0:0/97",
+		"2001:db8::/48", "2001:db9::/32", "ffff::/16",
+	)
+	for _, set := range sets {
+		psb := &PrefixSetBuilder{}
+		for _, p := range set {
+			psb.Add(p)
+		}
+		ps := psb.PrefixSet()
+		prefixes := ps.Prefixes()
+
+		// Forward and backward traversals visit the Prefixes in order.
+		c := ps.Cursor()
+		if c.Valid() {
+			t.Errorf("%v: new cursor is positioned at %v", ps, c.Prefix())
+		}
+		var got []netip.Prefix
+		for c.Next() {
+			got = append(got, c.Prefix())
+		}
+		checkPrefixSlice(t, got, prefixes)
+		got = got[:0]
+		for c.Prev() {
+			got = append(got, c.Prefix())
+		}
+		for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+			got[i], got[j] = got[j], got[i]
+		}
+		checkPrefixSlice(t, got, prefixes)
+		if c.Valid() || c.Prefix() != (netip.Prefix{}) {
+			t.Errorf("%v: cursor before first is positioned at %v", ps, c.Prefix())
+		}
+		if len(prefixes) > 0 {
+			if !c.Last() || c.Prefix() != prefixes[len(prefixes)-1] {
+				t.Errorf("%v: Last() moved to %v", ps, c.Prefix())
+			}
+			if !c.First() || c.Prefix() != prefixes[0] {
+				t.Errorf("%v: First() moved to %v", ps, c.Prefix())
+			}
+		}
+
+		// Seek moves to the first Prefix not ordered before the target.
+		for _, p := range seeks {
+			want := len(prefixes)
+			for i, q := range prefixes {
+				if !keyLess(keyFromPrefix(q), keyFromPrefix(p)) {
+					want = i
+					break
+				}
+			}
+			ok := c.Seek(p)
+			if ok != (want < len(prefixes)) || (ok && c.Prefix() != prefixes[want]) {
+				t.Errorf("%v: Seek(%v) moved to %v, %v, want index %d", ps, p, c.Prefix(), ok, want)
+				continue
+			}
+			if c.Prev() != (want > 0) || (want > 0 && c.Prefix() != prefixes[want-1]) {
+				t.Errorf("%v: Prev() after Seek(%v) moved to %v", ps, p, c.Prefix())
+			}
+		}
+		if c.Seek(netip.Prefix{}) || c.Valid() {
+			t.Errorf("%v: Seek of invalid Prefix moved to %v", ps, c.Prefix())
+		}
+	}
+}
+
+func TestPrefixMapCursor(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	for i, p := range pfxs("10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32", "2001:db8:1::/48") {
+		pmb.Set(p, i)
+	}
+	pm := pmb.PrefixMap()
+
+	c := pm.Cursor()
+	tests := []struct {
+		move      func() bool
+		want      bool
+		wantPfx   netip.Prefix
+		wantValue int
+	}{
+		{c.Next, true, pfx("10.0.0.0/8"), 0},
+		{func() bool { return c.Seek(pfx("10.1.2.3/16")) }, true, pfx("10.1.0.0/16"), 1},
+		{func() bool { return c.Seek(pfx("10.1.0.0/17")) }, true, pfx("2001:db8::/32"), 2},
+		{c.Next, true, pfx("2001:db8:1::/48"), 3},
+		{c.Next, false, netip.Prefix{}, 0},
+		{c.Next, false, netip.Prefix{}, 0},
+		{c.Prev, true, pfx("2001:db8:1::/48"), 3},
+		{func() bool { return c.Seek(pfx("::1/128")) }, true, pfx("2001:db8::/32"), 2},
+		{c.Prev, true, pfx("10.1.0.0/16"), 1},
+		{c.Prev, true, pfx("10.0.0.0/8"), 0},
+		{c.Prev, false, netip.Prefix{}, 0},
+		{c.Last, true, pfx("2001:db8:1::/48"), 3},
+		// ::/0 encompasses ::ffff:0:0/96, so it is ordered first.
+		{func() bool { return c.Seek(pfx("::/0")) }, true, pfx("10.0.0.0/8"), 0},
+	}
+	for i, tt := range tests {
+		got := tt.move()
+		if got != tt.want || c.Prefix() != tt.wantPfx || c.Value() != tt.wantValue {
+			t.Errorf("step %d: got %v at %v = %d, want %v at %v = %d",
+				i, got, c.Prefix(), c.Value(), tt.want, tt.wantPfx, tt.wantValue)
+		}
+	}
+}
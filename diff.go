@@ -0,0 +1,50 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"strings"
+)
+
+// DiffString returns a line-based description of the differences between the
+// compacted forms (see PrefixSet.PrefixesCompact) of a and b, intended for
+// human review.
+//
+// Each line consists of "-" followed by a Prefix present only in a's compacted
+// form, or "+" followed by a Prefix present only in b's compacted form.
+// Prefixes present in both are omitted. Lines are ordered by Prefix in the
+// same order as PrefixSet.Prefixes; a "-" line precedes a "+" line for the
+// same position. If there are no differences, DiffString returns "".
+func DiffString(a, b *PrefixSet) string {
+	const (
+		inA = 1 << iota
+		inB
+	)
+	var flags PrefixMapBuilder[int]
+	for _, p := range a.PrefixesCompact() {
+		flags.Set(p, inA)
+	}
+	for _, p := range b.PrefixesCompact() {
+		f, _ := flags.Get(p)
+		flags.Set(p, f|inB)
+	}
+
+	var sb strings.Builder
+	flags.tree.walk(key{}, func(n *tree[int]) bool {
+		if !n.hasValue {
+			return false
+		}
+		switch n.value {
+		case inA:
+			sb.WriteString("-")
+		case inB:
+			sb.WriteString("+")
+		default:
+			return false
+		}
+		sb.WriteString(prefixFromKey(n.key).String())
+		sb.WriteString("\n")
+		return false
+	})
+	return sb.String()
+}
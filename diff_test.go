@@ -0,0 +1,45 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestDiffString(t *testing.T) {
+	tests := []struct {
+		a    []netip.Prefix
+		b    []netip.Prefix
+		want string
+	}{
+		{pfxs(), pfxs(), ""},
+		{pfxs("::0/128"), pfxs("::0/128"), ""},
+		{pfxs("::0/128"), pfxs(), "-::/128\n"},
+		{pfxs(), pfxs("::0/128"), "+::/128\n"},
+		{pfxs("::0/128"), pfxs("::1/128"), "-::/128\n+::1/128\n"},
+
+		// Prefixes are compacted before comparing
+		{pfxs("::0/127", "::1/128"), pfxs("::0/127"), ""},
+		{pfxs("::0/127"), pfxs("::0/128"), "-::/127\n+::/128\n"},
+
+		// Lines are in trie order
+		{
+			a:    pfxs("10.0.0.0/8", "192.168.0.0/16", "2001:db8::/32"),
+			b:    pfxs("10.0.0.0/16", "172.16.0.0/12", "2001:db8::/32"),
+			want: "-10.0.0.0/8\n+10.0.0.0/16\n+172.16.0.0/12\n-192.168.0.0/16\n",
+		},
+	}
+	for _, tt := range tests {
+		a, b := &PrefixSetBuilder{}, &PrefixSetBuilder{}
+		for _, p := range tt.a {
+			a.Add(p)
+		}
+		for _, p := range tt.b {
+			b.Add(p)
+		}
+		if got := DiffString(a.PrefixSet(), b.PrefixSet()); got != tt.want {
+			t.Errorf("DiffString(%v, %v) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
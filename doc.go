@@ -0,0 +1,49 @@
+// Package netipds provides immutable collection types for netip.Prefix:
+// PrefixSet and PrefixMap, each built with a builder type (PrefixSetBuilder
+// and PrefixMapBuilder). Both are backed by a binary radix tree with path
+// compression, in which IPv4 Prefixes are stored as the IPv4-mapped IPv6
+// Prefixes within ::ffff:0:0/96.
+//
+// # Order
+//
+// Methods that visit the Prefixes of a set or map in order, such as All,
+// Prefixes and WalkPrune, use the order defined by netip.Prefix.Compare,
+// whatever the order in which the Prefixes were added, except that IPv6
+// Prefixes encompassing ::ffff:0:0/96 come before the IPv4 Prefixes, so that
+// each Prefix is visited before its descendants (see PrefixSet.Prefixes).
+// The PostOrder option visits each Prefix after its descendants instead, and
+// AllSorted visits them in other orders.
+//
+// # Complexity
+//
+// In the following, n is the number of Prefixes in a set or map (m for a
+// second operand), and L is the length in bits of the Prefix or address
+// involved, at most 128, which bounds the depth of the tree beneath it. The
+// costs of the methods fall into a few classes:
+//
+//   - Queries of a single Prefix or address, such as Contains, Encompasses,
+//     OverlapsPrefix, Get, ParentOf, RootOf, ContainsAddr and LookupAddr, take
+//     O(L) time, independent of n. The address lookups do not allocate.
+//   - Builder methods that add or remove a single Prefix, such as Add, Set,
+//     Remove and Subtract, take O(L) time.
+//   - Queries that return a collection, such as DescendantsOf and
+//     AncestorsOf, take O(L + k) time, where k is the size of the result.
+//   - Operations over whole sets, such as Merge, Intersect, Filter,
+//     OverlapsSet and EncompassesSet, take O((n + m) * L) time or better;
+//     none is quadratic in the number of Prefixes.
+//   - Iteration (All, Prefixes, ToMap and similar) and building an
+//     immutable snapshot from a builder take O(n) time.
+//   - Size takes O(n) time on the first call and O(1) thereafter. At and
+//     IndexOf build an index in O(n) time on first use and take O(L) time
+//     thereafter.
+//
+// Methods whose cost differs from their class document it.
+//
+// # Reduced API
+//
+// Building with the netipds_core tag leaves out everything but PrefixSet,
+// PrefixMap, their builders and the types they return, for embedded use,
+// e.g. with TinyGo. The reduced API uses no finalizers and does not depend on
+// the host's network stack. It still uses fmt, and so reflection, to format
+// errors and the values held by a PrefixMap.
+package netipds
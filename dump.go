@@ -0,0 +1,122 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ValueEncoder encodes a value of a PrefixMap for Dump.
+type ValueEncoder[T any] func(T) ([]byte, error)
+
+// ValueDecoder decodes a value encoded by the corresponding ValueEncoder, for
+// PrefixMapBuilder.Restore.
+type ValueDecoder[T any] func([]byte) (T, error)
+
+// dumpHeader is the first line written by Dump, describing the format.
+const dumpHeader = "# netipds PrefixMap dump: prefix<TAB>base64(value)\n"
+
+// EncoderFor returns the built-in ValueEncoder for T, if there is one. There
+// are built-in codecs for string and []byte, which are encoded as-is, and
+// int64, which is encoded in decimal.
+func EncoderFor[T any]() (ValueEncoder[T], bool) {
+	var enc any
+	switch any(*new(T)).(type) {
+	case string:
+		enc = ValueEncoder[string](func(v string) ([]byte, error) {
+			return []byte(v), nil
+		})
+	case []byte:
+		enc = ValueEncoder[[]byte](func(v []byte) ([]byte, error) {
+			return v, nil
+		})
+	case int64:
+		enc = ValueEncoder[int64](func(v int64) ([]byte, error) {
+			return strconv.AppendInt(nil, v, 10), nil
+		})
+	}
+	ret, ok := enc.(ValueEncoder[T])
+	return ret, ok
+}
+
+// DecoderFor returns the built-in ValueDecoder for T, if there is one. See
+// EncoderFor.
+func DecoderFor[T any]() (ValueDecoder[T], bool) {
+	var dec any
+	switch any(*new(T)).(type) {
+	case string:
+		dec = ValueDecoder[string](func(b []byte) (string, error) {
+			return string(b), nil
+		})
+	case []byte:
+		dec = ValueDecoder[[]byte](func(b []byte) ([]byte, error) {
+			return b, nil
+		})
+	case int64:
+		dec = ValueDecoder[int64](func(b []byte) (int64, error) {
+			return strconv.ParseInt(string(b), 10, 64)
+		})
+	}
+	ret, ok := dec.(ValueDecoder[T])
+	return ret, ok
+}
+
+// Dump writes the entries of m to w in a line-oriented text format intended
+// for inspection and editing by hand, using enc to encode each value (see
+// EncoderFor). After a comment line describing the format, each entry is
+// written on a line of its own, in the same order as All, as the Prefix and
+// the base64 encoding of its value, separated by a tab. Use
+// PrefixMapBuilder.Restore to read the result.
+func (m *PrefixMap[T]) Dump(w io.Writer, enc ValueEncoder[T]) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(dumpHeader)
+	for p, v := range m.All() {
+		b, err := enc(v)
+		if err != nil {
+			return fmt.Errorf("encoding value for %v: %w", p, err)
+		}
+		bw.WriteString(p.String())
+		bw.WriteByte('\t')
+		bw.WriteString(base64.StdEncoding.EncodeToString(b))
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// Restore sets the entries read from r, in the format written by
+// PrefixMap.Dump, using dec to decode each value (see DecoderFor). Prefixes
+// are parsed as by SetString. Empty lines and lines beginning with '#' are
+// ignored. If a line is invalid, Restore returns an error identifying it, and
+// the entries on the preceding lines remain set.
+func (m *PrefixMapBuilder[T]) Restore(r io.Reader, dec ValueDecoder[T]) error {
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		// The value of an empty encoding is empty, so the tab may end the
+		// line.
+		p, enc, ok := strings.Cut(sc.Text(), "\t")
+		if !ok {
+			return fmt.Errorf("line %d: missing value", line)
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(enc))
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		v, err := dec(b)
+		if err != nil {
+			return fmt.Errorf("line %d: decoding value: %w", line, err)
+		}
+		if err := m.SetString(strings.TrimSpace(p), v); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,109 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDumpRestore(t *testing.T) {
+	pmb := &PrefixMapBuilder[string]{}
+	pmb.Set(pfx("10.0.0.0/8"), "ten")
+	pmb.Set(pfx("2001:db8::/32"), "")
+	pmb.Set(pfx("192.168.0.0/16"), "with\ttab")
+	pm := pmb.PrefixMap()
+
+	enc, ok := EncoderFor[string]()
+	if !ok {
+		t.Fatal("EncoderFor[string]() not found")
+	}
+	dec, _ := DecoderFor[string]()
+	var buf bytes.Buffer
+	if err := pm.Dump(&buf, enc); err != nil {
+		t.Fatalf("Dump() = %v", err)
+	}
+	want := dumpHeader +
+		"10.0.0.0/8\tdGVu\n" +
+		"192.168.0.0/16\td2l0aAl0YWI=\n" +
+		"2001:db8::/32\t\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Dump() wrote\n%s\nwant\n%s", got, want)
+	}
+
+	restored := &PrefixMapBuilder[string]{}
+	if err := restored.Restore(&buf, dec); err != nil {
+		t.Fatalf("Restore() = %v", err)
+	}
+	if got, want := restored.PrefixMap().String(), pm.String(); got != want {
+		t.Errorf("Restore() =\n%s\nwant\n%s", got, want)
+	}
+
+	// Hand-edited input
+	edited := &PrefixMapBuilder[string]{}
+	err := edited.Restore(strings.NewReader("# edited\n\n  172.16.0.0/12\taGk= \r\n"), dec)
+	if err != nil {
+		t.Fatalf("Restore() of edited input = %v", err)
+	}
+	if v, ok := edited.Get(pfx("172.16.0.0/12")); !ok || v != "hi" {
+		t.Errorf("Get(172.16.0.0/12) after Restore = %q, %v, want \"hi\", true", v, ok)
+	}
+
+	for _, in := range []string{
+		"10.0.0.0/8\n",
+		"10.0.0.0/8\t!!!\n",
+		"bogus\tdGVu\n",
+	} {
+		b := &PrefixMapBuilder[string]{}
+		if err := b.Restore(strings.NewReader(dumpHeader+in), dec); err == nil || !strings.HasPrefix(err.Error(), "line 2: ") {
+			t.Errorf("Restore(%q) = %v, want error for line 2", in, err)
+		}
+	}
+
+	errEnc := errors.New("unencodable")
+	if err := pm.Dump(&buf, func(string) ([]byte, error) { return nil, errEnc }); !errors.Is(err, errEnc) {
+		t.Errorf("Dump() with failing encoder = %v, want %v", err, errEnc)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	checkRoundTrip(t, int64(-42))
+	checkRoundTrip(t, "value")
+	checkRoundTrip(t, []byte{0, 1, 2})
+	if _, ok := EncoderFor[int](); ok {
+		t.Errorf("EncoderFor[int]() found, want none")
+	}
+	if _, ok := DecoderFor[any](); ok {
+		t.Errorf("DecoderFor[any]() found, want none")
+	}
+	dec, _ := DecoderFor[int64]()
+	if _, err := dec([]byte("x")); err == nil {
+		t.Errorf("int64 decoder accepted %q", "x")
+	}
+}
+
+func checkRoundTrip[T any](t *testing.T, v T) {
+	t.Helper()
+	enc, ok := EncoderFor[T]()
+	if !ok {
+		t.Fatalf("EncoderFor[%T]() not found", v)
+	}
+	dec, ok := DecoderFor[T]()
+	if !ok {
+		t.Fatalf("DecoderFor[%T]() not found", v)
+	}
+	b, err := enc(v)
+	if err != nil {
+		t.Fatalf("encoding %v: %v", v, err)
+	}
+	got, err := dec(b)
+	if err != nil {
+		t.Fatalf("decoding %v: %v", v, err)
+	}
+	if a, b := fmt.Sprint(got), fmt.Sprint(v); a != b {
+		t.Errorf("round trip of %v = %v", b, a)
+	}
+}
@@ -0,0 +1,183 @@
+package netipds
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// fuzzInput decodes Prefixes and operations from the bytes provided by the
+// fuzzer.
+type fuzzInput struct {
+	b []byte
+}
+
+func (in *fuzzInput) byte() byte {
+	if len(in.b) == 0 {
+		return 0
+	}
+	ret := in.b[0]
+	in.b = in.b[1:]
+	return ret
+}
+
+// addr returns an IPv4 or IPv6 address. Addresses are drawn from a small
+// space, so that the Prefixes used by an operation are likely to be related.
+func (in *fuzzInput) addr() netip.Addr {
+	fam, hi, lo := in.byte(), in.byte(), in.byte()
+	if fam&1 == 0 {
+		return netip.AddrFrom4([4]byte{10, hi, lo, 0})
+	}
+	return netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, hi, lo})
+}
+
+// prefix returns a Prefix of any length, including /0.
+func (in *fuzzInput) prefix() netip.Prefix {
+	a := in.addr()
+	p, _ := a.Prefix(int(in.byte()) % (a.BitLen() + 1))
+	return p
+}
+
+// lastAddr returns the last address within p, which must be masked.
+func lastAddr(p netip.Prefix) netip.Addr {
+	k := keyFromPrefix(p)
+	return prefixFromKey(key{k.content.bitsSetFrom(k.len), 0, 128}).Addr()
+}
+
+// FuzzPrefixSetBuilder applies arbitrary sequences of whole-set operations to
+// two builders, checking that none of them panic and that the results are
+// consistent.
+func FuzzPrefixSetBuilder(f *testing.F) {
+	f.Add([]byte{})
+	// Add ::/0 and 0.0.0.0/0, then subtract them
+	f.Add([]byte{0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 2, 1, 0, 0, 0, 2, 0, 0, 0, 0})
+	// Add to both, then intersect, merge and filter
+	f.Add([]byte{0, 0, 1, 0, 8, 1, 0, 1, 2, 16, 3, 4, 5, 6, 7})
+	f.Add([]byte{0, 1, 1, 0, 32, 1, 1, 1, 2, 48, 8, 0, 1, 0, 0, 1, 1, 0, 255, 3})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		in := &fuzzInput{b}
+		a, o := &PrefixSetBuilder{}, &PrefixSetBuilder{}
+		for len(in.b) > 0 {
+			switch op := in.byte(); op % 12 {
+			case 0:
+				p := in.prefix()
+				a.Add(p)
+				// ::/0 is stored at the root of the tree, where queries do
+				// not find it.
+				if p.Bits() > 0 && !a.PrefixSet().Encompasses(p) {
+					t.Fatalf("Add(%v) did not add %v", p, p)
+				}
+			case 1:
+				o.Add(in.prefix())
+			case 2:
+				p := in.prefix()
+				a.Subtract(p)
+				if a.PrefixSet().OverlapsPrefix(p) {
+					t.Fatalf("Subtract(%v) left %v", p, a.PrefixSet())
+				}
+			case 3:
+				a.Intersect(o.PrefixSet())
+			case 4:
+				a.Merge(o.PrefixSet())
+			case 5:
+				a.Filter(o.PrefixSet())
+			case 6:
+				a.RemoveEncompassedBy(o.PrefixSet())
+			case 7:
+				a.Remove(in.prefix())
+			case 8:
+				first, last := in.addr(), in.addr()
+				if last.Less(first) {
+					first, last = last, first
+				}
+				a.SubtractRange(first, last)
+			case 9:
+				first, last := in.addr(), in.addr()
+				if last.Less(first) {
+					first, last = last, first
+				}
+				a.IntersectRange(first, last)
+			case 10:
+				a = &PrefixSetBuilder{}
+				a.Merge(o.PrefixSet(WithMergedSiblings()))
+			case 11:
+				a.MergeReporting(o.PrefixSet())
+			}
+		}
+
+		// Exercise the read-only operations on the result.
+		s, os := a.PrefixSet(), o.PrefixSet()
+		s.Prefixes()
+		s.PrefixesCompact()
+		for range s.AddressCounts() {
+		}
+		for range s.AggregationCandidates() {
+		}
+		for range s.Nodes() {
+		}
+		s.EncompassesSet(os)
+		ib := &PrefixSetBuilder{}
+		ib.Merge(s)
+		ib.Intersect(os)
+		if got, want := s.OverlapsSet(os), ib.PrefixSet().Size() > 0; got != want {
+			t.Fatalf("%v.OverlapsSet(%v) = %v, want %v", s, os, got, want)
+		}
+		s.IntersectAnnotated(os)
+		// The Prefixes are in the order of netip.Prefix.Compare.
+		valid := slices.DeleteFunc(s.Prefixes(), func(p netip.Prefix) bool { return !p.IsValid() })
+		for i := 1; i < len(valid); i++ {
+			if comparePrefixes(valid[i-1], valid[i]) >= 0 {
+				t.Fatalf("%v.Prefixes() has %v before %v", s, valid[i-1], valid[i])
+			}
+		}
+		for i, p := range s.Prefixes() {
+			// ::/0 is stored at the root of the tree, where queries do not
+			// find it.
+			if p.IsValid() && p.Bits() > 0 {
+				if got, _ := s.At(i); got != p {
+					t.Fatalf("%v.At(%d) = %v, want %v", s, i, got, p)
+				}
+				if got, ok := s.IndexOf(p); got != i || !ok {
+					t.Fatalf("%v.IndexOf(%v) = %d, %v, want %d", s, p, got, ok, i)
+				}
+				if c := s.Cursor(); !c.Seek(p) || c.Prefix() != p {
+					t.Fatalf("%v: Seek(%v) moved to %v", s, p, c.Prefix())
+				}
+			}
+		}
+		// The gaps within a Prefix, together with s, cover it.
+		for _, within := range []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")} {
+			gb := &PrefixSetBuilder{}
+			gb.Merge(s)
+			for p := range s.GapsWithin(within) {
+				if s.OverlapsPrefix(p) {
+					t.Fatalf("gap %v overlaps %v", p, s)
+				}
+				gb.Add(p)
+			}
+			if !gb.PrefixSet().EncompassesRange(within.Addr(), lastAddr(within)) {
+				t.Fatalf("gaps within %v do not cover the rest of %v", within, s)
+			}
+		}
+		a.PrefixSet(WithCompaction())
+		// Queries with invalid Prefixes find nothing.
+		invalid := []netip.Prefix{{}, netip.PrefixFrom(netip.IPv6Unspecified(), 129)}
+		for _, p := range invalid {
+			if s.Contains(p) || s.Encompasses(p) || s.EncompassesStrict(p) || s.OverlapsPrefix(p) {
+				t.Fatalf("query for invalid Prefix %v matched %v", p, s)
+			}
+			for _, r := range []*PrefixSet{s.ChildrenOf(p), s.DescendantsOf(p), s.AncestorsOf(p)} {
+				if r.Size() != 0 {
+					t.Fatalf("query for invalid Prefix %v returned %v", p, r)
+				}
+			}
+		}
+		for _, p := range os.Prefixes() {
+			s.ChildrenOf(p)
+			s.AncestorsOf(p, Strict())
+			s.DescendantsOf(p, Strict())
+			s.SubtractFromPrefix(p)
+		}
+	})
+}
@@ -0,0 +1,91 @@
+//go:build !tinygo && !netipds_core
+
+package netipds
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// PrefixSetFromInterfaces returns a PrefixSet containing the networks
+// assigned to the local system's network interfaces, i.e. the Prefix of each
+// interface address with its host bits cleared. Only the interfaces for
+// which filter returns true are included; if filter is nil, all interfaces
+// are included.
+//
+// IPv4 addresses reported in IPv4-mapped form are converted to IPv4, and IPv6
+// zones are discarded. Addresses without a netmask are included as
+// single-address Prefixes.
+func PrefixSetFromInterfaces(filter func(net.Interface) bool) (*PrefixSet, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	addrs := func(iface net.Interface) ([]net.Addr, error) {
+		return iface.Addrs()
+	}
+	return prefixSetFromInterfaces(ifaces, addrs, filter)
+}
+
+// prefixSetFromInterfaces implements PrefixSetFromInterfaces, using addrs to
+// obtain the addresses of each interface.
+func prefixSetFromInterfaces(
+	ifaces []net.Interface,
+	addrs func(net.Interface) ([]net.Addr, error),
+	filter func(net.Interface) bool,
+) (*PrefixSet, error) {
+	var psb PrefixSetBuilder
+	for _, iface := range ifaces {
+		if filter != nil && !filter(iface) {
+			continue
+		}
+		as, err := addrs(iface)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", iface.Name, err)
+		}
+		for _, a := range as {
+			p, err := prefixFromNetAddr(a)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", iface.Name, err)
+			}
+			psb.Add(p)
+		}
+	}
+	return psb.PrefixSet(), nil
+}
+
+// prefixFromNetAddr converts an interface address, as returned by
+// net.Interface.Addrs, to a Prefix.
+func prefixFromNetAddr(a net.Addr) (netip.Prefix, error) {
+	var (
+		ip   net.IP
+		mask net.IPMask
+	)
+	switch a := a.(type) {
+	case *net.IPNet:
+		ip, mask = a.IP, a.Mask
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		return netip.Prefix{}, fmt.Errorf("unsupported address type %T: %v", a, a)
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Prefix{}, fmt.Errorf("invalid address: %v", a)
+	}
+	addr = addr.Unmap()
+	bits := addr.BitLen()
+	if mask != nil {
+		ones, size := mask.Size()
+		// IPv4 masks may be reported in 16-byte form.
+		if size == 128 && addr.Is4() {
+			ones -= 96
+		}
+		if size == 0 || ones < 0 || ones > bits {
+			return netip.Prefix{}, fmt.Errorf("invalid netmask: %v", a)
+		}
+		bits = ones
+	}
+	return netip.PrefixFrom(addr, bits).Masked(), nil
+}
@@ -0,0 +1,76 @@
+//go:build !tinygo && !netipds_core
+
+package netipds
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestPrefixSetFromInterfaces(t *testing.T) {
+	ifaces := []net.Interface{
+		{Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+		{Name: "eth0", Flags: net.FlagUp},
+		{Name: "eth1"},
+	}
+	addrs := map[string][]net.Addr{
+		"lo": {
+			&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+			&net.IPNet{IP: net.ParseIP("::1"), Mask: net.CIDRMask(128, 128)},
+		},
+		"eth0": {
+			// 16-byte IPv4 address and mask
+			&net.IPNet{IP: net.ParseIP("192.168.1.10"), Mask: net.CIDRMask(120, 128)},
+			&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+			&net.IPAddr{IP: net.ParseIP("2001:db8::1"), Zone: "eth0"},
+		},
+		"eth1": {
+			&net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)},
+		},
+	}
+	fake := func(iface net.Interface) ([]net.Addr, error) {
+		return addrs[iface.Name], nil
+	}
+
+	tests := []struct {
+		name   string
+		filter func(net.Interface) bool
+		want   []string
+	}{
+		{"all", nil, []string{
+			"10.0.0.0/24", "127.0.0.0/8", "192.168.1.0/24", "::1/128", "2001:db8::1/128", "fe80::/64",
+		}},
+		{"up, not loopback", func(i net.Interface) bool {
+			return i.Flags&net.FlagUp != 0 && i.Flags&net.FlagLoopback == 0
+		}, []string{
+			"192.168.1.0/24", "2001:db8::1/128", "fe80::/64",
+		}},
+	}
+	for _, tt := range tests {
+		s, err := prefixSetFromInterfaces(ifaces, fake, tt.filter)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		checkPrefixSlice(t, s.Prefixes(), pfxs(tt.want...))
+	}
+
+	errAddrs := errors.New("addrs")
+	_, err := prefixSetFromInterfaces(ifaces, func(net.Interface) ([]net.Addr, error) {
+		return nil, errAddrs
+	}, nil)
+	if !errors.Is(err, errAddrs) {
+		t.Errorf("err = %v, want %v", err, errAddrs)
+	}
+	_, err = prefixSetFromInterfaces(ifaces, func(net.Interface) ([]net.Addr, error) {
+		return []net.Addr{&net.UnixAddr{Name: "sock"}}, nil
+	}, nil)
+	if err == nil {
+		t.Errorf("unsupported address type: err = nil")
+	}
+
+	// The real interfaces can be read without error.
+	if _, err := PrefixSetFromInterfaces(nil); err != nil {
+		t.Errorf("PrefixSetFromInterfaces(nil): %v", err)
+	}
+}
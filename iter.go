@@ -0,0 +1,121 @@
+package netipds
+
+import (
+	"iter"
+	"net/netip"
+)
+
+// WalkAction is returned by the callback passed to WalkPrune to control the
+// remainder of the traversal.
+type WalkAction int
+
+const (
+	// WalkContinue continues the traversal, including descendants of the
+	// current entry.
+	WalkContinue WalkAction = iota
+
+	// WalkSkipDescendants continues the traversal, but skips all
+	// descendants of the current entry.
+	WalkSkipDescendants
+
+	// WalkStop ends the traversal.
+	WalkStop
+)
+
+// TraversalOption configures the order in which methods such as All and
+// WalkPrune visit Prefixes. By default, they visit a Prefix before its
+// descendants (pre-order), in the order of PrefixSet.Prefixes.
+type TraversalOption func(*traversalConfig)
+
+type traversalConfig struct {
+	postOrder bool
+}
+
+func newTraversalConfig(opts []TraversalOption) traversalConfig {
+	var c traversalConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// PostOrder causes a Prefix to be visited after its descendants, e.g. so that
+// a hierarchy can be deleted or exported bottom-up. Otherwise, the order is
+// unchanged: IPv4 Prefixes are visited before the IPv6 Prefixes that do not
+// encompass them, and the descendants of a Prefix's lower half before those
+// of its upper half. With
+// PostOrder, WalkSkipDescendants has the same effect as WalkContinue, since
+// the descendants have already been visited.
+func PostOrder() TraversalOption {
+	return func(c *traversalConfig) { c.postOrder = true }
+}
+
+// walkPrune calls fn for each entry in t, in the order visited by walk, or by
+// walkPostorder if post is set, following the WalkAction returned by fn.
+func walkPrune[T any](t *tree[T], post bool, fn func(*tree[T]) WalkAction) {
+	if post {
+		t.walkPostorder(func(n *tree[T]) bool {
+			return n.hasValue && fn(n) == WalkStop
+		})
+		return
+	}
+	stop := false
+	t.walk(key{}, func(n *tree[T]) bool {
+		if stop {
+			return true
+		}
+		if !n.hasValue {
+			return false
+		}
+		switch fn(n) {
+		case WalkSkipDescendants:
+			return true
+		case WalkStop:
+			stop = true
+			return true
+		default:
+			return false
+		}
+	})
+}
+
+// walkPath calls fn for each entry in t that encompasses k or is encompassed
+// by it, in the order visited by walk. If fn returns true for an entry that
+// strictly encompasses k, the traversal stops; otherwise, the entry's
+// descendants are skipped.
+func walkPath[T any](t *tree[T], k key, fn func(*tree[T]) bool) {
+	t.walk(k, func(n *tree[T]) bool {
+		// walk also visits the node at which its path diverges.
+		if !n.hasValue || !(n.key.isPrefixOf(k) || k.isPrefixOf(n.key)) {
+			return false
+		}
+		return fn(n)
+	})
+}
+
+// Chunked returns an iterator over batches of up to n consecutive Prefixes
+// from seq. Every batch but the last contains exactly n Prefixes; the last
+// may contain fewer. Each batch is a newly allocated slice.
+//
+// Chunked is useful for processing large collections incrementally, e.g. in a
+// single-threaded event loop that must remain responsive between batches.
+func Chunked(seq iter.Seq[netip.Prefix], n int) iter.Seq[[]netip.Prefix] {
+	if n <= 0 {
+		panic("netipds: Chunked requires a positive batch size")
+	}
+	return func(yield func([]netip.Prefix) bool) {
+		batch := make([]netip.Prefix, 0, n)
+		for p := range seq {
+			batch = append(batch, p)
+			if len(batch) == n {
+				if !yield(batch) {
+					return
+				}
+				batch = make([]netip.Prefix, 0, n)
+			}
+		}
+		if len(batch) > 0 {
+			yield(batch)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package netipds
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestChunked(t *testing.T) {
+	tests := []struct {
+		add  []netip.Prefix
+		n    int
+		want [][]netip.Prefix
+	}{
+		{pfxs(), 2, [][]netip.Prefix{}},
+		{pfxs("::0/128"), 2, [][]netip.Prefix{pfxs("::0/128")}},
+		{
+			add:  pfxs("::0/128", "::1/128", "::2/128"),
+			n:    2,
+			want: [][]netip.Prefix{pfxs("::0/128", "::1/128"), pfxs("::2/128")},
+		},
+		{
+			add:  pfxs("::0/128", "::1/128", "::2/128", "::3/128"),
+			n:    2,
+			want: [][]netip.Prefix{pfxs("::0/128", "::1/128"), pfxs("::2/128", "::3/128")},
+		},
+	}
+	for _, tt := range tests {
+		psb := &PrefixSetBuilder{}
+		for _, p := range tt.add {
+			psb.Add(p)
+		}
+		got := [][]netip.Prefix{}
+		for batch := range Chunked(psb.PrefixSet().All(), tt.n) {
+			got = append(got, batch)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("Chunked(%v, %d) = %v, want %v", tt.add, tt.n, got, tt.want)
+			continue
+		}
+		for i := range got {
+			checkPrefixSlice(t, got[i], tt.want[i])
+		}
+	}
+}
+
+func TestPrefixSetWalkWithYield(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	for _, p := range pfxs("::0/128", "::1/128", "::2/128", "::3/128") {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+
+	var got []netip.Prefix
+	pauses := 0
+	ps.WalkWithYield(func(p netip.Prefix) bool {
+		got = append(got, p)
+		return true
+	}, 2, func() { pauses++ })
+	checkPrefixSlice(t, got, ps.Prefixes())
+	// The tree has 7 non-root nodes: ::/126, ::/127, ::2/127, and the four
+	// entries.
+	if pauses != 3 {
+		t.Errorf("pauses = %d, want 3", pauses)
+	}
+
+	// Early termination
+	got = nil
+	ps.WalkWithYield(func(p netip.Prefix) bool {
+		got = append(got, p)
+		return len(got) < 2
+	}, 1, func() {})
+	checkPrefixSlice(t, got, pfxs("::0/128", "::1/128"))
+}
+
+func TestWalkPrune(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	for _, p := range pfxs("10.0.0.0/8", "10.1.0.0/16", "11.0.0.0/8", "11.1.0.0/16", "12.0.0.0/8") {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+	tests := []struct {
+		actions map[netip.Prefix]WalkAction
+		want    []netip.Prefix
+	}{
+		{
+			actions: map[netip.Prefix]WalkAction{},
+			want:    pfxs("10.0.0.0/8", "10.1.0.0/16", "11.0.0.0/8", "11.1.0.0/16", "12.0.0.0/8"),
+		},
+		{
+			actions: map[netip.Prefix]WalkAction{pfx("10.0.0.0/8"): WalkSkipDescendants},
+			want:    pfxs("10.0.0.0/8", "11.0.0.0/8", "11.1.0.0/16", "12.0.0.0/8"),
+		},
+		{
+			actions: map[netip.Prefix]WalkAction{pfx("11.0.0.0/8"): WalkStop},
+			want:    pfxs("10.0.0.0/8", "10.1.0.0/16", "11.0.0.0/8"),
+		},
+	}
+	for _, tt := range tests {
+		var got []netip.Prefix
+		ps.WalkPrune(func(p netip.Prefix) WalkAction {
+			got = append(got, p)
+			return tt.actions[p]
+		})
+		checkPrefixSlice(t, got, tt.want)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	for i, p := range pfxs(
+		"10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24", "10.1.2.0/24", "10.2.0.0/16", "11.0.0.0/8",
+	) {
+		pmb.Set(p, i)
+	}
+	pm := pmb.PrefixMap()
+	tests := []struct {
+		p    string
+		stop map[netip.Prefix]bool
+		want []netip.Prefix
+	}{
+		{
+			p:    "10.1.0.0/16",
+			want: pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24", "10.1.2.0/24"),
+		},
+		{
+			p:    "10.1.1.128/25",
+			want: pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24"),
+		},
+		{
+			p:    "10.0.0.0/15",
+			want: pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24", "10.1.2.0/24"),
+		},
+		{
+			p:    "12.0.0.0/8",
+			want: nil,
+		},
+		{
+			p:    "::/0",
+			want: pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24", "10.1.2.0/24", "10.2.0.0/16", "11.0.0.0/8"),
+		},
+		// Returning true for an ancestor stops the traversal.
+		{
+			p:    "10.1.0.0/16",
+			stop: map[netip.Prefix]bool{pfx("10.0.0.0/8"): true},
+			want: pfxs("10.0.0.0/8"),
+		},
+		// Returning true for a descendant skips its descendants.
+		{
+			p:    "10.0.0.0/8",
+			stop: map[netip.Prefix]bool{pfx("10.1.0.0/16"): true},
+			want: pfxs("10.0.0.0/8", "10.1.0.0/16", "10.2.0.0/16"),
+		},
+		{
+			p:    "::/0",
+			stop: map[netip.Prefix]bool{pfx("10.0.0.0/8"): true},
+			want: pfxs("10.0.0.0/8", "11.0.0.0/8"),
+		},
+	}
+	for _, tt := range tests {
+		var got []netip.Prefix
+		pm.Walk(pfx(tt.p), func(p netip.Prefix, v int) bool {
+			if want, _ := pm.Get(p); v != want {
+				t.Errorf("Walk(%s) passed %s with value %d, want %d", tt.p, p, v, want)
+			}
+			got = append(got, p)
+			return tt.stop[p]
+		})
+		checkPrefixSlice(t, got, tt.want)
+
+		got = nil
+		pm.KeySet().Walk(pfx(tt.p), func(p netip.Prefix) bool {
+			got = append(got, p)
+			return tt.stop[p]
+		})
+		checkPrefixSlice(t, got, tt.want)
+	}
+
+	pm.Walk(netip.Prefix{}, func(p netip.Prefix, _ int) bool {
+		t.Errorf("Walk of invalid Prefix visited %s", p)
+		return false
+	})
+}
+
+func TestPrefixMapWalkMixedFamilies(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	for i, p := range pfxs("::/8", "10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32") {
+		pmb.Set(p, i)
+	}
+	pm := pmb.PrefixMap()
+	// ::/8 encompasses ::ffff:0:0/96, so it is an ancestor of the IPv4
+	// Prefixes, whichever window contains it.
+	tests := []struct {
+		p    string
+		stop map[netip.Prefix]bool
+		want []netip.Prefix
+	}{
+		{p: "::/0", want: pfxs("::/8", "10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32")},
+		{p: "::/8", want: pfxs("::/8", "10.0.0.0/8", "10.1.0.0/16")},
+		{p: "10.1.0.0/16", want: pfxs("::/8", "10.0.0.0/8", "10.1.0.0/16")},
+		{
+			p:    "::/0",
+			stop: map[netip.Prefix]bool{pfx("::/8"): true},
+			want: pfxs("::/8", "2001:db8::/32"),
+		},
+		{
+			p:    "::/8",
+			stop: map[netip.Prefix]bool{pfx("::/8"): true},
+			want: pfxs("::/8"),
+		},
+		{
+			p:    "10.1.0.0/16",
+			stop: map[netip.Prefix]bool{pfx("::/8"): true},
+			want: pfxs("::/8"),
+		},
+	}
+	for _, tt := range tests {
+		var got []netip.Prefix
+		pm.Walk(pfx(tt.p), func(p netip.Prefix, _ int) bool {
+			got = append(got, p)
+			return tt.stop[p]
+		})
+		checkPrefixSlice(t, got, tt.want)
+	}
+}
+
+func TestPostOrder(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	for i, p := range pfxs(
+		"10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24", "10.2.0.0/16", "11.0.0.0/8",
+		"::/1", "2001:db8::/32", "2001:db8:1::/48", "2001:db8:2::/48",
+	) {
+		pmb.Set(p, i)
+	}
+	pm := pmb.PrefixMap()
+	ps := pm.KeySet()
+
+	want4 := pfxs("10.1.1.0/24", "10.1.0.0/16", "10.2.0.0/16", "10.0.0.0/8", "11.0.0.0/8")
+	want6 := pfxs("2001:db8:1::/48", "2001:db8:2::/48", "2001:db8::/32", "::/1")
+	want := append(slices.Clone(want4), want6...)
+
+	checkPrefixSlice(t, slices.Collect(ps.All(PostOrder())), want)
+	checkPrefixSlice(t, slices.Collect(ps.All4(PostOrder())), want4)
+	checkPrefixSlice(t, slices.Collect(ps.All6(PostOrder())), want6)
+	checkPrefixSlice(t, seqKeys(pm.All(PostOrder())), want)
+	checkPrefixSlice(t, seqKeys(pm.All4(PostOrder())), want4)
+	checkPrefixSlice(t, seqKeys(pm.All6(PostOrder())), want6)
+	for p, v := range pm.All(PostOrder()) {
+		if got, _ := pm.Get(p); got != v {
+			t.Errorf("All(PostOrder()) yielded %s with value %d, want %d", p, v, got)
+		}
+	}
+
+	// Early termination
+	var got []netip.Prefix
+	for p := range ps.All(PostOrder()) {
+		got = append(got, p)
+		if len(got) == 3 {
+			break
+		}
+	}
+	checkPrefixSlice(t, got, want[:3])
+
+	tests := []struct {
+		actions map[netip.Prefix]WalkAction
+		want    []netip.Prefix
+	}{
+		{
+			actions: map[netip.Prefix]WalkAction{},
+			want:    want,
+		},
+		// Descendants have already been visited.
+		{
+			actions: map[netip.Prefix]WalkAction{pfx("10.1.0.0/16"): WalkSkipDescendants},
+			want:    want,
+		},
+		{
+			actions: map[netip.Prefix]WalkAction{pfx("10.0.0.0/8"): WalkStop},
+			want:    want[:4],
+		},
+	}
+	for _, tt := range tests {
+		var got []netip.Prefix
+		ps.WalkPrune(func(p netip.Prefix) WalkAction {
+			got = append(got, p)
+			return tt.actions[p]
+		}, PostOrder())
+		checkPrefixSlice(t, got, tt.want)
+
+		got = nil
+		pm.WalkPrune(func(p netip.Prefix, _ int) WalkAction {
+			got = append(got, p)
+			return tt.actions[p]
+		}, PostOrder())
+		checkPrefixSlice(t, got, tt.want)
+	}
+}
@@ -1,11 +1,19 @@
 package netipds
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net/netip"
 	"strings"
 )
 
+// v4MappedPrefix is the content of the key for ::ffff:0:0/96, under which
+// IPv4 Prefixes are stored.
+var v4MappedPrefix = uint128{0, 0xffff << 32}
+
+// v4Key is the key for ::ffff:0:0/96, which encompasses every IPv4 key.
+var v4Key = key{content: v4MappedPrefix, len: 96}
+
 // key stores the bits which represent the full path to a node in a prefix
 // tree. The maximum size of a key is 128 bits. The key is stored in the
 // most-significant bits of the content field.
@@ -32,10 +40,15 @@ func (k key) rooted() key {
 	return key{k.content, 0, k.len}
 }
 
-// keyFromPrefix returns the key that represents the provided Prefix.
+// keyFromPrefix returns the key that represents the provided Prefix. Invalid
+// Prefixes have no such key; for them, keyFromPrefix returns the zero key,
+// which no exact or encompassing entry lookup can find. Queries for which the
+// zero key matches everything must reject invalid Prefixes themselves.
 func keyFromPrefix(p netip.Prefix) key {
+	if !p.IsValid() {
+		return key{}
+	}
 	addr := p.Addr()
-	// TODO bits could be -1
 	bits := uint8(p.Bits())
 	if addr.Is4() {
 		bits = bits + 96
@@ -43,6 +56,35 @@ func keyFromPrefix(p netip.Prefix) key {
 	return newKey(u128From16(addr.As16()), 0, bits)
 }
 
+// keyFromAddr returns the key that represents the single-address Prefix
+// containing addr. Since IPv4 keys are stored IPv4-mapped, this is the full
+// 128-bit key for both address families.
+func keyFromAddr(addr netip.Addr) key {
+	return key{u128From16(addr.As16()), 0, 128}
+}
+
+// keyFromBytes returns the key that represents the Prefix with the provided
+// address bytes and length, without constructing a netip.Prefix. addr must be
+// 4 bytes (IPv4) or 16 bytes (IPv6) long, and bits must be within the range
+// allowed for that address length; otherwise keyFromBytes returns false.
+func keyFromBytes(addr []byte, bits int) (key, bool) {
+	switch len(addr) {
+	case 4:
+		if bits < 0 || bits > 32 {
+			return key{}, false
+		}
+		lo := 0xffff<<32 | uint64(binary.BigEndian.Uint32(addr))
+		return newKey(uint128{0, lo}, 0, uint8(bits+96)), true
+	case 16:
+		if bits < 0 || bits > 128 {
+			return key{}, false
+		}
+		return newKey(u128From16([16]byte(addr)), 0, uint8(bits)), true
+	default:
+		return key{}, false
+	}
+}
+
 // String prints the key's content in hex, followed by "/" + k.len.
 // The least significant bit in the output is the bit at position (k.len - 1).
 // Leading zeros are omitted.
@@ -147,7 +189,9 @@ func (k key) rest(i uint8) key {
 	if i > k.len {
 		i = 0
 	}
-	return newKey(k.content, i, k.len)
+	// k.content is already cleared beyond k.len, so there's no need to
+	// re-mask it via newKey.
+	return key{k.content, i, k.len}
 }
 
 // hasBitZeroAt returns true if the bit at position i is 0.
@@ -167,19 +211,7 @@ func (k key) equalFromRoot(o key) bool {
 // commonPrefixLen returns the length of the common prefix between k and
 // o, truncated to the length of the shorter of the two.
 func (k key) commonPrefixLen(o key) uint8 {
-	common := k.content.commonPrefixLen(o.content)
-	// min(l.len, o.len, common)
-	if k.len < o.len {
-		if k.len < common {
-			return k.len
-		}
-		return common
-	} else {
-		if o.len < common {
-			return o.len
-		}
-		return common
-	}
+	return min(k.content.commonPrefixLen(o.content), k.len, o.len)
 }
 
 // isPrefixOf reports whether k has the same content as o up to position k.len.
@@ -187,6 +219,33 @@ func (k key) isPrefixOf(o key) bool {
 	return k.len <= o.len && k.content == o.content.bitsClearedFrom(k.len)
 }
 
+// span returns the number of addresses covered by k. The span of the zero key
+// (2^128) is not representable, so span returns 0 in that case.
+func (k key) span() uint128 {
+	return uint128{0, 1}.shiftLeft(128 - k.len)
+}
+
+// is4 reports whether k represents an IPv4 Prefix, i.e. whether it falls
+// within ::ffff:0:0/96.
+func (k key) is4() bool {
+	return k.len >= 96 && k.content.bitsClearedFrom(96) == v4MappedPrefix
+}
+
+// prefixBits returns the number of bits of the Prefix represented by k, as
+// reported by netip.Prefix.Bits.
+func (k key) prefixBits() int {
+	if k.is4() {
+		return int(k.len) - 96
+	}
+	return int(k.len)
+}
+
+// encompasses4 reports whether k is an IPv6 key that strictly encompasses
+// ::ffff:0:0/96, and so every IPv4 key, e.g. ::/8.
+func (k key) encompasses4() bool {
+	return k.len < 96 && k.isPrefixOf(v4Key)
+}
+
 // isZero reports whether k is the zero key.
 func (k key) isZero() bool {
 	// Bits beyond len are always ignored, so if k.len == zero, then this
@@ -1,6 +1,7 @@
 package netipds
 
 import (
+	"net/netip"
 	"testing"
 )
 
@@ -140,3 +141,58 @@ func TestKeyLeftRight(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyCommonPrefixLen(t *testing.T) {
+	tests := []struct {
+		a    key
+		b    key
+		want uint8
+	}{
+		{k(uint128{0, 0}, 0, 0), k(uint128{0, 0}, 0, 0), 0},
+		{k(uint128{0, 0}, 0, 0), k(uint128{0, 0}, 0, 128), 0},
+		{k(uint128{0, 0}, 0, 128), k(uint128{0, 0}, 0, 128), 128},
+		{k(uint128{0, 0}, 0, 128), k(uint128{0, 1}, 0, 128), 127},
+		{k(uint128{0, 2}, 0, 127), k(uint128{0, 3}, 0, 128), 127},
+		{k(uint128{0, 3}, 0, 128), k(uint128{0, 2}, 0, 127), 127},
+		{k(uint128{1, 0}, 0, 64), k(uint128{1, 1}, 0, 128), 64},
+		{k(uint128{1 << 63, 0}, 0, 1), k(uint128{0, 1}, 0, 128), 0},
+		{k(uint128{1 << 62, 0}, 0, 128), k(uint128{1 << 63, 0}, 0, 128), 0},
+		{k(uint128{0, 1 << 63}, 0, 128), k(uint128{0, 1 << 62}, 0, 128), 64},
+	}
+	for _, tt := range tests {
+		if got := tt.a.commonPrefixLen(tt.b); got != tt.want {
+			t.Errorf("%v.commonPrefixLen(%v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestKeyFromBytes(t *testing.T) {
+	tests := []struct {
+		addr   []byte
+		bits   int
+		want   netip.Prefix
+		wantOk bool
+	}{
+		{[]byte{1, 2, 3, 0}, 24, pfx("1.2.3.0/24"), true},
+		{[]byte{1, 2, 3, 4}, 24, pfx("1.2.3.0/24"), true},
+		{[]byte{1, 2, 3, 4}, 32, pfx("1.2.3.4/32"), true},
+		{[]byte{1, 2, 3, 4}, 0, pfx("0.0.0.0/0"), true},
+		{netip.MustParseAddr("2001:db8::1").AsSlice(), 32, pfx("2001:db8::/32"), true},
+		{netip.MustParseAddr("::1").AsSlice(), 128, pfx("::1/128"), true},
+
+		// Invalid lengths
+		{[]byte{1, 2, 3, 4}, 33, netip.Prefix{}, false},
+		{[]byte{1, 2, 3, 4}, -1, netip.Prefix{}, false},
+		{netip.MustParseAddr("::1").AsSlice(), 129, netip.Prefix{}, false},
+		{[]byte{1, 2, 3}, 8, netip.Prefix{}, false},
+		{nil, 0, netip.Prefix{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := keyFromBytes(tt.addr, tt.bits)
+		if ok != tt.wantOk {
+			t.Errorf("keyFromBytes(%v, %d) ok = %v, want %v", tt.addr, tt.bits, ok, tt.wantOk)
+		} else if ok && got != keyFromPrefix(tt.want) {
+			t.Errorf("keyFromBytes(%v, %d) = %v, want %v", tt.addr, tt.bits, got, keyFromPrefix(tt.want))
+		}
+	}
+}
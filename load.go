@@ -0,0 +1,59 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// LoadPrefixSets builds one PrefixSet from each file in fsys whose name
+// matches glob (see fs.Glob), returning them keyed by file name.
+//
+// Each file must contain one Prefix per line, in the format accepted by
+// ParsePrefixCanonical. Empty lines and lines beginning with '#' are
+// ignored. If any file cannot be read or contains an invalid line,
+// LoadPrefixSets returns an error identifying the file and line.
+func LoadPrefixSets(fsys fs.FS, glob string) (map[string]*PrefixSet, error) {
+	names, err := fs.Glob(fsys, glob)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]*PrefixSet, len(names))
+	for _, name := range names {
+		f, err := fsys.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		s, err := readPrefixSet(f, name)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		ret[name] = s
+	}
+	return ret, nil
+}
+
+// readPrefixSet builds a PrefixSet from r, in the format described by
+// LoadPrefixSets. name is used to identify r in errors.
+func readPrefixSet(r io.Reader, name string) (*PrefixSet, error) {
+	var psb PrefixSetBuilder
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := psb.AddString(text); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return psb.PrefixSet(), nil
+}
@@ -0,0 +1,46 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadPrefixSets(t *testing.T) {
+	fsys := fstest.MapFS{
+		"conf.d/a.txt": {Data: []byte("10.0.0.0/8\n\n# comment\n  192.168.0.0/16  \n")},
+		"conf.d/b.txt": {Data: []byte("2001:db8::/32")},
+		"conf.d/c.bak": {Data: []byte("bogus\n")},
+	}
+	got, err := LoadPrefixSets(fsys, "conf.d/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"conf.d/a.txt": {"10.0.0.0/8", "192.168.0.0/16"},
+		"conf.d/b.txt": {"2001:db8::/32"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("LoadPrefixSets returned %d sets, want %d", len(got), len(want))
+	}
+	for name, prefixes := range want {
+		s, ok := got[name]
+		if !ok {
+			t.Errorf("LoadPrefixSets is missing %s", name)
+			continue
+		}
+		checkPrefixSlice(t, s.Prefixes(), pfxs(prefixes...))
+	}
+
+	_, err = LoadPrefixSets(fsys, "conf.d/*")
+	var pErr *PrefixParseError
+	if !errors.As(err, &pErr) || pErr.Input != "bogus" {
+		t.Errorf("LoadPrefixSets with invalid line: err = %v, want *PrefixParseError", err)
+	}
+
+	if _, err := LoadPrefixSets(fsys, "["); err == nil {
+		t.Errorf("LoadPrefixSets with bad pattern returned nil error")
+	}
+}
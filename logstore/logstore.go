@@ -0,0 +1,290 @@
+// Package logstore implements a durable, log-structured store of
+// netip.Prefix to []byte mappings, indexed in memory by a netipds.PrefixMap.
+//
+// Every modification is appended to a single log file as a checksummed
+// record. On Open, the log is replayed to rebuild the index; a torn or
+// corrupt record at the tail (e.g. from a crash mid-write) is discarded and
+// the log is truncated to the last intact record. Compact rewrites the log to
+// contain only live entries, atomically replacing the old log.
+package logstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/aromatt/netipds"
+)
+
+const (
+	opSet    byte = 1
+	opDelete byte = 2
+)
+
+// maxValueLen bounds the length of a value read from the log, so a corrupt
+// length field can't trigger an enormous allocation.
+const maxValueLen = 1 << 30
+
+// Store is a durable map of netip.Prefix to []byte. It is safe for
+// concurrent use.
+//
+// Use Open to obtain a Store.
+type Store struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	w    *bufio.Writer
+	idx  netipds.PrefixMapBuilder[[]byte]
+}
+
+// Open opens the store at path, creating it if it does not exist, and replays
+// its log to rebuild the in-memory index.
+func Open(path string) (*Store, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{path: path, f: f}
+	end, err := s.replay(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Discard anything after the last intact record.
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.w = bufio.NewWriter(f)
+	return s, nil
+}
+
+// replay applies every intact record in r to the index and returns the offset
+// just past the last one.
+func (s *Store) replay(r io.Reader) (int64, error) {
+	br := bufio.NewReader(r)
+	var end int64
+	for {
+		op, p, val, n, err := readRecord(br)
+		if errors.Is(err, io.EOF) || errors.Is(err, errCorrupt) {
+			return end, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case opSet:
+			s.idx.Set(p, val)
+		case opDelete:
+			s.idx.Remove(p)
+		}
+		end += int64(n)
+	}
+}
+
+// Set durably associates val with p. The value is copied.
+func (s *Store) Set(p netip.Prefix, val []byte) error {
+	if !p.IsValid() {
+		return fmt.Errorf("Prefix is not valid: %v", p)
+	}
+	p = p.Masked()
+	val = append([]byte(nil), val...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(opSet, p, val); err != nil {
+		return err
+	}
+	return s.idx.Set(p, val)
+}
+
+// Delete durably removes p from the store.
+func (s *Store) Delete(p netip.Prefix) error {
+	if !p.IsValid() {
+		return fmt.Errorf("Prefix is not valid: %v", p)
+	}
+	p = p.Masked()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(opDelete, p, nil); err != nil {
+		return err
+	}
+	return s.idx.Remove(p)
+}
+
+// append writes a record to the log and syncs it to stable storage.
+func (s *Store) append(op byte, p netip.Prefix, val []byte) error {
+	if _, err := s.w.Write(encodeRecord(op, p, val)); err != nil {
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// Get returns the value associated with the exact Prefix provided, if any.
+// The returned slice must not be modified.
+func (s *Store) Get(p netip.Prefix) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.idx.Get(p)
+}
+
+// PrefixMap returns an immutable snapshot of the store's contents. The
+// values in the snapshot must not be modified.
+func (s *Store) PrefixMap() *netipds.PrefixMap[[]byte] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.idx.PrefixMap()
+}
+
+// Compact rewrites the log so that it contains exactly one record per live
+// entry. The new log is written to a temporary file and atomically renamed
+// over the old one, so a crash during compaction leaves either the old or the
+// new log intact.
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmpPath := s.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	pm := s.idx.PrefixMap()
+	for _, p := range pm.KeySet().Prefixes() {
+		val, _ := pm.Get(p)
+		if _, err := w.Write(encodeRecord(opSet, p, val)); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		tmp.Close()
+		return err
+	}
+	// Make the rename itself durable.
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	s.f.Close()
+	s.f, s.w = tmp, bufio.NewWriter(tmp)
+	return nil
+}
+
+// Close closes the store's log file.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+var errCorrupt = errors.New("corrupt record")
+
+// encodeRecord returns the encoding of a record:
+//
+//	op (1 byte)
+//	address length (1 byte, 4 or 16)
+//	address (4 or 16 bytes)
+//	prefix length (1 byte)
+//	value length (uvarint)
+//	value
+//	CRC-32 (IEEE) of all preceding bytes of the record (4 bytes, big-endian)
+func encodeRecord(op byte, p netip.Prefix, val []byte) []byte {
+	addr := p.Addr().AsSlice()
+	b := make([]byte, 0, 3+len(addr)+binary.MaxVarintLen64+len(val)+4)
+	b = append(b, op, byte(len(addr)))
+	b = append(b, addr...)
+	b = append(b, byte(p.Bits()))
+	b = binary.AppendUvarint(b, uint64(len(val)))
+	b = append(b, val...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
+
+// readRecord reads one record from r, returning its contents and encoded
+// length. It returns io.EOF if r is exhausted at a record boundary, and
+// errCorrupt if the record is truncated or fails validation.
+func readRecord(r *bufio.Reader) (op byte, p netip.Prefix, val []byte, n int, err error) {
+	crc := crc32.NewIEEE()
+	var buf []byte
+	read := func(size int) ([]byte, error) {
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		crc.Write(b)
+		buf = append(buf, b...)
+		return b, nil
+	}
+
+	hdr, err := read(2)
+	if errors.Is(err, io.EOF) {
+		return 0, p, nil, 0, io.EOF
+	} else if err != nil {
+		return 0, p, nil, 0, errCorrupt
+	}
+	op, addrLen := hdr[0], int(hdr[1])
+	if (op != opSet && op != opDelete) || (addrLen != 4 && addrLen != 16) {
+		return 0, p, nil, 0, errCorrupt
+	}
+	addrBits, err := read(addrLen + 1)
+	if err != nil {
+		return 0, p, nil, 0, errCorrupt
+	}
+	addr, _ := netip.AddrFromSlice(addrBits[:addrLen])
+	p = netip.PrefixFrom(addr, int(addrBits[addrLen]))
+	if !p.IsValid() {
+		return 0, p, nil, 0, errCorrupt
+	}
+
+	// Read the uvarint value length one byte at a time so it's included in
+	// the checksum.
+	var lenBytes []byte
+	for {
+		b, err := read(1)
+		if err != nil || len(lenBytes) == binary.MaxVarintLen64 {
+			return 0, p, nil, 0, errCorrupt
+		}
+		lenBytes = append(lenBytes, b[0])
+		if b[0] < 0x80 {
+			break
+		}
+	}
+	valLen, _ := binary.Uvarint(lenBytes)
+	if valLen > maxValueLen {
+		return 0, p, nil, 0, errCorrupt
+	}
+	if val, err = read(int(valLen)); err != nil {
+		return 0, p, nil, 0, errCorrupt
+	}
+
+	sum := make([]byte, 4)
+	if _, err := io.ReadFull(r, sum); err != nil {
+		return 0, p, nil, 0, errCorrupt
+	}
+	if binary.BigEndian.Uint32(sum) != crc.Sum32() {
+		return 0, p, nil, 0, errCorrupt
+	}
+	return op, p, val, len(buf) + 4, nil
+}
@@ -0,0 +1,116 @@
+package logstore
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func pfx(s string) netip.Prefix {
+	return netip.MustParsePrefix(s)
+}
+
+func checkContents(t *testing.T, s *Store, want map[netip.Prefix]string) {
+	t.Helper()
+	got := s.PrefixMap().ToMap()
+	if len(got) != len(want) {
+		t.Errorf("got %v, want %v", got, want)
+		return
+	}
+	for p, v := range want {
+		if string(got[p]) != v {
+			t.Errorf("got %v, want %v", got, want)
+			return
+		}
+	}
+}
+
+func TestStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.log")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set(pfx("10.0.0.0/8"), []byte("a"))
+	s.Set(pfx("2001:db8::/32"), []byte("b"))
+	s.Set(pfx("10.0.0.0/8"), []byte("c"))
+	s.Set(pfx("192.168.0.0/16"), []byte("d"))
+	s.Delete(pfx("192.168.0.0/16"))
+	s.Close()
+
+	if s, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkContents(t, s, map[netip.Prefix]string{
+		pfx("10.0.0.0/8"):    "c",
+		pfx("2001:db8::/32"): "b",
+	})
+}
+
+func TestStoreRecoversTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.log")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set(pfx("10.0.0.0/8"), []byte("a"))
+	s.Close()
+	intact, _ := os.ReadFile(path)
+
+	// Simulate a crash partway through appending a record.
+	partial := encodeRecord(opSet, pfx("11.0.0.0/8"), []byte("b"))
+	os.WriteFile(path, append(intact, partial[:len(partial)-2]...), 0o644)
+
+	if s, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, s, map[netip.Prefix]string{pfx("10.0.0.0/8"): "a"})
+
+	// The torn record is discarded, and new records follow the intact ones.
+	s.Set(pfx("12.0.0.0/8"), []byte("c"))
+	s.Close()
+	if s, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkContents(t, s, map[netip.Prefix]string{
+		pfx("10.0.0.0/8"): "a",
+		pfx("12.0.0.0/8"): "c",
+	})
+}
+
+func TestStoreCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.log")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		s.Set(pfx("10.0.0.0/8"), []byte{byte(i)})
+	}
+	s.Set(pfx("11.0.0.0/8"), []byte("x"))
+	s.Delete(pfx("11.0.0.0/8"))
+	before, _ := os.Stat(path)
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Errorf("log size after Compact = %d, want < %d", after.Size(), before.Size())
+	}
+
+	// The store remains writable after compaction.
+	s.Set(pfx("12.0.0.0/8"), []byte("y"))
+	s.Close()
+	if s, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkContents(t, s, map[netip.Prefix]string{
+		pfx("10.0.0.0/8"): "\x09",
+		pfx("12.0.0.0/8"): "y",
+	})
+}
@@ -0,0 +1,129 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"math/bits"
+	"net/netip"
+	"sync/atomic"
+)
+
+const (
+	// negativeBucketBits4 and negativeBucketBits6 are the lengths of the
+	// buckets of addresses recorded by a NegativeCachedSet, for IPv4 and IPv6
+	// respectively.
+	negativeBucketBits4 = 24
+	negativeBucketBits6 = 64
+)
+
+// NegativeCachedSet answers address lookups against a PrefixSet, caching
+// misses: after a lookup finds that no Prefix in the set overlaps the
+// address's /24 (IPv4) or /64 (IPv6), later lookups within that bucket miss
+// without querying the set. This speeds up workloads in which nearly all
+// lookups miss, such as checking general traffic against a blocklist.
+//
+// The cache holds a fixed number of buckets per address family. When two
+// buckets compete for the same slot, the most recent one is kept, so the
+// cache never grows and needs no eviction. Lookups always return the same
+// results as PrefixSet.ContainsAddr on the current set.
+//
+// A NegativeCachedSet is safe for concurrent use.
+type NegativeCachedSet struct {
+	state atomic.Pointer[negativeCache]
+	size  int
+}
+
+// negativeCache holds a PrefixSet and the buckets known to miss it. It is
+// replaced as a whole when the set is swapped, so that no bucket recorded for
+// one set is used for another.
+type negativeCache struct {
+	set *PrefixSet
+
+	// Each slot holds the tag of a bucket known to miss set, or zero. Tags
+	// are stored per address family, so IPv4 and IPv6 tags never collide.
+	slots4 []atomic.Uint64
+	slots6 []atomic.Uint64
+	shift  int
+}
+
+// NewNegativeCachedSet returns a NegativeCachedSet that answers lookups using
+// s, caching up to size buckets per address family. size is rounded up to a
+// power of two.
+func NewNegativeCachedSet(s *PrefixSet, size int) *NegativeCachedSet {
+	c := &NegativeCachedSet{size: 1 << bits.Len(uint(max(size, 1)-1))}
+	c.Swap(s)
+	return c
+}
+
+// Swap replaces the PrefixSet used to answer lookups with s, discarding all
+// cached buckets. Lookups made concurrently with Swap use either the previous
+// set or s, along with the buckets cached for that set.
+func (c *NegativeCachedSet) Swap(s *PrefixSet) {
+	c.state.Store(&negativeCache{
+		set:    s,
+		slots4: make([]atomic.Uint64, c.size),
+		slots6: make([]atomic.Uint64, c.size),
+		shift:  64 - bits.Len(uint(c.size-1)),
+	})
+}
+
+// PrefixSet returns the PrefixSet currently used to answer lookups.
+func (c *NegativeCachedSet) PrefixSet() *PrefixSet {
+	return c.state.Load().set
+}
+
+// ContainsAddr returns true if the set includes a Prefix which contains addr.
+// See PrefixSet.ContainsAddr.
+func (c *NegativeCachedSet) ContainsAddr(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	st := c.state.Load()
+	slot, tag := st.slot(addr)
+	if slot != nil && slot.Load() == tag {
+		return false
+	}
+	k := keyFromAddr(addr)
+	if st.set.tree.longestMatch(k) != nil {
+		return true
+	}
+	if slot != nil {
+		bucketLen := uint8(negativeBucketBits6)
+		if k.is4() {
+			bucketLen = 96 + negativeBucketBits4
+		}
+		if !st.set.tree.overlapsKey(k.truncated(bucketLen)) {
+			slot.Store(tag)
+		}
+	}
+	return false
+}
+
+// slot returns the slot for the bucket containing addr, along with the tag
+// that identifies the bucket. If the bucket cannot be cached, slot returns a
+// nil slot.
+func (st *negativeCache) slot(addr netip.Addr) (*atomic.Uint64, uint64) {
+	var (
+		tag   uint64
+		slots []atomic.Uint64
+	)
+	if addr.Is4() || addr.Is4In6() {
+		a := addr.Unmap().As4()
+		// Offset by one so that no tag is zero.
+		tag = uint64(a[0])<<16 | uint64(a[1])<<8 | uint64(a[2]) + 1
+		slots = st.slots4
+	} else {
+		a := addr.As16()
+		for _, b := range a[:8] {
+			tag = tag<<8 | uint64(b)
+		}
+		// The bucket with tag zero (::/64) is not cached, since zero marks an
+		// empty slot.
+		if tag == 0 {
+			return nil, 0
+		}
+		slots = st.slots6
+	}
+	// Fibonacci hashing spreads neighboring buckets across the slots.
+	return &slots[(tag*0x9e3779b97f4a7c15)>>st.shift], tag
+}
@@ -0,0 +1,77 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestNegativeCachedSet(t *testing.T) {
+	build := func(prefixes ...string) *PrefixSet {
+		psb := &PrefixSetBuilder{}
+		for _, p := range pfxs(prefixes...) {
+			psb.Add(p)
+		}
+		return psb.PrefixSet()
+	}
+	ps := build("10.0.0.0/8", "192.168.1.128/25", "2001:db8::/32", "2001:db9::1/128")
+	c := NewNegativeCachedSet(ps, 100)
+	if c.size != 128 {
+		t.Errorf("size = %d, want 128", c.size)
+	}
+
+	addrs := []netip.Addr{
+		netip.MustParseAddr("10.1.2.3"),
+		netip.MustParseAddr("11.1.2.3"),
+		// In a bucket that overlaps the set, so never cached
+		netip.MustParseAddr("192.168.1.1"),
+		netip.MustParseAddr("192.168.1.200"),
+		netip.MustParseAddr("::ffff:11.1.2.4"),
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("2001:db9::2"),
+		netip.MustParseAddr("2001:dba::1"),
+		netip.MustParseAddr("::1"),
+		{},
+	}
+	check := func(c *NegativeCachedSet, ps *PrefixSet) {
+		t.Helper()
+		// The second pass is answered from the cache where possible.
+		for range 2 {
+			for _, a := range addrs {
+				if got, want := c.ContainsAddr(a), ps.ContainsAddr(a); got != want {
+					t.Errorf("ContainsAddr(%v) = %v, want %v", a, got, want)
+				}
+			}
+		}
+	}
+	check(c, ps)
+
+	cached := func(a netip.Addr) bool {
+		slot, tag := c.state.Load().slot(a)
+		return slot != nil && slot.Load() == tag
+	}
+	for _, tt := range []struct {
+		addr netip.Addr
+		want bool
+	}{
+		{netip.MustParseAddr("11.1.2.3"), true},
+		{netip.MustParseAddr("11.1.2.200"), true},
+		{netip.MustParseAddr("192.168.1.1"), false},
+		{netip.MustParseAddr("10.1.2.3"), false},
+		{netip.MustParseAddr("2001:dba::1"), true},
+		{netip.MustParseAddr("2001:db9::2"), false},
+	} {
+		if got := cached(tt.addr); got != tt.want {
+			t.Errorf("bucket of %v cached = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	// Buckets cached for the previous set are not used after a swap.
+	ps2 := build("11.1.2.0/24", "2001:dba::/32")
+	c.Swap(ps2)
+	if c.PrefixSet() != ps2 {
+		t.Errorf("PrefixSet() after Swap did not return the new set")
+	}
+	check(c, ps2)
+}
@@ -0,0 +1,93 @@
+//go:build cgo
+
+// Command libnetipds exports the netipdsc API as a C shared library. Build it
+// with:
+//
+//	go build -buildmode=c-shared -o libnetipds.so ./netipdsc/libnetipds
+//
+// which also generates the header libnetipds.h. Functions that create a set
+// return its handle, or 0 on error. Queries return 1 (true), 0 (false) or -1
+// on error, e.g. an unknown handle or an address of the wrong length.
+package main
+
+/*
+#include <stddef.h>
+#include <stdint.h>
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/aromatt/netipds/netipdsc"
+)
+
+func bytes(b *C.uint8_t, n C.size_t) []byte {
+	if n == 0 {
+		return nil
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(b)), int(n))
+}
+
+func result(ok bool, err error) C.int {
+	switch {
+	case err != nil:
+		return -1
+	case ok:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// netipds_load decodes a set encoded by netipdspb.SetToProto. See
+// netipdsc.Load.
+//
+//export netipds_load
+func netipds_load(b *C.uint8_t, n C.size_t) C.uint64_t {
+	h, err := netipdsc.Load(bytes(b, n))
+	if err != nil {
+		return 0
+	}
+	return C.uint64_t(h)
+}
+
+// netipds_build builds a set from a packed list of Prefixes. See
+// netipdsc.Build.
+//
+//export netipds_build
+func netipds_build(b *C.uint8_t, n C.size_t) C.uint64_t {
+	h, err := netipdsc.Build(bytes(b, n))
+	if err != nil {
+		return 0
+	}
+	return C.uint64_t(h)
+}
+
+// netipds_free releases a set. It returns 0, or -1 if h is unknown.
+//
+//export netipds_free
+func netipds_free(h C.uint64_t) C.int {
+	if netipdsc.Free(netipdsc.Handle(h)) != nil {
+		return -1
+	}
+	return 0
+}
+
+// netipds_contains_addr reports whether the set includes a Prefix which
+// contains the address of n (4 or 16) bytes.
+//
+//export netipds_contains_addr
+func netipds_contains_addr(h C.uint64_t, addr *C.uint8_t, n C.size_t) C.int {
+	return result(netipdsc.ContainsAddr(netipdsc.Handle(h), bytes(addr, n)))
+}
+
+// netipds_encompasses reports whether the set includes a Prefix which
+// encompasses the Prefix of the address of n (4 or 16) bytes and length bits.
+//
+//export netipds_encompasses
+func netipds_encompasses(h C.uint64_t, addr *C.uint8_t, n C.size_t, bits C.int) C.int {
+	return result(netipdsc.Encompasses(netipdsc.Handle(h), bytes(addr, n), int(bits)))
+}
+
+func main() {}
@@ -0,0 +1,131 @@
+// Package netipdsc provides a handle-based API to netipds PrefixSets, using
+// only integers and byte slices, so that it can be exported from a c-shared
+// library (see the libnetipds command). This lets programs written in other
+// languages, such as C or Rust, query sets built by Go programs without
+// reimplementing netipds or its encoding.
+//
+// A set is identified by a Handle returned by Load or Build, and remains in
+// memory until it is released with Free. All functions are safe for
+// concurrent use.
+package netipdsc
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/aromatt/netipds"
+	"github.com/aromatt/netipds/netipdspb"
+)
+
+// Handle identifies a PrefixSet loaded with Load or Build. The zero Handle is
+// never returned for a valid set.
+type Handle uint64
+
+var (
+	mu   sync.RWMutex
+	sets = make(map[Handle]*netipds.PrefixSet)
+	next Handle
+)
+
+// register stores s and returns its new Handle.
+func register(s *netipds.PrefixSet) Handle {
+	mu.Lock()
+	defer mu.Unlock()
+	next++
+	sets[next] = s
+	return next
+}
+
+// lookup returns the set identified by h.
+func lookup(h Handle) (*netipds.PrefixSet, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	s, ok := sets[h]
+	if !ok {
+		return nil, fmt.Errorf("unknown handle: %d", h)
+	}
+	return s, nil
+}
+
+// Load decodes a PrefixSet encoded by netipdspb.SetToProto, and returns its
+// Handle.
+func Load(b []byte) (Handle, error) {
+	s, err := netipdspb.SetFromProto(b)
+	if err != nil {
+		return 0, err
+	}
+	return register(s), nil
+}
+
+// Build builds a PrefixSet from a packed list of Prefixes, and returns its
+// Handle. Each Prefix is encoded as the length of its address in bytes (4 or
+// 16), followed by the address and then the Prefix length, e.g. 10.0.0.0/8 is
+// encoded as {4, 10, 0, 0, 0, 8}.
+func Build(b []byte) (Handle, error) {
+	var psb netipds.PrefixSetBuilder
+	for len(b) > 0 {
+		n := int(b[0])
+		if n != 4 && n != 16 {
+			return 0, fmt.Errorf("invalid address length %d", n)
+		}
+		if len(b) < n+2 {
+			return 0, fmt.Errorf("truncated Prefix: %v", b)
+		}
+		addr, _ := netip.AddrFromSlice(b[1 : n+1])
+		p := netip.PrefixFrom(addr, int(b[n+1]))
+		if err := psb.Add(p); err != nil {
+			return 0, err
+		}
+		b = b[n+2:]
+	}
+	return register(psb.PrefixSet()), nil
+}
+
+// Free releases the set identified by h. The Handle must not be used again.
+func Free(h Handle) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := sets[h]; !ok {
+		return fmt.Errorf("unknown handle: %d", h)
+	}
+	delete(sets, h)
+	return nil
+}
+
+// ContainsAddr reports whether the set identified by h includes a Prefix
+// which contains addr. addr must be 4 bytes (IPv4) or 16 bytes (IPv6) long.
+func ContainsAddr(h Handle, addr []byte) (bool, error) {
+	s, err := lookup(h)
+	if err != nil {
+		return false, err
+	}
+	a, ok := netip.AddrFromSlice(addr)
+	if !ok {
+		return false, fmt.Errorf("invalid address length %d", len(addr))
+	}
+	return s.ContainsAddr(a), nil
+}
+
+// Encompasses reports whether the set identified by h includes a Prefix
+// which encompasses the Prefix of the provided address bytes and length. See
+// netipds.PrefixSet.EncompassesFromBytes. addr must be 4 or 16 bytes long.
+func Encompasses(h Handle, addr []byte, bits int) (bool, error) {
+	s, err := lookup(h)
+	if err != nil {
+		return false, err
+	}
+	if len(addr) != 4 && len(addr) != 16 {
+		return false, fmt.Errorf("invalid address length %d", len(addr))
+	}
+	return s.EncompassesFromBytes(addr, bits), nil
+}
+
+// Size returns the number of Prefixes in the set identified by h.
+func Size(h Handle) (int, error) {
+	s, err := lookup(h)
+	if err != nil {
+		return 0, err
+	}
+	return s.Size(), nil
+}
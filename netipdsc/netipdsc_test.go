@@ -0,0 +1,84 @@
+package netipdsc
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/aromatt/netipds"
+	"github.com/aromatt/netipds/netipdspb"
+)
+
+func TestHandles(t *testing.T) {
+	var psb netipds.PrefixSetBuilder
+	psb.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	psb.Add(netip.MustParsePrefix("2001:db8::/32"))
+	loaded, err := Load(netipdspb.SetToProto(psb.PrefixSet()))
+	if err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	built, err := Build([]byte{
+		4, 10, 0, 0, 0, 8,
+		16, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 32,
+	})
+	if err != nil {
+		t.Fatalf("Build() = %v", err)
+	}
+	if loaded == 0 || built == 0 || loaded == built {
+		t.Fatalf("handles = %d, %d, want distinct non-zero handles", loaded, built)
+	}
+
+	tests := []struct {
+		addr    []byte
+		bits    int
+		want    bool
+		wantErr bool
+	}{
+		{[]byte{10, 1, 2, 3}, 16, true, false},
+		{[]byte{11, 1, 2, 3}, 32, false, false},
+		{netip.MustParseAddr("2001:db8::1").AsSlice(), 64, true, false},
+		{netip.MustParseAddr("::ffff:10.1.2.3").AsSlice(), 128, true, false},
+		{[]byte{10, 1, 2}, 24, false, true},
+	}
+	for _, h := range []Handle{loaded, built} {
+		if n, err := Size(h); n != 2 || err != nil {
+			t.Errorf("Size(%d) = %d, %v, want 2, nil", h, n, err)
+		}
+		for _, tt := range tests {
+			got, err := ContainsAddr(h, tt.addr)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("ContainsAddr(%d, %v) = %v, %v, want %v, error %v", h, tt.addr, got, err, tt.want, tt.wantErr)
+			}
+			got, err = Encompasses(h, tt.addr, tt.bits)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("Encompasses(%d, %v, %d) = %v, %v, want %v, error %v", h, tt.addr, tt.bits, got, err, tt.want, tt.wantErr)
+			}
+		}
+	}
+
+	// Handles are unusable once freed.
+	if err := Free(loaded); err != nil {
+		t.Errorf("Free() = %v", err)
+	}
+	if err := Free(loaded); err == nil {
+		t.Errorf("second Free() = nil, want error")
+	}
+	if _, err := ContainsAddr(loaded, []byte{10, 0, 0, 1}); err == nil {
+		t.Errorf("ContainsAddr() after Free = nil error, want error")
+	}
+	if _, err := Size(0); err == nil {
+		t.Errorf("Size(0) = nil error, want error")
+	}
+	Free(built)
+}
+
+func TestBuildInvalid(t *testing.T) {
+	for _, b := range [][]byte{
+		{5, 10, 0, 0, 0, 0, 8},
+		{4, 10, 0, 0, 0},
+		{4, 10, 0, 0, 0, 33},
+	} {
+		if _, err := Build(b); err == nil {
+			t.Errorf("Build(%v) = nil error, want error", b)
+		}
+	}
+}
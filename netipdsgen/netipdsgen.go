@@ -0,0 +1,147 @@
+// Package netipdsgen generates Go source code from netipds structures, so
+// that small, static collections of Prefixes (e.g. bogons or special-use
+// ranges) can be compiled into a binary.
+package netipdsgen
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"slices"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aromatt/netipds"
+)
+
+// addrRange is an inclusive range of addresses, as IPv6 (or IPv4-mapped IPv6)
+// addresses split into high and low halves.
+type addrRange struct {
+	firstHi, firstLo uint64
+	lastHi, lastLo   uint64
+}
+
+// ranges returns the minimal sorted list of non-overlapping, non-adjacent
+// ranges covering the addresses in s. IPv4 addresses are represented as
+// IPv4-mapped IPv6 addresses.
+func ranges(s *netipds.PrefixSet) []addrRange {
+	var all []addrRange
+	for _, p := range s.PrefixesCompact() {
+		a := p.Addr().As16()
+		hi, lo := binary.BigEndian.Uint64(a[:8]), binary.BigEndian.Uint64(a[8:])
+		bits := p.Bits()
+		if p.Addr().Is4() {
+			bits += 96
+		}
+		r := addrRange{hi, lo, hi, lo}
+		if bits < 64 {
+			r.lastHi |= ^uint64(0) >> bits
+			r.lastLo = ^uint64(0)
+		} else {
+			r.lastLo |= ^uint64(0) >> (bits - 64)
+		}
+		all = append(all, r)
+	}
+	// PrefixesCompact lists IPv4 Prefixes before most IPv6 Prefixes, so the
+	// ranges must be sorted by their mapped addresses. An IPv6 Prefix may
+	// also encompass the IPv4-mapped ranges, so overlapping ranges are
+	// merged as well.
+	slices.SortFunc(all, func(a, b addrRange) int {
+		return cmp.Or(cmp.Compare(a.firstHi, b.firstHi), cmp.Compare(a.firstLo, b.firstLo))
+	})
+	var ret []addrRange
+	for _, r := range all {
+		if n := len(ret); n > 0 {
+			prev := &ret[n-1]
+			// Merge with prev if r starts at or before the address following
+			// prev.
+			nextHi, nextLo := prev.lastHi, prev.lastLo+1
+			if nextLo == 0 {
+				nextHi++
+			}
+			overflow := nextHi == 0 && nextLo == 0
+			if overflow || r.firstHi < nextHi || r.firstHi == nextHi && r.firstLo <= nextLo {
+				if r.lastHi > prev.lastHi || r.lastHi == prev.lastHi && r.lastLo > prev.lastLo {
+					prev.lastHi, prev.lastLo = r.lastHi, r.lastLo
+				}
+				continue
+			}
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// WriteContains writes to w a Go source file for package pkg, declaring a
+// function with the provided name and the signature
+//
+//	func(addr netip.Addr) bool
+//
+// which reports whether addr is encompassed by a Prefix in s. The generated
+// function performs a binary search over a table of address ranges, and does
+// not allocate.
+//
+// The generated file imports only net/netip, and uses no generics, interfaces
+// or reflection, so it is suitable for constrained environments such as
+// TinyGo, where the netipds package itself may be too heavy.
+//
+// As with PrefixSet, IPv4-mapped IPv6 addresses are treated as the IPv4
+// addresses they map.
+func WriteContains(w io.Writer, pkg, name string, s *netipds.PrefixSet) error {
+	if !token.IsIdentifier(pkg) {
+		return fmt.Errorf("invalid package name %q", pkg)
+	}
+	if !token.IsIdentifier(name) {
+		return fmt.Errorf("invalid function name %q", name)
+	}
+	table := unexported(name) + "Ranges"
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by netipdsgen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", pkg)
+	fmt.Fprintf(&buf, "import \"net/netip\"\n\n")
+	fmt.Fprintf(&buf, "// %s holds the ranges matched by %s, as {first hi, first lo, last hi,\n", table, name)
+	fmt.Fprintf(&buf, "// last lo}, in ascending order.\n")
+	fmt.Fprintf(&buf, "var %s = [...][4]uint64{\n", table)
+	for _, r := range ranges(s) {
+		fmt.Fprintf(&buf, "\t{%#016x, %#016x, %#016x, %#016x},\n", r.firstHi, r.firstLo, r.lastHi, r.lastLo)
+	}
+	fmt.Fprintf(&buf, "}\n\n")
+	fmt.Fprintf(&buf, "// %s reports whether addr is in the set.\n", name)
+	fmt.Fprintf(&buf, "func %s(addr netip.Addr) bool {\n", name)
+	fmt.Fprintf(&buf, "\tif !addr.IsValid() {\n\t\treturn false\n\t}\n")
+	fmt.Fprintf(&buf, "\tb := addr.As16()\n")
+	fmt.Fprintf(&buf, "\tvar hi, lo uint64\n")
+	fmt.Fprintf(&buf, "\tfor i := 0; i < 8; i++ {\n")
+	fmt.Fprintf(&buf, "\t\thi = hi<<8 | uint64(b[i])\n")
+	fmt.Fprintf(&buf, "\t\tlo = lo<<8 | uint64(b[i+8])\n")
+	fmt.Fprintf(&buf, "\t}\n")
+	fmt.Fprintf(&buf, "\t// Find the first range whose end is not before addr.\n")
+	fmt.Fprintf(&buf, "\ti, j := 0, len(%s)\n", table)
+	fmt.Fprintf(&buf, "\tfor i < j {\n")
+	fmt.Fprintf(&buf, "\t\tm := int(uint(i+j) >> 1)\n")
+	fmt.Fprintf(&buf, "\t\tif r := %s[m]; r[2] < hi || (r[2] == hi && r[3] < lo) {\n", table)
+	fmt.Fprintf(&buf, "\t\t\ti = m + 1\n\t\t} else {\n\t\t\tj = m\n\t\t}\n")
+	fmt.Fprintf(&buf, "\t}\n")
+	fmt.Fprintf(&buf, "\tif i == len(%s) {\n\t\treturn false\n\t}\n", table)
+	fmt.Fprintf(&buf, "\tr := %s[i]\n", table)
+	fmt.Fprintf(&buf, "\treturn r[0] < hi || (r[0] == hi && r[1] <= lo)\n")
+	fmt.Fprintf(&buf, "}\n")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+// unexported returns name with its first letter in lower case.
+func unexported(name string) string {
+	r, n := utf8.DecodeRuneInString(name)
+	return string(unicode.ToLower(r)) + name[n:]
+}
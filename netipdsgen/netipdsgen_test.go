@@ -0,0 +1,196 @@
+package netipdsgen
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aromatt/netipds"
+)
+
+func buildSet(prefixes ...string) *netipds.PrefixSet {
+	var psb netipds.PrefixSetBuilder
+	for _, p := range prefixes {
+		psb.Add(netip.MustParsePrefix(p))
+	}
+	return psb.PrefixSet()
+}
+
+// contains reports whether addr is in rs, using the same search as the code
+// generated by WriteContains.
+func contains(rs []addrRange, addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	b := addr.As16()
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	i, j := 0, len(rs)
+	for i < j {
+		m := int(uint(i+j) >> 1)
+		if r := rs[m]; r.lastHi < hi || (r.lastHi == hi && r.lastLo < lo) {
+			i = m + 1
+		} else {
+			j = m
+		}
+	}
+	if i == len(rs) {
+		return false
+	}
+	r := rs[i]
+	return r.firstHi < hi || (r.firstHi == hi && r.firstLo <= lo)
+}
+
+func TestRanges(t *testing.T) {
+	s := buildSet(
+		"10.0.0.0/8", "10.1.0.0/16", "11.0.0.0/8", "192.168.0.0/24",
+		"192.168.2.0/24", "2001:db8::/32", "::1/128", "::2/128",
+	)
+	rs := ranges(s)
+	// 10/8 and 11/8 merge, as do ::1 and ::2; 10.1/16 is encompassed.
+	if len(rs) != 5 {
+		t.Errorf("len(ranges(s)) = %d, want 5: %v", len(rs), rs)
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.0.0.0", true},
+		{"11.255.255.255", true},
+		{"12.0.0.0", false},
+		{"9.255.255.255", false},
+		{"192.168.0.255", true},
+		{"192.168.1.0", false},
+		{"192.168.2.0", true},
+		{"::ffff:10.1.2.3", true},
+		{"2001:db8:ffff::1", true},
+		{"2001:db9::", false},
+		{"::", false},
+		{"::1", true},
+		{"::2", true},
+		{"::3", false},
+		{"ffff::", false},
+	}
+	for _, tt := range tests {
+		addr := netip.MustParseAddr(tt.addr)
+		if got := contains(rs, addr); got != tt.want {
+			t.Errorf("contains(%v) = %v, want %v", addr, got, tt.want)
+		}
+		if got := s.Encompasses(netip.PrefixFrom(addr, addr.BitLen())); got != tt.want {
+			t.Errorf("s.Encompasses(%v) = %v, want %v", addr, got, tt.want)
+		}
+	}
+	if contains(rs, netip.Addr{}) {
+		t.Errorf("contains(invalid) = true, want false")
+	}
+}
+
+func TestWriteContains(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteContains(&buf, "pkg", "IsBogon", buildSet("10.0.0.0/8", "::1/128")); err != nil {
+		t.Fatal(err)
+	}
+	src := buf.String()
+	for _, want := range []string{
+		"// Code generated by netipdsgen. DO NOT EDIT.",
+		"package pkg",
+		"func IsBogon(addr netip.Addr) bool",
+		"var isBogonRanges = [...][4]uint64{",
+	} {
+		if !strings.Contains(src, want) {
+			t.Errorf("generated source does not contain %q:\n%s", want, src)
+		}
+	}
+
+	if err := WriteContains(&buf, "pkg", "not valid", buildSet()); err == nil {
+		t.Errorf("WriteContains with invalid name returned nil error")
+	}
+	if err := WriteContains(&buf, "1pkg", "F", buildSet()); err == nil {
+		t.Errorf("WriteContains with invalid package returned nil error")
+	}
+}
+
+// TestWriteContainsDeps checks that the generated code is free of the features
+// that would keep it from building in constrained environments.
+func TestWriteContainsDeps(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteContains(&buf, "pkg", "Contains", buildSet("10.0.0.0/8", "2001:db8::/32")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), "gen.go", buf.Bytes(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, imp := range f.Imports {
+		if imp.Path.Value != `"net/netip"` {
+			t.Errorf("generated code imports %s; want only net/netip", imp.Path.Value)
+		}
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncType:
+			if n.TypeParams != nil {
+				t.Errorf("generated code declares a generic function")
+			}
+		case *ast.InterfaceType:
+			t.Errorf("generated code uses an interface type")
+		}
+		return true
+	})
+}
+
+// TestWriteContainsRun compiles and runs the generated code.
+func TestWriteContainsRun(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping compilation in short mode")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	if err := WriteContains(&buf, "main", "Contains", buildSet("10.0.0.0/8", "192.168.0.0/24", "2001:db8::/32")); err != nil {
+		t.Fatal(err)
+	}
+	main := `package main
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+func main() {
+	for _, a := range []string{"10.1.2.3", "11.0.0.0", "192.168.0.7", "::ffff:192.168.0.1", "2001:db8::1", "::1"} {
+		fmt.Print(Contains(netip.MustParseAddr(a)), " ")
+	}
+	fmt.Print(Contains(netip.Addr{}))
+}
+`
+	files := map[string]string{
+		"go.mod":      "module gen\n\ngo 1.21\n",
+		"contains.go": buf.String(),
+		"main.go":     main,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(goBin, "run", ".")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run: %v\n%s", err, out)
+	}
+	if got, want := string(out), "true false true true true false false"; got != want {
+		t.Errorf("generated Contains results = %q, want %q", got, want)
+	}
+}
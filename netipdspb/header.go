@@ -0,0 +1,223 @@
+package netipdspb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"maps"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// SchemaVersion is the version of netipds.proto implemented by this package.
+// It is recorded in the Header of each message written by SetToProto and
+// MapToProto; messages with a later version are rejected when decoding.
+const SchemaVersion = 1
+
+// ErrNoHeader is returned by ReadHeader for messages without a Header, such as
+// those written by earlier versions of this package.
+var ErrNoHeader = errors.New("netipdspb: message has no header")
+
+// Field numbers of the Header message, as defined in netipds.proto.
+const (
+	fieldHeaderSchemaVersion = 1
+	fieldHeaderIPv4Count     = 2
+	fieldHeaderIPv6Count     = 3
+	fieldHeaderFingerprint   = 4
+	fieldHeaderCreated       = 5
+	fieldHeaderLabels        = 6
+
+	fieldLabelKey   = 1
+	fieldLabelValue = 2
+)
+
+// Header describes the contents of an encoded PrefixList message. It is
+// written before the Prefixes, so ReadHeader can return it without decoding
+// them.
+type Header struct {
+	// SchemaVersion is the version of netipds.proto used by the encoder.
+	SchemaVersion uint32
+
+	// IPv4Count and IPv6Count are the numbers of IPv4 and IPv6 Prefixes in
+	// the message.
+	IPv4Count int
+	IPv6Count int
+
+	// Fingerprint is the SHA-256 digest of the encoded Prefixes. Two messages
+	// with the same Fingerprint have the same contents, so a receiver that
+	// has already applied one can skip the other.
+	Fingerprint []byte
+
+	// Created is the creation time provided with WithCreated, or the zero
+	// Time.
+	Created time.Time
+
+	// Labels holds the metadata provided with WithLabels, if any.
+	Labels map[string]string
+}
+
+// EncodeOption configures the Header written by SetToProto and MapToProto.
+type EncodeOption func(*Header)
+
+// WithCreated records t as the creation time in the Header.
+func WithCreated(t time.Time) EncodeOption {
+	return func(h *Header) {
+		h.Created = t
+	}
+}
+
+// WithLabels records labels as free-form metadata in the Header, e.g. the
+// name of the feed a PrefixSet was built from.
+func WithLabels(labels map[string]string) EncodeOption {
+	return func(h *Header) {
+		h.Labels = labels
+	}
+}
+
+// ReadHeader returns the Header of a PrefixList message produced by
+// SetToProto or MapToProto, without decoding its Prefixes. If the message has
+// no Header, ReadHeader returns ErrNoHeader.
+func ReadHeader(b []byte) (Header, error) {
+	var (
+		h     Header
+		found bool
+	)
+	errFound := errors.New("found")
+	err := readFields(b, func(field, wireType int, _ uint64, data []byte) error {
+		if field != fieldListHeader || wireType != wireLen {
+			return nil
+		}
+		var err error
+		if h, err = readHeader(data); err != nil {
+			return err
+		}
+		found = true
+		// The Header is written first, so there is no need to scan the
+		// Prefixes for another one.
+		return errFound
+	})
+	if err != nil && err != errFound {
+		return Header{}, err
+	}
+	if !found {
+		return Header{}, ErrNoHeader
+	}
+	return h, nil
+}
+
+// fingerprint accumulates the Fingerprint and address family counts of a
+// series of encoded Prefix messages.
+type fingerprint struct {
+	sum                  hash.Hash
+	ipv4Count, ipv6Count int
+}
+
+func newFingerprint() *fingerprint {
+	return &fingerprint{sum: sha256.New()}
+}
+
+// add records the encoded Prefix message msg, which encodes p.
+func (f *fingerprint) add(msg []byte, p netip.Prefix) {
+	f.write(msg)
+	if p.Addr().Is4() {
+		f.ipv4Count++
+	} else {
+		f.ipv6Count++
+	}
+}
+
+// write adds the encoded Prefix message msg to the Fingerprint. Each message
+// is hashed along with its length, so that the boundaries between messages
+// are part of the Fingerprint.
+func (f *fingerprint) write(msg []byte) {
+	f.sum.Write(binary.AppendUvarint(nil, uint64(len(msg))))
+	f.sum.Write(msg)
+}
+
+// header returns a Header describing the recorded Prefixes, configured by
+// opts.
+func (f *fingerprint) header(opts []EncodeOption) Header {
+	h := Header{
+		SchemaVersion: SchemaVersion,
+		IPv4Count:     f.ipv4Count,
+		IPv6Count:     f.ipv6Count,
+		Fingerprint:   f.sum.Sum(nil),
+	}
+	for _, opt := range opts {
+		opt(&h)
+	}
+	return h
+}
+
+// withHeader returns a PrefixList message consisting of h followed by the
+// encoded prefixes field body.
+func withHeader(h Header, body []byte) []byte {
+	ret := appendLen(nil, fieldListHeader, appendHeader(nil, h))
+	return append(ret, body...)
+}
+
+func appendHeader(b []byte, h Header) []byte {
+	b = appendVarint(b, fieldHeaderSchemaVersion, uint64(h.SchemaVersion))
+	b = appendVarint(b, fieldHeaderIPv4Count, uint64(h.IPv4Count))
+	b = appendVarint(b, fieldHeaderIPv6Count, uint64(h.IPv6Count))
+	b = appendLen(b, fieldHeaderFingerprint, h.Fingerprint)
+	if !h.Created.IsZero() {
+		b = appendVarint(b, fieldHeaderCreated, uint64(h.Created.UnixNano()))
+	}
+	// Labels are written in key order so that encoding is deterministic.
+	var label []byte
+	for _, k := range slices.Sorted(maps.Keys(h.Labels)) {
+		label = appendLen(label[:0], fieldLabelKey, []byte(k))
+		label = appendLen(label, fieldLabelValue, []byte(h.Labels[k]))
+		b = appendLen(b, fieldHeaderLabels, label)
+	}
+	return b
+}
+
+// readHeader decodes the Header message b.
+func readHeader(b []byte) (h Header, err error) {
+	err = readFields(b, func(field, wireType int, v uint64, data []byte) error {
+		switch {
+		case field == fieldHeaderSchemaVersion && wireType == wireVarint:
+			h.SchemaVersion = uint32(v)
+		case field == fieldHeaderIPv4Count && wireType == wireVarint:
+			h.IPv4Count = int(v)
+		case field == fieldHeaderIPv6Count && wireType == wireVarint:
+			h.IPv6Count = int(v)
+		case field == fieldHeaderFingerprint && wireType == wireLen:
+			h.Fingerprint = bytes.Clone(data)
+		case field == fieldHeaderCreated && wireType == wireVarint:
+			h.Created = time.Unix(0, int64(v))
+		case field == fieldHeaderLabels && wireType == wireLen:
+			var k, val string
+			err := readFields(data, func(field, wireType int, _ uint64, data []byte) error {
+				switch {
+				case field == fieldLabelKey && wireType == wireLen:
+					k = string(data)
+				case field == fieldLabelValue && wireType == wireLen:
+					val = string(data)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if h.Labels == nil {
+				h.Labels = make(map[string]string)
+			}
+			h.Labels[k] = val
+		}
+		return nil
+	})
+	if err != nil {
+		return Header{}, err
+	}
+	if h.SchemaVersion > SchemaVersion {
+		return Header{}, fmt.Errorf("netipdspb: unsupported schema version %d", h.SchemaVersion)
+	}
+	return h, nil
+}
@@ -0,0 +1,160 @@
+package netipdspb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"maps"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aromatt/netipds"
+)
+
+func TestReadHeader(t *testing.T) {
+	var sb netipds.PrefixSetBuilder
+	sb.Add(pfx("10.0.0.0/8"))
+	sb.Add(pfx("192.168.0.0/16"))
+	sb.Add(pfx("2001:db8::/32"))
+	s := sb.PrefixSet()
+
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	labels := map[string]string{"feed": "bogons", "region": "eu"}
+	b := SetToProto(s, WithCreated(created), WithLabels(labels))
+
+	h, err := ReadHeader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.SchemaVersion != SchemaVersion {
+		t.Errorf("SchemaVersion = %d, want %d", h.SchemaVersion, SchemaVersion)
+	}
+	if h.IPv4Count != 2 || h.IPv6Count != 1 {
+		t.Errorf("IPv4Count, IPv6Count = %d, %d, want 2, 1", h.IPv4Count, h.IPv6Count)
+	}
+	if !h.Created.Equal(created) {
+		t.Errorf("Created = %v, want %v", h.Created, created)
+	}
+	if !maps.Equal(h.Labels, labels) {
+		t.Errorf("Labels = %v, want %v", h.Labels, labels)
+	}
+
+	// The Fingerprint depends only on the contents.
+	h2, err := ReadHeader(SetToProto(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h.Fingerprint, h2.Fingerprint) {
+		t.Errorf("Fingerprint differs with different metadata: %x, %x", h.Fingerprint, h2.Fingerprint)
+	}
+	if !h2.Created.IsZero() || h2.Labels != nil {
+		t.Errorf("got Created %v, Labels %v without options, want zero values", h2.Created, h2.Labels)
+	}
+	sb.Add(pfx("::1/128"))
+	h3, err := ReadHeader(SetToProto(sb.PrefixSet()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(h.Fingerprint, h3.Fingerprint) {
+		t.Errorf("Fingerprint unchanged after adding a Prefix: %x", h.Fingerprint)
+	}
+}
+
+func TestReadHeaderMap(t *testing.T) {
+	var mb netipds.PrefixMapBuilder[int]
+	mb.Set(pfx("10.0.0.0/8"), 1)
+	mb.Set(pfx("::1/128"), 2)
+	m := mb.PrefixMap()
+	enc := func(v int) ([]byte, error) { return []byte(strconv.Itoa(v)), nil }
+
+	b, err := MapToProto(m, enc, WithLabels(map[string]string{"k": "v"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ReadHeader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.IPv4Count != 1 || h.IPv6Count != 1 || h.Labels["k"] != "v" {
+		t.Errorf("ReadHeader = %+v", h)
+	}
+
+	// Values are part of the Fingerprint.
+	mb.Set(pfx("::1/128"), 3)
+	b2, err := MapToProto(mb.PrefixMap(), enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2, _ := ReadHeader(b2); bytes.Equal(h.Fingerprint, h2.Fingerprint) {
+		t.Errorf("Fingerprint unchanged after changing a value: %x", h.Fingerprint)
+	}
+}
+
+func TestMapFingerprint(t *testing.T) {
+	hash := func(v string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(v))
+		return h.Sum64()
+	}
+	var mb netipds.PrefixMapBuilder[string]
+	mb.Set(pfx("10.0.0.0/8"), "192.0.2.1")
+	mb.Set(pfx("2001:db8::/32"), "2001:db8::1")
+	fp := MapFingerprint(mb.PrefixMap(), hash)
+
+	// The same contents give the same digest, which matches the Header of
+	// the equivalent encoding.
+	if fp2 := MapFingerprint(mb.PrefixMap(), hash); !bytes.Equal(fp, fp2) {
+		t.Errorf("MapFingerprint differs for the same map: %x, %x", fp, fp2)
+	}
+	enc := func(v string) ([]byte, error) { return binary.BigEndian.AppendUint64(nil, hash(v)), nil }
+	b, err := MapToProto(mb.PrefixMap(), enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := ReadHeader(b); !bytes.Equal(fp, h.Fingerprint) {
+		t.Errorf("MapFingerprint = %x, want Header Fingerprint %x", fp, h.Fingerprint)
+	}
+
+	// Changing a value changes the digest.
+	mb.Set(pfx("10.0.0.0/8"), "192.0.2.2")
+	if fp2 := MapFingerprint(mb.PrefixMap(), hash); bytes.Equal(fp, fp2) {
+		t.Errorf("MapFingerprint unchanged after changing a value: %x", fp)
+	}
+}
+
+func TestReadHeaderMissing(t *testing.T) {
+	// PrefixList{prefixes: [{addr: 10.0.0.0, bits: 8}]}, without a Header.
+	b := []byte{0x0a, 8, 0x0a, 4, 10, 0, 0, 0, 0x10, 8}
+	if _, err := ReadHeader(b); !errors.Is(err, ErrNoHeader) {
+		t.Errorf("ReadHeader(%x) err = %v, want %v", b, err, ErrNoHeader)
+	}
+	// Messages without a Header can still be decoded.
+	if _, err := SetFromProto(b); err != nil {
+		t.Errorf("SetFromProto(%x) err = %v", b, err)
+	}
+}
+
+func TestFromProtoHeaderMismatch(t *testing.T) {
+	var sb netipds.PrefixSetBuilder
+	sb.Add(pfx("10.0.0.0/8"))
+	b := SetToProto(sb.PrefixSet())
+
+	// Corrupt the last byte of the Prefix, i.e. its length.
+	corrupt := bytes.Clone(b)
+	corrupt[len(corrupt)-1] = 9
+	if _, err := SetFromProto(corrupt); err == nil {
+		t.Errorf("SetFromProto with mismatched fingerprint returned nil error")
+	}
+
+	// A Header from a later schema version is rejected.
+	h := Header{SchemaVersion: SchemaVersion + 1}
+	newer := appendLen(nil, fieldListHeader, appendHeader(nil, h))
+	if _, err := SetFromProto(newer); err == nil {
+		t.Errorf("SetFromProto with schema version %d returned nil error", h.SchemaVersion)
+	}
+	if _, err := ReadHeader(newer); err == nil {
+		t.Errorf("ReadHeader with schema version %d returned nil error", h.SchemaVersion)
+	}
+}
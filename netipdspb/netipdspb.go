@@ -0,0 +1,267 @@
+// Package netipdspb encodes netipds sets and maps using a canonical protobuf
+// schema (see netipds.proto), so that they can be distributed over gRPC or
+// any other protobuf-based transport.
+//
+// The encoding is implemented directly on the protobuf wire format, so this
+// package has no dependencies beyond netipds. Its output can be decoded by
+// code generated from netipds.proto, and vice versa.
+package netipdspb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/aromatt/netipds"
+)
+
+// Field numbers, as defined in netipds.proto.
+const (
+	fieldListPrefixes = 1
+	fieldListHeader   = 2
+
+	fieldPrefixAddr  = 1
+	fieldPrefixBits  = 2
+	fieldPrefixValue = 3
+	fieldPrefixFlags = 4
+)
+
+// Protobuf wire types.
+const (
+	wireVarint = 0
+	wireI64    = 1
+	wireLen    = 2
+	wireI32    = 5
+)
+
+var errTruncated = errors.New("netipdspb: truncated message")
+
+// SetToProto encodes s as a PrefixList message, including a Header
+// configured by opts. Each Prefix's flags are encoded in its flags field.
+func SetToProto(s *netipds.PrefixSet, opts ...EncodeOption) []byte {
+	var buf, msg []byte
+	f := newFingerprint()
+	for p := range s.All() {
+		flags, _ := s.Flags(p)
+		msg = appendPrefix(msg[:0], p, nil, false, flags)
+		buf = appendLen(buf, fieldListPrefixes, msg)
+		f.add(msg, p)
+	}
+	return withHeader(f.header(opts), buf)
+}
+
+// SetFromProto decodes a PrefixList message produced by SetToProto. Values
+// are ignored.
+func SetFromProto(b []byte) (*netipds.PrefixSet, error) {
+	var sb netipds.PrefixSetBuilder
+	err := readList(b, func(p netip.Prefix, _ []byte, flags uint8) error {
+		return sb.AddWithFlags(p, flags)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sb.PrefixSet(), nil
+}
+
+// MapToProto encodes m as a PrefixList message, including a Header configured
+// by opts, using enc to encode each value.
+func MapToProto[T any](
+	m *netipds.PrefixMap[T],
+	enc func(T) ([]byte, error),
+	opts ...EncodeOption,
+) ([]byte, error) {
+	var buf, msg []byte
+	var err error
+	f := newFingerprint()
+	m.WalkPrune(func(p netip.Prefix, v T) netipds.WalkAction {
+		var vb []byte
+		if vb, err = enc(v); err != nil {
+			err = fmt.Errorf("encoding value for %v: %w", p, err)
+			return netipds.WalkStop
+		}
+		msg = appendPrefix(msg[:0], p, vb, true, 0)
+		buf = appendLen(buf, fieldListPrefixes, msg)
+		f.add(msg, p)
+		return netipds.WalkContinue
+	})
+	if err != nil {
+		return nil, err
+	}
+	return withHeader(f.header(opts), buf), nil
+}
+
+// MapFingerprint returns a digest of the Prefixes and values in m, using hash
+// to reduce each value to 64 bits, without encoding m. A change to any value
+// changes the digest (unless the old and new values have the same hash), so
+// it can be compared with an earlier result to detect updates that leave the
+// Prefixes unchanged, e.g. a route whose next hop has changed.
+//
+// The result is the Fingerprint that MapToProto would record in the Header
+// if each value were encoded as the 8 big-endian bytes of its hash.
+func MapFingerprint[T any](m *netipds.PrefixMap[T], hash func(T) uint64) []byte {
+	var msg, vb []byte
+	f := newFingerprint()
+	m.WalkPrune(func(p netip.Prefix, v T) netipds.WalkAction {
+		vb = binary.BigEndian.AppendUint64(vb[:0], hash(v))
+		msg = appendPrefix(msg[:0], p, vb, true, 0)
+		f.write(msg)
+		return netipds.WalkContinue
+	})
+	return f.sum.Sum(nil)
+}
+
+// MapFromProto decodes a PrefixList message produced by MapToProto, using dec
+// to decode each value. Flags are ignored.
+func MapFromProto[T any](b []byte, dec func([]byte) (T, error)) (*netipds.PrefixMap[T], error) {
+	var mb netipds.PrefixMapBuilder[T]
+	err := readList(b, func(p netip.Prefix, vb []byte, _ uint8) error {
+		v, err := dec(vb)
+		if err != nil {
+			return fmt.Errorf("decoding value for %v: %w", p, err)
+		}
+		return mb.Set(p, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mb.PrefixMap(), nil
+}
+
+func appendPrefix(b []byte, p netip.Prefix, value []byte, hasValue bool, flags uint8) []byte {
+	b = appendLen(b, fieldPrefixAddr, p.Addr().AsSlice())
+	b = appendVarint(b, fieldPrefixBits, uint64(p.Bits()))
+	if hasValue {
+		b = appendLen(b, fieldPrefixValue, value)
+	}
+	if flags != 0 {
+		b = appendVarint(b, fieldPrefixFlags, uint64(flags))
+	}
+	return b
+}
+
+func appendTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+func appendVarint(b []byte, field int, v uint64) []byte {
+	return binary.AppendUvarint(appendTag(b, field, wireVarint), v)
+}
+
+func appendLen(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(appendTag(b, field, wireLen), uint64(len(v)))
+	return append(b, v...)
+}
+
+// readList calls fn for each Prefix message in the PrefixList message b. If b
+// has a Header with a Fingerprint, it is checked against the Prefix messages.
+func readList(b []byte, fn func(netip.Prefix, []byte, uint8) error) error {
+	var h *Header
+	f := newFingerprint()
+	err := readFields(b, func(field, wireType int, v uint64, data []byte) error {
+		switch {
+		case field == fieldListPrefixes && wireType == wireLen:
+			f.write(data)
+			return readPrefix(data, fn)
+		case field == fieldListHeader && wireType == wireLen:
+			hdr, err := readHeader(data)
+			if err != nil {
+				return err
+			}
+			h = &hdr
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if h != nil && len(h.Fingerprint) > 0 && !bytes.Equal(h.Fingerprint, f.sum.Sum(nil)) {
+		return errors.New("netipdspb: fingerprint does not match contents")
+	}
+	return nil
+}
+
+// readPrefix decodes the Prefix message b and passes its contents to fn.
+func readPrefix(b []byte, fn func(netip.Prefix, []byte, uint8) error) error {
+	var (
+		addr  []byte
+		bits  uint64
+		value []byte
+		flags uint64
+	)
+	err := readFields(b, func(field, wireType int, v uint64, data []byte) error {
+		switch {
+		case field == fieldPrefixAddr && wireType == wireLen:
+			addr = data
+		case field == fieldPrefixBits && wireType == wireVarint:
+			bits = v
+		case field == fieldPrefixValue && wireType == wireLen:
+			value = data
+		case field == fieldPrefixFlags && wireType == wireVarint:
+			flags = v
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	a, ok := netip.AddrFromSlice(addr)
+	if !ok {
+		return fmt.Errorf("netipdspb: invalid address length %d", len(addr))
+	}
+	if bits > uint64(a.BitLen()) {
+		return fmt.Errorf("netipdspb: invalid prefix length %d for %v", bits, a)
+	}
+	if flags > 0xff {
+		return fmt.Errorf("netipdspb: invalid flags %d", flags)
+	}
+	return fn(netip.PrefixFrom(a, int(bits)), value, uint8(flags))
+}
+
+// readFields calls fn for each field in the message b. For varint fields, v
+// holds the value; for length-delimited fields, data holds the contents.
+// Fixed-width fields are skipped.
+func readFields(b []byte, fn func(field, wireType int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		b = b[n:]
+		field, wireType := int(tag>>3), int(tag&7)
+		var (
+			v    uint64
+			data []byte
+		)
+		switch wireType {
+		case wireVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+		case wireLen:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errTruncated
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		case wireI64, wireI32:
+			w := 8
+			if wireType == wireI32 {
+				w = 4
+			}
+			if len(b) < w {
+				return errTruncated
+			}
+			b = b[w:]
+			continue
+		default:
+			return fmt.Errorf("netipdspb: unsupported wire type %d", wireType)
+		}
+		if err := fn(field, wireType, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
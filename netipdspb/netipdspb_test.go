@@ -0,0 +1,107 @@
+package netipdspb
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/aromatt/netipds"
+)
+
+func pfx(s string) netip.Prefix {
+	return netip.MustParsePrefix(s)
+}
+
+func TestSetRoundTrip(t *testing.T) {
+	var sb netipds.PrefixSetBuilder
+	sb.AddWithFlags(pfx("10.0.0.0/8"), 3)
+	sb.Add(pfx("10.1.0.0/16"))
+	sb.Add(pfx("2001:db8::/32"))
+	sb.AddWithFlags(pfx("::1/128"), 0x80)
+	want := sb.PrefixSet()
+
+	got, err := SetFromProto(SetToProto(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.Prefixes(), want.Prefixes()) {
+		t.Errorf("SetFromProto(SetToProto(s)) = %v, want %v", got.Prefixes(), want.Prefixes())
+	}
+	for _, p := range want.Prefixes() {
+		wantFlags, _ := want.Flags(p)
+		if gotFlags, _ := got.Flags(p); gotFlags != wantFlags {
+			t.Errorf("Flags(%v) = %d, want %d", p, gotFlags, wantFlags)
+		}
+	}
+}
+
+func TestMapRoundTrip(t *testing.T) {
+	var mb netipds.PrefixMapBuilder[int]
+	mb.Set(pfx("10.0.0.0/8"), 1)
+	mb.Set(pfx("10.1.0.0/16"), 0)
+	mb.Set(pfx("2001:db8::/32"), -3)
+	want := mb.PrefixMap()
+
+	enc := func(v int) ([]byte, error) { return []byte(strconv.Itoa(v)), nil }
+	dec := func(b []byte) (int, error) { return strconv.Atoi(string(b)) }
+
+	b, err := MapToProto(want, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := MapFromProto(b, dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotMap, wantMap := got.ToMap(), want.ToMap()
+	if len(gotMap) != len(wantMap) {
+		t.Fatalf("MapFromProto(MapToProto(m)) = %v, want %v", gotMap, wantMap)
+	}
+	for p, v := range wantMap {
+		if gotMap[p] != v {
+			t.Errorf("MapFromProto(MapToProto(m)) = %v, want %v", gotMap, wantMap)
+			break
+		}
+	}
+
+	errEnc := errors.New("enc")
+	if _, err := MapToProto(want, func(int) ([]byte, error) { return nil, errEnc }); !errors.Is(err, errEnc) {
+		t.Errorf("MapToProto with failing encoder: err = %v, want %v", err, errEnc)
+	}
+}
+
+func TestFromProtoWireCompat(t *testing.T) {
+	// PrefixList{prefixes: [{addr: 10.0.0.0, bits: 8}]}, with an unknown
+	// fixed64 field (15) and an unknown varint field (16) interspersed, as
+	// might be produced by a newer version of the schema.
+	msg := []byte{0x0a, 4, 10, 0, 0, 0, 0x10, 8, 0x79, 0, 0, 0, 0, 0, 0, 0, 0, 0x80, 0x01, 1}
+	b := append([]byte{0x0a, byte(len(msg))}, msg...)
+	s, err := SetFromProto(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.Prefixes(), []netip.Prefix{pfx("10.0.0.0/8")}; !slices.Equal(got, want) {
+		t.Errorf("SetFromProto(%x) = %v, want %v", b, got, want)
+	}
+}
+
+func TestFromProtoInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"truncated tag", []byte{0x80}},
+		{"truncated length", []byte{0x0a, 10, 0x0a}},
+		{"bad address length", []byte{0x0a, 5, 0x0a, 3, 10, 0, 0}},
+		{"bad prefix length", []byte{0x0a, 8, 0x0a, 4, 10, 0, 0, 0, 0x10, 33}},
+		{"bad flags", []byte{0x0a, 9, 0x0a, 4, 10, 0, 0, 0, 0x20, 0x80, 0x02}},
+		{"bad wire type", []byte{0x0b}},
+	}
+	for _, tt := range tests {
+		if _, err := SetFromProto(tt.b); err == nil {
+			t.Errorf("%s: SetFromProto(%x) returned nil error", tt.name, tt.b)
+		}
+	}
+}
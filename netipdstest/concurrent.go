@@ -0,0 +1,63 @@
+package netipdstest
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/aromatt/netipds"
+)
+
+// queryResult holds the results of each PrefixQuerier query for one Prefix.
+type queryResult struct {
+	contains, encompasses, encompassesStrict, overlaps bool
+}
+
+func query(q netipds.PrefixQuerier, p netip.Prefix) queryResult {
+	return queryResult{
+		contains:          q.Contains(p),
+		encompasses:       q.Encompasses(p),
+		encompassesStrict: q.EncompassesStrict(p),
+		overlaps:          q.OverlapsPrefix(p),
+	}
+}
+
+// CheckConcurrentReads makes every PrefixQuerier query of q for each of
+// queries from the provided number of goroutines at once, and returns an
+// error if any result differs from the result of the same query made
+// sequentially.
+//
+// Run CheckConcurrentReads under the race detector (go test -race) to also
+// check that the queries do not race with one another, as required of the
+// immutable netipds types.
+func CheckConcurrentReads(q netipds.PrefixQuerier, queries []netip.Prefix, goroutines int) error {
+	want := make([]queryResult, len(queries))
+	for i, p := range queries {
+		want[i] = query(q, p)
+	}
+
+	errs := make([]error, goroutines)
+	var wg sync.WaitGroup
+	for g := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each goroutine starts at a different query, so that different
+			// parts of q are read at the same time.
+			for j := range queries {
+				i := (g + j) % len(queries)
+				if got := query(q, queries[i]); got != want[i] {
+					errs[g] = fmt.Errorf("concurrent query of %v = %+v, want %+v", queries[i], got, want[i])
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package netipdstest
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+)
+
+func TestCheckConcurrentReads(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	s := GenerateRandomPrefixSet(r, 1000)
+	queries := GenerateRandomPrefixSet(r, 200).Prefixes()
+	queries = append(queries, s.Prefixes()[:100]...)
+	if err := CheckConcurrentReads(s, queries, 8); err != nil {
+		t.Error(err)
+	}
+	if err := CheckConcurrentReads(s.Querier(), queries, 8); err != nil {
+		t.Error(err)
+	}
+}
+
+// flakyQuerier answers Contains differently on every other call.
+type flakyQuerier struct {
+	calls chan struct{}
+}
+
+func (f flakyQuerier) Contains(netip.Prefix) bool {
+	select {
+	case f.calls <- struct{}{}:
+		return true
+	default:
+		<-f.calls
+		return false
+	}
+}
+func (flakyQuerier) Encompasses(netip.Prefix) bool       { return false }
+func (flakyQuerier) EncompassesStrict(netip.Prefix) bool { return false }
+func (flakyQuerier) OverlapsPrefix(netip.Prefix) bool    { return false }
+
+func TestCheckConcurrentReadsMismatch(t *testing.T) {
+	q := flakyQuerier{make(chan struct{}, 1)}
+	queries := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	if err := CheckConcurrentReads(q, queries, 1); err == nil {
+		t.Error("CheckConcurrentReads returned nil error for inconsistent querier")
+	}
+}
@@ -0,0 +1,108 @@
+package netipdstest
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/aromatt/netipds"
+)
+
+// Method identifies a method of netipds.PrefixQuerier.
+type Method string
+
+const (
+	MethodContains          Method = "Contains"
+	MethodEncompasses       Method = "Encompasses"
+	MethodEncompassesStrict Method = "EncompassesStrict"
+	MethodOverlapsPrefix    Method = "OverlapsPrefix"
+)
+
+// Call records a call made to a FakePrefixQuerier.
+type Call struct {
+	Method Method
+	Prefix netip.Prefix
+}
+
+// FakePrefixQuerier is a netipds.PrefixQuerier whose results are scripted by
+// the test using it, and which records the calls made to it. It allows
+// testing code that consumes a PrefixQuerier without building a real
+// PrefixSet or PrefixMap.
+//
+// Each method returns the result of the corresponding Func field, or false if
+// the field is nil. The zero value is ready to use, and answers false to every
+// query. A FakePrefixQuerier is safe for concurrent use, provided its fields
+// are not modified while it is in use.
+type FakePrefixQuerier struct {
+	ContainsFunc          func(netip.Prefix) bool
+	EncompassesFunc       func(netip.Prefix) bool
+	EncompassesStrictFunc func(netip.Prefix) bool
+	OverlapsPrefixFunc    func(netip.Prefix) bool
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+var _ netipds.PrefixQuerier = (*FakePrefixQuerier)(nil)
+
+// Returning returns a func, for use in the Func fields of a
+// FakePrefixQuerier, that returns true for each Prefix in results that maps
+// to true, and false for all other Prefixes.
+func Returning(results map[netip.Prefix]bool) func(netip.Prefix) bool {
+	return func(p netip.Prefix) bool {
+		return results[p]
+	}
+}
+
+// call records a call to method and returns the result of fn.
+func (f *FakePrefixQuerier) call(method Method, fn func(netip.Prefix) bool, p netip.Prefix) bool {
+	f.mu.Lock()
+	f.calls = append(f.calls, Call{method, p})
+	f.mu.Unlock()
+	return fn != nil && fn(p)
+}
+
+func (f *FakePrefixQuerier) Contains(p netip.Prefix) bool {
+	return f.call(MethodContains, f.ContainsFunc, p)
+}
+
+func (f *FakePrefixQuerier) Encompasses(p netip.Prefix) bool {
+	return f.call(MethodEncompasses, f.EncompassesFunc, p)
+}
+
+func (f *FakePrefixQuerier) EncompassesStrict(p netip.Prefix) bool {
+	return f.call(MethodEncompassesStrict, f.EncompassesStrictFunc, p)
+}
+
+func (f *FakePrefixQuerier) OverlapsPrefix(p netip.Prefix) bool {
+	return f.call(MethodOverlapsPrefix, f.OverlapsPrefixFunc, p)
+}
+
+// Calls returns the calls made to f since it was created or last reset, in
+// the order they were made.
+func (f *FakePrefixQuerier) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.calls)
+}
+
+// CallsTo returns the Prefixes passed to method since f was created or last
+// reset, in the order they were passed.
+func (f *FakePrefixQuerier) CallsTo(method Method) []netip.Prefix {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ret []netip.Prefix
+	for _, c := range f.calls {
+		if c.Method == method {
+			ret = append(ret, c.Prefix)
+		}
+	}
+	return ret
+}
+
+// Reset discards the calls recorded by f.
+func (f *FakePrefixQuerier) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
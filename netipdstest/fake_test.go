@@ -0,0 +1,54 @@
+package netipdstest
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestFakePrefixQuerier(t *testing.T) {
+	p1, p2 := netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")
+	f := &FakePrefixQuerier{
+		ContainsFunc: Returning(map[netip.Prefix]bool{p1: true}),
+		OverlapsPrefixFunc: func(p netip.Prefix) bool {
+			return p.Addr().Is6()
+		},
+	}
+
+	tests := []struct {
+		method Method
+		fn     func(netip.Prefix) bool
+		p      netip.Prefix
+		want   bool
+	}{
+		{MethodContains, f.Contains, p1, true},
+		{MethodContains, f.Contains, p2, false},
+		{MethodEncompasses, f.Encompasses, p1, false},
+		{MethodEncompassesStrict, f.EncompassesStrict, p2, false},
+		{MethodOverlapsPrefix, f.OverlapsPrefix, p1, false},
+		{MethodOverlapsPrefix, f.OverlapsPrefix, p2, true},
+	}
+	var wantCalls []Call
+	for _, tt := range tests {
+		if got := tt.fn(tt.p); got != tt.want {
+			t.Errorf("%s(%v) = %v, want %v", tt.method, tt.p, got, tt.want)
+		}
+		wantCalls = append(wantCalls, Call{tt.method, tt.p})
+	}
+
+	if got := f.Calls(); !slices.Equal(got, wantCalls) {
+		t.Errorf("Calls() = %v, want %v", got, wantCalls)
+	}
+	if got, want := f.CallsTo(MethodOverlapsPrefix), []netip.Prefix{p1, p2}; !slices.Equal(got, want) {
+		t.Errorf("CallsTo(MethodOverlapsPrefix) = %v, want %v", got, want)
+	}
+	f.Reset()
+	if got := f.Calls(); len(got) != 0 {
+		t.Errorf("Calls() after Reset = %v, want none", got)
+	}
+
+	// The fake can stand in for a real PrefixQuerier.
+	if err := CheckConcurrentReads(f, []netip.Prefix{p1, p2}, 4); err != nil {
+		t.Error(err)
+	}
+}
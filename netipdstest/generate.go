@@ -0,0 +1,134 @@
+// Package netipdstest provides utilities for testing code that uses netipds.
+package netipdstest
+
+import (
+	"math/rand/v2"
+	"net/netip"
+
+	"github.com/aromatt/netipds"
+)
+
+// GenerateOption configures GenerateRandomPrefixSet.
+type GenerateOption func(*generateConfig)
+
+type generateConfig struct {
+	v4, v6   bool
+	maxDepth int
+}
+
+// IPv4Only restricts generated Prefixes to IPv4.
+func IPv4Only() GenerateOption {
+	return func(c *generateConfig) { c.v4, c.v6 = true, false }
+}
+
+// IPv6Only restricts generated Prefixes to IPv6.
+func IPv6Only() GenerateOption {
+	return func(c *generateConfig) { c.v4, c.v6 = false, true }
+}
+
+// MaxDepth limits how deeply generated Prefixes are nested within one
+// another. A depth of 1 generates no nested Prefixes. The default is 8.
+func MaxDepth(depth int) GenerateOption {
+	return func(c *generateConfig) { c.maxDepth = max(depth, 1) }
+}
+
+// GenerateRandomPrefixSet returns a PrefixSet of n Prefixes generated using r.
+//
+// The generated sets are structurally diverse: besides unrelated Prefixes of
+// random lengths, they include Prefixes nested within one another, adjacent
+// siblings, and single-address Prefixes, which exercise edge cases in
+// operations such as Subtract and Intersect. By default, both IPv4 and IPv6
+// Prefixes are generated.
+//
+// If the options leave fewer than n distinct Prefixes to generate, the result
+// may contain fewer than n Prefixes.
+func GenerateRandomPrefixSet(r *rand.Rand, n int, opts ...GenerateOption) *netipds.PrefixSet {
+	c := generateConfig{v4: true, v6: true, maxDepth: 8}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	type generated struct {
+		p     netip.Prefix
+		depth int
+	}
+	var (
+		psb  netipds.PrefixSetBuilder
+		gen  []generated
+		seen = make(map[netip.Prefix]bool, n)
+	)
+	for attempts := 0; len(gen) < n && attempts < 16*n+16; attempts++ {
+		var g generated
+		var parent *generated
+		if len(gen) > 0 {
+			parent = &gen[r.IntN(len(gen))]
+		}
+		switch op := r.IntN(8); {
+		case parent != nil && op < 3 && parent.depth < c.maxDepth:
+			g = generated{nested(r, parent.p), parent.depth + 1}
+		case parent != nil && op < 5:
+			g = generated{sibling(parent.p), parent.depth}
+		case op < 6:
+			g = generated{host(randomAddr(r, c)), 1}
+		default:
+			a := randomAddr(r, c)
+			g = generated{netip.PrefixFrom(a, 1+r.IntN(a.BitLen())).Masked(), 1}
+		}
+		if !g.p.IsValid() || seen[g.p] {
+			continue
+		}
+		seen[g.p] = true
+		gen = append(gen, g)
+		psb.Add(g.p)
+	}
+	return psb.PrefixSet()
+}
+
+// randomAddr returns a random address of one of the families allowed by c.
+func randomAddr(r *rand.Rand, c generateConfig) netip.Addr {
+	var b [16]byte
+	for i := range b {
+		b[i] = byte(r.Uint32())
+	}
+	if c.v4 && (!c.v6 || r.IntN(2) == 0) {
+		return netip.AddrFrom4([4]byte(b[:4]))
+	}
+	return netip.AddrFrom16(b)
+}
+
+// host returns the single-address Prefix containing a.
+func host(a netip.Addr) netip.Prefix {
+	return netip.PrefixFrom(a, a.BitLen())
+}
+
+// nested returns a random Prefix strictly encompassed by p, or the zero
+// Prefix if p is a single address.
+func nested(r *rand.Rand, p netip.Prefix) netip.Prefix {
+	bitLen := p.Addr().BitLen()
+	if p.Bits() == bitLen {
+		return netip.Prefix{}
+	}
+	// Favor short steps, so that nesting chains can grow deep.
+	bits := p.Bits() + 1 + r.IntN(min(bitLen-p.Bits(), 8))
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < bits; i++ {
+		if r.IntN(2) == 1 {
+			b[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return netip.PrefixFrom(a, bits).Masked()
+}
+
+// sibling returns the Prefix that differs from p only in its last bit, or the
+// zero Prefix if p has length zero.
+func sibling(p netip.Prefix) netip.Prefix {
+	if p.Bits() == 0 {
+		return netip.Prefix{}
+	}
+	b := p.Addr().AsSlice()
+	i := p.Bits() - 1
+	b[i/8] ^= 0x80 >> (i % 8)
+	a, _ := netip.AddrFromSlice(b)
+	return netip.PrefixFrom(a, p.Bits())
+}
@@ -0,0 +1,55 @@
+package netipdstest
+
+import (
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+func TestGenerateRandomPrefixSet(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []GenerateOption
+		want4      bool
+		want6      bool
+		wantNested bool
+	}{
+		{"default", nil, true, true, true},
+		{"IPv4Only", []GenerateOption{IPv4Only()}, true, false, true},
+		{"IPv6Only", []GenerateOption{IPv6Only()}, false, true, true},
+		{"MaxDepth(1)", []GenerateOption{MaxDepth(1)}, true, true, false},
+	}
+	for _, tt := range tests {
+		s := GenerateRandomPrefixSet(rand.New(rand.NewPCG(1, 2)), 500, tt.opts...)
+		prefixes := s.Prefixes()
+		if len(prefixes) != 500 {
+			t.Errorf("%s: got %d Prefixes, want 500", tt.name, len(prefixes))
+		}
+		var got4, got6, gotNested bool
+		for _, p := range prefixes {
+			if p.Addr().Is4() {
+				got4 = true
+			} else {
+				got6 = true
+			}
+			if s.EncompassesStrict(p) {
+				gotNested = true
+			}
+		}
+		if got4 != tt.want4 || got6 != tt.want6 {
+			t.Errorf("%s: got IPv4 = %v, IPv6 = %v, want %v, %v", tt.name, got4, got6, tt.want4, tt.want6)
+		}
+		// Siblings may be nested by coincidence, but with MaxDepth(1) nested
+		// Prefixes are never generated deliberately.
+		if tt.wantNested && !gotNested {
+			t.Errorf("%s: no nested Prefixes generated", tt.name)
+		}
+	}
+
+	// Generation is deterministic for a given source.
+	a := GenerateRandomPrefixSet(rand.New(rand.NewPCG(3, 4)), 100)
+	b := GenerateRandomPrefixSet(rand.New(rand.NewPCG(3, 4)), 100)
+	if !slices.Equal(a.Prefixes(), b.Prefixes()) {
+		t.Errorf("GenerateRandomPrefixSet is not deterministic")
+	}
+}
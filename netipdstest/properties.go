@@ -0,0 +1,69 @@
+package netipdstest
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/aromatt/netipds"
+)
+
+// SetOp combines two PrefixSets into a new PrefixSet, without modifying
+// either. Merge and Intersect are the SetOps of the netipds builders; code
+// that composes PrefixSets in its own way can define its own, and check it
+// with CheckCommutative and CheckAssociative.
+type SetOp func(a, b *netipds.PrefixSet) *netipds.PrefixSet
+
+// Merge returns the result of PrefixSetBuilder.Merge: the union of the entries
+// in a and b.
+func Merge(a, b *netipds.PrefixSet) *netipds.PrefixSet {
+	psb := &netipds.PrefixSetBuilder{}
+	psb.Merge(a)
+	psb.Merge(b)
+	return psb.PrefixSet()
+}
+
+// Intersect returns the result of PrefixSetBuilder.Intersect: the entries in
+// each of a and b that are encompassed by an entry in the other.
+func Intersect(a, b *netipds.PrefixSet) *netipds.PrefixSet {
+	psb := &netipds.PrefixSetBuilder{}
+	psb.Merge(a)
+	psb.Intersect(b)
+	return psb.PrefixSet()
+}
+
+// CheckCommutative returns an error if op(a, b) and op(b, a) differ in their
+// entries or the flags of their entries.
+func CheckCommutative(op SetOp, a, b *netipds.PrefixSet) error {
+	ab, ba := op(a, b), op(b, a)
+	if err := diffSets(ab, ba); err != nil {
+		return fmt.Errorf("op(%v, %v) != op(%v, %v): %w", a, b, b, a, err)
+	}
+	return nil
+}
+
+// CheckAssociative returns an error if op(op(a, b), c) and op(a, op(b, c))
+// differ in their entries or the flags of their entries.
+func CheckAssociative(op SetOp, a, b, c *netipds.PrefixSet) error {
+	left, right := op(op(a, b), c), op(a, op(b, c))
+	if err := diffSets(left, right); err != nil {
+		return fmt.Errorf("op(op(%v, %v), %v) != op(%v, op(%v, %v)): %w", a, b, c, a, b, c, err)
+	}
+	return nil
+}
+
+// diffSets returns an error describing the first difference between the
+// entries of x and y, if any.
+func diffSets(x, y *netipds.PrefixSet) error {
+	xp, yp := x.Prefixes(), y.Prefixes()
+	if !slices.Equal(xp, yp) {
+		return fmt.Errorf("entries %v != %v", xp, yp)
+	}
+	for _, p := range xp {
+		xf, _ := x.Flags(p)
+		yf, _ := y.Flags(p)
+		if xf != yf {
+			return fmt.Errorf("flags of %v: %d != %d", p, xf, yf)
+		}
+	}
+	return nil
+}
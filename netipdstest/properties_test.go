@@ -0,0 +1,69 @@
+package netipdstest
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+
+	"github.com/aromatt/netipds"
+)
+
+func TestSetOpProperties(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	ops := []struct {
+		name string
+		op   SetOp
+	}{
+		{"Merge", Merge},
+		{"Intersect", Intersect},
+	}
+	for range 50 {
+		// Small sets within a shared space are likely to overlap.
+		a := GenerateRandomPrefixSet(r, 20, IPv4Only())
+		b := GenerateRandomPrefixSet(r, 20, IPv4Only())
+		c := GenerateRandomPrefixSet(r, 20, IPv4Only())
+		// Prefixes from one set, nested within those of the others, make
+		// intersections non-empty.
+		b = Merge(b, nestedIn(r, a))
+		c = Merge(c, nestedIn(r, b))
+		for _, tt := range ops {
+			if err := CheckCommutative(tt.op, a, b); err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			if err := CheckAssociative(tt.op, a, b, c); err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+		}
+	}
+}
+
+// nestedIn returns a PrefixSet of Prefixes nested within those of s.
+func nestedIn(r *rand.Rand, s *netipds.PrefixSet) *netipds.PrefixSet {
+	psb := &netipds.PrefixSetBuilder{}
+	for _, p := range s.Prefixes() {
+		if r.IntN(2) == 0 {
+			psb.AddWithFlags(nested(r, p), uint8(r.IntN(4)))
+		}
+	}
+	return psb.PrefixSet()
+}
+
+// firstOp is not commutative: it returns its first argument.
+func firstOp(a, _ *netipds.PrefixSet) *netipds.PrefixSet {
+	return a
+}
+
+func TestCheckCommutativeMismatch(t *testing.T) {
+	build := func(p string) *netipds.PrefixSet {
+		psb := &netipds.PrefixSetBuilder{}
+		psb.Add(netip.MustParsePrefix(p))
+		return psb.PrefixSet()
+	}
+	a, b := build("10.0.0.0/8"), build("11.0.0.0/8")
+	if err := CheckCommutative(firstOp, a, b); err == nil {
+		t.Error("CheckCommutative returned nil error for non-commutative op")
+	}
+	if err := CheckAssociative(firstOp, a, b, a); err != nil {
+		t.Errorf("CheckAssociative returned error for associative op: %v", err)
+	}
+}
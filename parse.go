@@ -0,0 +1,91 @@
+package netipds
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// PrefixParseError is returned by methods that accept Prefixes as strings
+// when the input cannot be parsed.
+type PrefixParseError struct {
+	// Input is the string that failed to parse.
+	Input string
+
+	// Err is the underlying error returned by the parser.
+	Err error
+}
+
+func (e *PrefixParseError) Error() string {
+	return fmt.Sprintf("failed to parse Prefix %q: %v", e.Input, e.Err)
+}
+
+func (e *PrefixParseError) Unwrap() error {
+	return e.Err
+}
+
+// V4MappedPolicy determines how ParsePrefixCanonical treats IPv4-mapped IPv6
+// Prefixes, i.e. those within ::ffff:0:0/96 such as ::ffff:10.0.0.0/104.
+type V4MappedPolicy int
+
+const (
+	// V4MappedKeep returns IPv4-mapped IPv6 Prefixes as they are written.
+	// The builders store them as the IPv4 Prefixes they map, unless
+	// RejectV4Mapped is set.
+	V4MappedKeep V4MappedPolicy = iota
+
+	// V4MappedUnmap returns the IPv4 Prefix that an IPv4-mapped IPv6 Prefix
+	// maps, e.g. 10.0.0.0/8 for ::ffff:10.0.0.0/104. IPv6 Prefixes shorter
+	// than /96, such as ::ffff:0:0/80, are returned unchanged.
+	V4MappedUnmap
+
+	// V4MappedReject returns an error for IPv4-mapped IPv6 Prefixes.
+	V4MappedReject
+)
+
+// ParsePrefixCanonical parses s as a Prefix, applying the same rules wherever
+// this package accepts Prefixes as strings (e.g. PrefixSetBuilder.AddString
+// and LoadPrefixSets):
+//
+//   - Leading and trailing whitespace is ignored.
+//   - An address without a length is a host Prefix, e.g. 10.1.2.3 is parsed
+//     as 10.1.2.3/32 and 2001:db8::1 as 2001:db8::1/128.
+//   - IPv4-mapped IPv6 Prefixes are treated according to policy.
+//   - Zones are not allowed.
+//
+// Host bits are retained, e.g. 10.1.2.3/8 is not masked to 10.0.0.0/8, since
+// the builders normalize Prefixes themselves (see
+// PrefixMapBuilder.KeepOriginal). If s cannot be parsed, or is rejected by
+// policy, ParsePrefixCanonical returns a *PrefixParseError.
+func ParsePrefixCanonical(s string, policy V4MappedPolicy) (netip.Prefix, error) {
+	p, err := parseCanonical(strings.TrimSpace(s))
+	if err == nil && isV4Mapped(p) {
+		switch policy {
+		case V4MappedUnmap:
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		case V4MappedReject:
+			err = errors.New("IPv4-mapped IPv6 Prefix is not allowed")
+		}
+	}
+	if err != nil {
+		return netip.Prefix{}, &PrefixParseError{Input: s, Err: err}
+	}
+	return p, nil
+}
+
+// parseCanonical parses s, which has no surrounding whitespace, as a Prefix
+// or an address.
+func parseCanonical(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if addr.Zone() != "" {
+		return netip.Prefix{}, errors.New("IPv6 zones cannot be present in a prefix")
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
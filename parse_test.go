@@ -0,0 +1,44 @@
+package netipds
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestParsePrefixCanonical(t *testing.T) {
+	tests := []struct {
+		s       string
+		policy  V4MappedPolicy
+		want    netip.Prefix
+		wantErr bool
+	}{
+		{"10.0.0.0/8", V4MappedKeep, pfx("10.0.0.0/8"), false},
+		{"10.1.2.3/8", V4MappedKeep, pfx("10.1.2.3/8"), false},
+		{"  2001:db8::/32\t", V4MappedKeep, pfx("2001:db8::/32"), false},
+		{"10.1.2.3", V4MappedKeep, pfx("10.1.2.3/32"), false},
+		{"2001:db8::1", V4MappedKeep, pfx("2001:db8::1/128"), false},
+		{"::ffff:10.0.0.0/104", V4MappedKeep, pfx("::ffff:10.0.0.0/104"), false},
+		{"::ffff:10.0.0.0/104", V4MappedUnmap, pfx("10.0.0.0/8"), false},
+		{"::ffff:10.1.2.3", V4MappedUnmap, pfx("10.1.2.3/32"), false},
+		{"::ffff:0:0/96", V4MappedUnmap, pfx("0.0.0.0/0"), false},
+		{"::ffff:0:0/80", V4MappedUnmap, pfx("::ffff:0:0/80"), false},
+		{"::ffff:0:0/80", V4MappedReject, pfx("::ffff:0:0/80"), false},
+		{"::ffff:10.0.0.0/104", V4MappedReject, netip.Prefix{}, true},
+		{"::ffff:10.1.2.3", V4MappedReject, netip.Prefix{}, true},
+		{"fe80::1%eth0", V4MappedKeep, netip.Prefix{}, true},
+		{"10.0.0.0/33", V4MappedKeep, netip.Prefix{}, true},
+		{"10.0.0.0/", V4MappedKeep, netip.Prefix{}, true},
+		{"10.0.0 .0/8", V4MappedKeep, netip.Prefix{}, true},
+		{"", V4MappedKeep, netip.Prefix{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePrefixCanonical(tt.s, tt.policy)
+		var parseErr *PrefixParseError
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParsePrefixCanonical(%q, %d) = %v, %v, want %v, error %v", tt.s, tt.policy, got, err, tt.want, tt.wantErr)
+		} else if err != nil && (!errors.As(err, &parseErr) || parseErr.Input != tt.s) {
+			t.Errorf("ParsePrefixCanonical(%q, %d) error = %#v, want *PrefixParseError with input %q", tt.s, tt.policy, err, tt.s)
+		}
+	}
+}
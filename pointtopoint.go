@@ -0,0 +1,69 @@
+//go:build !netipds_core
+
+package netipds
+
+import "net/netip"
+
+// isPointToPoint reports whether p is an IPv4 /31 (RFC 3021) or an IPv6 /127
+// (RFC 6164), whose two addresses are both usable by hosts.
+func isPointToPoint(p netip.Prefix) bool {
+	return p.IsValid() && p.Bits() == p.Addr().BitLen()-1
+}
+
+// PointToPointPeers returns the two addresses of p, in ascending order, if p
+// is an IPv4 /31 or an IPv6 /127. On such point-to-point links, both
+// addresses are assigned to hosts (RFC 3021, RFC 6164). Host bits in p are
+// ignored.
+func PointToPointPeers(p netip.Prefix) (a, b netip.Addr, ok bool) {
+	if !isPointToPoint(p) {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	a = p.Masked().Addr()
+	return a, a.Next(), true
+}
+
+// UsableHostRange returns the first and last addresses of p that can be
+// assigned to hosts. For IPv4, these exclude the network and broadcast
+// addresses, and for IPv6 they exclude the Subnet-Router anycast address
+// (RFC 4291), except that both addresses of a point-to-point Prefix (see
+// PointToPointPeers) are usable, as is the only address of a single-address
+// Prefix. Host bits in p are ignored. If p is not valid, UsableHostRange
+// returns false.
+func UsableHostRange(p netip.Prefix) (first, last netip.Addr, ok bool) {
+	if !p.IsValid() {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	k := keyFromPrefix(p)
+	first = p.Masked().Addr()
+	last = prefixFromKey(key{k.content.bitsSetFrom(k.len), 0, 128}).Addr()
+	if p.Bits() >= p.Addr().BitLen()-1 {
+		return first, last, true
+	}
+	first = first.Next()
+	if first.Is4() {
+		last = last.Prev()
+	}
+	return first, last, true
+}
+
+// PeerOf returns the other address of the point-to-point link that addr is
+// on, according to s: if the longest Prefix in s containing addr is an IPv4
+// /31 or an IPv6 /127, PeerOf returns the other address in that Prefix.
+// Otherwise, PeerOf returns false.
+func (s *PrefixSet) PeerOf(addr netip.Addr) (netip.Addr, bool) {
+	if !addr.IsValid() {
+		return netip.Addr{}, false
+	}
+	n := s.tree.longestMatch(keyFromAddr(addr))
+	if n == nil {
+		return netip.Addr{}, false
+	}
+	a, b, ok := PointToPointPeers(prefixFromKey(n.key))
+	if !ok {
+		return netip.Addr{}, false
+	}
+	if addr.Unmap() == a {
+		return b, true
+	}
+	return a, true
+}
@@ -0,0 +1,95 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPointToPointPeers(t *testing.T) {
+	tests := []struct {
+		p    string
+		a, b string
+	}{
+		{"10.0.0.0/31", "10.0.0.0", "10.0.0.1"},
+		{"10.0.0.3/31", "10.0.0.2", "10.0.0.3"},
+		{"2001:db8::/127", "2001:db8::", "2001:db8::1"},
+		{"10.0.0.0/30", "", ""},
+		{"10.0.0.0/32", "", ""},
+		{"2001:db8::/31", "", ""},
+		{"2001:db8::/128", "", ""},
+	}
+	for _, tt := range tests {
+		a, b, ok := PointToPointPeers(pfx(tt.p))
+		if !ok {
+			if tt.a != "" {
+				t.Errorf("PointToPointPeers(%s) = false, want %s, %s", tt.p, tt.a, tt.b)
+			}
+			continue
+		}
+		if tt.a == "" || a.String() != tt.a || b.String() != tt.b {
+			t.Errorf("PointToPointPeers(%s) = %v, %v, want %q, %q", tt.p, a, b, tt.a, tt.b)
+		}
+	}
+	if _, _, ok := PointToPointPeers(netip.Prefix{}); ok {
+		t.Errorf("PointToPointPeers of invalid Prefix = true, want false")
+	}
+}
+
+func TestUsableHostRange(t *testing.T) {
+	tests := []struct {
+		p           string
+		first, last string
+	}{
+		{"10.0.0.0/24", "10.0.0.1", "10.0.0.254"},
+		{"10.0.0.7/30", "10.0.0.5", "10.0.0.6"},
+		{"10.0.0.0/31", "10.0.0.0", "10.0.0.1"},
+		{"10.0.0.1/32", "10.0.0.1", "10.0.0.1"},
+		{"0.0.0.0/0", "0.0.0.1", "255.255.255.254"},
+		{"2001:db8::/64", "2001:db8::1", "2001:db8::ffff:ffff:ffff:ffff"},
+		{"2001:db8::/126", "2001:db8::1", "2001:db8::3"},
+		{"2001:db8::/127", "2001:db8::", "2001:db8::1"},
+		{"2001:db8::1/128", "2001:db8::1", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		first, last, ok := UsableHostRange(pfx(tt.p))
+		if !ok || first.String() != tt.first || last.String() != tt.last {
+			t.Errorf("UsableHostRange(%s) = %v, %v, %v, want %s, %s, true", tt.p, first, last, ok, tt.first, tt.last)
+		}
+	}
+	if _, _, ok := UsableHostRange(netip.Prefix{}); ok {
+		t.Errorf("UsableHostRange of invalid Prefix = true, want false")
+	}
+}
+
+func TestPrefixSetPeerOf(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	for _, p := range pfxs("10.0.0.0/24", "10.0.0.4/31", "10.0.0.5/32", "2001:db8::/127") {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"10.0.0.4", "10.0.0.5"},
+		// The longest match is the /32
+		{"10.0.0.5", ""},
+		{"10.0.0.6", ""},
+		{"11.0.0.1", ""},
+		{"::ffff:10.0.0.4", "10.0.0.5"},
+		{"2001:db8::", "2001:db8::1"},
+		{"2001:db8::1", "2001:db8::"},
+	}
+	for _, tt := range tests {
+		got, ok := ps.PeerOf(netip.MustParseAddr(tt.addr))
+		if (tt.want == "") == ok || (ok && got.String() != tt.want) {
+			t.Errorf("ps.PeerOf(%s) = %v, %v, want %q", tt.addr, got, ok, tt.want)
+		}
+	}
+	if _, ok := ps.PeerOf(netip.Addr{}); ok {
+		t.Errorf("ps.PeerOf of invalid Addr = true, want false")
+	}
+}
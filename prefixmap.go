@@ -2,7 +2,10 @@ package netipds
 
 import (
 	"fmt"
+	"iter"
+	"math/big"
 	"net/netip"
+	"slices"
 )
 
 // PrefixMapBuilder builds an immutable PrefixMap.
@@ -12,7 +15,35 @@ import (
 //
 // Call PrefixMap to obtain an immutable PrefixMap from a PrefixMapBuilder.
 type PrefixMapBuilder[T any] struct {
-	tree tree[T]
+	tree  tree[T]
+	stats buildStats
+	slab  *nodeSlab[T]
+
+	// CloneValue, if set, is used by PrefixMap to copy each value into the
+	// new PrefixMap. Set it when T contains references (e.g. slices or maps)
+	// that must not be shared between the builder and its PrefixMaps.
+	CloneValue func(T) T
+
+	// KeepOriginal, if set, causes Set and SetString to retain each Prefix as
+	// provided, including any host bits, so that it can be retrieved from the
+	// resulting PrefixMaps with GetOriginal.
+	KeepOriginal bool
+
+	// RejectV4Mapped, if set, causes the Set methods to return an error for
+	// IPv4-mapped IPv6 Prefixes and ranges. See
+	// PrefixSetBuilder.RejectV4Mapped.
+	RejectV4Mapped bool
+
+	// Family, if not AnyFamily, causes the Set methods to return an error for
+	// Prefixes and ranges of the other address family. See
+	// PrefixSetBuilder.Family.
+	Family Family
+
+	// originals holds the Prefixes provided for keys whose Prefix had host
+	// bits set, if KeepOriginal is set. It is keyed like tree, so that
+	// Subtract and RemoveDescendantsOf can drop a subtree of it without a
+	// scan.
+	originals tree[netip.Prefix]
 }
 
 // Get returns the value associated with the exact Prefix provided, if any.
@@ -23,19 +54,138 @@ func (m *PrefixMapBuilder[T]) Get(p netip.Prefix) (T, bool) {
 // Set associates the provided value with the provided Prefix.
 func (m *PrefixMapBuilder[T]) Set(p netip.Prefix, value T) error {
 	if !p.IsValid() {
+		m.stats.invalid++
 		return fmt.Errorf("Prefix is not valid: %v", p)
 	}
-	// TODO so should m.tree just be a *tree[T]?
-	m.tree = *(m.tree.insert(keyFromPrefix(p), value))
+	k := keyFromPrefix(p)
+	if !m.Family.admits(k.is4()) {
+		return m.stats.rejectFamily(k.is4(), p)
+	}
+	if isV4Mapped(p) {
+		if err := m.stats.admitV4Mapped(m.RejectV4Mapped, p); err != nil {
+			return err
+		}
+	}
+	m.stats.recordNormalized(p)
+	m.insert(k, value)
+	m.recordOriginal(k, p)
+	return nil
+}
+
+// SetReporting is like Set, but also returns the Prefixes already in m that
+// p encompasses (excluding p itself), ordered as by PrefixSet.Prefixes.
+func (m *PrefixMapBuilder[T]) SetReporting(p netip.Prefix, value T) (covered []netip.Prefix, err error) {
+	if !p.IsValid() {
+		m.stats.invalid++
+		return nil, fmt.Errorf("Prefix is not valid: %v", p)
+	}
+	k := keyFromPrefix(p)
+	if !m.Family.admits(k.is4()) {
+		return nil, m.stats.rejectFamily(k.is4(), p)
+	}
+	if isV4Mapped(p) {
+		if err := m.stats.admitV4Mapped(m.RejectV4Mapped, p); err != nil {
+			return nil, err
+		}
+	}
+	m.stats.recordNormalized(p)
+	n := m.insert(k, value)
+	m.recordOriginal(k, p)
+	return strictDescendants(n), nil
+}
+
+// SetString parses p as a Prefix with ParsePrefixCanonical, using
+// V4MappedKeep, and associates the provided value with it. If p cannot be
+// parsed, SetString returns a *PrefixParseError.
+func (m *PrefixMapBuilder[T]) SetString(p string, value T) error {
+	pfx, err := ParsePrefixCanonical(p, V4MappedKeep)
+	if err != nil {
+		m.stats.invalid++
+		return err
+	}
+	return m.Set(pfx, value)
+}
+
+// SetFromBytes associates the provided value with the Prefix with the
+// provided address bytes and length. addr must be 4 bytes (IPv4) or 16 bytes
+// (IPv6) long. SetFromBytes avoids constructing a netip.Prefix, for use in hot
+// paths that already have raw address bytes.
+func (m *PrefixMapBuilder[T]) SetFromBytes(addr []byte, bits int, value T) error {
+	k, ok := keyFromBytes(addr, bits)
+	if !ok {
+		m.stats.invalid++
+		return fmt.Errorf("Prefix is not valid: %v/%d", addr, bits)
+	}
+	if !m.Family.admits(k.is4()) {
+		return m.stats.rejectFamily(k.is4(), fmt.Sprintf("%v/%d", addr, bits))
+	}
+	if len(addr) == 16 && k.is4() {
+		if err := m.stats.admitV4Mapped(m.RejectV4Mapped, netip.PrefixFrom(netip.AddrFrom16([16]byte(addr)), bits)); err != nil {
+			return err
+		}
+	}
+	m.insert(k, value)
 	return nil
 }
 
+// insert associates value with k, recording whether k was already present,
+// and returns the node holding k.
+func (m *PrefixMapBuilder[T]) insert(k key, value T) *tree[T] {
+	// TODO so should m.tree just be a *tree[T]?
+	t, ins := m.tree.insertFrom(m.slab, k, value)
+	m.tree = *t
+	if ins.existed {
+		m.stats.duplicates++
+	}
+	m.originals.remove(k)
+	return ins.node
+}
+
+// SetSizeHint informs m that approximately n Prefixes will be set in it. See
+// PrefixSetBuilder.SetSizeHint.
+func (m *PrefixMapBuilder[T]) SetSizeHint(n int) {
+	m.slab = newSizedSlab[T](n)
+}
+
+// recordOriginal records p as the original Prefix for k, if m.KeepOriginal is
+// set and p has host bits set.
+func (m *PrefixMapBuilder[T]) recordOriginal(k key, p netip.Prefix) {
+	if !m.KeepOriginal || p == p.Masked() {
+		return
+	}
+	m.originals = *m.originals.insert(k, p)
+}
+
+// SetRange associates the provided value with every address from first to
+// last, inclusive. The range is decomposed into the minimal list of Prefixes
+// that covers it exactly, and each is set to value. first and last must be of
+// the same family, with first <= last.
+func (m *PrefixMapBuilder[T]) SetRange(first, last netip.Addr, value T) error {
+	if err := m.stats.admitFamilyRange(m.Family, first, last); err != nil {
+		return err
+	}
+	if isV4MappedRange(first, last) {
+		if err := m.stats.admitV4Mapped(m.RejectV4Mapped, fmt.Sprintf("%v-%v", first, last)); err != nil {
+			return err
+		}
+	}
+	err := rangeKeys(first, last, func(k key) {
+		m.insert(k, value)
+	})
+	if err != nil {
+		m.stats.invalid++
+	}
+	return err
+}
+
 // Remove removes the provided Prefix from m.
 func (m *PrefixMapBuilder[T]) Remove(p netip.Prefix) error {
 	if !p.IsValid() {
 		return fmt.Errorf("Prefix is not valid: %v", p)
 	}
-	m.tree.remove(keyFromPrefix(p))
+	k := keyFromPrefix(p)
+	m.tree.remove(k)
+	m.originals.remove(k)
 	return nil
 }
 
@@ -50,21 +200,108 @@ func (m *PrefixMapBuilder[T]) Subtract(p netip.Prefix) error {
 	if !p.IsValid() {
 		return fmt.Errorf("Prefix is not valid: %v", p)
 	}
-	m.tree.subtract(keyFromPrefix(p))
+	k := keyFromPrefix(p)
+	if m.tree.subtract(k) == nil {
+		// k is the root key, so nothing remains.
+		m.tree = tree[T]{}
+	}
+	m.originals.removeDescendants(k, true)
 	return nil
 }
 
+// RemoveDescendantsOf removes p and every Prefix in m that p encompasses,
+// along with their values. Unlike Subtract, it removes those entries
+// entirely, so an entry that encompasses p is kept as it is rather than split
+// around p.
+func (m *PrefixMapBuilder[T]) RemoveDescendantsOf(p netip.Prefix) error {
+	if !p.IsValid() {
+		return fmt.Errorf("Prefix is not valid: %v", p)
+	}
+	k := keyFromPrefix(p)
+	m.tree.removeDescendants(k, true)
+	m.originals.removeDescendants(k, true)
+	return nil
+}
+
+// EntriesBetween returns an iterator over the entries of m whose Prefixes lie
+// entirely within the addresses from first to last, inclusive, in ascending
+// order of address. Only the parts of m's tree that overlap the range are
+// visited. first and last must be of the same family, with first <= last;
+// otherwise the iterator yields nothing.
+func (m *PrefixMap[T]) EntriesBetween(first, last netip.Addr) iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		stop := false
+		rangeKeys(first, last, func(k key) {
+			m.tree.walk(k, func(n *tree[T]) bool {
+				if stop {
+					return true
+				}
+				// IPv4 keys lie within some IPv6 ranges, e.g. ::/1.
+				if n.hasValue && k.isPrefixOf(n.key) && n.key.is4() == first.Is4() {
+					stop = !yield(prefixFromKey(n.key), n.value)
+				}
+				return stop
+			})
+		})
+	}
+}
+
 // Filter removes all Prefixes from m that are not encompassed by the provided
 // PrefixSet.
 func (m *PrefixMapBuilder[T]) Filter(s *PrefixSet) {
-	m.tree.filter(s.tree)
+	m.tree.filter(s.tree, FilterEncompassed)
+}
+
+// RemoveEncompassedBy removes all Prefixes from m that are encompassed by
+// s, keeping the rest. It is the inverse of Filter.
+func (m *PrefixMapBuilder[T]) RemoveEncompassedBy(s *PrefixSet) {
+	m.tree.removeEncompassed(s.tree)
+}
+
+// FilterWithMode removes all Prefixes from m that are not retained by the
+// provided PrefixSet under the provided FilterMode.
+func (m *PrefixMapBuilder[T]) FilterWithMode(s *PrefixSet, mode FilterMode) {
+	m.tree.filter(s.tree, mode)
 }
 
 // PrefixMap returns an immutable PrefixMap representing the current state of m.
+// Values are copied with CloneValue if it is set; otherwise they are copied by
+// assignment.
 //
 // The builder remains usable after calling PrefixMap.
 func (m *PrefixMapBuilder[T]) PrefixMap() *PrefixMap[T] {
-	return &PrefixMap[T]{*m.tree.copy()}
+	ret := &PrefixMap[T]{}
+	if m.CloneValue != nil {
+		ret.tree = *mapTree(&m.tree, m.CloneValue).canonicalize(true)
+	} else {
+		ret.tree = *m.tree.copy().canonicalize(true)
+	}
+	// Filter and FilterWithMode may have removed some of the entries with
+	// originals.
+	m.originals.walk(key{}, func(n *tree[netip.Prefix]) bool {
+		k := n.key.rooted()
+		if n.hasValue && ret.tree.contains(k) {
+			if ret.originals == nil {
+				ret.originals = make(map[key]netip.Prefix)
+			}
+			ret.originals[k] = n.value
+		}
+		return false
+	})
+	return ret
+}
+
+// Canonicalize removes the nodes left in the tree underlying m by its history
+// that neither hold an entry nor join others. See
+// PrefixSetBuilder.Canonicalize.
+func (m *PrefixMapBuilder[T]) Canonicalize() {
+	m.tree.canonicalize(true)
+}
+
+// PrefixMapWithReport is like PrefixMap, but also returns a BuildReport
+// describing the inputs m has received and the resulting PrefixMap.
+func (m *PrefixMapBuilder[T]) PrefixMapWithReport() (*PrefixMap[T], BuildReport) {
+	return m.PrefixMap(), newBuildReport(&m.stats, &m.tree)
 }
 
 func (s *PrefixMapBuilder[T]) String() string {
@@ -73,9 +310,31 @@ func (s *PrefixMapBuilder[T]) String() string {
 
 // PrefixMap is a map of netip.Prefix to T.
 //
+// A PrefixMap is immutable, and safe for concurrent use, in the same way as a
+// PrefixSet. The PrefixMaps returned by methods such as DescendantsOf and
+// GroupByRoots may share storage with the PrefixMap they are derived from,
+// but nothing modifies storage once it is part of a PrefixMap. Values are
+// returned by assignment, so callers must not modify values that contain
+// references (e.g. slices or maps) if the PrefixMap is shared; see
+// PrefixMapBuilder.CloneValue.
+//
 // Use PrefixMapBuilder to construct PrefixMaps.
 type PrefixMap[T any] struct {
 	tree tree[T]
+	size sizeCache
+	rank rankCache[T]
+
+	// originals holds the Prefixes provided to the builder for keys whose
+	// Prefix had host bits set (see PrefixMapBuilder.KeepOriginal). It may
+	// hold keys that are not in tree, and may be shared with other
+	// PrefixMaps.
+	originals map[key]netip.Prefix
+}
+
+// Size returns the number of Prefixes in m. It is computed by traversing m on
+// the first call, and cached.
+func (m *PrefixMap[T]) Size() int {
+	return m.size.get(m.tree.size)
 }
 
 // Get returns the value associated with the exact Prefix provided, if any.
@@ -88,12 +347,30 @@ func (m *PrefixMap[T]) Contains(p netip.Prefix) bool {
 	return m.tree.contains(keyFromPrefix(p))
 }
 
+// ContainsAll returns true if this map includes each of the exact Prefixes
+// provided.
+func (m *PrefixMap[T]) ContainsAll(ps []netip.Prefix) bool {
+	return containsAll(&m.tree, ps)
+}
+
+// MissingFrom returns the Prefixes in ps that this map does not include, in
+// the order provided, or nil if it includes all of them.
+func (m *PrefixMap[T]) MissingFrom(ps []netip.Prefix) []netip.Prefix {
+	return missingFrom(&m.tree, ps)
+}
+
 // Encompasses returns true if this map includes a Prefix which completely
 // encompasses the provided Prefix.
 func (m *PrefixMap[T]) Encompasses(p netip.Prefix) bool {
 	return m.tree.encompasses(keyFromPrefix(p), false)
 }
 
+// EncompassesAllIn returns whether m encompasses each of ps. See
+// PrefixSet.EncompassesAllIn.
+func (m *PrefixMap[T]) EncompassesAllIn(window netip.Prefix, ps []netip.Prefix) []bool {
+	return encompassesAllIn(&m.tree, window, ps)
+}
+
 // EncompassesStrict returns true if this map includes a Prefix which
 // completely encompasses the provided Prefix. The provided Prefix itself is
 // not considered.
@@ -104,7 +381,7 @@ func (m *PrefixMap[T]) EncompassesStrict(p netip.Prefix) bool {
 // OverlapsPrefix returns true if this map includes a Prefix which overlaps the
 // provided Prefix.
 func (m *PrefixMap[T]) OverlapsPrefix(p netip.Prefix) bool {
-	return m.tree.overlapsKey(keyFromPrefix(p))
+	return p.IsValid() && m.tree.overlapsKey(keyFromPrefix(p))
 }
 
 // prefixFromKey returns the Prefix represented by the provided key.
@@ -120,51 +397,253 @@ func prefixFromKey(b key) netip.Prefix {
 	return netip.PrefixFrom(addr.Unmap(), bits)
 }
 
-func (m *PrefixMap[T]) rootOf(
+// ancestor returns the entry that an ancestor query for p returns according
+// to cfg: the shortest if root is set, and otherwise the longest.
+func (m *PrefixMap[T]) ancestor(
 	p netip.Prefix,
-	strict bool,
+	cfg queryConfig,
+	root bool,
 ) (outPfx netip.Prefix, val T, ok bool) {
-	label, val, ok := m.tree.rootOf(keyFromPrefix(p), strict)
+	var k key
+	switch {
+	case cfg.limitLen:
+		n := ancestor(&m.tree, p, cfg, root)
+		if n == nil {
+			return outPfx, val, false
+		}
+		k, val, ok = n.key, n.value, true
+	case root:
+		k, val, ok = m.tree.rootOf(keyFromPrefix(p), cfg.strict)
+	default:
+		k, val, ok = m.tree.parentOf(keyFromPrefix(p), cfg.strict)
+	}
 	if !ok {
 		return outPfx, val, false
 	}
-	return prefixFromKey(label), val, true
+	return prefixFromKey(k), val, true
 }
 
-// RootOf returns the shortest-prefix ancestor of the Prefix provided, if any.
-// The Prefix itself is returned if it has no ancestors and has a value.
-func (m *PrefixMap[T]) RootOf(p netip.Prefix) (netip.Prefix, T, bool) {
-	return m.rootOf(p, false)
+// RootOf returns the shortest-prefix ancestor of the Prefix provided, if any,
+// as configured by opts (see Strict and MaxLen). The Prefix itself is
+// returned if it has no ancestors and has a value, unless Strict is among
+// opts.
+func (m *PrefixMap[T]) RootOf(p netip.Prefix, opts ...QueryOption) (netip.Prefix, T, bool) {
+	return m.ancestor(p, newQueryConfig(opts), true)
 }
 
-// RootOf returns the shortest-prefix ancestor of the Prefix provided, if any.
-// If the Prefix has no ancestors, RootOf returns zero values and false.
+// RootOfStrict returns the shortest-prefix ancestor of the Prefix provided,
+// excluding the Prefix itself, if any. If the Prefix has no such ancestors,
+// RootOfStrict returns zero values and false.
+//
+// Deprecated: Use RootOf(p, Strict()).
 func (m *PrefixMap[T]) RootOfStrict(p netip.Prefix) (netip.Prefix, T, bool) {
-	return m.rootOf(p, true)
+	return m.ancestor(p, queryConfig{strict: true}, true)
 }
 
-func (m *PrefixMap[T]) parentOf(
-	p netip.Prefix,
-	strict bool,
-) (outPfx netip.Prefix, val T, ok bool) {
-	key, val, ok := m.tree.parentOf(keyFromPrefix(p), strict)
+// GetOriginal is like Get, but also returns the Prefix as it was originally
+// provided to the PrefixMapBuilder, including any host bits, if the builder's
+// KeepOriginal field was set. Otherwise, the returned Prefix is masked.
+func (m *PrefixMap[T]) GetOriginal(p netip.Prefix) (netip.Prefix, T, bool) {
+	k := keyFromPrefix(p)
+	val, ok := m.tree.get(k)
 	if !ok {
-		return outPfx, val, false
+		return netip.Prefix{}, val, false
+	}
+	if o, ok := m.originals[k]; ok {
+		return o, val, true
 	}
-	return prefixFromKey(key), val, true
+	return prefixFromKey(k), val, true
 }
 
-// ParentOf returns the longest-prefix ancestor of the Prefix provided, if any.
-// If the Prefix has no ancestors, ParentOf returns zero values and false.
-func (m *PrefixMap[T]) ParentOf(p netip.Prefix) (netip.Prefix, T, bool) {
-	return m.parentOf(p, false)
+// ParentOf returns the longest-prefix ancestor of the Prefix provided, if any,
+// as configured by opts, e.g. m.ParentOf(p, Strict(), MaxLen(24)) returns the
+// longest entry of at most 24 bits that strictly encompasses p. The Prefix
+// itself is returned if it has a value, unless Strict is among opts. If the
+// Prefix has no ancestors, ParentOf returns zero values and false.
+//
+// Like the other query methods of PrefixMap, ParentOf always treats
+// IPv4-mapped IPv6 Prefixes as IPv4.
+func (m *PrefixMap[T]) ParentOf(p netip.Prefix, opts ...QueryOption) (netip.Prefix, T, bool) {
+	return m.ancestor(p, newQueryConfig(opts), false)
+}
+
+// ParentOfFromBytes is like ParentOf, but accepts the Prefix as address bytes
+// and a length. addr must be 4 bytes (IPv4) or 16 bytes (IPv6) long;
+// otherwise ParentOfFromBytes returns zero values and false.
+func (m *PrefixMap[T]) ParentOfFromBytes(
+	addr []byte,
+	bits int,
+) (outPfx netip.Prefix, val T, ok bool) {
+	k, ok := keyFromBytes(addr, bits)
+	if !ok {
+		return outPfx, val, false
+	}
+	k, val, ok = m.tree.parentOf(k, false)
+	if !ok {
+		return outPfx, val, false
+	}
+	return prefixFromKey(k), val, true
 }
 
 // ParentOfStrict returns the longest-prefix ancestor of the Prefix provided,
-// if any. If the Prefix has no ancestors, ParentOfStrict returns zero values
-// and false.
+// excluding the Prefix itself, if any, e.g. to find the allocation enclosing
+// an allocated Prefix. If the Prefix has no such ancestors, ParentOfStrict
+// returns zero values and false.
+//
+// Deprecated: Use ParentOf(p, Strict()).
 func (m *PrefixMap[T]) ParentOfStrict(p netip.Prefix) (netip.Prefix, T, bool) {
-	return m.parentOf(p, true)
+	return m.ancestor(p, queryConfig{strict: true}, false)
+}
+
+// LookupAddr returns the longest-prefix entry that contains addr, if any. It
+// is equivalent to ParentOf with the single-address Prefix of addr, but does
+// not construct that Prefix and does not allocate, so it is suited to
+// per-packet lookups. If no entry contains addr, or addr is not valid,
+// LookupAddr returns zero values and false.
+func (m *PrefixMap[T]) LookupAddr(addr netip.Addr) (p netip.Prefix, val T, ok bool) {
+	if !addr.IsValid() {
+		return
+	}
+	n := m.tree.longestMatch(keyFromAddr(addr))
+	if n == nil {
+		return
+	}
+	return prefixFromKey(n.key), n.value, true
+}
+
+// LookupResult is the result of a single lookup made by
+// PrefixMap.LookupAddrs or PrefixMap.LookupBoth.
+type LookupResult[T any] struct {
+	// Prefix and Value are the longest-prefix entry that contains the
+	// address, if OK is true.
+	Prefix netip.Prefix
+	Value  T
+	OK     bool
+}
+
+// lookup returns the LookupResult of LookupAddr(addr).
+func (m *PrefixMap[T]) lookup(addr netip.Addr) LookupResult[T] {
+	if !addr.IsValid() {
+		return LookupResult[T]{}
+	}
+	n := m.tree.longestMatch(keyFromAddr(addr))
+	if n == nil {
+		return LookupResult[T]{}
+	}
+	return LookupResult[T]{Prefix: prefixFromKey(n.key), Value: n.value, OK: true}
+}
+
+// LookupAddrs is like LookupAddr, but looks up each address in addrs,
+// returning one LookupResult per address in the same order. It looks up the
+// addresses in sorted order, so that the path shared by nearby addresses is
+// traversed once, which suits large batches of addresses.
+func (m *PrefixMap[T]) LookupAddrs(addrs []netip.Addr) []LookupResult[T] {
+	ret := make([]LookupResult[T], len(addrs))
+	m.tree.addrMatches(addrs, func(i int, n *tree[T]) {
+		ret[i] = LookupResult[T]{Prefix: prefixFromKey(n.key), Value: n.value, OK: true}
+	})
+	return ret
+}
+
+// LookupBoth looks up the IPv4 and IPv6 addresses of a dual-stack client,
+// e.g. to evaluate a policy for the client in one call. Each address is looked
+// up as by LookupAddr, and either may be the zero Addr if the client has no
+// address of that family, in which case its result is not OK. LookupBoth does
+// not allocate.
+func (m *PrefixMap[T]) LookupBoth(a4, a6 netip.Addr) (r4, r6 LookupResult[T]) {
+	return m.lookup(a4), m.lookup(a6)
+}
+
+// Nearest returns the entry whose Prefix shares the most leading bits with
+// addr, even if it does not encompass addr. Only entries of the same address
+// family as addr are considered. Of entries sharing the same number of bits,
+// one that encompasses addr is preferred. If there are no such entries,
+// Nearest returns zero values and false.
+func (m *PrefixMap[T]) Nearest(addr netip.Addr) (p netip.Prefix, val T, ok bool) {
+	if !addr.IsValid() {
+		return
+	}
+	n := m.tree.nearest(keyFromPrefix(netip.PrefixFrom(addr, addr.BitLen())))
+	if n == nil {
+		return
+	}
+	return prefixFromKey(n.key), n.value, true
+}
+
+// Distribution returns the number of entries in m within each Prefix of
+// length level that contains at least one of them. See
+// PrefixSet.Distribution.
+func (m *PrefixMap[T]) Distribution(level int) map[netip.Prefix]int {
+	ret := make(map[netip.Prefix]int)
+	for k, n := range m.tree.distribution(level) {
+		ret[prefixFromKey(k)] = n
+	}
+	return ret
+}
+
+// Querier returns a PrefixQuerier that queries m according to the provided
+// options, without copying m.
+//
+// The query methods of m itself are equivalent to those of
+// m.Querier(TreatV4MappedAsV4()).
+func (m *PrefixMap[T]) Querier(opts ...QueryOption) PrefixQuerier {
+	return newOptionQuerier(&m.tree, opts)
+}
+
+// All returns an iterator over the Prefixes in m and their values, in the
+// same order as WalkPrune, or as modified by opts. Unlike ToMap, it does not
+// build a copy of m.
+func (m *PrefixMap[T]) All(opts ...TraversalOption) iter.Seq2[netip.Prefix, T] {
+	return m.all(AnyFamily, opts)
+}
+
+// All4 is like All, but yields only the IPv4 Prefixes in m.
+func (m *PrefixMap[T]) All4(opts ...TraversalOption) iter.Seq2[netip.Prefix, T] {
+	return m.all(IPv4, opts)
+}
+
+// All6 is like All, but yields only the IPv6 Prefixes in m.
+func (m *PrefixMap[T]) All6(opts ...TraversalOption) iter.Seq2[netip.Prefix, T] {
+	return m.all(IPv6, opts)
+}
+
+// AllSorted is like All, but yields the entries of m in the order of their
+// Prefixes defined by cmp. See PrefixSet.AllSorted.
+func (m *PrefixMap[T]) AllSorted(cmp func(a, b netip.Prefix) int) iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		var es []Entry[T]
+		for p, v := range m.All() {
+			es = append(es, Entry[T]{Prefix: p, Value: v})
+		}
+		slices.SortStableFunc(es, func(a, b Entry[T]) int {
+			return cmp(a.Prefix, b.Prefix)
+		})
+		for _, e := range es {
+			if !yield(e.Prefix, e.Value) {
+				return
+			}
+		}
+	}
+}
+
+func (m *PrefixMap[T]) all(f Family, opts []TraversalOption) iter.Seq2[netip.Prefix, T] {
+	post := newTraversalConfig(opts).postOrder
+	return func(yield func(netip.Prefix, T) bool) {
+		m.tree.entries(f, post, func(n *tree[T]) bool {
+			return yield(prefixFromKey(n.key), n.value)
+		})
+	}
+}
+
+// AllCompact is like All, but yields only the entries of m whose Prefixes are
+// not encompassed by any other Prefix in m, e.g. the outermost of a hierarchy
+// of policies. See PrefixSet.PrefixesCompact.
+func (m *PrefixMap[T]) AllCompact() iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		m.tree.roots(func(n *tree[T]) bool {
+			return yield(prefixFromKey(n.key), n.value)
+		})
+	}
 }
 
 // ToMap returns a map of all Prefixes in m to their associated values.
@@ -179,34 +658,224 @@ func (m *PrefixMap[T]) ToMap() map[netip.Prefix]T {
 	return res
 }
 
+// AddressCounts returns an iterator over the Prefixes in m, each paired with
+// the number of addresses it covers that are not also covered by a
+// more-specific Prefix in m.
+func (m *PrefixMap[T]) AddressCounts() iter.Seq2[netip.Prefix, *big.Int] {
+	return func(yield func(netip.Prefix, *big.Int) bool) {
+		m.tree.addressCounts(func(n *tree[T], c *big.Int) bool {
+			return yield(prefixFromKey(n.key), c)
+		})
+	}
+}
+
+// HierarchyEdges returns an iterator over each pair of Prefixes in m such
+// that parent is the longest Prefix in m that strictly encompasses child, in
+// the order of their children in All.
+func (m *PrefixMap[T]) HierarchyEdges() iter.Seq2[netip.Prefix, netip.Prefix] {
+	return func(yield func(netip.Prefix, netip.Prefix) bool) {
+		m.tree.hierarchyEdges(nil, func(parent, child *tree[T]) bool {
+			return yield(prefixFromKey(parent.key), prefixFromKey(child.key))
+		})
+	}
+}
+
+// Nodes returns an iterator over the nodes of the tree in which m is stored,
+// each as its Prefix and whether it holds an entry. See PrefixSet.Nodes.
+func (m *PrefixMap[T]) Nodes() iter.Seq2[netip.Prefix, bool] {
+	return func(yield func(p netip.Prefix, entry bool) bool) {
+		m.tree.nodes(func(n *tree[T]) bool {
+			return yield(prefixFromKey(n.key), n.hasValue)
+		})
+	}
+}
+
+// KeySet returns a PrefixSet containing the Prefixes in m.
+//
+// The PrefixSet is built by copying the shape of m's tree directly, which is
+// cheaper than adding each Prefix to a PrefixSetBuilder.
+func (m *PrefixMap[T]) KeySet() *PrefixSet {
+	return &PrefixSet{tree: *mapTree(&m.tree, func(T) uint8 { return 0 })}
+}
+
+// WalkPrune calls fn for each Prefix in m and its value, in the same order as
+// PrefixSet.Prefixes, so parents are visited before their children, unless
+// PostOrder is among opts. The WalkAction returned by fn determines whether
+// the traversal continues into the Prefix's descendants, skips them, or stops
+// entirely.
+func (m *PrefixMap[T]) WalkPrune(fn func(netip.Prefix, T) WalkAction, opts ...TraversalOption) {
+	walkPrune(&m.tree, newTraversalConfig(opts).postOrder, func(n *tree[T]) WalkAction {
+		return fn(prefixFromKey(n.key), n.value)
+	})
+}
+
+// Walk calls fn for each Prefix in m that encompasses p or is encompassed by
+// it, and its value, in the same order as PrefixSet.Prefixes, so the
+// ancestors of p are visited first. If fn returns true for an ancestor of p,
+// the traversal stops; if fn returns true for p or one of its descendants,
+// the traversal skips that Prefix's descendants. Walk(::/0) visits every
+// Prefix in m. If p is not valid, Walk does nothing.
+func (m *PrefixMap[T]) Walk(p netip.Prefix, fn func(netip.Prefix, T) bool) {
+	if !p.IsValid() {
+		return
+	}
+	walkPath(&m.tree, keyFromPrefix(p), func(n *tree[T]) bool {
+		return fn(prefixFromKey(n.key), n.value)
+	})
+}
+
+// GroupByRoots returns an iterator over the root entries of m (those not
+// encompassed by another entry), each paired with a PrefixMap of the entry and
+// all of its descendants, as returned by DescendantsOf. Roots are yielded in
+// ascending order, and the sub-maps share m's storage.
+func (m *PrefixMap[T]) GroupByRoots() iter.Seq2[netip.Prefix, *PrefixMap[T]] {
+	return func(yield func(netip.Prefix, *PrefixMap[T]) bool) {
+		stop := false
+		m.tree.walk(key{}, func(n *tree[T]) bool {
+			if stop {
+				return true
+			}
+			if !n.hasValue {
+				return false
+			}
+			sub := &tree[T]{}
+			sub.setKey(n.key.rooted()).setValueFrom(n).setChildrenFrom(n)
+			stop = !yield(prefixFromKey(n.key), &PrefixMap[T]{tree: *sub, originals: m.originals})
+			// Skip the descendants of n; they're in the sub-map.
+			return true
+		})
+	}
+}
+
 // DescendantsOf returns all descendants of the provided Prefix (including the
-// Prefix itself, if it has a value) as a map of Prefixes to values.
-func (m *PrefixMap[T]) DescendantsOf(p netip.Prefix) *PrefixMap[T] {
-	return &PrefixMap[T]{*m.tree.descendantsOf(keyFromPrefix(p), false)}
+// Prefix itself, if it has a value, unless Strict is among opts) as a map of
+// Prefixes to values. See also MaxLen.
+func (m *PrefixMap[T]) DescendantsOf(p netip.Prefix, opts ...QueryOption) *PrefixMap[T] {
+	if !p.IsValid() {
+		return &PrefixMap[T]{}
+	}
+	return &PrefixMap[T]{tree: *queryDescendants(&m.tree, p, newQueryConfig(opts)), originals: m.originals}
 }
 
-// DescendantsOfStrict returns all descendants of the provided Prefix as a map
-// of Prefixes to values.
+// DescendantsOfStrict returns all descendants of the provided Prefix,
+// excluding the Prefix itself, as a map of Prefixes to values.
+//
+// Deprecated: Use DescendantsOf(p, Strict()).
 func (m *PrefixMap[T]) DescendantsOfStrict(p netip.Prefix) *PrefixMap[T] {
-	return &PrefixMap[T]{*m.tree.descendantsOf(keyFromPrefix(p), true)}
+	return m.DescendantsOf(p, Strict())
+}
+
+// AllDescendantsOf returns an iterator over the same entries as
+// DescendantsOf, in the same order as WalkPrune. Unlike DescendantsOf, it
+// yields them directly from m, without building a new PrefixMap.
+func (m *PrefixMap[T]) AllDescendantsOf(p netip.Prefix) iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		if !p.IsValid() {
+			return
+		}
+		m.tree.descendants(keyFromPrefix(p), func(n *tree[T]) bool {
+			return yield(prefixFromKey(n.key), n.value)
+		})
+	}
+}
+
+// ChildrenOf returns the descendants of the provided Prefix that have no
+// other descendant of it between them and the Prefix, i.e. the entries
+// directly beneath it in the hierarchy, as a map of Prefixes to values. The
+// Prefix itself is not included, and need not be in m.
+func (m *PrefixMap[T]) ChildrenOf(p netip.Prefix) *PrefixMap[T] {
+	if !p.IsValid() {
+		return &PrefixMap[T]{}
+	}
+	return &PrefixMap[T]{tree: *m.tree.childrenOf(keyFromPrefix(p)), originals: m.originals}
 }
 
 // AncestorsOf returns all ancestors of the provided Prefix (including the
-// Prefix itself, if it has a value) as a map of Prefixes to values.
-func (m *PrefixMap[T]) AncestorsOf(p netip.Prefix) *PrefixMap[T] {
-	return &PrefixMap[T]{*m.tree.ancestorsOf(keyFromPrefix(p), false)}
+// Prefix itself, if it has a value, unless Strict is among opts) as a map of
+// Prefixes to values. See also MaxLen.
+func (m *PrefixMap[T]) AncestorsOf(p netip.Prefix, opts ...QueryOption) *PrefixMap[T] {
+	return &PrefixMap[T]{tree: *queryAncestors(&m.tree, p, newQueryConfig(opts)), originals: m.originals}
+}
+
+// AllAncestorsOf returns an iterator over the same entries as AncestorsOf,
+// from the shortest Prefix to the longest. Unlike AncestorsOf, it yields them
+// during a single walk of the path to p, without building a new PrefixMap.
+func (m *PrefixMap[T]) AllAncestorsOf(p netip.Prefix) iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		if !p.IsValid() {
+			return
+		}
+		m.tree.ancestors(keyFromPrefix(p), func(n *tree[T]) bool {
+			return yield(prefixFromKey(n.key), n.value)
+		})
+	}
 }
 
-// AncestorsOfStrict returns all ancestors of the provided Prefix as a map of
-// Prefixes to values.
+// AncestorsOfStrict returns all ancestors of the provided Prefix, excluding
+// the Prefix itself, as a map of Prefixes to values.
+//
+// Deprecated: Use AncestorsOf(p, Strict()).
 func (m *PrefixMap[T]) AncestorsOfStrict(p netip.Prefix) *PrefixMap[T] {
-	return &PrefixMap[T]{*m.tree.ancestorsOf(keyFromPrefix(p), true)}
+	return m.AncestorsOf(p, Strict())
+}
+
+// Entry is a Prefix and its associated value in a PrefixMap.
+type Entry[T any] struct {
+	Prefix netip.Prefix
+	Value  T
+}
+
+// PathOf returns the ancestors of the provided Prefix (including the Prefix
+// itself, if it has a value), ordered from shortest to longest, e.g. for
+// resolving settings inherited from broader Prefixes. It is equivalent to
+// AncestorsOf, but does not build a new PrefixMap. If p has no ancestors,
+// PathOf returns nil.
+func (m *PrefixMap[T]) PathOf(p netip.Prefix) []Entry[T] {
+	return m.AppendAncestors(nil, p)
+}
+
+// AppendAncestors is like PathOf, but appends the ancestors of p to dst and
+// returns the extended slice. It descends the tree directly and allocates only
+// if dst lacks capacity; since a Prefix has at most 129 ancestors (including
+// itself), a buffer of that capacity can be reused for every call, e.g. for
+// per-packet policy evaluation.
+func (m *PrefixMap[T]) AppendAncestors(dst []Entry[T], p netip.Prefix) []Entry[T] {
+	if !p.IsValid() {
+		return dst
+	}
+	k := keyFromPrefix(p)
+	for n := &m.tree; n != nil; {
+		common := n.key.commonPrefixLen(k)
+		if common < n.key.len {
+			break
+		}
+		// As in walk, the root node is never considered.
+		if n.hasValue && !n.isZero() {
+			dst = append(dst, Entry[T]{Prefix: prefixFromKey(n.key), Value: n.value})
+		}
+		zero, ok := k.hasBitZeroAt(common)
+		if !ok {
+			break
+		}
+		if zero {
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return dst
 }
 
 // Filter removes all Prefixes from m that are not encompassed by the provided
 // PrefixSet.
 func (m *PrefixMap[T]) Filter(s *PrefixSet) *PrefixMap[T] {
-	return &PrefixMap[T]{*m.tree.filterCopy(s.tree)}
+	return &PrefixMap[T]{tree: *m.tree.filterCopy(s.tree, FilterEncompassed), originals: m.originals}
+}
+
+// FilterWithMode returns a new PrefixMap containing the Prefixes in m that
+// are retained by the provided PrefixSet under the provided FilterMode.
+func (m *PrefixMap[T]) FilterWithMode(s *PrefixSet, mode FilterMode) *PrefixMap[T] {
+	return &PrefixMap[T]{tree: *m.tree.filterCopy(s.tree, mode), originals: m.originals}
 }
 
 func (m *PrefixMap[T]) String() string {
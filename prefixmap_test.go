@@ -1,7 +1,11 @@
 package netipds
 
 import (
+	"errors"
+	"maps"
+	"math/rand/v2"
 	"net/netip"
+	"slices"
 	"testing"
 )
 
@@ -82,6 +86,20 @@ func TestPrefixMapSetGet(t *testing.T) {
 	}
 }
 
+// Make sure setting an existing non-root-level entry updates it in place rather
+// than adding a duplicate node.
+func TestPrefixMapSetExisting(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	pmb.Set(pfx("::0/128"), 1)
+	pmb.Set(pfx("::1/128"), 1)
+	pmb.Set(pfx("::0/128"), 2)
+	pm := pmb.PrefixMap()
+	checkMap(t, map[netip.Prefix]int{pfx("::0/128"): 2, pfx("::1/128"): 1}, pm.ToMap())
+	if got := pm.tree.size(); got != 2 {
+		t.Errorf("pm.tree.size() = %d, want 2", got)
+	}
+}
+
 func TestPrefixMapContains(t *testing.T) {
 	tests := []struct {
 		set  []netip.Prefix
@@ -330,6 +348,25 @@ func TestPrefixMapSubtract(t *testing.T) {
 	}
 }
 
+func TestPrefixMapBuilderRemoveDescendantsOf(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{KeepOriginal: true}
+	for i, p := range pfxs("10.0.0.0/8", "10.1.2.3/16", "10.1.2.0/24", "10.2.0.0/16", "2001:db8::/32") {
+		pmb.Set(p, i)
+	}
+	pmb.RemoveDescendantsOf(pfx("10.1.0.0/16"))
+	checkMap(t, map[netip.Prefix]int{
+		pfx("10.0.0.0/8"):    0,
+		pfx("10.2.0.0/16"):   3,
+		pfx("2001:db8::/32"): 4,
+	}, pmb.PrefixMap().ToMap())
+
+	// The original of a removed entry is not restored along with it.
+	pmb.Set(pfx("10.1.0.0/16"), 5)
+	if got, _, _ := pmb.PrefixMap().GetOriginal(pfx("10.1.0.0/16")); got != pfx("10.1.0.0/16") {
+		t.Errorf("GetOriginal(10.1.0.0/16) = %v, want 10.1.0.0/16", got)
+	}
+}
+
 // Make sure Subtract does not overwrite child values as it creates nodes to fill
 // in gaps.
 func TestPrefixMapSubtractNoOverwrite(t *testing.T) {
@@ -411,6 +448,155 @@ func TestPrefixMapParentOf(t *testing.T) {
 		}
 	}
 }
+
+func TestPrefixMapAncestorQueryOptions(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	for _, p := range pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.2.3/32", "2001:db8::/64", "2001:db8::/96") {
+		pmb.Set(p, p.Bits())
+	}
+	pm := pmb.PrefixMap()
+
+	tests := []struct {
+		get      netip.Prefix
+		opts     []QueryOption
+		wantRoot netip.Prefix
+		want     netip.Prefix
+	}{
+		{pfx("10.1.2.3/32"), nil, pfx("10.0.0.0/8"), pfx("10.1.2.3/32")},
+		{pfx("10.1.2.3/32"), []QueryOption{Strict()}, pfx("10.0.0.0/8"), pfx("10.1.2.0/24")},
+		{pfx("10.1.2.3/32"), []QueryOption{MaxLen(24)}, pfx("10.0.0.0/8"), pfx("10.1.2.0/24")},
+		{pfx("10.1.2.3/32"), []QueryOption{MaxLen(23)}, pfx("10.0.0.0/8"), pfx("10.1.0.0/16")},
+		// p is longer than MaxLen, so Strict has no further effect
+		{pfx("10.1.2.3/32"), []QueryOption{Strict(), MaxLen(24)}, pfx("10.0.0.0/8"), pfx("10.1.2.0/24")},
+		{pfx("10.1.2.0/24"), []QueryOption{Strict(), MaxLen(24)}, pfx("10.0.0.0/8"), pfx("10.1.0.0/16")},
+		{pfx("10.1.2.3/32"), []QueryOption{MaxLen(7)}, netip.Prefix{}, netip.Prefix{}},
+		{pfx("10.0.0.0/8"), []QueryOption{Strict()}, netip.Prefix{}, netip.Prefix{}},
+		{pfx("2001:db8::1/128"), []QueryOption{MaxLen(80)}, pfx("2001:db8::/64"), pfx("2001:db8::/64")},
+		{pfx("2001:db8::/96"), []QueryOption{Strict()}, pfx("2001:db8::/64"), pfx("2001:db8::/64")},
+	}
+	for _, tt := range tests {
+		got, val, ok := pm.ParentOf(tt.get, tt.opts...)
+		if got != tt.want || ok != tt.want.IsValid() || (ok && val != got.Bits()) {
+			t.Errorf("pm.ParentOf(%v, ...) = (%v, %v, %v), want %v", tt.get, got, val, ok, tt.want)
+		}
+		got, val, ok = pm.RootOf(tt.get, tt.opts...)
+		if got != tt.wantRoot || ok != tt.wantRoot.IsValid() || (ok && val != got.Bits()) {
+			t.Errorf("pm.RootOf(%v, ...) = (%v, %v, %v), want %v", tt.get, got, val, ok, tt.wantRoot)
+		}
+	}
+}
+
+func TestAncestorsDescendantsQueryOptions(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	pmb := &PrefixMapBuilder[int]{}
+	for _, p := range pfxs("::/8", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.2.3/32") {
+		psb.Add(p)
+		pmb.Set(p, p.Bits())
+	}
+	ps, pm := psb.PrefixSet(), pmb.PrefixMap()
+
+	tests := []struct {
+		get      netip.Prefix
+		opts     []QueryOption
+		wantAnc  []netip.Prefix
+		wantDesc []netip.Prefix
+	}{
+		{
+			pfx("10.1.0.0/16"), nil,
+			pfxs("::/8", "10.0.0.0/8", "10.1.0.0/16"),
+			pfxs("10.1.0.0/16", "10.1.2.0/24", "10.1.2.3/32"),
+		},
+		{
+			pfx("10.1.0.0/16"), []QueryOption{Strict()},
+			pfxs("::/8", "10.0.0.0/8"),
+			pfxs("10.1.2.0/24", "10.1.2.3/32"),
+		},
+		{
+			pfx("10.1.0.0/16"), []QueryOption{MaxLen(24)},
+			pfxs("::/8", "10.0.0.0/8", "10.1.0.0/16"),
+			pfxs("10.1.0.0/16", "10.1.2.0/24"),
+		},
+		// ::/8 is 8 bits long, so MaxLen(7) excludes it from the ancestors
+		// of an IPv4 Prefix even though 10.0.0.0/8 is only 8 bits long too.
+		{
+			pfx("10.1.0.0/16"), []QueryOption{Strict(), MaxLen(7)},
+			nil,
+			nil,
+		},
+		{
+			pfx("10.1.0.0/16"), []QueryOption{Strict(), MaxLen(8)},
+			pfxs("::/8", "10.0.0.0/8"),
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		checkPrefixSlice(t, ps.AncestorsOf(tt.get, tt.opts...).Prefixes(), tt.wantAnc)
+		checkPrefixSlice(t, ps.DescendantsOf(tt.get, tt.opts...).Prefixes(), tt.wantDesc)
+		checkPrefixSlice(t, pm.AncestorsOf(tt.get, tt.opts...).KeySet().Prefixes(), tt.wantAnc)
+		checkPrefixSlice(t, pm.DescendantsOf(tt.get, tt.opts...).KeySet().Prefixes(), tt.wantDesc)
+	}
+}
+
+func TestPrefixMapSize(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	for i, p := range pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "11.0.0.0/8", "::1/128") {
+		pmb.Set(p, i)
+	}
+	pm := pmb.PrefixMap()
+	tests := []struct {
+		m    *PrefixMap[int]
+		want int
+	}{
+		{&PrefixMap[int]{}, 0},
+		{pm, 5},
+		{pm.DescendantsOf(pfx("10.0.0.0/8")), 3},
+		{pm.AncestorsOf(pfx("10.1.2.0/24")), 3},
+		{pm.DescendantsOf(pfx("12.0.0.0/8")), 0},
+		{pm.DescendantsOf(pfx("10.0.0.0/8"), Strict()), 2},
+		{pm.AncestorsOf(pfx("10.1.2.0/24"), Strict()), 2},
+	}
+	for _, tt := range tests {
+		// The second call returns the cached size.
+		for range 2 {
+			if got := tt.m.Size(); got != tt.want {
+				t.Errorf("%v.Size() = %d, want %d", tt.m, got, tt.want)
+			}
+		}
+	}
+	if got, want := pm.KeySet().Size(), 5; got != want {
+		t.Errorf("KeySet().Size() = %d, want %d", got, want)
+	}
+}
+
+// TestSizeRootEntry checks that Size agrees with iteration when ::/0, which is
+// held by the root node and ignored by queries, is among the entries.
+func TestSizeRootEntry(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	pmb := &PrefixMapBuilder[int]{}
+	for i, p := range pfxs("::/0", "2001::/16", "10.0.0.0/8") {
+		psb.Add(p)
+		pmb.Set(p, i)
+	}
+	ps, pm := psb.PrefixSet(), pmb.PrefixMap()
+
+	var n int
+	for range ps.All() {
+		n++
+	}
+	if got := ps.Size(); got != n || got != len(ps.Prefixes()) {
+		t.Errorf("ps.Size() = %d, want %d", got, n)
+	}
+	checkPrefixSlice(t, ps.Prefixes(), pfxs("10.0.0.0/8", "2001::/16"))
+
+	n = 0
+	for range pm.All() {
+		n++
+	}
+	if got := pm.Size(); got != n || got != len(pm.ToMap()) {
+		t.Errorf("pm.Size() = %d, want %d", got, n)
+	}
+}
+
 func TestPrefixMapDescendantsOf(t *testing.T) {
 	tests := []struct {
 		set  []netip.Prefix
@@ -495,7 +681,9 @@ func TestPrefixMapDescendantsOf(t *testing.T) {
 		for _, p := range tt.set {
 			pmb.Set(p, true)
 		}
-		checkMap(t, tt.want, pmb.PrefixMap().DescendantsOf(tt.get).ToMap())
+		pm := pmb.PrefixMap()
+		checkMap(t, tt.want, pm.DescendantsOf(tt.get).ToMap())
+		checkMap(t, tt.want, maps.Collect(pm.AllDescendantsOf(tt.get)))
 	}
 }
 
@@ -586,9 +774,128 @@ func TestPrefixMapAncestorsOf(t *testing.T) {
 		for _, p := range tt.set {
 			pmb.Set(p, true)
 		}
-		checkMap(t, tt.want, pmb.PrefixMap().AncestorsOf(tt.get).ToMap())
+		pm := pmb.PrefixMap()
+		checkMap(t, tt.want, pm.AncestorsOf(tt.get).ToMap())
+		checkMap(t, tt.want, maps.Collect(pm.AllAncestorsOf(tt.get)))
+	}
+
+}
+
+func TestPrefixMapPathOf(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	// Values are the Prefix lengths
+	for _, p := range pfxs("10.0.0.0/8", "10.1.2.0/24", "10.1.0.0/16", "10.1.3.0/24", "::0/126", "::0/128") {
+		pmb.Set(p, p.Bits())
+	}
+	pm := pmb.PrefixMap()
+
+	tests := []struct {
+		get  netip.Prefix
+		want []netip.Prefix
+	}{
+		{pfx("10.1.2.3/32"), pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24")},
+		{pfx("10.1.2.0/24"), pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24")},
+		{pfx("10.1.0.0/16"), pfxs("10.0.0.0/8", "10.1.0.0/16")},
+		{pfx("10.2.0.0/16"), pfxs("10.0.0.0/8")},
+		{pfx("11.0.0.0/8"), pfxs()},
+		{pfx("::0/127"), pfxs("::0/126")},
+		{pfx("::0/128"), pfxs("::0/126", "::0/128")},
+	}
+	for _, tt := range tests {
+		got := pm.PathOf(tt.get)
+		var gotPrefixes []netip.Prefix
+		for _, e := range got {
+			gotPrefixes = append(gotPrefixes, e.Prefix)
+			if e.Value != e.Prefix.Bits() {
+				t.Errorf("pm.PathOf(%v) includes %v with value %d, want %d", tt.get, e.Prefix, e.Value, e.Prefix.Bits())
+			}
+		}
+		checkPrefixSlice(t, gotPrefixes, tt.want)
+	}
+}
+
+func TestPrefixMapAppendAncestors(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	for _, p := range pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "2001:db8::/32") {
+		pmb.Set(p, p.Bits())
+	}
+	pm := pmb.PrefixMap()
+
+	buf := make([]Entry[int], 0, 129)
+	tests := []struct {
+		get  netip.Prefix
+		want []netip.Prefix
+	}{
+		{pfx("10.1.2.3/32"), pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24")},
+		{pfx("10.1.0.0/16"), pfxs("10.0.0.0/8", "10.1.0.0/16")},
+		{pfx("2001:db8::1/128"), pfxs("2001:db8::/32")},
+		{pfx("11.0.0.0/8"), pfxs()},
+		{netip.Prefix{}, pfxs()},
+	}
+	for _, tt := range tests {
+		// Entries are appended after those already in dst.
+		got := pm.AppendAncestors(append(buf[:0], Entry[int]{}), tt.get)
+		if got[0] != (Entry[int]{}) {
+			t.Errorf("pm.AppendAncestors(%v) overwrote dst", tt.get)
+		}
+		var gotPrefixes []netip.Prefix
+		for _, e := range got[1:] {
+			gotPrefixes = append(gotPrefixes, e.Prefix)
+		}
+		checkPrefixSlice(t, gotPrefixes, tt.want)
+	}
+
+	q := pfx("10.1.2.3/32")
+	if allocs := testing.AllocsPerRun(100, func() {
+		buf = pm.AppendAncestors(buf[:0], q)
+	}); allocs != 0 {
+		t.Errorf("AppendAncestors allocated %v times, want 0", allocs)
+	}
+}
+
+func TestPrefixMapEntriesBetween(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	// Values are the Prefix lengths
+	for _, p := range pfxs("10.0.0.0/8", "10.1.2.0/24", "10.1.0.0/16", "10.1.3.0/24", "10.2.0.0/31", "11.0.0.0/8", "::0/126", "::0/128", "2001:db8::/32") {
+		pmb.Set(p, p.Bits())
+	}
+	pm := pmb.PrefixMap()
+
+	addr := netip.MustParseAddr
+	tests := []struct {
+		first, last netip.Addr
+		want        []netip.Prefix
+	}{
+		{addr("10.0.0.0"), addr("10.255.255.255"), pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.3.0/24", "10.2.0.0/31")},
+		{addr("10.1.2.0"), addr("10.2.0.0"), pfxs("10.1.2.0/24", "10.1.3.0/24")},
+		{addr("10.1.0.0"), addr("10.2.0.1"), pfxs("10.1.0.0/16", "10.1.2.0/24", "10.1.3.0/24", "10.2.0.0/31")},
+		{addr("10.1.2.1"), addr("10.1.2.255"), pfxs()},
+		{addr("0.0.0.0"), addr("255.255.255.255"), pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.3.0/24", "10.2.0.0/31", "11.0.0.0/8")},
+		// IPv4 Prefixes are not within IPv6 ranges
+		{addr("::"), addr("2001:db8::1"), pfxs("::0/126", "::0/128")},
+		{addr("::"), addr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), pfxs("::0/126", "::0/128", "2001:db8::/32")},
+		// Invalid ranges
+		{addr("10.0.0.1"), addr("10.0.0.0"), pfxs()},
+		{addr("10.0.0.0"), addr("::1"), pfxs()},
+	}
+	for _, tt := range tests {
+		var got []netip.Prefix
+		for p, v := range pm.EntriesBetween(tt.first, tt.last) {
+			got = append(got, p)
+			if v != p.Bits() {
+				t.Errorf("pm.EntriesBetween(%v, %v) includes %v with value %d, want %d", tt.first, tt.last, p, v, p.Bits())
+			}
+		}
+		checkPrefixSlice(t, got, tt.want)
 	}
 
+	// Stopping early
+	n := 0
+	for range pm.EntriesBetween(addr("10.0.0.0"), addr("11.255.255.255")) {
+		if n++; n == 2 {
+			break
+		}
+	}
 }
 
 func TestPrefixMapBuilderUsableAfterPrefixMap(t *testing.T) {
@@ -669,6 +976,60 @@ func TestPrefixMapBuilderFilter(t *testing.T) {
 	}
 }
 
+func TestPrefixMapBuilderRemoveEncompassedBy(t *testing.T) {
+	tests := []struct {
+		set    []netip.Prefix
+		remove []netip.Prefix
+		want   map[netip.Prefix]bool
+	}{
+		{pfxs(), pfxs(), wantMap(true)},
+		{pfxs(), pfxs("::0/128"), wantMap(true)},
+		{pfxs("::0/128"), pfxs(), wantMap(true, "::0/128")},
+		{pfxs("::0/128"), pfxs("::0/128"), wantMap(true)},
+		{pfxs("::0/128"), pfxs("::0/127"), wantMap(true)},
+		{pfxs("::2/128"), pfxs("::0/127"), wantMap(true, "::2/128")},
+
+		// Remove by a parent of some entries in the map
+		{
+			set:    pfxs("::0/128", "::1/128", "::2/128"),
+			remove: pfxs("::0/127"),
+			want:   wantMap(true, "::2/128"),
+		},
+
+		// Entries that encompass a removed Prefix are kept
+		{
+			set:    pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "11.0.0.0/8"),
+			remove: pfxs("10.1.0.0/16"),
+			want:   wantMap(true, "10.0.0.0/8", "11.0.0.0/8"),
+		},
+
+		// Removal uses encompassment; the set covers "::0/127" but does not
+		// encompass it.
+		{pfxs("::0/127"), pfxs("::0/128", "::1/128"), wantMap(true, "::0/127")},
+	}
+	for _, tt := range tests {
+		pmb := &PrefixMapBuilder[bool]{}
+		psb := &PrefixSetBuilder{}
+		for _, p := range tt.set {
+			pmb.Set(p, true)
+			psb.Add(p)
+		}
+		remove := &PrefixSetBuilder{}
+		for _, p := range tt.remove {
+			remove.Add(p)
+		}
+		pmb.RemoveEncompassedBy(remove.PrefixSet())
+		checkMap(t, tt.want, pmb.PrefixMap().ToMap())
+
+		psb.RemoveEncompassedBy(remove.PrefixSet())
+		got := make(map[netip.Prefix]bool)
+		for _, p := range psb.PrefixSet().Prefixes() {
+			got[p] = true
+		}
+		checkMap(t, tt.want, got)
+	}
+}
+
 func TestPrefixMapFilter(t *testing.T) {
 	tests := []struct {
 		set    []netip.Prefix
@@ -761,3 +1122,623 @@ func TestOverlapsPrefix(t *testing.T) {
 		}
 	}
 }
+
+func BenchmarkPrefixMapParentOf(b *testing.B) {
+	pmb := &PrefixMapBuilder[int]{}
+	for i := 0; i < 1024; i++ {
+		a := netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, byte(i >> 8), byte(i)})
+		pmb.Set(netip.PrefixFrom(a, 48), i)
+	}
+	pm := pmb.PrefixMap()
+	p := pfx("2001:db8:1:ff::1/128")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pm.ParentOf(p)
+	}
+}
+
+func TestPrefixMapHierarchyEdges(t *testing.T) {
+	tests := []struct {
+		set  []netip.Prefix
+		want [][2]string
+	}{
+		{pfxs(), nil},
+		{pfxs("::0/128", "::1/128"), nil},
+		{
+			pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.0.0/16", "11.0.0.0/8", "11.1.0.0/16"),
+			[][2]string{
+				{"10.0.0.0/8", "10.1.0.0/16"},
+				{"10.1.0.0/16", "10.1.2.0/24"},
+				{"10.0.0.0/8", "10.2.0.0/16"},
+				{"11.0.0.0/8", "11.1.0.0/16"},
+			},
+		},
+		{
+			pfxs("::/8", "::/16", "10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32"),
+			[][2]string{
+				{"::/8", "::/16"},
+				{"::/16", "10.0.0.0/8"},
+				{"10.0.0.0/8", "10.1.0.0/16"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		pmb := &PrefixMapBuilder[int]{}
+		for i, p := range tt.set {
+			pmb.Set(p, i)
+		}
+		var got [][2]string
+		for parent, child := range pmb.PrefixMap().HierarchyEdges() {
+			got = append(got, [2]string{parent.String(), child.String()})
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("HierarchyEdges() of %v = %v, want %v", tt.set, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixMapKeySet(t *testing.T) {
+	tests := []struct {
+		set  []netip.Prefix
+		want []netip.Prefix
+	}{
+		{pfxs(), pfxs()},
+		{pfxs("::0/128"), pfxs("::0/128")},
+		{pfxs("::0/128", "::1/128"), pfxs("::0/128", "::1/128")},
+		{pfxs("::0/127", "::0/128"), pfxs("::0/127", "::0/128")},
+		// Value-less shared prefix nodes are not included
+		{pfxs("::0/128", "::2/128"), pfxs("::0/128", "::2/128")},
+		// IPv4
+		{pfxs("1.2.3.0/24", "1.2.3.4/32"), pfxs("1.2.3.0/24", "1.2.3.4/32")},
+	}
+	for _, tt := range tests {
+		pmb := &PrefixMapBuilder[int]{}
+		for i, p := range tt.set {
+			pmb.Set(p, i)
+		}
+		checkPrefixSlice(t, pmb.PrefixMap().KeySet().Prefixes(), tt.want)
+	}
+}
+
+func TestPrefixMapBuilderSetString(t *testing.T) {
+	pmb := &PrefixMapBuilder[string]{}
+	if err := pmb.SetString("1.2.3.0/24", "a"); err != nil {
+		t.Errorf("pmb.SetString(1.2.3.0/24) = %v, want nil", err)
+	}
+	var parseErr *PrefixParseError
+	if err := pmb.SetString("1.2.3.0/", "b"); !errors.As(err, &parseErr) {
+		t.Errorf("pmb.SetString(1.2.3.0/) = %v, want *PrefixParseError", err)
+	}
+	checkMap(t, map[netip.Prefix]string{pfx("1.2.3.0/24"): "a"}, pmb.PrefixMap().ToMap())
+}
+
+func TestPrefixMapFromBytes(t *testing.T) {
+	pmb := &PrefixMapBuilder[string]{}
+	pmb.SetFromBytes([]byte{10, 0, 0, 0}, 8, "v4")
+	pmb.SetFromBytes(netip.MustParseAddr("2001:db8::").AsSlice(), 32, "v6")
+	if err := pmb.SetFromBytes([]byte{10, 0, 0}, 8, "bad"); err == nil {
+		t.Errorf("pmb.SetFromBytes(3 bytes) = nil, want error")
+	}
+	pm := pmb.PrefixMap()
+	checkMap(t, map[netip.Prefix]string{
+		pfx("10.0.0.0/8"):    "v4",
+		pfx("2001:db8::/32"): "v6",
+	}, pm.ToMap())
+
+	tests := []struct {
+		addr       []byte
+		bits       int
+		wantPrefix netip.Prefix
+		wantOK     bool
+	}{
+		{[]byte{10, 1, 2, 3}, 32, pfx("10.0.0.0/8"), true},
+		{[]byte{11, 1, 2, 3}, 32, netip.Prefix{}, false},
+		{netip.MustParseAddr("2001:db8::1").AsSlice(), 128, pfx("2001:db8::/32"), true},
+		{[]byte{10, 1, 2}, 24, netip.Prefix{}, false},
+	}
+	for _, tt := range tests {
+		gotPrefix, _, gotOK := pm.ParentOfFromBytes(tt.addr, tt.bits)
+		if gotPrefix != tt.wantPrefix || gotOK != tt.wantOK {
+			t.Errorf(
+				"pm.ParentOfFromBytes(%v, %d) = (%v, _, %v), want (%v, _, %v)",
+				tt.addr, tt.bits, gotPrefix, gotOK, tt.wantPrefix, tt.wantOK,
+			)
+		}
+	}
+}
+
+func TestPrefixMapFilterWithMode(t *testing.T) {
+	tests := []struct {
+		set    []netip.Prefix
+		filter []netip.Prefix
+		mode   FilterMode
+		want   map[netip.Prefix]bool
+	}{
+		// Encompassed matches Filter
+		{pfxs("::0/127"), pfxs("::0/128", "::1/128"), FilterEncompassed, wantMap(true)},
+		{pfxs("::0/128", "::2/128"), pfxs("::0/127"), FilterEncompassed, wantMap(true, "::0/128")},
+
+		// Overlapping keeps ancestors and descendants of the filter entries
+		{
+			set:    pfxs("::0/127", "::0/128", "::2/128"),
+			filter: pfxs("::1/128"),
+			mode:   FilterOverlapping,
+			want:   wantMap(true, "::0/127"),
+		},
+		{
+			set:    pfxs("::0/126", "::0/128", "::4/128"),
+			filter: pfxs("::0/127"),
+			mode:   FilterOverlapping,
+			want:   wantMap(true, "::0/126", "::0/128"),
+		},
+
+		// Exact keeps only entries present in the filter
+		{
+			set:    pfxs("::0/127", "::0/128", "::1/128"),
+			filter: pfxs("::0/127", "::1/128", "::2/128"),
+			mode:   FilterExact,
+			want:   wantMap(true, "::0/127", "::1/128"),
+		},
+		{pfxs("::0/128"), pfxs("::0/127"), FilterExact, wantMap(true)},
+
+		// IPv4
+		{
+			set:    pfxs("10.0.0.0/8", "10.1.0.0/16", "11.0.0.0/8"),
+			filter: pfxs("10.1.2.0/24"),
+			mode:   FilterOverlapping,
+			want:   wantMap(true, "10.0.0.0/8", "10.1.0.0/16"),
+		},
+	}
+	for _, tt := range tests {
+		pmb := &PrefixMapBuilder[bool]{}
+		for _, p := range tt.set {
+			pmb.Set(p, true)
+		}
+		filter := &PrefixSetBuilder{}
+		for _, p := range tt.filter {
+			filter.Add(p)
+		}
+		fs := filter.PrefixSet()
+		checkMap(t, tt.want, pmb.PrefixMap().FilterWithMode(fs, tt.mode).ToMap())
+		pmb.FilterWithMode(fs, tt.mode)
+		checkMap(t, tt.want, pmb.PrefixMap().ToMap())
+	}
+}
+
+func TestPrefixMapBuilderCloneValue(t *testing.T) {
+	pmb := &PrefixMapBuilder[[]int]{
+		CloneValue: func(v []int) []int { return append([]int(nil), v...) },
+	}
+	val := []int{1}
+	pmb.Set(pfx("::0/128"), val)
+	pm := pmb.PrefixMap()
+
+	// Mutate the value held by the builder
+	val[0] = 2
+	if got, _ := pm.Get(pfx("::0/128")); got[0] != 1 {
+		t.Errorf("pm.Get(::0/128) = %v, want [1]", got)
+	}
+
+	// Without CloneValue, values are shared
+	pmb.CloneValue = nil
+	pm = pmb.PrefixMap()
+	val[0] = 3
+	if got, _ := pm.Get(pfx("::0/128")); got[0] != 3 {
+		t.Errorf("pm.Get(::0/128) = %v, want [3]", got)
+	}
+}
+
+func TestPrefixMapBuilderSetRange(t *testing.T) {
+	pmb := &PrefixMapBuilder[string]{}
+	pmb.SetRange(netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.4"), "a")
+	pmb.SetRange(netip.MustParseAddr("2001:db8::"), netip.MustParseAddr("2001:db8::ff"), "b")
+	if err := pmb.SetRange(netip.MustParseAddr("10.0.0.9"), netip.MustParseAddr("10.0.0.8"), "c"); err == nil {
+		t.Errorf("pmb.SetRange(10.0.0.9, 10.0.0.8) = nil, want error")
+	}
+	checkMap(t, map[netip.Prefix]string{
+		pfx("10.0.0.1/32"):    "a",
+		pfx("10.0.0.2/31"):    "a",
+		pfx("10.0.0.4/32"):    "a",
+		pfx("2001:db8::/120"): "b",
+	}, pmb.PrefixMap().ToMap())
+}
+
+func TestPrefixMapNearest(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	pmb.Set(pfx("10.0.0.0/8"), 1)
+	pmb.Set(pfx("10.1.0.0/16"), 2)
+	pmb.Set(pfx("192.168.0.0/16"), 3)
+	pmb.Set(pfx("2001:db8::/32"), 4)
+	pm := pmb.PrefixMap()
+
+	tests := []struct {
+		addr    netip.Addr
+		want    netip.Prefix
+		wantVal int
+		wantOK  bool
+	}{
+		{netip.MustParseAddr("10.1.2.3"), pfx("10.1.0.0/16"), 2, true},
+		// Shares 14 bits with 10.1.0.0/16, but only 8 with 10.0.0.0/8
+		{netip.MustParseAddr("10.2.0.1"), pfx("10.1.0.0/16"), 2, true},
+		// Shares 8 bits with both; the encompassing entry wins
+		{netip.MustParseAddr("10.128.0.1"), pfx("10.0.0.0/8"), 1, true},
+		{netip.MustParseAddr("11.0.0.1"), pfx("10.0.0.0/8"), 1, true},
+		{netip.MustParseAddr("192.169.0.1"), pfx("192.168.0.0/16"), 3, true},
+		{netip.MustParseAddr("2001:db9::1"), pfx("2001:db8::/32"), 4, true},
+		// Only entries of the same family are considered
+		{netip.MustParseAddr("::1"), pfx("2001:db8::/32"), 4, true},
+		{netip.Addr{}, netip.Prefix{}, 0, false},
+	}
+	for _, tt := range tests {
+		got, gotVal, gotOK := pm.Nearest(tt.addr)
+		if got != tt.want || gotVal != tt.wantVal || gotOK != tt.wantOK {
+			t.Errorf("pm.Nearest(%v) = (%v, %v, %v), want (%v, %v, %v)",
+				tt.addr, got, gotVal, gotOK, tt.want, tt.wantVal, tt.wantOK)
+		}
+	}
+
+	v4 := &PrefixSetBuilder{}
+	v4.Add(pfx("10.0.0.0/8"))
+	if got, ok := v4.PrefixSet().Nearest(netip.MustParseAddr("2001:db8::1")); ok {
+		t.Errorf("Nearest(2001:db8::1) in IPv4-only set = (%v, true), want false", got)
+	}
+}
+
+func TestPrefixMapLookupAddr(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	pmb.Set(pfx("10.0.0.0/8"), 1)
+	pmb.Set(pfx("10.1.0.0/16"), 2)
+	pmb.Set(pfx("10.1.2.3/32"), 3)
+	pmb.Set(pfx("2001:db8::/32"), 4)
+	pmb.Set(pfx("2001:db8::1/128"), 5)
+	pm := pmb.PrefixMap()
+
+	tests := []struct {
+		addr    netip.Addr
+		want    netip.Prefix
+		wantVal int
+		wantOK  bool
+	}{
+		{netip.MustParseAddr("10.2.0.1"), pfx("10.0.0.0/8"), 1, true},
+		{netip.MustParseAddr("10.1.0.1"), pfx("10.1.0.0/16"), 2, true},
+		{netip.MustParseAddr("10.1.2.3"), pfx("10.1.2.3/32"), 3, true},
+		{netip.MustParseAddr("11.0.0.1"), netip.Prefix{}, 0, false},
+		{netip.MustParseAddr("2001:db8::2"), pfx("2001:db8::/32"), 4, true},
+		{netip.MustParseAddr("2001:db8::1"), pfx("2001:db8::1/128"), 5, true},
+		{netip.MustParseAddr("2001:db9::1"), netip.Prefix{}, 0, false},
+		// IPv4-mapped IPv6 addresses are looked up as IPv4
+		{netip.MustParseAddr("::ffff:10.1.0.1"), pfx("10.1.0.0/16"), 2, true},
+		{netip.Addr{}, netip.Prefix{}, 0, false},
+	}
+	for _, tt := range tests {
+		got, gotVal, gotOK := pm.LookupAddr(tt.addr)
+		if got != tt.want || gotVal != tt.wantVal || gotOK != tt.wantOK {
+			t.Errorf(
+				"pm.LookupAddr(%v) = (%v, %v, %v), want (%v, %v, %v)",
+				tt.addr, got, gotVal, gotOK, tt.want, tt.wantVal, tt.wantOK,
+			)
+		}
+		if !tt.addr.IsValid() {
+			continue
+		}
+		// LookupAddr is equivalent to ParentOf with the single-address Prefix.
+		wantP, wantVal, wantOK := pm.ParentOf(netip.PrefixFrom(tt.addr, tt.addr.BitLen()))
+		if got != wantP || gotVal != wantVal || gotOK != wantOK {
+			t.Errorf(
+				"pm.LookupAddr(%v) = (%v, %v, %v), but ParentOf returned (%v, %v, %v)",
+				tt.addr, got, gotVal, gotOK, wantP, wantVal, wantOK,
+			)
+		}
+	}
+
+	addr := netip.MustParseAddr("10.1.0.1")
+	if allocs := testing.AllocsPerRun(100, func() { pm.LookupAddr(addr) }); allocs != 0 {
+		t.Errorf("LookupAddr made %v allocations, want 0", allocs)
+	}
+}
+
+func TestPrefixMapLookupAddrs(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	pmb.Set(pfx("10.0.0.0/8"), 1)
+	pmb.Set(pfx("10.1.0.0/16"), 2)
+	pmb.Set(pfx("2001:db8::/32"), 3)
+	pm := pmb.PrefixMap()
+
+	addrs := []netip.Addr{
+		netip.MustParseAddr("10.1.0.1"),
+		netip.MustParseAddr("11.0.0.1"),
+		netip.MustParseAddr("2001:db8::1"),
+		{},
+		netip.MustParseAddr("10.2.0.1"),
+	}
+	got := pm.LookupAddrs(addrs)
+	if len(got) != len(addrs) {
+		t.Fatalf("len(pm.LookupAddrs(%v)) = %d, want %d", addrs, len(got), len(addrs))
+	}
+	for i, addr := range addrs {
+		var want LookupResult[int]
+		want.Prefix, want.Value, want.OK = pm.LookupAddr(addr)
+		if got[i] != want {
+			t.Errorf("pm.LookupAddrs(...)[%d] (%v) = %v, want %v", i, addr, got[i], want)
+		}
+	}
+
+	ps := pm.KeySet()
+	for i, ok := range ps.ContainsAddrs(addrs) {
+		if want := ps.ContainsAddr(addrs[i]); ok != want {
+			t.Errorf("ps.ContainsAddrs(...)[%d] (%v) = %v, want %v", i, addrs[i], ok, want)
+		}
+	}
+
+	// A larger batch, whose addresses share paths in a random order.
+	r := rand.New(rand.NewPCG(1, 2))
+	src := randomPrefixSet(r, 1000)
+	bpmb := &PrefixMapBuilder[int]{}
+	for i, p := range src.Prefixes() {
+		bpmb.Set(p, i)
+	}
+	bpm := bpmb.PrefixMap()
+	var batch []netip.Addr
+	for _, p := range randomPrefixes(r, 500) {
+		batch = append(batch, p.Addr(), p.Masked().Addr())
+	}
+	for i, got := range bpm.LookupAddrs(batch) {
+		var want LookupResult[int]
+		want.Prefix, want.Value, want.OK = bpm.LookupAddr(batch[i])
+		if got != want {
+			t.Errorf("LookupAddrs(...)[%d] (%v) = %v, want %v", i, batch[i], got, want)
+		}
+	}
+
+	// One allocation for the results, and one for the sorted queries.
+	if allocs := testing.AllocsPerRun(100, func() { pm.LookupAddrs(addrs) }); allocs != 2 {
+		t.Errorf("LookupAddrs made %v allocations, want 2", allocs)
+	}
+}
+
+func TestPrefixMapLookupBoth(t *testing.T) {
+	pmb := &PrefixMapBuilder[string]{}
+	pmb.Set(pfx("10.0.0.0/8"), "v4")
+	pmb.Set(pfx("2001:db8::/32"), "v6")
+	pm := pmb.PrefixMap()
+
+	tests := []struct {
+		a4, a6 netip.Addr
+		r4, r6 LookupResult[string]
+	}{
+		{
+			netip.MustParseAddr("10.1.2.3"), netip.MustParseAddr("2001:db8::1"),
+			LookupResult[string]{pfx("10.0.0.0/8"), "v4", true},
+			LookupResult[string]{pfx("2001:db8::/32"), "v6", true},
+		},
+		{
+			netip.MustParseAddr("11.1.2.3"), netip.MustParseAddr("2001:db8::1"),
+			LookupResult[string]{},
+			LookupResult[string]{pfx("2001:db8::/32"), "v6", true},
+		},
+		{
+			netip.MustParseAddr("10.1.2.3"), netip.Addr{},
+			LookupResult[string]{pfx("10.0.0.0/8"), "v4", true},
+			LookupResult[string]{},
+		},
+	}
+	for _, tt := range tests {
+		if r4, r6 := pm.LookupBoth(tt.a4, tt.a6); r4 != tt.r4 || r6 != tt.r6 {
+			t.Errorf("pm.LookupBoth(%v, %v) = %v, %v, want %v, %v", tt.a4, tt.a6, r4, r6, tt.r4, tt.r6)
+		}
+	}
+
+	a4, a6 := tests[0].a4, tests[0].a6
+	if allocs := testing.AllocsPerRun(100, func() { pm.LookupBoth(a4, a6) }); allocs != 0 {
+		t.Errorf("LookupBoth made %v allocations, want 0", allocs)
+	}
+}
+
+func TestPrefixMapBuilderPrefixMapAllocs(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	for i := 0; i < 4096; i++ {
+		a := netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, byte(i >> 8), byte(i)})
+		pmb.Set(netip.PrefixFrom(a, 48), i)
+	}
+	nodes := pmb.tree.nodeCount()
+	pm := pmb.PrefixMap()
+	checkMap(t, pmb.PrefixMap().ToMap(), pm.ToMap())
+	if got := len(pm.ToMap()); got != 4096 {
+		t.Errorf("len(pm.ToMap()) = %d, want 4096", got)
+	}
+
+	// Nodes are allocated in slabs rather than individually.
+	allocs := testing.AllocsPerRun(10, func() { pmb.PrefixMap() })
+	if max := float64(nodes/slabSize + 2); allocs > max {
+		t.Errorf("PrefixMap() with %d nodes made %v allocations, want <= %v", nodes, allocs, max)
+	}
+}
+
+func TestPrefixMapBuilderSetSizeHint(t *testing.T) {
+	const n = 4096
+	build := func(hint bool) *PrefixMapBuilder[int] {
+		pmb := &PrefixMapBuilder[int]{}
+		if hint {
+			pmb.SetSizeHint(n)
+		}
+		for i := 0; i < n; i++ {
+			a := netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, byte(i >> 8), byte(i)})
+			pmb.Set(netip.PrefixFrom(a, 48), i)
+		}
+		return pmb
+	}
+	checkMap(t, build(true).PrefixMap().ToMap(), build(false).PrefixMap().ToMap())
+
+	unhinted := testing.AllocsPerRun(5, func() { build(false) })
+	hinted := testing.AllocsPerRun(5, func() { build(true) })
+	if hinted > unhinted/10 {
+		t.Errorf("building with a size hint made %v allocations, want <= %v", hinted, unhinted/10)
+	}
+}
+
+func BenchmarkPrefixMapBuilderPrefixMap(b *testing.B) {
+	pmb := &PrefixMapBuilder[int]{}
+	for i := 0; i < 1<<16; i++ {
+		a := netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, byte(i >> 8), byte(i)})
+		pmb.Set(netip.PrefixFrom(a, 48), i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pmb.PrefixMap()
+	}
+}
+
+func TestPrefixMapGetOriginal(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{KeepOriginal: true}
+	pmb.Set(pfx("10.0.0.1/24"), 1)
+	pmb.Set(pfx("10.0.1.0/24"), 2)
+	pmb.SetString("2001:db8::1/64", 3)
+	pmb.Set(pfx("192.168.0.1/24"), 4)
+	pmb.Remove(pfx("192.168.0.0/24"))
+	pmb.Set(pfx("192.168.0.0/24"), 5)
+	pmb.Set(pfx("172.16.0.1/16"), 6)
+	pmb.Subtract(pfx("172.16.0.0/12"))
+	pmb.Set(pfx("10.2.0.1/24"), 7)
+	pmb.RemoveDescendantsOf(pfx("10.2.0.0/16"))
+	pmb.Set(pfx("10.2.0.0/24"), 8)
+	pm := pmb.PrefixMap()
+
+	tests := []struct {
+		get     netip.Prefix
+		want    netip.Prefix
+		wantVal int
+		wantOK  bool
+	}{
+		{pfx("10.0.0.0/24"), pfx("10.0.0.1/24"), 1, true},
+		{pfx("10.0.0.99/24"), pfx("10.0.0.1/24"), 1, true},
+		{pfx("10.0.1.0/24"), pfx("10.0.1.0/24"), 2, true},
+		{pfx("2001:db8::/64"), pfx("2001:db8::1/64"), 3, true},
+		{pfx("192.168.0.0/24"), pfx("192.168.0.0/24"), 5, true},
+		{pfx("172.16.0.0/16"), netip.Prefix{}, 0, false},
+		{pfx("10.0.2.0/24"), netip.Prefix{}, 0, false},
+		{pfx("10.2.0.0/24"), pfx("10.2.0.0/24"), 8, true},
+	}
+	for _, tt := range tests {
+		got, gotVal, gotOK := pm.GetOriginal(tt.get)
+		if got != tt.want || gotVal != tt.wantVal || gotOK != tt.wantOK {
+			t.Errorf("pm.GetOriginal(%v) = (%v, %v, %v), want (%v, %v, %v)",
+				tt.get, got, gotVal, gotOK, tt.want, tt.wantVal, tt.wantOK)
+		}
+	}
+
+	// Originals are not kept unless requested.
+	pmb = &PrefixMapBuilder[int]{}
+	pmb.Set(pfx("10.0.0.1/24"), 1)
+	if got, _, _ := pmb.PrefixMap().GetOriginal(pfx("10.0.0.0/24")); got != pfx("10.0.0.0/24") {
+		t.Errorf("GetOriginal without KeepOriginal = %v, want 10.0.0.0/24", got)
+	}
+}
+
+func TestPrefixMapGroupByRoots(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	pmb.Set(pfx("10.0.0.0/8"), 1)
+	pmb.Set(pfx("10.1.0.0/16"), 2)
+	pmb.Set(pfx("10.1.2.0/24"), 3)
+	pmb.Set(pfx("11.0.0.0/8"), 4)
+	pmb.Set(pfx("192.168.0.0/24"), 5)
+	pmb.Set(pfx("192.168.1.0/24"), 6)
+	pm := pmb.PrefixMap()
+
+	want := []struct {
+		root netip.Prefix
+		sub  map[netip.Prefix]int
+	}{
+		{pfx("10.0.0.0/8"), map[netip.Prefix]int{pfx("10.0.0.0/8"): 1, pfx("10.1.0.0/16"): 2, pfx("10.1.2.0/24"): 3}},
+		{pfx("11.0.0.0/8"), map[netip.Prefix]int{pfx("11.0.0.0/8"): 4}},
+		{pfx("192.168.0.0/24"), map[netip.Prefix]int{pfx("192.168.0.0/24"): 5}},
+		{pfx("192.168.1.0/24"), map[netip.Prefix]int{pfx("192.168.1.0/24"): 6}},
+	}
+	i := 0
+	for root, sub := range pm.GroupByRoots() {
+		if i >= len(want) {
+			t.Fatalf("GroupByRoots yielded extra root %v", root)
+		}
+		if root != want[i].root {
+			t.Errorf("root %d = %v, want %v", i, root, want[i].root)
+		}
+		checkMap(t, want[i].sub, sub.ToMap())
+		if v, ok := sub.Get(root); !ok || v != want[i].sub[root] {
+			t.Errorf("sub.Get(%v) = (%v, %v)", root, v, ok)
+		}
+		i++
+	}
+	if i != len(want) {
+		t.Errorf("GroupByRoots yielded %d roots, want %d", i, len(want))
+	}
+
+	// Stopping early
+	n := 0
+	for range pm.GroupByRoots() {
+		n++
+		break
+	}
+	if n != 1 {
+		t.Errorf("GroupByRoots yielded %d roots after break, want 1", n)
+	}
+}
+
+func TestPrefixMapGroupByRootsMixedFamilies(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	pmb.Set(pfx("::/8"), 1)
+	pmb.Set(pfx("10.0.0.0/8"), 2)
+	pmb.Set(pfx("10.1.0.0/16"), 3)
+	pmb.Set(pfx("2001:db8::/32"), 4)
+	pm := pmb.PrefixMap()
+
+	// ::/8 encompasses ::ffff:0:0/96, so the IPv4 Prefixes are in its group.
+	var roots []netip.Prefix
+	for root, sub := range pm.GroupByRoots() {
+		roots = append(roots, root)
+		if root == pfx("::/8") {
+			checkMap(t, map[netip.Prefix]int{
+				pfx("::/8"):        1,
+				pfx("10.0.0.0/8"):  2,
+				pfx("10.1.0.0/16"): 3,
+			}, sub.ToMap())
+		}
+	}
+	checkPrefixSlice(t, roots, pfxs("::/8", "2001:db8::/32"))
+}
+
+func TestPrefixMapAllCompact(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	for i, p := range pfxs("1.2.0.0/16", "1.2.3.0/24", "1.3.0.0/16", "::0/126", "::0/127", "::4/128") {
+		pmb.Set(p, i)
+	}
+	pm := pmb.PrefixMap()
+	want := pfxs("1.2.0.0/16", "1.3.0.0/16", "::0/126", "::4/128")
+	checkPrefixSlice(t, seqKeys(pm.AllCompact()), want)
+	for p, v := range pm.AllCompact() {
+		if got, _ := pm.Get(p); v != got {
+			t.Errorf("AllCompact() yielded %s with value %d, want %d", p, v, got)
+		}
+	}
+
+	// Early termination
+	var got []netip.Prefix
+	for p := range pm.AllCompact() {
+		got = append(got, p)
+		if len(got) == 2 {
+			break
+		}
+	}
+	checkPrefixSlice(t, got, want[:2])
+}
+
+func TestPrefixMapAllCompactMixedFamilies(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	for i, p := range pfxs("::/8", "10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32") {
+		pmb.Set(p, i)
+	}
+	pm := pmb.PrefixMap()
+	// ::/8 encompasses ::ffff:0:0/96, and so the IPv4 Prefixes.
+	want := pfxs("::/8", "2001:db8::/32")
+	checkPrefixSlice(t, seqKeys(pm.AllCompact()), want)
+	checkPrefixSlice(t, pm.KeySet().PrefixesCompact(), want)
+}
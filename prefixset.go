@@ -1,22 +1,257 @@
 package netipds
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
+	"iter"
+	"math/big"
 	"net/netip"
+	"slices"
 )
 
+// FilterMode determines which entries are retained when filtering by a
+// PrefixSet.
+type FilterMode int
+
+const (
+	// FilterEncompassed retains entries that are encompassed by some Prefix
+	// in the filter set. This is the mode used by Filter.
+	FilterEncompassed FilterMode = iota
+
+	// FilterOverlapping retains entries that overlap some Prefix in the
+	// filter set.
+	FilterOverlapping
+
+	// FilterExact retains entries that are present in the filter set.
+	FilterExact
+)
+
+// IntersectOrigin records which operand(s) of an intersection contributed an
+// entry to the result.
+type IntersectOrigin uint8
+
+const (
+	// OriginReceiver indicates that the entry is present in the receiver and
+	// is encompassed by an entry in the argument.
+	OriginReceiver IntersectOrigin = 1 << iota
+
+	// OriginArgument indicates that the entry is present in the argument and
+	// is encompassed by an entry in the receiver.
+	OriginArgument
+
+	// OriginBoth indicates that the entry is present in both operands.
+	OriginBoth = OriginReceiver | OriginArgument
+)
+
+func (o IntersectOrigin) String() string {
+	switch o {
+	case OriginReceiver:
+		return "receiver"
+	case OriginArgument:
+		return "argument"
+	case OriginBoth:
+		return "both"
+	default:
+		return fmt.Sprintf("IntersectOrigin(%d)", uint8(o))
+	}
+}
+
+// PrefixSetBuilder builds an immutable PrefixSet.
+//
+// Each Prefix in a PrefixSet carries 8 bits of flags, whose meanings are
+// defined by the user (e.g. "static", "learned"). Prefixes added without flags
+// have all flags cleared.
+//
+// The zero value is a valid PrefixSetBuilder representing a builder with zero
+// Prefixes.
 type PrefixSetBuilder struct {
-	tree tree[bool]
+	tree  tree[uint8]
+	stats buildStats
+	slab  *nodeSlab[uint8]
+
+	// RejectV4Mapped, if set, causes the Add methods to return an error for
+	// IPv4-mapped IPv6 Prefixes (those within ::ffff:0:0/96). Otherwise, such
+	// Prefixes are stored as the IPv4 Prefixes they map, and counted in
+	// BuildReport.V4Mapped. Set it when loading data that should not mix the
+	// two representations, so that mixing them is detected rather than
+	// silently merged.
+	RejectV4Mapped bool
+
+	// Family, if not AnyFamily, causes the Add methods to return an error for
+	// Prefixes of the other address family, for users who only handle one.
+	// It does not restrict Merge, which adds Prefixes from an existing set.
+	Family Family
 }
 
 func (s *PrefixSetBuilder) Add(p netip.Prefix) error {
+	return s.AddWithFlags(p, 0)
+}
+
+// AddWithFlags adds p to s with the provided flags set. If p is already
+// present, flags are combined with its existing flags using bitwise OR.
+func (s *PrefixSetBuilder) AddWithFlags(p netip.Prefix, flags uint8) error {
 	if !p.IsValid() {
+		s.stats.invalid++
 		return fmt.Errorf("Prefix is not valid: %v", p)
 	}
-	s.tree = *s.tree.insert(keyFromPrefix(p), true)
+	k := keyFromPrefix(p)
+	if !s.Family.admits(k.is4()) {
+		return s.stats.rejectFamily(k.is4(), p)
+	}
+	if isV4Mapped(p) {
+		if err := s.stats.admitV4Mapped(s.RejectV4Mapped, p); err != nil {
+			return err
+		}
+	}
+	s.stats.recordNormalized(p)
+	s.insert(k, flags)
 	return nil
 }
 
+// AddReporting is like Add, but also returns the Prefixes already in s that
+// p encompasses (excluding p itself), in the same order as
+// PrefixSet.Prefixes. This is useful for marking entries that are shadowed by
+// a broader Prefix as it is added.
+func (s *PrefixSetBuilder) AddReporting(p netip.Prefix) (covered []netip.Prefix, err error) {
+	if !p.IsValid() {
+		s.stats.invalid++
+		return nil, fmt.Errorf("Prefix is not valid: %v", p)
+	}
+	k := keyFromPrefix(p)
+	if !s.Family.admits(k.is4()) {
+		return nil, s.stats.rejectFamily(k.is4(), p)
+	}
+	if isV4Mapped(p) {
+		if err := s.stats.admitV4Mapped(s.RejectV4Mapped, p); err != nil {
+			return nil, err
+		}
+	}
+	s.stats.recordNormalized(p)
+	return strictDescendants(s.insert(k, 0)), nil
+}
+
+// ErrOverlap is returned, wrapped, by PrefixSetBuilder.AddDisjoint when the
+// Prefix provided overlaps a Prefix already in the builder.
+var ErrOverlap = errors.New("Prefix overlaps an existing Prefix")
+
+// AddDisjoint is like Add, but returns an error wrapping ErrOverlap, leaving
+// s unchanged, if p overlaps any Prefix already in s (including p itself).
+// Building a PrefixSet with AddDisjoint alone guarantees that its Prefixes
+// are disjoint.
+func (s *PrefixSetBuilder) AddDisjoint(p netip.Prefix) error {
+	if !p.IsValid() {
+		s.stats.invalid++
+		return fmt.Errorf("Prefix is not valid: %v", p)
+	}
+	k := keyFromPrefix(p)
+	if !s.Family.admits(k.is4()) {
+		return s.stats.rejectFamily(k.is4(), p)
+	}
+	v4Mapped := isV4Mapped(p)
+	if v4Mapped && s.RejectV4Mapped {
+		return s.stats.admitV4Mapped(true, p)
+	}
+	// overlapsKey, like walk, never considers the root node, which holds ::/0
+	// if it has a value, and so overlaps every Prefix.
+	if s.tree.hasValue || s.tree.overlapsKey(k) {
+		s.stats.invalid++
+		return fmt.Errorf("%w: %v", ErrOverlap, p)
+	}
+	if v4Mapped {
+		s.stats.v4Mapped++
+	}
+	s.stats.recordNormalized(p)
+	s.insert(k, 0)
+	return nil
+}
+
+// AddString parses p as a Prefix with ParsePrefixCanonical, using
+// V4MappedKeep, and adds it to s. If p cannot be parsed, AddString returns a
+// *PrefixParseError.
+func (s *PrefixSetBuilder) AddString(p string) error {
+	pfx, err := ParsePrefixCanonical(p, V4MappedKeep)
+	if err != nil {
+		s.stats.invalid++
+		return err
+	}
+	return s.Add(pfx)
+}
+
+// AddFromBytes adds the Prefix with the provided address bytes and length to
+// s. addr must be 4 bytes (IPv4) or 16 bytes (IPv6) long. AddFromBytes avoids
+// constructing a netip.Prefix, for use in hot paths that already have raw
+// address bytes.
+func (s *PrefixSetBuilder) AddFromBytes(addr []byte, bits int) error {
+	k, ok := keyFromBytes(addr, bits)
+	if !ok {
+		s.stats.invalid++
+		return fmt.Errorf("Prefix is not valid: %v/%d", addr, bits)
+	}
+	if !s.Family.admits(k.is4()) {
+		return s.stats.rejectFamily(k.is4(), fmt.Sprintf("%v/%d", addr, bits))
+	}
+	if len(addr) == 16 && k.is4() {
+		if err := s.stats.admitV4Mapped(s.RejectV4Mapped, netip.PrefixFrom(netip.AddrFrom16([16]byte(addr)), bits)); err != nil {
+			return err
+		}
+	}
+	s.insert(k, 0)
+	return nil
+}
+
+// insert adds k to s with the provided flags, combining them with any
+// existing flags of k, and returns the node holding k.
+func (s *PrefixSetBuilder) insert(k key, flags uint8) *tree[uint8] {
+	t, ins := s.tree.insertFrom(s.slab, k, flags)
+	s.tree = *t
+	if ins.existed {
+		s.stats.duplicates++
+		ins.node.value |= ins.old
+	}
+	return ins.node
+}
+
+// SetSizeHint informs s that approximately n Prefixes will be added to it, so
+// that it can allocate storage for them in large chunks up front rather than
+// one Prefix at a time. This reduces allocation and garbage collection
+// overhead when loading many Prefixes. Storage is only released once the
+// builder and all of the Prefixes allocated with it are discarded, so n should
+// not greatly exceed the number of Prefixes actually added.
+func (s *PrefixSetBuilder) SetSizeHint(n int) {
+	s.slab = newSizedSlab[uint8](n)
+}
+
+// Merge adds all Prefixes in o to s. The flags of Prefixes present in both
+// are combined using bitwise OR.
+//
+// Merge is commutative and associative: the resulting Prefixes and their
+// flags do not depend on the order in which sets are merged. See
+// netipdstest.CheckCommutative and netipdstest.CheckAssociative.
+func (s *PrefixSetBuilder) Merge(o *PrefixSet) {
+	o.tree.walk(key{}, func(n *tree[uint8]) bool {
+		if n.hasValue {
+			s.insert(n.key, n.value)
+		}
+		return false
+	})
+}
+
+// MergeReporting is like Merge, but also returns a PrefixSet containing the
+// Prefixes in o that were new to s, i.e. neither present in s nor encompassed
+// by a Prefix in s before the merge. Their flags are those they have in o.
+func (s *PrefixSetBuilder) MergeReporting(o *PrefixSet) (added *PrefixSet) {
+	ret := &tree[uint8]{}
+	o.tree.walk(key{}, func(n *tree[uint8]) bool {
+		if n.hasValue && !s.tree.encompasses(n.key, false) {
+			ret = ret.insert(n.key, n.value)
+		}
+		return false
+	})
+	s.Merge(o)
+	return &PrefixSet{tree: *ret}
+}
+
 func (s *PrefixSetBuilder) Remove(p netip.Prefix) error {
 	if !p.IsValid() {
 		return fmt.Errorf("Prefix is not valid: %v", p)
@@ -25,9 +260,57 @@ func (s *PrefixSetBuilder) Remove(p netip.Prefix) error {
 	return nil
 }
 
+// RemoveDescendantsOf removes p and every Prefix in s that p encompasses.
+// Unlike Subtract, it removes those Prefixes entirely, so an entry that
+// encompasses p is kept as it is rather than split around p.
+//
+// For example, if s is {::0/126, ::0/127, ::0/128}, and we remove the
+// descendants of ::0/127, then s will become {::0/126}.
+func (s *PrefixSetBuilder) RemoveDescendantsOf(p netip.Prefix) error {
+	if !p.IsValid() {
+		return fmt.Errorf("Prefix is not valid: %v", p)
+	}
+	s.tree.removeDescendants(keyFromPrefix(p), true)
+	return nil
+}
+
 // Filter removes all Prefixes from s that are not encompassed by pm.
 func (s *PrefixSetBuilder) Filter(o *PrefixSet) {
-	s.tree.filter(o.tree)
+	s.tree.filter(o.tree, FilterEncompassed)
+}
+
+// RemoveEncompassedBy removes all Prefixes from s that are encompassed by
+// o, keeping the rest. It is the inverse of Filter.
+func (s *PrefixSetBuilder) RemoveEncompassedBy(o *PrefixSet) {
+	s.tree.removeEncompassed(o.tree)
+}
+
+// FilterWithMode removes all Prefixes from s that are not retained by o under
+// the provided FilterMode.
+func (s *PrefixSetBuilder) FilterWithMode(o *PrefixSet, mode FilterMode) {
+	s.tree.filter(o.tree, mode)
+}
+
+// Intersect modifies s so that it contains the intersection of the entries
+// in s and o: an entry is retained if it is encompassed by an entry in the
+// other set. For example, the intersection of {::0/126} and {::0/128} is
+// {::0/128}.
+//
+// The flags of each resulting Prefix are the bitwise OR of its flags in s and
+// o.
+//
+// Like Merge, Intersect is commutative and associative.
+func (s *PrefixSetBuilder) Intersect(o *PrefixSet) {
+	res := &tree[uint8]{}
+	intersectOrigins(&s.tree, &o.tree).walk(key{}, func(n *tree[IntersectOrigin]) bool {
+		if n.hasValue {
+			sFlags, _ := s.tree.get(n.key)
+			oFlags, _ := o.tree.get(n.key)
+			res = res.insert(n.key, sFlags|oFlags)
+		}
+		return false
+	})
+	s.tree = *res
 }
 
 // Subtract modifies the map such that the provided Prefix and all of its
@@ -41,41 +324,360 @@ func (s *PrefixSetBuilder) Subtract(p netip.Prefix) error {
 	if !p.IsValid() {
 		return fmt.Errorf("Prefix is not valid: %v", p)
 	}
-	s.tree.subtract(keyFromPrefix(p))
+	s.subtract(keyFromPrefix(p))
 	return nil
 }
 
-// PrefixSet returns an immutable PrefixSet representing the current state of s.
+// subtract removes k and all of its descendants from s.
+func (s *PrefixSetBuilder) subtract(k key) {
+	if s.tree.subtract(k) == nil {
+		// k is the root key, so nothing remains.
+		s.tree = tree[uint8]{}
+	}
+}
+
+// SubtractRange is like Subtract, but removes every address from first to
+// last, inclusive. first and last must be of the same family, with first <=
+// last.
+func (s *PrefixSetBuilder) SubtractRange(first, last netip.Addr) error {
+	return rangeKeys(first, last, s.subtract)
+}
+
+// IntersectRange modifies s so that it contains only the addresses from first
+// to last, inclusive, that it already contains. Entries that extend past the
+// range are replaced by the Prefixes needed to cover their part of the range,
+// which retain the flags of the entry they were taken from. first and last
+// must be of the same family, with first <= last.
+//
+// For example, if s is {10.0.0.0/8}, then intersecting with the range
+// 10.0.0.1-10.0.0.2 results in {10.0.0.1/32, 10.0.0.2/32}.
+func (s *PrefixSetBuilder) IntersectRange(first, last netip.Addr) error {
+	r := &tree[uint8]{}
+	err := rangeKeys(first, last, func(k key) {
+		r = r.insert(k, 0)
+	})
+	if err != nil {
+		return err
+	}
+	res := &tree[uint8]{}
+	intersectOrigins(&s.tree, r).walk(key{}, func(n *tree[IntersectOrigin]) bool {
+		if n.hasValue {
+			_, flags, _ := s.tree.parentOf(n.key, false)
+			res = res.insert(n.key, flags)
+		}
+		return false
+	})
+	s.tree = *res
+	return nil
+}
+
+// SnapshotOption configures the PrefixSet returned by
+// PrefixSetBuilder.PrefixSet.
+type SnapshotOption func(*snapshotConfig)
+
+type snapshotConfig struct {
+	compact       bool
+	mergeSiblings bool
+}
+
+// WithCompaction causes the PrefixSet to include only the Prefixes that are
+// not encompassed by any other Prefix, as returned by
+// PrefixSet.PrefixesCompact. The resulting PrefixSet covers the same
+// addresses, and Encompasses returns the same results, but it is smaller.
+func WithCompaction() SnapshotOption {
+	return func(c *snapshotConfig) { c.compact = true }
+}
+
+// WithMergedSiblings is like WithCompaction, but additionally replaces each
+// pair of sibling Prefixes (the two halves of a common parent) having the same
+// flags with their parent, repeatedly, so that the PrefixSet holds as few
+// Prefixes as possible. IPv4 and IPv6 Prefixes are never merged together.
+func WithMergedSiblings() SnapshotOption {
+	return func(c *snapshotConfig) { c.compact, c.mergeSiblings = true, true }
+}
+
+// PrefixSet returns an immutable PrefixSet representing the current state of s,
+// configured by opts.
 //
 // The builder remains usable after calling PrefixSet.
-func (s *PrefixSetBuilder) PrefixSet() *PrefixSet {
-	return &PrefixSet{*s.tree.copy()}
+func (s *PrefixSetBuilder) PrefixSet(opts ...SnapshotOption) *PrefixSet {
+	var cfg snapshotConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if !cfg.compact {
+		return &PrefixSet{tree: *s.tree.copy().canonicalize(true)}
+	}
+	var merge func(l, r uint8) (uint8, bool)
+	if cfg.mergeSiblings {
+		merge = func(l, r uint8) (uint8, bool) { return l, l == r }
+	}
+	// compacted builds a new tree, but its nodes are not slab-allocated, so
+	// copy it for the same layout as an uncompacted PrefixSet.
+	return &PrefixSet{tree: *s.tree.compacted(merge).copy()}
+}
+
+// Canonicalize removes the nodes left in the tree underlying s by its history
+// (e.g. by Remove) that neither hold a Prefix nor join others, so that the
+// tree's shape depends only on the Prefixes in s. The PrefixSets returned by
+// PrefixSet are always in this canonical form, so two builders with the same
+// Prefixes and flags produce PrefixSets with identical structure, whatever
+// their histories. Canonicalize does the same for s itself, e.g. before
+// comparing the output of String.
+func (s *PrefixSetBuilder) Canonicalize() {
+	s.tree.canonicalize(true)
+}
+
+// PrefixSetWithReport is like PrefixSet, but also returns a BuildReport
+// describing the inputs s has received and the resulting PrefixSet.
+func (s *PrefixSetBuilder) PrefixSetWithReport() (*PrefixSet, BuildReport) {
+	return s.PrefixSet(), newBuildReport(&s.stats, &s.tree)
 }
 
 func (s *PrefixSetBuilder) String() string {
 	return s.tree.stringHelper("", "", true)
 }
 
+// PrefixSet is a set of netip.Prefixes.
+//
+// A PrefixSet is immutable: no method modifies it, and the PrefixSets derived
+// from it (e.g. by PrefixSet.DescendantsOf or PrefixSet.AncestorsOf) either
+// copy its storage or share storage that is never modified either. The same
+// holds for the PrefixSets that PrefixMap.KeySet derives from a PrefixMap. A
+// PrefixSet is therefore safe for concurrent use by multiple goroutines
+// without synchronization.
+//
+// Use PrefixSetBuilder to construct PrefixSets.
 type PrefixSet struct {
-	tree tree[bool]
+	tree tree[uint8]
+	size sizeCache
+	rank rankCache[uint8]
 }
 
 func (s *PrefixSet) Contains(p netip.Prefix) bool {
 	return s.tree.contains(keyFromPrefix(p))
 }
 
+// EncompassesSet returns true if every Prefix in o is encompassed by some
+// Prefix in s. An empty o is encompassed by any PrefixSet.
+func (s *PrefixSet) EncompassesSet(o *PrefixSet) bool {
+	ret := true
+	o.tree.walk(key{}, func(n *tree[uint8]) bool {
+		if !ret {
+			return true
+		}
+		if n.hasValue {
+			ret = s.tree.encompasses(n.key.rooted(), false)
+			// The descendants of n are encompassed by whatever encompasses n.
+			return true
+		}
+		return false
+	})
+	return ret
+}
+
+// EncompassesRange returns true if every address from first to last,
+// inclusive, is covered by some Prefix in s. Unlike Encompasses, the range
+// may be covered by several Prefixes together. first and last must be of the
+// same family, with first <= last; otherwise EncompassesRange returns false.
+func (s *PrefixSet) EncompassesRange(first, last netip.Addr) bool {
+	ret := true
+	err := rangeKeys(first, last, func(k key) {
+		ret = ret && s.tree.covers(k)
+	})
+	return err == nil && ret
+}
+
+// ContainsAll returns true if s includes each of the exact Prefixes provided.
+func (s *PrefixSet) ContainsAll(ps []netip.Prefix) bool {
+	return containsAll(&s.tree, ps)
+}
+
+// MissingFrom returns the Prefixes in ps that s does not include, in the order
+// provided, or nil if s includes all of them. This is useful for verifying
+// that an expected list of Prefixes is present.
+func (s *PrefixSet) MissingFrom(ps []netip.Prefix) []netip.Prefix {
+	return missingFrom(&s.tree, ps)
+}
+
+// containsAll returns true if t includes the keys of all of the Prefixes in
+// ps, which must be valid.
+func containsAll[T any](t *tree[T], ps []netip.Prefix) bool {
+	for _, p := range ps {
+		if !p.IsValid() {
+			return false
+		}
+		if _, ok := t.get(keyFromPrefix(p)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// missingFrom returns the Prefixes in ps, in order, whose keys t does not
+// include. Invalid Prefixes are always returned.
+func missingFrom[T any](t *tree[T], ps []netip.Prefix) (ret []netip.Prefix) {
+	for _, p := range ps {
+		if !p.IsValid() {
+			ret = append(ret, p)
+		} else if _, ok := t.get(keyFromPrefix(p)); !ok {
+			ret = append(ret, p)
+		}
+	}
+	return
+}
+
+// Flags returns the flags of the exact Prefix provided, if it is in s.
+func (s *PrefixSet) Flags(p netip.Prefix) (uint8, bool) {
+	return s.tree.get(keyFromPrefix(p))
+}
+
+// ContainsWithFlags returns true if s includes the exact Prefix provided and
+// all of the provided flags are set on it.
+func (s *PrefixSet) ContainsWithFlags(p netip.Prefix, flags uint8) bool {
+	f, ok := s.tree.get(keyFromPrefix(p))
+	return ok && f&flags == flags
+}
+
 func (s *PrefixSet) Encompasses(p netip.Prefix) bool {
 	return s.tree.encompasses(keyFromPrefix(p), false)
 }
 
+// EncompassesAllIn returns whether s encompasses each of ps, as Encompasses
+// would, e.g. for validating many candidate Prefixes within one customer's
+// aggregate. The search for the part of s within window is done once, and
+// each of ps within window is looked up from there, rather than from the
+// root. Prefixes in ps that are not within window are looked up as by
+// Encompasses.
+func (s *PrefixSet) EncompassesAllIn(window netip.Prefix, ps []netip.Prefix) []bool {
+	return encompassesAllIn(&s.tree, window, ps)
+}
+
+// encompassesAllIn implements EncompassesAllIn for t.
+func encompassesAllIn[T any](t *tree[T], window netip.Prefix, ps []netip.Prefix) []bool {
+	ret := make([]bool, len(ps))
+	w := keyFromPrefix(window)
+	var sub *tree[T]
+	covered := false
+	if window.IsValid() {
+		sub, covered = t.window(w)
+	}
+	for i, p := range ps {
+		k := keyFromPrefix(p)
+		switch {
+		case !p.IsValid():
+		case !window.IsValid() || !w.isPrefixOf(k):
+			ret[i] = t.encompasses(k, false)
+		case covered:
+			ret[i] = true
+		case sub != nil:
+			ret[i] = sub.encompasses(k, false)
+		}
+	}
+	return ret
+}
+
+// EncompassesFromBytes is like Encompasses, but accepts the Prefix as address
+// bytes and a length. addr must be 4 bytes (IPv4) or 16 bytes (IPv6) long;
+// otherwise EncompassesFromBytes returns false.
+func (s *PrefixSet) EncompassesFromBytes(addr []byte, bits int) bool {
+	k, ok := keyFromBytes(addr, bits)
+	return ok && s.tree.encompasses(k, false)
+}
+
+// ContainsAddr returns true if the set includes a Prefix which contains addr.
+// It is equivalent to Encompasses with the single-address Prefix of addr, but
+// does not construct that Prefix and does not allocate. If addr is not valid,
+// ContainsAddr returns false.
+func (s *PrefixSet) ContainsAddr(addr netip.Addr) bool {
+	return addr.IsValid() && s.tree.longestMatch(keyFromAddr(addr)) != nil
+}
+
+// ContainsAddrs is like ContainsAddr, but checks each address in addrs,
+// returning one result per address in the same order. It looks up the
+// addresses in sorted order, so that the path shared by nearby addresses is
+// traversed once, which suits large batches of addresses.
+func (s *PrefixSet) ContainsAddrs(addrs []netip.Addr) []bool {
+	ret := make([]bool, len(addrs))
+	s.tree.addrMatches(addrs, func(i int, _ *tree[uint8]) {
+		ret[i] = true
+	})
+	return ret
+}
+
+// ParentOfAddr returns the longest Prefix in s that contains addr, e.g. to
+// report which rule of an allow-list matched. Like ContainsAddr, it does not
+// allocate. If no Prefix contains addr, or addr is not valid, ParentOfAddr
+// returns the zero Prefix and false.
+func (s *PrefixSet) ParentOfAddr(addr netip.Addr) (netip.Prefix, bool) {
+	if !addr.IsValid() {
+		return netip.Prefix{}, false
+	}
+	n := s.tree.longestMatch(keyFromAddr(addr))
+	if n == nil {
+		return netip.Prefix{}, false
+	}
+	return prefixFromKey(n.key), true
+}
+
+// EncompassingEntries returns a map from each of the provided Prefixes to the
+// longest Prefix in s that encompasses it (possibly itself). Prefixes that
+// are not encompassed by any Prefix in s, or are not valid, are omitted.
+//
+// The queries are resolved in a single pass in sorted order, so the part of
+// the tree shared by neighboring queries is only traversed once. This is
+// faster than calling Encompasses for each query when there are many of
+// them.
+func (s *PrefixSet) EncompassingEntries(queries []netip.Prefix) map[netip.Prefix]netip.Prefix {
+	type query struct {
+		p netip.Prefix
+		k key
+	}
+	qs := make([]query, 0, len(queries))
+	for _, p := range queries {
+		if p.IsValid() {
+			qs = append(qs, query{p, keyFromPrefix(p)})
+		}
+	}
+	slices.SortFunc(qs, func(a, b query) int {
+		switch {
+		case a.k.content.less(b.k.content):
+			return -1
+		case b.k.content.less(a.k.content):
+			return 1
+		}
+		return cmp.Compare(a.k.len, b.k.len)
+	})
+	ret := make(map[netip.Prefix]netip.Prefix)
+	s.tree.longestMatches(len(qs), func(i int) key { return qs[i].k }, func(i int, n *tree[uint8]) {
+		ret[qs[i].p] = prefixFromKey(n.key)
+	})
+	return ret
+}
+
 func (s *PrefixSet) EncompassesStrict(p netip.Prefix) bool {
 	return s.tree.encompasses(keyFromPrefix(p), true)
 }
 
+// Size returns the number of Prefixes in s. It is computed by traversing s on
+// the first call, and cached.
+func (s *PrefixSet) Size() int {
+	return s.size.get(s.tree.size)
+}
+
+// Prefixes returns the Prefixes in s in ascending order, as defined by
+// netip.Prefix.Compare: IPv4 Prefixes before IPv6 Prefixes, then by address,
+// then shorter Prefixes before longer ones. The exception is the IPv6
+// Prefixes that encompass ::ffff:0:0/96, such as ::/0, and so every IPv4
+// Prefix: these come first, shorter before longer, so that each Prefix comes
+// before its descendants. All, WalkPrune and the other methods that visit
+// Prefixes in order use the same order, as do the equivalent methods of
+// PrefixMap. This order is guaranteed, and does not depend on the order in
+// which the Prefixes were added; see AllSorted for other orders.
 func (s *PrefixSet) Prefixes() []netip.Prefix {
-	res := make([]netip.Prefix, s.tree.size())
+	res := make([]netip.Prefix, s.Size())
 	i := 0
-	s.tree.walk(key{}, func(n *tree[bool]) bool {
+	s.tree.walk(key{}, func(n *tree[uint8]) bool {
 		if n.hasValue {
 			res[i] = prefixFromKey(n.key)
 			i++
@@ -85,8 +687,291 @@ func (s *PrefixSet) Prefixes() []netip.Prefix {
 	return res
 }
 
+// ExportRaw4 returns the IPv4 Prefixes in s as parallel slices of addresses
+// (as big-endian integers, e.g. 0x0a000000 for 10.0.0.0) and lengths, in the
+// same order as Prefixes. This is intended for handing a PrefixSet to code
+// outside Go, e.g. via cgo, without converting each Prefix individually.
+func (s *PrefixSet) ExportRaw4() (addrs []uint32, lens []uint8) {
+	v4 := s.tree.v4Root()
+	if v4 == nil {
+		return nil, nil
+	}
+	v4.preorder(func(n *tree[uint8]) bool {
+		if n.hasValue {
+			addrs = append(addrs, uint32(n.key.content.lo))
+			lens = append(lens, n.key.len-96)
+		}
+		return false
+	})
+	return
+}
+
+// ExportRaw6 is like ExportRaw4, but returns the IPv6 Prefixes in s, with the
+// high and low 64 bits of each address in hi and lo respectively.
+func (s *PrefixSet) ExportRaw6() (hi, lo []uint64, lens []uint8) {
+	s.tree.walk(key{}, func(n *tree[uint8]) bool {
+		if n.hasValue && !n.key.is4() {
+			hi = append(hi, n.key.content.hi)
+			lo = append(lo, n.key.content.lo)
+			lens = append(lens, n.key.len)
+		}
+		return false
+	})
+	return
+}
+
+// All returns an iterator over the Prefixes in s, in the same order as
+// Prefixes, or as modified by opts, e.g. PostOrder.
+func (s *PrefixSet) All(opts ...TraversalOption) iter.Seq[netip.Prefix] {
+	return s.all(AnyFamily, opts)
+}
+
+// All4 is like All, but yields only the IPv4 Prefixes in s.
+func (s *PrefixSet) All4(opts ...TraversalOption) iter.Seq[netip.Prefix] {
+	return s.all(IPv4, opts)
+}
+
+// All6 is like All, but yields only the IPv6 Prefixes in s.
+func (s *PrefixSet) All6(opts ...TraversalOption) iter.Seq[netip.Prefix] {
+	return s.all(IPv6, opts)
+}
+
+func (s *PrefixSet) all(f Family, opts []TraversalOption) iter.Seq[netip.Prefix] {
+	post := newTraversalConfig(opts).postOrder
+	return func(yield func(netip.Prefix) bool) {
+		s.tree.entries(f, post, func(n *tree[uint8]) bool {
+			return yield(prefixFromKey(n.key))
+		})
+	}
+}
+
+// AllSorted returns an iterator over the Prefixes in s in the order defined by
+// cmp, e.g. from the longest Prefix to the shortest with
+//
+//	func(a, b netip.Prefix) int { return cmp.Compare(b.Bits(), a.Bits()) }
+//
+// Prefixes that cmp considers equal are yielded in the same order as by
+// Prefixes, so the order is deterministic whenever cmp is. AllSorted sorts a
+// copy of the Prefixes in s before yielding the first.
+func (s *PrefixSet) AllSorted(cmp func(a, b netip.Prefix) int) iter.Seq[netip.Prefix] {
+	return func(yield func(netip.Prefix) bool) {
+		ps := slices.Collect(s.All())
+		slices.SortStableFunc(ps, cmp)
+		for _, p := range ps {
+			if !yield(p) {
+				return
+			}
+		}
+	}
+}
+
+// WalkPrune calls fn for each Prefix in s, in the same order as Prefixes, or
+// as modified by opts. The WalkAction returned by fn determines whether the
+// traversal continues into the Prefix's descendants, skips them, or stops
+// entirely.
+func (s *PrefixSet) WalkPrune(fn func(netip.Prefix) WalkAction, opts ...TraversalOption) {
+	walkPrune(&s.tree, newTraversalConfig(opts).postOrder, func(n *tree[uint8]) WalkAction {
+		return fn(prefixFromKey(n.key))
+	})
+}
+
+// Walk calls fn for each Prefix in s that encompasses p or is encompassed by
+// it. See PrefixMap.Walk.
+func (s *PrefixSet) Walk(p netip.Prefix, fn func(netip.Prefix) bool) {
+	if !p.IsValid() {
+		return
+	}
+	walkPath(&s.tree, keyFromPrefix(p), func(n *tree[uint8]) bool {
+		return fn(prefixFromKey(n.key))
+	})
+}
+
+// WalkWithYield calls fn for each Prefix in s, in the same order as Prefixes,
+// until fn returns false. Additionally, pause is called after every `every`
+// tree nodes visited (including nodes that do not hold a Prefix), giving
+// long traversals a chance to cooperatively yield to other work.
+func (s *PrefixSet) WalkWithYield(fn func(netip.Prefix) bool, every int, pause func()) {
+	if every <= 0 {
+		panic("netipds: WalkWithYield requires a positive interval")
+	}
+	visited, stop := 0, false
+	s.tree.walk(key{}, func(n *tree[uint8]) bool {
+		if stop {
+			return true
+		}
+		if n.hasValue {
+			stop = !fn(prefixFromKey(n.key))
+		}
+		if visited++; visited%every == 0 && !stop {
+			pause()
+		}
+		return stop
+	})
+}
+
+// PrefixesCompact returns the Prefixes in s that are not encompassed by any
+// other Prefix in s, in the same order as Prefixes.
+func (s *PrefixSet) PrefixesCompact() []netip.Prefix {
+	res := make([]netip.Prefix, 0)
+	s.tree.walk(key{}, func(n *tree[uint8]) bool {
+		if n.hasValue {
+			res = append(res, prefixFromKey(n.key))
+			// Skip the descendants of n; they're all encompassed by it.
+			return true
+		}
+		return false
+	})
+	return res
+}
+
+// AllCompact returns an iterator over the Prefixes returned by
+// PrefixesCompact, without building that list.
+func (s *PrefixSet) AllCompact() iter.Seq[netip.Prefix] {
+	return func(yield func(netip.Prefix) bool) {
+		s.tree.roots(func(n *tree[uint8]) bool {
+			return yield(prefixFromKey(n.key))
+		})
+	}
+}
+
+// AddressCounts returns an iterator over the Prefixes in s, each paired with
+// the number of addresses it covers that are not also covered by a
+// more-specific Prefix in s.
+func (s *PrefixSet) AddressCounts() iter.Seq2[netip.Prefix, *big.Int] {
+	return func(yield func(netip.Prefix, *big.Int) bool) {
+		s.tree.addressCounts(func(n *tree[uint8], c *big.Int) bool {
+			return yield(prefixFromKey(n.key), c)
+		})
+	}
+}
+
+// Nearest returns the Prefix in s that shares the most leading bits with
+// addr, even if it does not encompass addr. See PrefixMap.Nearest.
+func (s *PrefixSet) Nearest(addr netip.Addr) (netip.Prefix, bool) {
+	if !addr.IsValid() {
+		return netip.Prefix{}, false
+	}
+	n := s.tree.nearest(keyFromPrefix(netip.PrefixFrom(addr, addr.BitLen())))
+	if n == nil {
+		return netip.Prefix{}, false
+	}
+	return prefixFromKey(n.key), true
+}
+
+// AggregationCandidates returns an iterator over the Prefixes not in s whose
+// halves are both completely covered by Prefixes in s, i.e. the Prefixes that
+// could replace some of the Prefixes in s without changing the addresses s
+// covers. Prefixes encompassed by a Prefix in s are not included.
+//
+// Candidates are yielded in the same order as Prefixes, so a candidate is
+// yielded before any candidates it encompasses.
+func (s *PrefixSet) AggregationCandidates() iter.Seq[netip.Prefix] {
+	return func(yield func(netip.Prefix) bool) {
+		stop := false
+		s.tree.aggregationCandidates().walk(key{}, func(n *tree[bool]) bool {
+			if n.hasValue && !stop {
+				stop = !yield(prefixFromKey(n.key))
+			}
+			return stop
+		})
+	}
+}
+
+// Distribution returns the number of Prefixes in s within each Prefix of
+// length level that contains at least one of them, e.g. the number of
+// Prefixes per /8 when level is 8. level applies to IPv4 and IPv6 Prefixes
+// alike. Prefixes shorter than level are counted under themselves.
+func (s *PrefixSet) Distribution(level int) map[netip.Prefix]int {
+	ret := make(map[netip.Prefix]int)
+	for k, n := range s.tree.distribution(level) {
+		ret[prefixFromKey(k)] = n
+	}
+	return ret
+}
+
+// Querier returns a PrefixQuerier that queries s according to the provided
+// options, without copying s.
+//
+// The query methods of s itself are equivalent to those of
+// s.Querier(TreatV4MappedAsV4()).
+func (s *PrefixSet) Querier(opts ...QueryOption) PrefixQuerier {
+	return newOptionQuerier(&s.tree, opts)
+}
+
+// HierarchyEdges returns an iterator over each pair of Prefixes in s such
+// that parent is the longest Prefix in s that strictly encompasses child, in
+// the order of their children in Prefixes.
+func (s *PrefixSet) HierarchyEdges() iter.Seq2[netip.Prefix, netip.Prefix] {
+	return func(yield func(netip.Prefix, netip.Prefix) bool) {
+		s.tree.hierarchyEdges(nil, func(parent, child *tree[uint8]) bool {
+			return yield(prefixFromKey(parent.key), prefixFromKey(child.key))
+		})
+	}
+}
+
+// Nodes returns an iterator over the nodes of the tree in which s is stored,
+// each as its Prefix and whether it holds a Prefix of s. Besides the nodes
+// holding Prefixes, the tree contains structural nodes where the paths to
+// Prefixes diverge, for which entry is false; comparing the two shows how
+// well the tree's path compression suits a dataset. Nodes are yielded in the
+// same order as Prefixes.
+//
+// Nodes is intended for analysis and debugging; the shape of the tree is an
+// implementation detail, and may change between versions of this package.
+func (s *PrefixSet) Nodes() iter.Seq2[netip.Prefix, bool] {
+	return func(yield func(p netip.Prefix, entry bool) bool) {
+		s.tree.nodes(func(n *tree[uint8]) bool {
+			return yield(prefixFromKey(n.key), n.hasValue)
+		})
+	}
+}
+
+// OverlapsSet returns true if any Prefix in s overlaps any Prefix in o. It
+// walks both sets together and stops at the first overlap, so it is much
+// cheaper than computing their intersection.
+func (s *PrefixSet) OverlapsSet(o *PrefixSet) bool {
+	return overlapsTree(&s.tree, &o.tree)
+}
+
 func (s *PrefixSet) OverlapsPrefix(p netip.Prefix) bool {
-	return s.tree.overlapsKey(keyFromPrefix(p))
+	return p.IsValid() && s.tree.overlapsKey(keyFromPrefix(p))
+}
+
+// Gaps returns an iterator over the Prefixes not covered by s: the minimal
+// list of Prefixes that, together with those in s, covers every address. The
+// gaps in IPv4 are yielded first, followed by those in IPv6, each in
+// ascending order. IPv6 gaps exclude the IPv4-mapped range ::ffff:0:0/96,
+// which is covered by the IPv4 gaps.
+//
+// The gaps are computed lazily as the iterator advances, so they can be
+// streamed without building the complement of s.
+func (s *PrefixSet) Gaps() iter.Seq[netip.Prefix] {
+	return func(yield func(netip.Prefix) bool) {
+		stop := false
+		s.gaps(keyFromPrefix(netip.PrefixFrom(netip.IPv4Unspecified(), 0)), func(p netip.Prefix) bool {
+			stop = !yield(p)
+			return !stop
+		})
+		if !stop {
+			s.gaps(key{}, yield)
+		}
+	}
+}
+
+// GapsWithin is like Gaps, but only yields the gaps within p. If p is not
+// valid, GapsWithin yields nothing.
+func (s *PrefixSet) GapsWithin(p netip.Prefix) iter.Seq[netip.Prefix] {
+	return func(yield func(netip.Prefix) bool) {
+		if p.IsValid() {
+			s.gaps(keyFromPrefix(p), yield)
+		}
+	}
+}
+
+func (s *PrefixSet) gaps(k key, yield func(netip.Prefix) bool) {
+	s.tree.gaps(k, func(k key) bool {
+		return yield(prefixFromKey(k))
+	})
 }
 
 // SubtractFromPrefix returns a new PrefixSet that is the result of removing
@@ -94,13 +979,74 @@ func (s *PrefixSet) OverlapsPrefix(p netip.Prefix) bool {
 func (s *PrefixSet) SubtractFromPrefix(p netip.Prefix) *PrefixSet {
 	ret := &PrefixSetBuilder{}
 	ret.Add(p)
-	s.tree.walk(keyFromPrefix(p), func(n *tree[bool]) bool {
+	s.tree.walk(keyFromPrefix(p), func(n *tree[uint8]) bool {
 		ret.Subtract(prefixFromKey(n.key))
 		return false
 	})
 	return ret.PrefixSet()
 }
 
+// DescendantsOf returns a PrefixSet containing the Prefixes in s that p
+// encompasses, including p itself if it is in s, unless Strict is among
+// opts. See also MaxLen.
+func (s *PrefixSet) DescendantsOf(p netip.Prefix, opts ...QueryOption) *PrefixSet {
+	if !p.IsValid() {
+		return &PrefixSet{}
+	}
+	return &PrefixSet{tree: *queryDescendants(&s.tree, p, newQueryConfig(opts))}
+}
+
+// AllDescendantsOf returns an iterator over the same Prefixes as
+// DescendantsOf, in the same order as Prefixes, without building a new
+// PrefixSet.
+func (s *PrefixSet) AllDescendantsOf(p netip.Prefix) iter.Seq[netip.Prefix] {
+	return func(yield func(netip.Prefix) bool) {
+		if !p.IsValid() {
+			return
+		}
+		s.tree.descendants(keyFromPrefix(p), func(n *tree[uint8]) bool {
+			return yield(prefixFromKey(n.key))
+		})
+	}
+}
+
+// ChildrenOf returns a PrefixSet containing the Prefixes in s that p strictly
+// encompasses and that are not encompassed by another such Prefix, i.e. the
+// Prefixes directly beneath p in the hierarchy. p need not be in s.
+func (s *PrefixSet) ChildrenOf(p netip.Prefix) *PrefixSet {
+	if !p.IsValid() {
+		return &PrefixSet{}
+	}
+	return &PrefixSet{tree: *s.tree.childrenOf(keyFromPrefix(p))}
+}
+
+// AncestorsOf returns a PrefixSet containing the Prefixes in s that encompass
+// p, including p itself if it is in s, unless Strict is among opts. See also
+// MaxLen.
+func (s *PrefixSet) AncestorsOf(p netip.Prefix, opts ...QueryOption) *PrefixSet {
+	return &PrefixSet{tree: *queryAncestors(&s.tree, p, newQueryConfig(opts))}
+}
+
+// AllAncestorsOf returns an iterator over the same Prefixes as AncestorsOf,
+// from the shortest to the longest, without building a new PrefixSet.
+func (s *PrefixSet) AllAncestorsOf(p netip.Prefix) iter.Seq[netip.Prefix] {
+	return func(yield func(netip.Prefix) bool) {
+		if !p.IsValid() {
+			return
+		}
+		s.tree.ancestors(keyFromPrefix(p), func(n *tree[uint8]) bool {
+			return yield(prefixFromKey(n.key))
+		})
+	}
+}
+
+// IntersectAnnotated returns the intersection of s and o (see
+// PrefixSetBuilder.Intersect) as a map from each resulting Prefix to the
+// operand(s) that contributed it.
+func (s *PrefixSet) IntersectAnnotated(o *PrefixSet) *PrefixMap[IntersectOrigin] {
+	return &PrefixMap[IntersectOrigin]{tree: *intersectOrigins(&s.tree, &o.tree)}
+}
+
 // PrettyPrint prints the PrefixSet in a human-readable format.
 func (s *PrefixSet) String() string {
 	return s.tree.stringHelper("", "", true)
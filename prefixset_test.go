@@ -1,7 +1,11 @@
 package netipds
 
 import (
+	"cmp"
+	"errors"
+	"iter"
 	"net/netip"
+	"slices"
 	"testing"
 )
 
@@ -31,6 +35,257 @@ func TestPrefixSetAddContains(t *testing.T) {
 	}
 }
 
+func TestPrefixSetEncompassesSet(t *testing.T) {
+	tests := []struct {
+		s, o []netip.Prefix
+		want bool
+	}{
+		{pfxs(), pfxs(), true},
+		{pfxs("10.0.0.0/8"), pfxs(), true},
+		{pfxs(), pfxs("10.0.0.0/8"), false},
+		{pfxs("10.0.0.0/8"), pfxs("10.0.0.0/8"), true},
+		{pfxs("10.0.0.0/8"), pfxs("10.1.0.0/16", "10.2.3.0/24", "10.2.0.0/16"), true},
+		{pfxs("10.0.0.0/8"), pfxs("10.1.0.0/16", "11.0.0.0/16"), false},
+		// o is covered by s, but not encompassed by any single Prefix in s
+		{pfxs("10.0.0.0/9", "10.128.0.0/9"), pfxs("10.0.0.0/8"), false},
+		{pfxs("10.0.0.0/8", "2001:db8::/32"), pfxs("10.1.0.0/16", "2001:db8:1::/48"), true},
+		{pfxs("10.0.0.0/8", "2001:db8::/32"), pfxs("10.1.0.0/16", "2001:db9::/48"), false},
+	}
+	for _, tt := range tests {
+		sb, ob := &PrefixSetBuilder{}, &PrefixSetBuilder{}
+		for _, p := range tt.s {
+			sb.Add(p)
+		}
+		for _, p := range tt.o {
+			ob.Add(p)
+		}
+		if got := sb.PrefixSet().EncompassesSet(ob.PrefixSet()); got != tt.want {
+			t.Errorf("%v.EncompassesSet(%v) = %v, want %v", tt.s, tt.o, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixSetOverlapsSet(t *testing.T) {
+	tests := []struct {
+		s, o []netip.Prefix
+		want bool
+	}{
+		{pfxs(), pfxs(), false},
+		{pfxs("10.0.0.0/8"), pfxs(), false},
+		{pfxs("10.0.0.0/8"), pfxs("10.0.0.0/8"), true},
+		{pfxs("10.0.0.0/8"), pfxs("10.1.2.0/24"), true},
+		{pfxs("10.1.2.0/24"), pfxs("10.0.0.0/8"), true},
+		{pfxs("10.0.0.0/8"), pfxs("11.0.0.0/8"), false},
+		// Sharing structure, but no entries in common
+		{pfxs("10.1.0.0/16", "10.2.0.0/16"), pfxs("10.3.0.0/16", "10.0.0.0/16"), false},
+		{pfxs("10.1.0.0/16", "10.2.0.0/16"), pfxs("10.3.0.0/16", "10.2.3.0/24"), true},
+		{pfxs("::0/128", "::2/128"), pfxs("::1/128", "::3/128"), false},
+		{pfxs("::0/128", "::2/128"), pfxs("::1/128", "::2/127"), true},
+		{pfxs("10.0.0.0/8", "2001:db8::/32"), pfxs("2001:db8:1::/48"), true},
+		{pfxs("10.0.0.0/8", "2001:db8::/32"), pfxs("2001:db9::/48", "11.0.0.0/8"), false},
+	}
+	for _, tt := range tests {
+		sb, ob := &PrefixSetBuilder{}, &PrefixSetBuilder{}
+		for _, p := range tt.s {
+			sb.Add(p)
+		}
+		for _, p := range tt.o {
+			ob.Add(p)
+		}
+		s, o := sb.PrefixSet(), ob.PrefixSet()
+		if got := s.OverlapsSet(o); got != tt.want {
+			t.Errorf("%v.OverlapsSet(%v) = %v, want %v", tt.s, tt.o, got, tt.want)
+		}
+		if got := o.OverlapsSet(s); got != tt.want {
+			t.Errorf("%v.OverlapsSet(%v) = %v, want %v", tt.o, tt.s, got, tt.want)
+		}
+		// OverlapsSet agrees with an intersection being non-empty.
+		sb.Intersect(o)
+		if got := sb.PrefixSet().Size() > 0; got != tt.want {
+			t.Errorf("intersection of %v and %v non-empty = %v, want %v", tt.s, tt.o, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixSetExportRaw(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	for _, p := range pfxs("2001:db8::/32", "10.0.0.0/8", "::1/128", "192.168.1.0/24", "10.1.0.0/16", "0.0.0.0/0") {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+
+	addrs, lens := ps.ExportRaw4()
+	if want := []uint32{0, 0x0a000000, 0x0a010000, 0xc0a80100}; !slices.Equal(addrs, want) {
+		t.Errorf("ExportRaw4() addrs = %#x, want %#x", addrs, want)
+	}
+	if want := []uint8{0, 8, 16, 24}; !slices.Equal(lens, want) {
+		t.Errorf("ExportRaw4() lens = %v, want %v", lens, want)
+	}
+
+	hi, lo, lens := ps.ExportRaw6()
+	if want := []uint64{0, 0x20010db800000000}; !slices.Equal(hi, want) {
+		t.Errorf("ExportRaw6() hi = %#x, want %#x", hi, want)
+	}
+	if want := []uint64{1, 0}; !slices.Equal(lo, want) {
+		t.Errorf("ExportRaw6() lo = %#x, want %#x", lo, want)
+	}
+	if want := []uint8{128, 32}; !slices.Equal(lens, want) {
+		t.Errorf("ExportRaw6() lens = %v, want %v", lens, want)
+	}
+
+	empty := &PrefixSet{}
+	if addrs, lens := empty.ExportRaw4(); addrs != nil || lens != nil {
+		t.Errorf("ExportRaw4() of empty set = (%v, %v), want nil", addrs, lens)
+	}
+}
+
+func TestPrefixSetEncompassesRange(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	for _, p := range pfxs("10.0.0.0/8", "11.0.0.0/9", "11.128.0.0/9", "12.0.0.0/24", "12.0.2.0/24", "2001:db8::/32") {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+	addr := netip.MustParseAddr
+	tests := []struct {
+		first, last netip.Addr
+		want        bool
+	}{
+		{addr("10.1.2.3"), addr("10.1.2.3"), true},
+		{addr("10.0.0.0"), addr("10.255.255.255"), true},
+		// Covered by several Prefixes together
+		{addr("10.255.0.0"), addr("11.255.255.255"), true},
+		{addr("11.0.0.0"), addr("11.255.255.255"), true},
+		{addr("10.0.0.0"), addr("12.0.0.255"), true},
+		{addr("10.0.0.0"), addr("12.0.1.0"), false},
+		{addr("12.0.0.0"), addr("12.0.2.255"), false},
+		{addr("9.255.255.255"), addr("10.0.0.0"), false},
+		{addr("2001:db8::1"), addr("2001:db8:ffff::"), true},
+		{addr("2001:db8::1"), addr("2001:db9::"), false},
+		{addr("::"), addr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), false},
+		// Invalid ranges
+		{addr("10.0.0.2"), addr("10.0.0.1"), false},
+		{addr("10.0.0.1"), addr("2001:db8::1"), false},
+		{netip.Addr{}, addr("10.0.0.1"), false},
+	}
+	for _, tt := range tests {
+		if got := ps.EncompassesRange(tt.first, tt.last); got != tt.want {
+			t.Errorf("ps.EncompassesRange(%v, %v) = %v, want %v", tt.first, tt.last, got, tt.want)
+		}
+	}
+
+	// The zero key's halves are checked separately.
+	psb = &PrefixSetBuilder{}
+	psb.Add(pfx("::/1"))
+	psb.Add(pfx("8000::/1"))
+	if !psb.PrefixSet().EncompassesRange(addr("::"), addr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")) {
+		t.Errorf("EncompassesRange of all IPv6 addresses = false, want true")
+	}
+}
+
+func TestPrefixSetGaps(t *testing.T) {
+	tests := []struct {
+		set    []netip.Prefix
+		within netip.Prefix
+		want   []netip.Prefix
+	}{
+		{pfxs(), pfx("10.0.0.0/8"), pfxs("10.0.0.0/8")},
+		{pfxs("10.0.0.0/8"), pfx("10.0.0.0/8"), pfxs()},
+		{pfxs("0.0.0.0/0"), pfx("10.0.0.0/8"), pfxs()},
+		{pfxs("10.0.0.0/9"), pfx("10.0.0.0/8"), pfxs("10.128.0.0/9")},
+		{
+			pfxs("10.0.0.0/10", "10.128.0.0/24", "10.128.1.0/24", "11.0.0.0/8"),
+			pfx("10.0.0.0/8"),
+			pfxs("10.64.0.0/10", "10.128.2.0/23", "10.128.4.0/22", "10.128.8.0/21",
+				"10.128.16.0/20", "10.128.32.0/19", "10.128.64.0/18", "10.128.128.0/17",
+				"10.129.0.0/16", "10.130.0.0/15", "10.132.0.0/14", "10.136.0.0/13",
+				"10.144.0.0/12", "10.160.0.0/11", "10.192.0.0/10"),
+		},
+		{pfxs("2001:db8::/33"), pfx("2001:db8::/32"), pfxs("2001:db8:8000::/33")},
+		// IPv6 gaps exclude the IPv4-mapped range
+		{pfxs("::/1"), pfx("::/0"), pfxs("8000::/1")},
+		{pfxs("::/2"), pfx("::/1"), pfxs("4000::/2")},
+		{pfxs("::/1"), pfx("0.0.0.0/0"), pfxs()},
+	}
+	for _, tt := range tests {
+		psb := &PrefixSetBuilder{}
+		for _, p := range tt.set {
+			psb.Add(p)
+		}
+		var got []netip.Prefix
+		for p := range psb.PrefixSet().GapsWithin(tt.within) {
+			got = append(got, p)
+		}
+		checkPrefixSlice(t, got, tt.want)
+	}
+
+	// The gaps and the set together cover every address, without
+	// overlapping.
+	psb := &PrefixSetBuilder{}
+	for _, p := range pfxs("10.0.0.0/8", "192.168.1.0/24", "::/8", "2001:db8::/32", "::ffff:0:0/97") {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+	all := &PrefixSetBuilder{}
+	all.Merge(ps)
+	for p := range ps.Gaps() {
+		if ps.OverlapsPrefix(p) {
+			t.Errorf("gap %v overlaps %v", p, ps)
+		}
+		all.Add(p)
+	}
+	allSet := all.PrefixSet()
+	if !allSet.EncompassesRange(netip.IPv4Unspecified(), netip.MustParseAddr("255.255.255.255")) {
+		t.Errorf("gaps and set do not cover all IPv4 addresses")
+	}
+	if !allSet.EncompassesRange(netip.IPv6Unspecified(), netip.MustParseAddr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")) {
+		t.Errorf("gaps and set do not cover all IPv6 addresses")
+	}
+
+	// Stopping early
+	n := 0
+	for range ps.Gaps() {
+		if n++; n == 3 {
+			break
+		}
+	}
+	if n != 3 {
+		t.Errorf("Gaps yielded %d Prefixes, want at least 3", n)
+	}
+}
+
+func TestPrefixSetContainsAll(t *testing.T) {
+	set := pfxs("10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32")
+	tests := []struct {
+		ps          []netip.Prefix
+		wantMissing []netip.Prefix
+	}{
+		{pfxs(), nil},
+		{pfxs("10.0.0.0/8", "2001:db8::/32"), nil},
+		{pfxs("10.1.0.0/16", "10.1.2.0/24", "10.0.0.0/8", "11.0.0.0/8"), pfxs("10.1.2.0/24", "11.0.0.0/8")},
+		// Encompassed, but not present
+		{pfxs("2001:db8::/48"), pfxs("2001:db8::/48")},
+		{[]netip.Prefix{{}}, []netip.Prefix{{}}},
+	}
+	psb := &PrefixSetBuilder{}
+	pmb := &PrefixMapBuilder[bool]{}
+	for _, p := range set {
+		psb.Add(p)
+		pmb.Set(p, true)
+	}
+	ps, pm := psb.PrefixSet(), pmb.PrefixMap()
+	for _, tt := range tests {
+		wantAll := len(tt.wantMissing) == 0
+		if got := ps.ContainsAll(tt.ps); got != wantAll {
+			t.Errorf("ps.ContainsAll(%v) = %v, want %v", tt.ps, got, wantAll)
+		}
+		if got := pm.ContainsAll(tt.ps); got != wantAll {
+			t.Errorf("pm.ContainsAll(%v) = %v, want %v", tt.ps, got, wantAll)
+		}
+		checkPrefixSlice(t, ps.MissingFrom(tt.ps), tt.wantMissing)
+		checkPrefixSlice(t, pm.MissingFrom(tt.ps), tt.wantMissing)
+	}
+}
+
 func TestPrefixSetAddEncompasses(t *testing.T) {
 	tests := []struct {
 		set  []netip.Prefix
@@ -59,6 +314,222 @@ func TestPrefixSetAddEncompasses(t *testing.T) {
 	}
 }
 
+func TestPrefixSetContainsAddr(t *testing.T) {
+	tests := []struct {
+		set  []netip.Prefix
+		addr netip.Addr
+		want bool
+	}{
+		{pfxs(), netip.MustParseAddr("::0"), false},
+		{pfxs("::0/128"), netip.MustParseAddr("::0"), true},
+		{pfxs("::0/128"), netip.MustParseAddr("::1"), false},
+		{pfxs("::0/127"), netip.MustParseAddr("::1"), true},
+		{pfxs("1.2.3.0/24"), netip.MustParseAddr("1.2.3.4"), true},
+		{pfxs("1.2.3.0/24"), netip.MustParseAddr("1.2.4.0"), false},
+		{pfxs("1.2.3.0/24", "1.2.3.4/32"), netip.MustParseAddr("1.2.3.4"), true},
+		{pfxs("1.2.3.0/24"), netip.MustParseAddr("::ffff:1.2.3.4"), true},
+		{pfxs("::0/128"), netip.Addr{}, false},
+	}
+
+	for _, tt := range tests {
+		psb := &PrefixSetBuilder{}
+		for _, p := range tt.set {
+			psb.Add(p)
+		}
+		ps := psb.PrefixSet()
+		if got := ps.ContainsAddr(tt.addr); got != tt.want {
+			t.Errorf("ps.ContainsAddr(%v) = %v, want %v", tt.addr, got, tt.want)
+		}
+		if tt.addr.IsValid() {
+			if want := ps.Encompasses(netip.PrefixFrom(tt.addr, tt.addr.BitLen())); tt.want != want {
+				t.Errorf("ps.ContainsAddr(%v) = %v, but Encompasses returned %v", tt.addr, tt.want, want)
+			}
+		}
+	}
+}
+
+func TestPrefixSetParentOfAddr(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	for _, p := range pfxs("1.2.3.0/24", "1.2.3.4/31", "::0/127", "2001:db8::/32") {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+
+	tests := []struct {
+		addr netip.Addr
+		want netip.Prefix
+	}{
+		{netip.MustParseAddr("1.2.3.1"), pfx("1.2.3.0/24")},
+		{netip.MustParseAddr("1.2.3.5"), pfx("1.2.3.4/31")},
+		{netip.MustParseAddr("::ffff:1.2.3.4"), pfx("1.2.3.4/31")},
+		{netip.MustParseAddr("1.2.4.0"), netip.Prefix{}},
+		{netip.MustParseAddr("::1"), pfx("::0/127")},
+		{netip.MustParseAddr("2001:db8::1"), pfx("2001:db8::/32")},
+		{netip.MustParseAddr("2001:db9::1"), netip.Prefix{}},
+		{netip.Addr{}, netip.Prefix{}},
+	}
+	for _, tt := range tests {
+		got, ok := ps.ParentOfAddr(tt.addr)
+		if got != tt.want || ok != tt.want.IsValid() {
+			t.Errorf("ps.ParentOfAddr(%v) = %v, %v, want %v", tt.addr, got, ok, tt.want)
+		}
+	}
+
+	addr := netip.MustParseAddr("1.2.3.5")
+	if allocs := testing.AllocsPerRun(100, func() { ps.ParentOfAddr(addr) }); allocs != 0 {
+		t.Errorf("ParentOfAddr allocated %v times, want 0", allocs)
+	}
+}
+
+func TestPrefixSetAtIndexOf(t *testing.T) {
+	sets := [][]netip.Prefix{
+		pfxs(),
+		pfxs("10.0.0.0/8"),
+		pfxs("2001:db8::/32"),
+		pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.0.0/16", "11.0.0.0/8"),
+		// IPv6 ancestors of the IPv4 Prefixes are ordered before them.
+		pfxs("::/64", "::/1", "10.0.0.0/8", "0.0.0.0/1", "::1/128", "2001:db8::/32", "8000::/1"),
+		pfxs("::ffff:0:0/95", "0.0.0.0/0", "1.2.3.4/32", "::fffe:0:0/96"),
+	}
+	for _, set := range sets {
+		psb := &PrefixSetBuilder{}
+		for _, p := range set {
+			psb.Add(p)
+		}
+		ps := psb.PrefixSet()
+		prefixes := ps.Prefixes()
+		for i, want := range prefixes {
+			if got, ok := ps.At(i); got != want || !ok {
+				t.Errorf("%v.At(%d) = %v, %v, want %v", ps, i, got, ok, want)
+			}
+			if got, ok := ps.IndexOf(want); got != i || !ok {
+				t.Errorf("%v.IndexOf(%v) = %d, %v, want %d", ps, want, got, ok, i)
+			}
+		}
+		for _, i := range []int{-1, len(prefixes)} {
+			if got, ok := ps.At(i); ok {
+				t.Errorf("%v.At(%d) = %v, want none", ps, i, got)
+			}
+		}
+		for _, p := range pfxs("10.0.0.0/9", "12.0.0.0/8", "::/0", "::/2", "2001:db8::/33") {
+			if i, ok := ps.IndexOf(p); ok != ps.Contains(p) {
+				t.Errorf("%v.IndexOf(%v) = %d, %v, want %v", ps, p, i, ok, ps.Contains(p))
+			}
+		}
+		if _, ok := ps.IndexOf(netip.Prefix{}); ok {
+			t.Errorf("%v.IndexOf of invalid Prefix found an entry", ps)
+		}
+	}
+}
+
+func TestPrefixSetEncompassingEntries(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	set := pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "12.0.0.0/8", "2001:db8::/32", "2001:db8:1::/48")
+	for _, p := range set {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+
+	queries := pfxs(
+		"10.1.2.3/32", "12.1.0.0/16", "10.1.0.0/16", "11.0.0.0/8", "10.2.0.0/16",
+		"2001:db8:1::1/128", "2001:db8:2::/48", "2001:db9::/32", "10.1.2.3/32",
+	)
+	queries = append(queries, netip.Prefix{})
+	want := map[netip.Prefix]netip.Prefix{
+		pfx("10.1.2.3/32"):       pfx("10.1.2.0/24"),
+		pfx("12.1.0.0/16"):       pfx("12.0.0.0/8"),
+		pfx("10.1.0.0/16"):       pfx("10.1.0.0/16"),
+		pfx("10.2.0.0/16"):       pfx("10.0.0.0/8"),
+		pfx("2001:db8:1::1/128"): pfx("2001:db8:1::/48"),
+		pfx("2001:db8:2::/48"):   pfx("2001:db8::/32"),
+	}
+	got := ps.EncompassingEntries(queries)
+	if len(got) != len(want) {
+		t.Errorf("ps.EncompassingEntries(%v) = %v, want %v", queries, got, want)
+	}
+	for q, w := range want {
+		if got[q] != w {
+			t.Errorf("ps.EncompassingEntries(...)[%v] = %v, want %v", q, got[q], w)
+		}
+	}
+}
+
+func TestPrefixSetAncestorsDescendantsOf(t *testing.T) {
+	set := pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.3.0/24", "11.0.0.0/8")
+	tests := []struct {
+		get                   netip.Prefix
+		wantDesc, wantDescStr []netip.Prefix
+		wantAnc, wantAncStr   []netip.Prefix
+	}{
+		{
+			pfx("10.1.0.0/16"),
+			pfxs("10.1.0.0/16", "10.1.2.0/24", "10.1.3.0/24"),
+			pfxs("10.1.2.0/24", "10.1.3.0/24"),
+			pfxs("10.0.0.0/8", "10.1.0.0/16"),
+			pfxs("10.0.0.0/8"),
+		},
+		// Not in the set, so strictness makes no difference
+		{
+			pfx("10.1.2.0/23"),
+			pfxs("10.1.2.0/24", "10.1.3.0/24"),
+			pfxs("10.1.2.0/24", "10.1.3.0/24"),
+			pfxs("10.0.0.0/8", "10.1.0.0/16"),
+			pfxs("10.0.0.0/8", "10.1.0.0/16"),
+		},
+		{pfx("11.0.0.0/8"), pfxs("11.0.0.0/8"), pfxs(), pfxs("11.0.0.0/8"), pfxs()},
+		{pfx("12.0.0.0/8"), pfxs(), pfxs(), pfxs(), pfxs()},
+	}
+	psb := &PrefixSetBuilder{}
+	pmb := &PrefixMapBuilder[bool]{}
+	for _, p := range set {
+		psb.Add(p)
+		pmb.Set(p, true)
+	}
+	ps, pm := psb.PrefixSet(), pmb.PrefixMap()
+	for _, tt := range tests {
+		checkPrefixSlice(t, ps.DescendantsOf(tt.get).Prefixes(), tt.wantDesc)
+		checkPrefixSlice(t, ps.DescendantsOf(tt.get, Strict()).Prefixes(), tt.wantDescStr)
+		checkPrefixSlice(t, ps.AncestorsOf(tt.get).Prefixes(), tt.wantAnc)
+		checkPrefixSlice(t, ps.AncestorsOf(tt.get, Strict()).Prefixes(), tt.wantAncStr)
+
+		checkPrefixSlice(t, pm.DescendantsOf(tt.get, Strict()).KeySet().Prefixes(), tt.wantDescStr)
+		checkPrefixSlice(t, pm.AncestorsOf(tt.get, Strict()).KeySet().Prefixes(), tt.wantAncStr)
+	}
+}
+
+func TestPrefixSetChildrenOf(t *testing.T) {
+	set := pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.3.0/24", "10.2.3.4/32", "11.0.0.0/8")
+	tests := []struct {
+		get  netip.Prefix
+		want []netip.Prefix
+	}{
+		{pfx("10.0.0.0/8"), pfxs("10.1.0.0/16", "10.2.3.0/24")},
+		{pfx("10.1.0.0/16"), pfxs("10.1.2.0/24")},
+		// Not in the set
+		{pfx("10.2.0.0/16"), pfxs("10.2.3.0/24")},
+		{pfx("10.0.0.0/7"), pfxs("10.0.0.0/8", "11.0.0.0/8")},
+		{pfx("10.2.3.4/32"), pfxs()},
+		{pfx("12.0.0.0/8"), pfxs()},
+	}
+	psb := &PrefixSetBuilder{}
+	pmb := &PrefixMapBuilder[int]{}
+	for i, p := range set {
+		psb.Add(p)
+		pmb.Set(p, i)
+	}
+	ps, pm := psb.PrefixSet(), pmb.PrefixMap()
+	for _, tt := range tests {
+		checkPrefixSlice(t, ps.ChildrenOf(tt.get).Prefixes(), tt.want)
+		children := pm.ChildrenOf(tt.get)
+		checkPrefixSlice(t, children.KeySet().Prefixes(), tt.want)
+		for p, v := range children.ToMap() {
+			if want := slices.Index(set, p); v != want {
+				t.Errorf("pm.ChildrenOf(%v) maps %v to %d, want %d", tt.get, p, v, want)
+			}
+		}
+	}
+}
+
 func TestPrefixSetOverlapsPrefix(t *testing.T) {
 	tests := []struct {
 		set  []netip.Prefix
@@ -119,6 +590,9 @@ func TestPrefixSetSubtract(t *testing.T) {
 		{pfxs("::2/127"), pfx("::3/128"), pfxs("::2/128")},
 		{pfxs("::0/126"), pfx("::0/128"), pfxs("::1/128", "::2/127")},
 		{pfxs("::0/126"), pfx("::3/128"), pfxs("::0/127", "::2/128")},
+		// Subtracting below a node that holds no entry creates no entries.
+		{pfxs("::2/128", "::8/128"), pfx("::0/128"), pfxs("::2/128", "::8/128")},
+		{pfxs("::0/128", "::2/128", "::8/128"), pfx("::0/127"), pfxs("::2/128", "::8/128")},
 		// IPv4
 		{
 			set:      pfxs("1.2.3.0/30"),
@@ -136,6 +610,110 @@ func TestPrefixSetSubtract(t *testing.T) {
 	}
 }
 
+func TestPrefixSetBuilderRemoveDescendantsOf(t *testing.T) {
+	tests := []struct {
+		set    []netip.Prefix
+		remove netip.Prefix
+		want   []netip.Prefix
+	}{
+		{pfxs(), pfx("::0/128"), pfxs()},
+		{pfxs("::0/128"), pfx("::0/128"), pfxs()},
+		{pfxs("::0/128"), pfx("::0/127"), pfxs()},
+		{pfxs("::0/128"), pfx("::1/128"), pfxs("::0/128")},
+		{pfxs("::0/127"), pfx("::0/128"), pfxs("::0/127")},
+		{pfxs("::0/126", "::0/127", "::0/128", "::2/128"), pfx("::0/127"), pfxs("::0/126", "::2/128")},
+		{pfxs("::0/128", "::1/128", "::2/128"), pfx("::0/127"), pfxs("::2/128")},
+		{pfxs("::0/128", "::2/128", "::8/128"), pfx("::0/125"), pfxs("::8/128")},
+		{pfxs("::0/128", "::2/128"), pfx("::/0"), pfxs()},
+		{
+			set:    pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.0.0/16", "2001:db8::/32"),
+			remove: pfx("10.1.0.0/16"),
+			want:   pfxs("10.0.0.0/8", "10.2.0.0/16", "2001:db8::/32"),
+		},
+		{
+			set:    pfxs("10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32"),
+			remove: pfx("0.0.0.0/0"),
+			want:   pfxs("2001:db8::/32"),
+		},
+	}
+	for _, tt := range tests {
+		psb := &PrefixSetBuilder{}
+		for _, p := range tt.set {
+			psb.Add(p)
+		}
+		if err := psb.RemoveDescendantsOf(tt.remove); err != nil {
+			t.Errorf("psb.RemoveDescendantsOf(%v) = %v", tt.remove, err)
+		}
+		checkPrefixSlice(t, psb.PrefixSet().Prefixes(), tt.want)
+
+		// The builder remains consistent for further changes.
+		for _, p := range tt.set {
+			psb.Add(p)
+		}
+		checkPrefixSlice(t, psb.PrefixSet().Prefixes(), tt.set)
+	}
+	if err := (&PrefixSetBuilder{}).RemoveDescendantsOf(netip.Prefix{}); err == nil {
+		t.Errorf("RemoveDescendantsOf of invalid Prefix = nil, want error")
+	}
+}
+
+func TestPrefixSetAllDescendantsOf(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	for _, p := range pfxs("::/64", "::1/128", "10.0.0.0/8", "10.1.0.0/16", "11.0.0.0/8", "2001:db8::/32") {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+	for _, p := range append(pfxs("::/0", "::/1", "::/64", "10.0.0.0/8", "10.0.0.0/7", "12.0.0.0/8", "2001:db8::/48"), netip.Prefix{}) {
+		checkPrefixSlice(t, slices.Collect(ps.AllDescendantsOf(p)), ps.DescendantsOf(p).Prefixes())
+	}
+
+	// The iteration stops when the caller breaks out of it.
+	var got []netip.Prefix
+	for d := range ps.AllDescendantsOf(pfx("::/1")) {
+		got = append(got, d)
+		if len(got) == 2 {
+			break
+		}
+	}
+	checkPrefixSlice(t, got, pfxs("::/64", "10.0.0.0/8"))
+}
+
+func TestPrefixSetAllAncestorsOf(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	for _, p := range pfxs("::/1", "::/64", "::1/128", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "2001:db8::/32") {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+	tests := []struct {
+		p    netip.Prefix
+		want []netip.Prefix
+	}{
+		{pfx("::1/128"), pfxs("::/1", "::/64", "::1/128")},
+		{pfx("::/63"), pfxs("::/1")},
+		// IPv4 Prefixes are stored within ::/64.
+		{pfx("10.1.2.3/32"), pfxs("::/1", "::/64", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24")},
+		{pfx("10.1.0.0/16"), pfxs("::/1", "::/64", "10.0.0.0/8", "10.1.0.0/16")},
+		{pfx("10.2.0.0/16"), pfxs("::/1", "::/64", "10.0.0.0/8")},
+		{pfx("2001:db8::1/128"), pfxs("::/1", "2001:db8::/32")},
+		{pfx("8000::/1"), pfxs()},
+		{pfx("::/0"), pfxs()},
+		{netip.Prefix{}, pfxs()},
+	}
+	for _, tt := range tests {
+		checkPrefixSlice(t, slices.Collect(ps.AllAncestorsOf(tt.p)), tt.want)
+	}
+
+	// The iteration stops when the caller breaks out of it.
+	var got []netip.Prefix
+	for a := range ps.AllAncestorsOf(pfx("10.1.2.3/32")) {
+		got = append(got, a)
+		if len(got) == 2 {
+			break
+		}
+	}
+	checkPrefixSlice(t, got, pfxs("::/1", "::/64"))
+}
+
 func TestPrefixSetSubtractFromPrefix(t *testing.T) {
 	tests := []struct {
 		subtract []netip.Prefix
@@ -170,6 +748,19 @@ func TestPrefixSetPrefixes(t *testing.T) {
 		{pfxs("::0/128"), pfxs("::0/128"), pfxs()},
 		{pfxs("::0/128"), pfxs("::1/128"), pfxs("::0/128")},
 		{pfxs("::0/128"), pfxs("::0/127"), pfxs("::0/128")},
+		// IPv4 before IPv6, then by address, then shorter before longer
+		{
+			pfxs("2001:db8::/32", "::1/128", "10.0.0.0/8", "1.2.3.0/24", "10.0.0.0/16"),
+			pfxs(),
+			pfxs("1.2.3.0/24", "10.0.0.0/8", "10.0.0.0/16", "::1/128", "2001:db8::/32"),
+		},
+		// IPv6 Prefixes that encompass ::ffff:0:0/96 come before the IPv4
+		// Prefixes, shorter first
+		{
+			pfxs("::/64", "::fffe:0:0/95", "10.0.0.0/8", "::2/128"),
+			pfxs(),
+			pfxs("::/64", "::fffe:0:0/95", "10.0.0.0/8", "::2/128"),
+		},
 	}
 	for _, tt := range tests {
 		psb := &PrefixSetBuilder{}
@@ -183,3 +774,899 @@ func TestPrefixSetPrefixes(t *testing.T) {
 		checkPrefixSlice(t, ps.Prefixes(), tt.want)
 	}
 }
+
+func TestPrefixSetOrderConsistent(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	for _, p := range pfxs(
+		"2001:db8::/32", "2001:db8::/48", "::/64", "::1/128", "::fffe:0:0/95",
+		"0.0.0.0/8", "10.0.0.0/8", "10.1.0.0/16", "192.168.0.0/16",
+	) {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+	want := ps.Prefixes()
+	if !slices.IsSortedFunc(want, comparePrefixes) {
+		t.Errorf("Prefixes() = %v, not sorted", want)
+	}
+
+	checkPrefixSlice(t, slices.Collect(ps.All()), want)
+
+	var walked []netip.Prefix
+	ps.WalkPrune(func(p netip.Prefix) WalkAction {
+		walked = append(walked, p)
+		return WalkContinue
+	})
+	checkPrefixSlice(t, walked, want)
+
+	var counted []netip.Prefix
+	for p := range ps.AddressCounts() {
+		counted = append(counted, p)
+	}
+	checkPrefixSlice(t, counted, want)
+
+	pmb := &PrefixMapBuilder[bool]{}
+	for _, p := range want {
+		pmb.Set(p, true)
+	}
+	var mapWalked []netip.Prefix
+	pmb.PrefixMap().WalkPrune(func(p netip.Prefix, _ bool) WalkAction {
+		mapWalked = append(mapWalked, p)
+		return WalkContinue
+	})
+	checkPrefixSlice(t, mapWalked, want)
+
+	pm := pmb.PrefixMap()
+	checkPrefixSlice(t, seqKeys(pm.All()), want)
+
+	// All4 and All6 yield the Prefixes of each family in the same order.
+	var want4, want6 []netip.Prefix
+	for _, p := range want {
+		if p.Addr().Is4() {
+			want4 = append(want4, p)
+		} else {
+			want6 = append(want6, p)
+		}
+	}
+	checkPrefixSlice(t, slices.Collect(ps.All4()), want4)
+	checkPrefixSlice(t, slices.Collect(ps.All6()), want6)
+	checkPrefixSlice(t, seqKeys(pm.All4()), want4)
+	checkPrefixSlice(t, seqKeys(pm.All6()), want6)
+}
+
+func TestAllSorted(t *testing.T) {
+	set := pfxs("2001:db8::/32", "2001:db8::/48", "10.0.0.0/8", "10.1.0.0/16", "192.168.0.0/16", "::1/128")
+	psb := &PrefixSetBuilder{}
+	pmb := &PrefixMapBuilder[int]{}
+	for i, p := range set {
+		psb.Add(p)
+		pmb.Set(p, i)
+	}
+	ps, pm := psb.PrefixSet(), pmb.PrefixMap()
+
+	byLengthDesc := func(a, b netip.Prefix) int { return cmp.Compare(b.Bits(), a.Bits()) }
+	// Prefixes of equal length keep their usual order.
+	want := pfxs("::1/128", "2001:db8::/48", "2001:db8::/32", "10.1.0.0/16", "192.168.0.0/16", "10.0.0.0/8")
+	checkPrefixSlice(t, slices.Collect(ps.AllSorted(byLengthDesc)), want)
+	checkPrefixSlice(t, seqKeys(pm.AllSorted(byLengthDesc)), want)
+	for p, v := range pm.AllSorted(byLengthDesc) {
+		if got, _ := pm.Get(p); got != v {
+			t.Errorf("pm.AllSorted yielded %v: %d, want %d", p, v, got)
+		}
+	}
+	checkPrefixSlice(t, slices.Collect(ps.AllSorted(comparePrefixes)), ps.Prefixes())
+}
+
+func TestPrefixSetCanonicalShape(t *testing.T) {
+	tests := []struct {
+		add, remove []netip.Prefix
+	}{
+		{pfxs("::0/128", "::1/128", "::2/128", "::8/128"), pfxs("::0/128", "::1/128")},
+		{pfxs("::0/128", "::1/128", "::8/128"), pfxs("::0/128", "::1/128")},
+		{pfxs("10.0.0.0/8", "10.1.0.0/16", "10.2.0.0/16", "11.0.0.0/8"), pfxs("10.0.0.0/8", "10.1.0.0/16")},
+		{pfxs("10.0.0.0/8", "2001:db8::/32"), pfxs("10.0.0.0/8", "2001:db8::/32")},
+	}
+	for _, tt := range tests {
+		a := &PrefixSetBuilder{}
+		am := &PrefixMapBuilder[int]{}
+		for _, p := range tt.add {
+			a.Add(p)
+			am.Set(p, 1)
+		}
+		for _, p := range tt.remove {
+			a.Remove(p)
+			am.Remove(p)
+		}
+		// b has the same Prefixes as a, added in reverse order.
+		b := &PrefixSetBuilder{}
+		bm := &PrefixMapBuilder[int]{}
+		remaining := a.PrefixSet().Prefixes()
+		for _, p := range slices.Backward(remaining) {
+			b.Add(p)
+			bm.Set(p, 1)
+		}
+
+		if got, want := a.PrefixSet().String(), b.PrefixSet().String(); got != want {
+			t.Errorf("PrefixSet() after removing %v =\n%s\nwant\n%s", tt.remove, got, want)
+		}
+		if got, want := am.PrefixMap().String(), bm.PrefixMap().String(); got != want {
+			t.Errorf("PrefixMap() after removing %v =\n%s\nwant\n%s", tt.remove, got, want)
+		}
+		if got, want := seqKeys(a.PrefixSet().Nodes()), seqKeys(b.PrefixSet().Nodes()); !slices.Equal(got, want) {
+			t.Errorf("Nodes() after removing %v = %v, want %v", tt.remove, got, want)
+		}
+
+		a.Canonicalize()
+		am.Canonicalize()
+		if got, want := a.String(), b.String(); got != want {
+			t.Errorf("builder after removing %v and Canonicalize =\n%s\nwant\n%s", tt.remove, got, want)
+		}
+		if got, want := am.String(), bm.String(); got != want {
+			t.Errorf("map builder after removing %v and Canonicalize =\n%s\nwant\n%s", tt.remove, got, want)
+		}
+		// The builders remain usable.
+		for _, p := range tt.remove {
+			a.Add(p)
+			b.Add(p)
+		}
+		checkPrefixSlice(t, a.PrefixSet().Prefixes(), b.PrefixSet().Prefixes())
+	}
+}
+
+// seqKeys returns the keys yielded by seq, in order.
+func seqKeys[K, V any](seq iter.Seq2[K, V]) []K {
+	var ret []K
+	for k := range seq {
+		ret = append(ret, k)
+	}
+	return ret
+}
+
+// comparePrefixes orders Prefixes in the order in which they are visited:
+// as netip.Prefix.Compare does, except that the IPv6 Prefixes encompassing
+// ::ffff:0:0/96 come first.
+func comparePrefixes(a, b netip.Prefix) int {
+	return cmp.Or(
+		cmp.Compare(orderClass(keyFromPrefix(a)), orderClass(keyFromPrefix(b))),
+		cmp.Compare(a.Addr().BitLen(), b.Addr().BitLen()),
+		a.Addr().Compare(b.Addr()),
+		cmp.Compare(a.Bits(), b.Bits()),
+	)
+}
+
+// orderClass returns 0 for keys encompassing ::ffff:0:0/96, 1 for other IPv4
+// keys and 2 for other IPv6 keys, which are visited in that order.
+func orderClass(k key) int {
+	switch {
+	case k.encompasses4():
+		return 0
+	case k.is4():
+		return 1
+	default:
+		return 2
+	}
+}
+
+func TestPrefixSetAddressCounts(t *testing.T) {
+	tests := []struct {
+		add  []netip.Prefix
+		want map[netip.Prefix]string
+	}{
+		{pfxs(), map[netip.Prefix]string{}},
+		{pfxs("::0/128"), map[netip.Prefix]string{pfx("::0/128"): "1"}},
+		{pfxs("::0/126"), map[netip.Prefix]string{pfx("::0/126"): "4"}},
+		{
+			add: pfxs("::0/126", "::1/128"),
+			want: map[netip.Prefix]string{
+				pfx("::0/126"): "3",
+				pfx("::1/128"): "1",
+			},
+		},
+		// Only the nearest more-specific entries count against an entry.
+		{
+			add: pfxs("::0/124", "::0/126", "::1/128", "::8/127"),
+			want: map[netip.Prefix]string{
+				pfx("::0/124"): "10",
+				pfx("::0/126"): "3",
+				pfx("::1/128"): "1",
+				pfx("::8/127"): "2",
+			},
+		},
+		{pfxs("8000::/1"), map[netip.Prefix]string{
+			pfx("8000::/1"): "170141183460469231731687303715884105728",
+		}},
+		// The span of ::/0 does not fit in 128 bits.
+		{pfxs("::/0"), map[netip.Prefix]string{
+			pfx("::/0"): "340282366920938463463374607431768211456",
+		}},
+		{
+			add: pfxs("::/0", "::/1", "8000::/2"),
+			want: map[netip.Prefix]string{
+				pfx("::/0"):     "85070591730234615865843651857942052864",
+				pfx("::/1"):     "170141183460469231731687303715884105728",
+				pfx("8000::/2"): "85070591730234615865843651857942052864",
+			},
+		},
+		{
+			add: pfxs("::/0", "::/1", "8000::/1"),
+			want: map[netip.Prefix]string{
+				pfx("::/0"):     "0",
+				pfx("8000::/1"): "170141183460469231731687303715884105728",
+				pfx("::/1"):     "170141183460469231731687303715884105728",
+			},
+		},
+		// IPv4
+		{
+			add: pfxs("10.0.0.0/24", "10.0.0.0/25", "10.0.0.128/32"),
+			want: map[netip.Prefix]string{
+				pfx("10.0.0.0/24"):   "127",
+				pfx("10.0.0.0/25"):   "128",
+				pfx("10.0.0.128/32"): "1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		psb := &PrefixSetBuilder{}
+		for _, p := range tt.add {
+			psb.Add(p)
+		}
+		got := make(map[netip.Prefix]string)
+		for p, c := range psb.PrefixSet().AddressCounts() {
+			got[p] = c.String()
+		}
+		checkMap(t, tt.want, got)
+	}
+}
+
+func TestPrefixSetBuilderAddString(t *testing.T) {
+	tests := []struct {
+		add     string
+		want    []netip.Prefix
+		wantErr bool
+	}{
+		{"::0/128", pfxs("::0/128"), false},
+		{"1.2.3.0/24", pfxs("1.2.3.0/24"), false},
+		{"1.2.3.0", pfxs("1.2.3.0/32"), false},
+		{" 1.2.3.0/24\n", pfxs("1.2.3.0/24"), false},
+		{"1.2.3.0/", pfxs(), true},
+		{"1.2.3.0/33", pfxs(), true},
+		{"", pfxs(), true},
+	}
+	for _, tt := range tests {
+		psb := &PrefixSetBuilder{}
+		err := psb.AddString(tt.add)
+		var parseErr *PrefixParseError
+		if gotErr := errors.As(err, &parseErr); gotErr != tt.wantErr {
+			t.Errorf("psb.AddString(%q) = %v, want error: %v", tt.add, err, tt.wantErr)
+		} else if gotErr && parseErr.Input != tt.add {
+			t.Errorf("psb.AddString(%q) error input = %q", tt.add, parseErr.Input)
+		}
+		checkPrefixSlice(t, psb.PrefixSet().Prefixes(), tt.want)
+	}
+}
+
+func TestPrefixSetFromBytes(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	psb.AddFromBytes([]byte{192, 168, 0, 0}, 16)
+	if err := psb.AddFromBytes([]byte{192, 168, 0, 0}, 40); err == nil {
+		t.Errorf("psb.AddFromBytes(192.168.0.0, 40) = nil, want error")
+	}
+	ps := psb.PrefixSet()
+	checkPrefixSlice(t, ps.Prefixes(), pfxs("192.168.0.0/16"))
+	if !ps.EncompassesFromBytes([]byte{192, 168, 1, 1}, 32) {
+		t.Errorf("ps.EncompassesFromBytes(192.168.1.1, 32) = false, want true")
+	}
+	if ps.EncompassesFromBytes([]byte{192, 169, 1, 1}, 32) {
+		t.Errorf("ps.EncompassesFromBytes(192.169.1.1, 32) = true, want false")
+	}
+}
+
+func TestPrefixSetPrefixesCompact(t *testing.T) {
+	tests := []struct {
+		add  []netip.Prefix
+		want []netip.Prefix
+	}{
+		{pfxs(), pfxs()},
+		{pfxs("::0/128"), pfxs("::0/128")},
+		{pfxs("::0/128", "::1/128"), pfxs("::0/128", "::1/128")},
+		{pfxs("::0/127", "::0/128", "::1/128"), pfxs("::0/127")},
+		{pfxs("::0/126", "::0/127", "::4/128"), pfxs("::0/126", "::4/128")},
+		{pfxs("1.2.0.0/16", "1.2.3.0/24", "1.3.0.0/16"), pfxs("1.2.0.0/16", "1.3.0.0/16")},
+		// An IPv6 Prefix encompassing ::ffff:0:0/96 encompasses the IPv4
+		// Prefixes
+		{pfxs("::/8", "10.0.0.0/8", "10.1.0.0/16"), pfxs("::/8")},
+		{pfxs("::/8", "10.0.0.0/8", "2001:db8::/32"), pfxs("::/8", "2001:db8::/32")},
+	}
+	for _, tt := range tests {
+		psb := &PrefixSetBuilder{}
+		for _, p := range tt.add {
+			psb.Add(p)
+		}
+		checkPrefixSlice(t, psb.PrefixSet().PrefixesCompact(), tt.want)
+		checkPrefixSlice(t, slices.Collect(psb.PrefixSet().AllCompact()), tt.want)
+	}
+}
+
+func TestPrefixSetBuilderPrefixSetCompaction(t *testing.T) {
+	tests := []struct {
+		set         []netip.Prefix
+		wantCompact []netip.Prefix
+		wantMerged  []netip.Prefix
+	}{
+		{pfxs(), pfxs(), pfxs()},
+		{
+			pfxs("10.0.0.0/8", "10.1.0.0/16", "11.0.0.0/8"),
+			pfxs("10.0.0.0/8", "11.0.0.0/8"),
+			pfxs("10.0.0.0/7"),
+		},
+		// Merging repeats up the tree
+		{
+			pfxs("::0/128", "::1/128", "::2/127", "::4/126"),
+			pfxs("::0/128", "::1/128", "::2/127", "::4/126"),
+			pfxs("::0/125"),
+		},
+		// Not siblings
+		{
+			pfxs("10.0.0.0/8", "12.0.0.0/8", "::1/128"),
+			pfxs("10.0.0.0/8", "12.0.0.0/8", "::1/128"),
+			pfxs("10.0.0.0/8", "12.0.0.0/8", "::1/128"),
+		},
+		// An IPv6 Prefix encompassing ::ffff:0:0/96 encompasses the IPv4
+		// Prefixes
+		{
+			pfxs("::/8", "10.0.0.0/8", "10.1.0.0/16"),
+			pfxs("::/8"),
+			pfxs("::/8"),
+		},
+		// IPv4 and IPv6 are not merged together
+		{
+			pfxs("0.0.0.0/0", "::fffe:0:0/96"),
+			pfxs("0.0.0.0/0", "::fffe:0:0/96"),
+			pfxs("0.0.0.0/0", "::fffe:0:0/96"),
+		},
+	}
+	for _, tt := range tests {
+		psb := &PrefixSetBuilder{}
+		for _, p := range tt.set {
+			psb.Add(p)
+		}
+		checkPrefixSlice(t, psb.PrefixSet(WithCompaction()).Prefixes(), tt.wantCompact)
+		checkPrefixSlice(t, psb.PrefixSet(WithMergedSiblings()).Prefixes(), tt.wantMerged)
+		checkPrefixSlice(t, psb.PrefixSet().PrefixesCompact(), tt.wantCompact)
+	}
+
+	// Siblings with different flags are not merged.
+	psb := &PrefixSetBuilder{}
+	psb.AddWithFlags(pfx("10.0.0.0/8"), 1)
+	psb.AddWithFlags(pfx("11.0.0.0/8"), 2)
+	checkPrefixSlice(t, psb.PrefixSet(WithMergedSiblings()).Prefixes(), pfxs("10.0.0.0/8", "11.0.0.0/8"))
+}
+
+func TestPrefixSetIntersect(t *testing.T) {
+	tests := []struct {
+		a    []netip.Prefix
+		b    []netip.Prefix
+		want map[netip.Prefix]IntersectOrigin
+	}{
+		{pfxs(), pfxs(), map[netip.Prefix]IntersectOrigin{}},
+		{pfxs("::0/128"), pfxs(), map[netip.Prefix]IntersectOrigin{}},
+		{pfxs("::0/128"), pfxs("::1/128"), map[netip.Prefix]IntersectOrigin{}},
+		{pfxs("::0/128"), pfxs("::0/128"), map[netip.Prefix]IntersectOrigin{
+			pfx("::0/128"): OriginBoth,
+		}},
+		// The more-specific entry is retained, whichever side it's on
+		{pfxs("::0/126"), pfxs("::0/128"), map[netip.Prefix]IntersectOrigin{
+			pfx("::0/128"): OriginArgument,
+		}},
+		{pfxs("::0/128"), pfxs("::0/126"), map[netip.Prefix]IntersectOrigin{
+			pfx("::0/128"): OriginReceiver,
+		}},
+		{
+			a: pfxs("10.0.0.0/8", "10.1.0.0/16", "192.168.0.0/24"),
+			b: pfxs("10.0.0.0/8", "10.2.0.0/16", "192.168.0.0/16"),
+			want: map[netip.Prefix]IntersectOrigin{
+				pfx("10.0.0.0/8"):     OriginBoth,
+				pfx("10.1.0.0/16"):    OriginReceiver,
+				pfx("10.2.0.0/16"):    OriginArgument,
+				pfx("192.168.0.0/24"): OriginReceiver,
+			},
+		},
+	}
+	for _, tt := range tests {
+		a, b := &PrefixSetBuilder{}, &PrefixSetBuilder{}
+		for _, p := range tt.a {
+			a.Add(p)
+		}
+		for _, p := range tt.b {
+			b.Add(p)
+		}
+		checkMap(t, tt.want, a.PrefixSet().IntersectAnnotated(b.PrefixSet()).ToMap())
+
+		a.Intersect(b.PrefixSet())
+		got := make(map[netip.Prefix]bool)
+		for _, p := range a.PrefixSet().Prefixes() {
+			got[p] = true
+		}
+		want := make(map[netip.Prefix]bool)
+		for p := range tt.want {
+			want[p] = true
+		}
+		checkMap(t, want, got)
+	}
+}
+
+func TestPrefixSetFlags(t *testing.T) {
+	const (
+		static uint8 = 1 << iota
+		learned
+	)
+	a := &PrefixSetBuilder{}
+	a.AddWithFlags(pfx("10.0.0.0/8"), static)
+	a.Add(pfx("11.0.0.0/8"))
+	a.AddWithFlags(pfx("12.0.0.0/8"), static)
+
+	b := &PrefixSetBuilder{}
+	b.AddWithFlags(pfx("10.0.0.0/8"), learned)
+	b.AddWithFlags(pfx("13.0.0.0/8"), learned)
+
+	a.Merge(b.PrefixSet())
+	ps := a.PrefixSet()
+
+	tests := []struct {
+		p         netip.Prefix
+		wantFlags uint8
+		wantOK    bool
+	}{
+		{pfx("10.0.0.0/8"), static | learned, true},
+		{pfx("11.0.0.0/8"), 0, true},
+		{pfx("12.0.0.0/8"), static, true},
+		{pfx("13.0.0.0/8"), learned, true},
+		{pfx("14.0.0.0/8"), 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := ps.Flags(tt.p); got != tt.wantFlags || ok != tt.wantOK {
+			t.Errorf("ps.Flags(%v) = (%d, %v), want (%d, %v)", tt.p, got, ok, tt.wantFlags, tt.wantOK)
+		}
+	}
+	if !ps.ContainsWithFlags(pfx("10.0.0.0/8"), static|learned) {
+		t.Errorf("ps.ContainsWithFlags(10.0.0.0/8, static|learned) = false, want true")
+	}
+	if ps.ContainsWithFlags(pfx("12.0.0.0/8"), learned) {
+		t.Errorf("ps.ContainsWithFlags(12.0.0.0/8, learned) = true, want false")
+	}
+	if !ps.ContainsWithFlags(pfx("11.0.0.0/8"), 0) {
+		t.Errorf("ps.ContainsWithFlags(11.0.0.0/8, 0) = false, want true")
+	}
+
+	// Flags are retained by fragments created by Subtract
+	a.Subtract(pfx("12.0.0.0/9"))
+	if got, _ := a.PrefixSet().Flags(pfx("12.128.0.0/9")); got != static {
+		t.Errorf("Flags(12.128.0.0/9) after Subtract = %d, want %d", got, static)
+	}
+}
+
+func TestPrefixSetBuilderRanges(t *testing.T) {
+	addr := netip.MustParseAddr
+	tests := []struct {
+		set           []netip.Prefix
+		first, last   netip.Addr
+		wantSubtract  []netip.Prefix
+		wantIntersect []netip.Prefix
+	}{
+		{
+			pfxs("10.0.0.0/30"), addr("10.0.0.1"), addr("10.0.0.2"),
+			pfxs("10.0.0.0/32", "10.0.0.3/32"),
+			pfxs("10.0.0.1/32", "10.0.0.2/32"),
+		},
+		{
+			pfxs("10.0.0.0/24", "192.168.0.0/16"), addr("10.0.0.0"), addr("10.0.0.255"),
+			pfxs("192.168.0.0/16"),
+			pfxs("10.0.0.0/24"),
+		},
+		{
+			pfxs("10.0.0.0/24", "10.0.1.0/24"), addr("10.0.0.128"), addr("10.0.1.127"),
+			pfxs("10.0.0.0/25", "10.0.1.128/25"),
+			pfxs("10.0.0.128/25", "10.0.1.0/25"),
+		},
+		{
+			pfxs("2001:db8::/32"), addr("2001:db8::"), addr("2001:db8:ffff:ffff:ffff:ffff:ffff:fffe"),
+			pfxs("2001:db8:ffff:ffff:ffff:ffff:ffff:ffff/128"),
+			nil,
+		},
+		// Disjoint
+		{
+			pfxs("10.0.0.0/24"), addr("11.0.0.0"), addr("11.0.0.255"),
+			pfxs("10.0.0.0/24"),
+			pfxs(),
+		},
+	}
+	for _, tt := range tests {
+		sub, in := &PrefixSetBuilder{}, &PrefixSetBuilder{}
+		for _, p := range tt.set {
+			sub.Add(p)
+			in.AddWithFlags(p, 1)
+		}
+		if err := sub.SubtractRange(tt.first, tt.last); err != nil {
+			t.Fatalf("SubtractRange(%v, %v) = %v", tt.first, tt.last, err)
+		}
+		checkPrefixSlice(t, sub.PrefixSet().Prefixes(), tt.wantSubtract)
+
+		if err := in.IntersectRange(tt.first, tt.last); err != nil {
+			t.Fatalf("IntersectRange(%v, %v) = %v", tt.first, tt.last, err)
+		}
+		if tt.wantIntersect == nil {
+			// Too many Prefixes to list
+			continue
+		}
+		ps := in.PrefixSet()
+		checkPrefixSlice(t, ps.Prefixes(), tt.wantIntersect)
+		for _, p := range tt.wantIntersect {
+			if !ps.ContainsWithFlags(p, 1) {
+				t.Errorf("IntersectRange(%v, %v): %v lost its flags", tt.first, tt.last, p)
+			}
+		}
+	}
+
+	var b PrefixSetBuilder
+	if err := b.SubtractRange(addr("10.0.0.1"), addr("10.0.0.0")); err == nil {
+		t.Errorf("SubtractRange with reversed range returned nil error")
+	}
+	if err := b.IntersectRange(addr("10.0.0.0"), addr("::1")); err == nil {
+		t.Errorf("IntersectRange with mixed families returned nil error")
+	}
+}
+
+func TestPrefixSetEncompassesStrict(t *testing.T) {
+	tests := []struct {
+		set  []netip.Prefix
+		get  netip.Prefix
+		want bool
+	}{
+		{pfxs("::0/128"), pfx("::0/128"), false},
+		{pfxs("::0/127"), pfx("::0/128"), true},
+		{pfxs("::0/127", "::0/128"), pfx("::0/128"), true},
+		{pfxs("::0/127", "::0/128"), pfx("::0/127"), false},
+		{pfxs("10.0.0.0/8", "10.1.0.0/16"), pfx("10.1.0.0/16"), true},
+		{pfxs("10.0.0.0/8", "11.0.0.0/8"), pfx("10.0.0.0/8"), false},
+	}
+	for _, tt := range tests {
+		psb := &PrefixSetBuilder{}
+		for _, p := range tt.set {
+			psb.Add(p)
+		}
+		if got := psb.PrefixSet().EncompassesStrict(tt.get); got != tt.want {
+			t.Errorf("ps.EncompassesStrict(%v) = %v, want %v", tt.get, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixSetAggregationCandidates(t *testing.T) {
+	tests := []struct {
+		set  []netip.Prefix
+		want []netip.Prefix
+	}{
+		{pfxs(), pfxs()},
+		{pfxs("::0/128"), pfxs()},
+		{pfxs("::0/128", "::1/128"), pfxs("::0/127")},
+		{pfxs("::0/128", "::2/128"), pfxs()},
+		// Encompassed by an entry
+		{pfxs("::0/127", "::0/128", "::1/128"), pfxs()},
+		// Covered via a descendant candidate
+		{pfxs("::0/128", "::1/128", "::2/127"), pfxs("::0/126", "::0/127")},
+		{
+			pfxs("10.0.0.0/26", "10.0.0.64/26", "10.0.0.128/25", "10.0.1.0/25"),
+			pfxs("10.0.0.0/24", "10.0.0.0/25"),
+		},
+		{pfxs("10.0.0.0/25", "10.0.1.128/25"), pfxs()},
+	}
+	for _, tt := range tests {
+		psb := &PrefixSetBuilder{}
+		for _, p := range tt.set {
+			psb.Add(p)
+		}
+		var got []netip.Prefix
+		for p := range psb.PrefixSet().AggregationCandidates() {
+			got = append(got, p)
+		}
+		checkPrefixSlice(t, got, tt.want)
+	}
+}
+
+func TestPrefixSetBuilderAddReporting(t *testing.T) {
+	tests := []struct {
+		set  []netip.Prefix
+		add  netip.Prefix
+		want []netip.Prefix
+	}{
+		{pfxs(), pfx("10.0.0.0/8"), pfxs()},
+		{pfxs("10.0.0.0/8"), pfx("10.0.0.0/8"), pfxs()},
+		{pfxs("10.0.0.0/8"), pfx("10.1.0.0/16"), pfxs()},
+		{
+			pfxs("10.1.0.0/16", "10.2.0.0/16", "10.2.3.0/24", "11.0.0.0/8"),
+			pfx("10.0.0.0/8"),
+			pfxs("10.1.0.0/16", "10.2.0.0/16", "10.2.3.0/24"),
+		},
+		{pfxs("::0/128", "::1/128", "::2/128"), pfx("::0/127"), pfxs("::0/128", "::1/128")},
+		// p falls on an existing node that holds no entry
+		{pfxs("10.1.0.0/16", "10.2.0.0/16"), pfx("10.0.0.0/14"), pfxs("10.1.0.0/16", "10.2.0.0/16")},
+		// IPv6 Prefixes encompassing ::ffff:0:0/96 come first
+		{pfxs("10.0.0.0/8", "::/16", "2001:db8::/32"), pfx("::/8"), pfxs("::/16", "10.0.0.0/8")},
+		{pfxs("10.0.0.0/8", "::1/128", "2001:db8::/32", "8000::/1"), pfx("::/1"), pfxs("10.0.0.0/8", "::1/128", "2001:db8::/32")},
+	}
+	for _, tt := range tests {
+		psb := &PrefixSetBuilder{}
+		pmb := &PrefixMapBuilder[bool]{}
+		for _, p := range tt.set {
+			psb.Add(p)
+			pmb.Set(p, true)
+		}
+		got, err := psb.AddReporting(tt.add)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkPrefixSlice(t, got, tt.want)
+		if !psb.PrefixSet().Contains(tt.add) {
+			t.Errorf("AddReporting(%v) did not add %v", tt.add, tt.add)
+		}
+
+		got, err = pmb.SetReporting(tt.add, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkPrefixSlice(t, got, tt.want)
+	}
+}
+
+func TestPrefixSetBuilderAddDisjoint(t *testing.T) {
+	tests := []struct {
+		set     []netip.Prefix
+		add     netip.Prefix
+		wantErr bool
+	}{
+		{pfxs(), pfx("10.0.0.0/8"), false},
+		{pfxs("10.0.0.0/8"), pfx("11.0.0.0/8"), false},
+		{pfxs("10.0.0.0/8"), pfx("10.0.0.0/8"), true},
+		// Covered by an existing Prefix
+		{pfxs("10.0.0.0/8"), pfx("10.1.0.0/16"), true},
+		// Covers an existing Prefix
+		{pfxs("10.1.0.0/16"), pfx("10.0.0.0/8"), true},
+		{pfxs("::0/128"), pfx("::1/128"), false},
+		{pfxs("::0/128"), pfx("::0/127"), true},
+		{pfxs("10.0.0.0/8"), pfx("2001:db8::/32"), false},
+		{pfxs(), netip.Prefix{}, true},
+	}
+	for _, tt := range tests {
+		psb := &PrefixSetBuilder{}
+		for _, p := range tt.set {
+			if err := psb.AddDisjoint(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := psb.AddDisjoint(tt.add)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("AddDisjoint(%v) to %v: err = %v, want error: %v", tt.add, tt.set, err, tt.wantErr)
+		}
+		if tt.wantErr && tt.add.IsValid() && !errors.Is(err, ErrOverlap) {
+			t.Errorf("AddDisjoint(%v) to %v: err = %v, want ErrOverlap", tt.add, tt.set, err)
+		}
+		want := tt.set
+		if !tt.wantErr {
+			want = append(slices.Clone(tt.set), tt.add)
+		}
+		checkPrefixSlice(t, psb.PrefixSet().Prefixes(), want)
+	}
+
+	// ::/0 is held by the root node, but still overlaps every Prefix.
+	psb := &PrefixSetBuilder{}
+	if err := psb.AddDisjoint(pfx("::/0")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range pfxs("10.0.0.0/8", "2001:db8::/32", "::/0") {
+		if err := psb.AddDisjoint(p); !errors.Is(err, ErrOverlap) {
+			t.Errorf("AddDisjoint(%v) to [::/0]: err = %v, want ErrOverlap", p, err)
+		}
+	}
+
+	// A rejected IPv4-mapped Prefix is reported as such, even if it overlaps.
+	psb = &PrefixSetBuilder{RejectV4Mapped: true}
+	if err := psb.AddDisjoint(pfx("10.0.0.0/8")); err != nil {
+		t.Fatal(err)
+	}
+	if err := psb.AddDisjoint(pfx("::ffff:10.0.0.0/104")); err == nil || errors.Is(err, ErrOverlap) {
+		t.Errorf("AddDisjoint(::ffff:10.0.0.0/104) with RejectV4Mapped: err = %v, want IPv4-mapped rejection", err)
+	}
+}
+
+func TestPrefixSetBuilderMergeReporting(t *testing.T) {
+	tests := []struct {
+		s, o      []netip.Prefix
+		wantAdded []netip.Prefix
+	}{
+		{pfxs(), pfxs(), pfxs()},
+		{pfxs(), pfxs("10.0.0.0/8"), pfxs("10.0.0.0/8")},
+		{pfxs("10.0.0.0/8"), pfxs("10.0.0.0/8"), pfxs()},
+		// Encompassed by an existing Prefix
+		{pfxs("10.0.0.0/8"), pfxs("10.1.0.0/16"), pfxs()},
+		// Encompassing an existing Prefix
+		{pfxs("10.1.0.0/16"), pfxs("10.0.0.0/8"), pfxs("10.0.0.0/8")},
+		// Prefixes new to s are reported even if they encompass each other
+		{
+			pfxs("10.0.0.0/8", "::1/128"),
+			pfxs("10.1.0.0/16", "11.0.0.0/8", "11.1.0.0/16", "::1/128", "2001:db8::/32"),
+			pfxs("11.0.0.0/8", "11.1.0.0/16", "2001:db8::/32"),
+		},
+	}
+	for _, tt := range tests {
+		sb, ob := &PrefixSetBuilder{}, &PrefixSetBuilder{}
+		for _, p := range tt.s {
+			sb.Add(p)
+		}
+		for _, p := range tt.o {
+			ob.AddWithFlags(p, 2)
+		}
+		added := sb.MergeReporting(ob.PrefixSet())
+		checkPrefixSlice(t, added.Prefixes(), tt.wantAdded)
+		for _, p := range tt.wantAdded {
+			if f, _ := added.Flags(p); f != 2 {
+				t.Errorf("added.Flags(%v) = %d, want 2", p, f)
+			}
+		}
+		// s must hold the union, as with Merge.
+		for _, p := range tt.o {
+			if !sb.PrefixSet().Contains(p) {
+				t.Errorf("merged set does not contain %v", p)
+			}
+		}
+	}
+}
+
+func TestPrefixSetNodes(t *testing.T) {
+	type node struct {
+		p     netip.Prefix
+		entry bool
+	}
+	tests := []struct {
+		add  []netip.Prefix
+		want []node
+	}{
+		{pfxs(), nil},
+		{pfxs("10.0.0.0/8"), []node{{pfx("10.0.0.0/8"), true}}},
+		{
+			pfxs("10.0.0.0/24", "10.0.1.0/24", "10.0.0.0/8"),
+			[]node{
+				{pfx("10.0.0.0/8"), true},
+				{pfx("10.0.0.0/23"), false},
+				{pfx("10.0.0.0/24"), true},
+				{pfx("10.0.1.0/24"), true},
+			},
+		},
+		{
+			pfxs("2001:db8::/32", "2001:db8:2::/48", "2001:db8:1::/48", "10.0.0.0/8"),
+			[]node{
+				// IPv4 Prefixes are stored under ::ffff:0:0/96, which
+				// diverges from 2001:db8::/32 after 2 bits, so ::/2
+				// encompasses them and comes first.
+				{pfx("::/2"), false},
+				{pfx("10.0.0.0/8"), true},
+				{pfx("2001:db8::/32"), true},
+				{pfx("2001:db8::/46"), false},
+				{pfx("2001:db8:1::/48"), true},
+				{pfx("2001:db8:2::/48"), true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		psb := &PrefixSetBuilder{}
+		for _, p := range tt.add {
+			psb.Add(p)
+		}
+		var got []node
+		for p, entry := range psb.PrefixSet().Nodes() {
+			got = append(got, node{p, entry})
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Nodes() = %v, want %v", got, tt.want)
+		}
+	}
+}
+
+func TestPrefixSetDistribution(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	for _, p := range pfxs(
+		"10.0.0.0/8", "10.1.0.0/16", "10.2.0.0/16", "11.1.0.0/16", "12.0.0.0/7",
+		"2001:db8::/32", "2001:db8:1::/48",
+	) {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+
+	checkMap(t, map[netip.Prefix]int{
+		pfx("10.0.0.0/8"): 3,
+		pfx("11.0.0.0/8"): 1,
+		pfx("12.0.0.0/7"): 1,
+		pfx("2000::/8"):   2,
+	}, ps.Distribution(8))
+
+	checkMap(t, map[netip.Prefix]int{
+		pfx("10.0.0.0/8"):  1,
+		pfx("10.1.0.0/16"): 1,
+		pfx("10.2.0.0/16"): 1,
+		pfx("11.1.0.0/16"): 1,
+		pfx("12.0.0.0/7"):  1,
+		pfx("2001::/16"):   2,
+	}, ps.Distribution(16))
+}
+
+func TestPrefixSetHierarchyEdges(t *testing.T) {
+	tests := []struct {
+		set  []netip.Prefix
+		want [][2]string
+	}{
+		{pfxs(), nil},
+		{pfxs("::0/128", "::1/128"), nil},
+		{pfxs("::0/127", "::0/128", "::1/128"), [][2]string{
+			{"::/127", "::/128"},
+			{"::/127", "::1/128"},
+		}},
+		{
+			pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.0.0/16", "11.0.0.0/8", "11.1.0.0/16"),
+			[][2]string{
+				{"10.0.0.0/8", "10.1.0.0/16"},
+				{"10.1.0.0/16", "10.1.2.0/24"},
+				{"10.0.0.0/8", "10.2.0.0/16"},
+				{"11.0.0.0/8", "11.1.0.0/16"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		psb := &PrefixSetBuilder{}
+		for _, p := range tt.set {
+			psb.Add(p)
+		}
+		var got [][2]string
+		for parent, child := range psb.PrefixSet().HierarchyEdges() {
+			got = append(got, [2]string{parent.String(), child.String()})
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("HierarchyEdges() of %v = %v, want %v", tt.set, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixSetEncompassesAllIn(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	pmb := &PrefixMapBuilder[bool]{}
+	for _, p := range pfxs("10.1.0.0/16", "10.2.3.0/24", "2001:db8::/32", "2001:db8:1:2::/64") {
+		psb.Add(p)
+		pmb.Set(p, true)
+	}
+	ps := psb.PrefixSet()
+	pm := pmb.PrefixMap()
+
+	candidates := pfxs(
+		"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.2.3/32", "10.2.3.128/25", "10.2.4.0/24",
+		"11.0.0.0/8", "192.168.1.0/24", "2001:db8:1::/48", "2001:db9::/32", "::/0",
+	)
+	candidates = append(candidates, netip.Prefix{})
+	got := ps.EncompassesAllIn(pfx("10.0.0.0/8"), candidates)
+	want := []bool{false, true, true, true, true, false, false, false, true, false, false, false}
+	if !slices.Equal(got, want) {
+		t.Errorf("EncompassesAllIn(10.0.0.0/8, %v) = %v, want %v", candidates, got, want)
+	}
+
+	// Every window gives the same results as Encompasses.
+	for _, w := range append(pfxs(
+		"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.0.0/16", "192.168.0.0/16",
+		"2001:db8::/32", "2001:db8:1::/48", "2001:db8:1:2::/64", "::/0", "0.0.0.0/0",
+	), netip.Prefix{}) {
+		want := make([]bool, len(candidates))
+		for i, p := range candidates {
+			want[i] = ps.Encompasses(p)
+		}
+		if got := ps.EncompassesAllIn(w, candidates); !slices.Equal(got, want) {
+			t.Errorf("EncompassesAllIn(%s, %v) = %v, want %v", w, candidates, got, want)
+		}
+		if got := pm.EncompassesAllIn(w, candidates); !slices.Equal(got, want) {
+			t.Errorf("PrefixMap.EncompassesAllIn(%s, %v) = %v, want %v", w, candidates, got, want)
+		}
+	}
+}
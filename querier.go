@@ -0,0 +1,207 @@
+package netipds
+
+import "net/netip"
+
+// PrefixQuerier is the set of read-only queries shared by PrefixSet and
+// PrefixMap. Code that only needs to ask questions about a collection of
+// Prefixes can depend on PrefixQuerier rather than on a concrete type, which
+// allows remote, composite or fake implementations to be substituted.
+//
+// Queries that return values (e.g. PrefixMap.ParentOf) are not part of
+// PrefixQuerier, since their signatures depend on the value type; see
+// PrefixMapQuerier.
+type PrefixQuerier interface {
+	// Contains returns true if the collection includes the exact Prefix
+	// provided.
+	Contains(p netip.Prefix) bool
+
+	// Encompasses returns true if the collection includes a Prefix which
+	// completely encompasses the provided Prefix.
+	Encompasses(p netip.Prefix) bool
+
+	// EncompassesStrict is like Encompasses, but the provided Prefix itself
+	// is not considered.
+	EncompassesStrict(p netip.Prefix) bool
+
+	// OverlapsPrefix returns true if the collection includes a Prefix which
+	// overlaps the provided Prefix.
+	OverlapsPrefix(p netip.Prefix) bool
+}
+
+// PrefixMapQuerier extends PrefixQuerier with the read-only queries of
+// PrefixMap that return values, so that code looking up values can likewise
+// depend on an interface rather than on PrefixMap itself.
+type PrefixMapQuerier[T any] interface {
+	PrefixQuerier
+
+	// ParentOf returns the longest-prefix ancestor of the Prefix provided,
+	// including the Prefix itself unless Strict is among opts, and its
+	// value, if any.
+	ParentOf(p netip.Prefix, opts ...QueryOption) (netip.Prefix, T, bool)
+
+	// LookupAddr returns the longest-prefix entry that contains addr, if
+	// any.
+	LookupAddr(addr netip.Addr) (netip.Prefix, T, bool)
+}
+
+var (
+	_ PrefixQuerier         = (*PrefixSet)(nil)
+	_ PrefixQuerier         = (*PrefixMap[any])(nil)
+	_ PrefixMapQuerier[any] = (*PrefixMap[any])(nil)
+)
+
+// QueryOption configures a query: the ancestor and descendant queries of
+// PrefixMap and PrefixSet, such as ParentOf, RootOf, AncestorsOf and
+// DescendantsOf, and the queries made through a PrefixQuerier returned by
+// PrefixSet.Querier or PrefixMap.Querier. Each option documents the queries
+// it applies to; the others ignore it. New query behaviors are added as
+// QueryOptions rather than as new methods.
+type QueryOption func(*queryConfig)
+
+type queryConfig struct {
+	unmapV4 bool
+	strict  bool
+
+	// maxLen is the maximum length of the entries considered, if limitLen is
+	// set.
+	maxLen   int
+	limitLen bool
+}
+
+func newQueryConfig(opts []QueryOption) queryConfig {
+	var c queryConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// ancestor returns the node holding the entry of t that an ancestor query
+// for p returns according to c: the shortest such entry if root is set, and
+// otherwise the longest, or nil if there is none.
+func ancestor[T any](t *tree[T], p netip.Prefix, c queryConfig, root bool) (ret *tree[T]) {
+	k := keyFromPrefix(p)
+	t.ancestors(k, func(n *tree[T]) bool {
+		if (c.strict && n.key.equalFromRoot(k)) || !c.includes(n.key) {
+			return true
+		}
+		ret = n
+		return !root
+	})
+	return
+}
+
+// queryDescendants returns a tree holding the entries of t that
+// DescendantsOf returns for p according to c.
+func queryDescendants[T any](t *tree[T], p netip.Prefix, c queryConfig) *tree[T] {
+	ret := t.descendantsOf(keyFromPrefix(p), c.strict)
+	if c.limitLen {
+		ret = ret.filterKeys(c.includes)
+	}
+	return ret
+}
+
+// queryAncestors returns a tree holding the entries of t that AncestorsOf
+// returns for p according to c.
+func queryAncestors[T any](t *tree[T], p netip.Prefix, c queryConfig) *tree[T] {
+	ret := t.ancestorsOf(keyFromPrefix(p), c.strict)
+	if c.limitLen {
+		ret = ret.filterKeys(c.includes)
+	}
+	return ret
+}
+
+// includes reports whether an entry for k may be in the result of an
+// ancestor or descendant query according to c, as far as MaxLen is
+// concerned.
+func (c queryConfig) includes(k key) bool {
+	return !c.limitLen || k.prefixBits() <= c.maxLen
+}
+
+// Strict causes the queried Prefix itself to be excluded from the results of
+// an ancestor or descendant query (ParentOf, RootOf, AncestorsOf or
+// DescendantsOf), so that only entries strictly encompassing it, or strictly
+// encompassed by it, are considered.
+func Strict() QueryOption {
+	return func(c *queryConfig) { c.strict = true }
+}
+
+// MaxLen causes an ancestor or descendant query (ParentOf, RootOf,
+// AncestorsOf or DescendantsOf) to only consider entries whose Prefixes are
+// at most n bits long, e.g. MaxLen(24) ignores entries more specific than a
+// /24.
+func MaxLen(n int) QueryOption {
+	return func(c *queryConfig) { c.maxLen, c.limitLen = max(n, 0), true }
+}
+
+// TreatV4MappedAsV4 causes the queries made through a PrefixQuerier returned
+// by Querier to treat IPv4-mapped IPv6 Prefixes (e.g. ::ffff:10.0.0.0/104) as
+// the IPv4 Prefixes they map (e.g. 10.0.0.0/8), as the methods of PrefixSet
+// and PrefixMap always do.
+//
+// Without this option, an IPv4-mapped Prefix is treated as an IPv6 Prefix: it
+// is never contained in the collection, and is only encompassed by IPv6
+// Prefixes.
+func TreatV4MappedAsV4() QueryOption {
+	return func(c *queryConfig) { c.unmapV4 = true }
+}
+
+// optionQuerier implements PrefixQuerier over a tree, according to a
+// queryConfig.
+type optionQuerier[T any] struct {
+	tree *tree[T]
+	cfg  queryConfig
+}
+
+func newOptionQuerier[T any](t *tree[T], opts []QueryOption) *optionQuerier[T] {
+	return &optionQuerier[T]{tree: t, cfg: newQueryConfig(opts)}
+}
+
+// mapped reports whether p must be queried as an IPv4-mapped IPv6 Prefix
+// rather than as the IPv4 Prefix it shares a key with.
+func (q *optionQuerier[T]) mapped(p netip.Prefix) bool {
+	return !q.cfg.unmapV4 && p.Addr().Is4In6() && p.Bits() >= 96
+}
+
+// encompassedBy6 returns true if the tree includes an IPv6 key which
+// encompasses k.
+func (q *optionQuerier[T]) encompassedBy6(k key) (ret bool) {
+	q.tree.walk(k, func(n *tree[T]) bool {
+		ret = n.hasValue && !n.key.is4() && n.key.isPrefixOf(k)
+		return ret
+	})
+	return
+}
+
+func (q *optionQuerier[T]) Contains(p netip.Prefix) bool {
+	if q.mapped(p) {
+		// The collection never holds IPv4-mapped Prefixes as such.
+		return false
+	}
+	return q.tree.contains(keyFromPrefix(p))
+}
+
+func (q *optionQuerier[T]) Encompasses(p netip.Prefix) bool {
+	if q.mapped(p) {
+		return q.encompassedBy6(keyFromPrefix(p))
+	}
+	return q.tree.encompasses(keyFromPrefix(p), false)
+}
+
+func (q *optionQuerier[T]) EncompassesStrict(p netip.Prefix) bool {
+	if q.mapped(p) {
+		// No IPv6 key is equal to p's key, so this is the same as
+		// Encompasses.
+		return q.encompassedBy6(keyFromPrefix(p))
+	}
+	return q.tree.encompasses(keyFromPrefix(p), true)
+}
+
+func (q *optionQuerier[T]) OverlapsPrefix(p netip.Prefix) bool {
+	if q.mapped(p) {
+		// Every key encompassed by p's key is an IPv4 key, so only
+		// encompassing IPv6 keys can overlap p.
+		return q.encompassedBy6(keyFromPrefix(p))
+	}
+	return p.IsValid() && q.tree.overlapsKey(keyFromPrefix(p))
+}
@@ -0,0 +1,91 @@
+package netipds
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestQuerierV4Mapped(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	psb.Add(pfx("10.0.0.0/8"))
+	psb.Add(pfx("2001:db8::/32"))
+	ps := psb.PrefixSet()
+
+	strict := ps.Querier()
+	unmapped := ps.Querier(TreatV4MappedAsV4())
+
+	type result struct{ contains, encompasses, encompassesStrict, overlaps bool }
+	query := func(q PrefixQuerier, p netip.Prefix) result {
+		return result{q.Contains(p), q.Encompasses(p), q.EncompassesStrict(p), q.OverlapsPrefix(p)}
+	}
+	tests := []struct {
+		p            netip.Prefix
+		wantStrict   result
+		wantUnmapped result
+	}{
+		{pfx("10.0.0.0/8"), result{true, true, false, true}, result{true, true, false, true}},
+		{pfx("10.1.0.0/16"), result{false, true, true, true}, result{false, true, true, true}},
+		{pfx("::ffff:10.0.0.0/104"), result{}, result{true, true, false, true}},
+		{pfx("::ffff:10.1.0.0/112"), result{}, result{false, true, true, true}},
+		{pfx("::ffff:0.0.0.0/96"), result{}, result{false, false, false, true}},
+		// Not IPv4-mapped, since it is shorter than 96 bits
+		{pfx("::ffff:0:0/80"), result{false, false, false, true}, result{false, false, false, true}},
+		{pfx("2001:db8::/32"), result{true, true, false, true}, result{true, true, false, true}},
+		{pfx("2001:db9::/32"), result{}, result{}},
+	}
+	for _, tt := range tests {
+		if got := query(strict, tt.p); got != tt.wantStrict {
+			t.Errorf("strict query of %v = %+v, want %+v", tt.p, got, tt.wantStrict)
+		}
+		if got := query(unmapped, tt.p); got != tt.wantUnmapped {
+			t.Errorf("unmapped query of %v = %+v, want %+v", tt.p, got, tt.wantUnmapped)
+		}
+		if got := query(ps, tt.p); got != tt.wantUnmapped {
+			t.Errorf("query of %v = %+v, want %+v", tt.p, got, tt.wantUnmapped)
+		}
+	}
+
+	// IPv4-mapped Prefixes are encompassed by IPv6 Prefixes when strict.
+	psb.Add(pfx("::ffff:0:0/95"))
+	if !psb.PrefixSet().Querier().Encompasses(pfx("::ffff:10.0.0.0/104")) {
+		t.Errorf("strict Encompasses(::ffff:10.0.0.0/104) = false, want true")
+	}
+}
+
+// fakeMapQuerier is a PrefixMapQuerier that maps every address to a single
+// entry, as a stand-in for e.g. a remote lookup service.
+type fakeMapQuerier struct {
+	PrefixQuerier
+	p netip.Prefix
+	v int
+}
+
+func (f fakeMapQuerier) ParentOf(p netip.Prefix, _ ...QueryOption) (netip.Prefix, int, bool) {
+	return f.p, f.v, f.p.Overlaps(p) && f.p.Bits() <= p.Bits()
+}
+
+func (f fakeMapQuerier) LookupAddr(addr netip.Addr) (netip.Prefix, int, bool) {
+	return f.p, f.v, f.p.Contains(addr)
+}
+
+func TestPrefixMapQuerier(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	pmb.Set(pfx("10.0.0.0/8"), 1)
+	pm := pmb.PrefixMap()
+	fake := fakeMapQuerier{pm, pfx("10.0.0.0/8"), 1}
+
+	for _, q := range []PrefixMapQuerier[int]{pm, fake} {
+		if p, v, ok := q.ParentOf(pfx("10.1.0.0/16")); p != pfx("10.0.0.0/8") || v != 1 || !ok {
+			t.Errorf("%T.ParentOf(10.1.0.0/16) = %v, %v, %v", q, p, v, ok)
+		}
+		if _, _, ok := q.ParentOf(pfx("11.0.0.0/8")); ok {
+			t.Errorf("%T.ParentOf(11.0.0.0/8) found an entry", q)
+		}
+		if p, v, ok := q.LookupAddr(netip.MustParseAddr("10.1.2.3")); p != pfx("10.0.0.0/8") || v != 1 || !ok {
+			t.Errorf("%T.LookupAddr(10.1.2.3) = %v, %v, %v", q, p, v, ok)
+		}
+		if !q.Encompasses(pfx("10.1.0.0/16")) {
+			t.Errorf("%T.Encompasses(10.1.0.0/16) = false", q)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+)
+
+// Quota is the capacity and usage of a Prefix in a QuotaMap.
+type Quota struct {
+	Capacity uint64
+	Usage    uint64
+}
+
+// QuotaMap accounts usage against a hierarchy of capacities. Each Prefix in
+// the map has its own capacity, and usage charged to an address counts
+// against every Prefix that encompasses it, e.g. a per-/32 quota, a per-/24
+// quota and a quota for a tenant's aggregate.
+//
+// A QuotaMap is safe for concurrent use. Use NewQuotaMap to construct a
+// QuotaMap.
+type QuotaMap struct {
+	mu     sync.Mutex
+	quotas PrefixMap[*Quota]
+}
+
+// NewQuotaMap returns a QuotaMap with the provided capacities. Usage of each
+// Prefix starts at zero.
+func NewQuotaMap(capacities *PrefixMap[uint64]) *QuotaMap {
+	quotas := mapTree(&capacities.tree, func(c uint64) *Quota {
+		return &Quota{Capacity: c}
+	})
+	return &QuotaMap{quotas: PrefixMap[*Quota]{tree: *quotas}}
+}
+
+// path returns the quotas of the Prefixes that encompass addr, ordered from
+// shortest to longest.
+func (q *QuotaMap) path(addr netip.Addr) []Entry[*Quota] {
+	return q.quotas.PathOf(netip.PrefixFrom(addr, addr.BitLen()))
+}
+
+// Charge adds n to the usage of every Prefix that encompasses addr. If doing
+// so would take any of them over its capacity, Charge returns an error naming
+// the shortest such Prefix and leaves all usage unchanged. Addresses that are
+// not encompassed by any Prefix in q are charged to nothing.
+func (q *QuotaMap) Charge(addr netip.Addr, n uint64) error {
+	if !addr.IsValid() {
+		return fmt.Errorf("Address is not valid: %v", addr)
+	}
+	path := q.path(addr)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, e := range path {
+		if e.Value.Usage+n < e.Value.Usage || e.Value.Usage+n > e.Value.Capacity {
+			return fmt.Errorf("quota exceeded for %v", e.Prefix)
+		}
+	}
+	for _, e := range path {
+		e.Value.Usage += n
+	}
+	return nil
+}
+
+// Release subtracts n from the usage of every Prefix that encompasses addr,
+// e.g. to return a charge that is no longer in use. Usage does not go below
+// zero.
+func (q *QuotaMap) Release(addr netip.Addr, n uint64) {
+	if !addr.IsValid() {
+		return
+	}
+	path := q.path(addr)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, e := range path {
+		e.Value.Usage -= min(n, e.Value.Usage)
+	}
+}
+
+// Get returns the capacity and current usage of p, if p is in q.
+func (q *QuotaMap) Get(p netip.Prefix) (Quota, bool) {
+	v, ok := q.quotas.Get(p)
+	if !ok {
+		return Quota{}, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return *v, true
+}
@@ -0,0 +1,111 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func TestQuotaMap(t *testing.T) {
+	cb := &PrefixMapBuilder[uint64]{}
+	cb.Set(pfx("10.0.0.0/8"), 10)
+	cb.Set(pfx("10.1.0.0/16"), 6)
+	cb.Set(pfx("10.1.2.0/24"), 4)
+	cb.Set(pfx("2001:db8::/32"), 3)
+	q := NewQuotaMap(cb.PrefixMap())
+
+	addr := netip.MustParseAddr
+	steps := []struct {
+		addr    string
+		n       uint64
+		release bool
+		wantErr bool
+	}{
+		{"10.1.2.3", 3, false, false},
+		// Would exceed 10.1.2.0/24
+		{"10.1.2.4", 2, false, true},
+		// Charged to 10.1.0.0/16 and 10.0.0.0/8 only
+		{"10.1.3.1", 3, false, false},
+		// Would exceed 10.1.0.0/16, though 10.1.2.0/24 has room
+		{"10.1.2.3", 1, false, true},
+		{"10.2.0.1", 4, false, false},
+		// Would exceed 10.0.0.0/8
+		{"10.2.0.1", 1, false, true},
+		{"10.1.2.3", 1, true, false},
+		{"10.2.0.1", 1, false, false},
+		// Not encompassed by any quota
+		{"11.0.0.1", 100, false, false},
+		{"2001:db8::1", 3, false, false},
+		{"2001:db8::1", 1, false, true},
+		// Usage does not go below zero
+		{"2001:db8::1", 5, true, false},
+		{"2001:db8::1", 3, false, false},
+		// Overflow
+		{"2001:db8::1", ^uint64(0), false, true},
+	}
+	for _, s := range steps {
+		if s.release {
+			q.Release(addr(s.addr), s.n)
+			continue
+		}
+		if err := q.Charge(addr(s.addr), s.n); (err != nil) != s.wantErr {
+			t.Errorf("Charge(%s, %d) error = %v, want error %v", s.addr, s.n, err, s.wantErr)
+		}
+	}
+	if err := q.Charge(netip.Addr{}, 1); err == nil {
+		t.Errorf("Charge of invalid Addr succeeded")
+	}
+
+	for _, tt := range []struct {
+		p    string
+		want Quota
+		ok   bool
+	}{
+		{"10.0.0.0/8", Quota{Capacity: 10, Usage: 10}, true},
+		{"10.1.0.0/16", Quota{Capacity: 6, Usage: 5}, true},
+		{"10.1.2.0/24", Quota{Capacity: 4, Usage: 2}, true},
+		{"2001:db8::/32", Quota{Capacity: 3, Usage: 3}, true},
+		{"11.0.0.0/8", Quota{}, false},
+	} {
+		got, ok := q.Get(pfx(tt.p))
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Get(%s) = %+v, %v, want %+v, %v", tt.p, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestQuotaMapConcurrent(t *testing.T) {
+	cb := &PrefixMapBuilder[uint64]{}
+	cb.Set(pfx("10.0.0.0/8"), 100)
+	cb.Set(pfx("10.1.0.0/16"), 1000)
+	q := NewQuotaMap(cb.PrefixMap())
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+		ok int
+	)
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a := netip.AddrFrom4([4]byte{10, byte(i % 2), 0, 1})
+			for range 50 {
+				if q.Charge(a, 1) == nil {
+					mu.Lock()
+					ok++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if ok != 100 {
+		t.Errorf("%d charges succeeded, want 100", ok)
+	}
+	if got, _ := q.Get(pfx("10.0.0.0/8")); got.Usage != 100 {
+		t.Errorf("usage of 10.0.0.0/8 = %d, want 100", got.Usage)
+	}
+}
@@ -0,0 +1,48 @@
+package netipds
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// rangeKeys calls fn with each key in the minimal list of keys that exactly
+// covers the addresses from first to last, inclusive, in ascending order.
+// first and last must be valid addresses of the same family, with first <=
+// last; otherwise rangeKeys returns an error without calling fn.
+func rangeKeys(first, last netip.Addr, fn func(key)) error {
+	if !first.IsValid() || !last.IsValid() {
+		return fmt.Errorf("range is not valid: %v-%v", first, last)
+	}
+	if first.Is4() != last.Is4() {
+		return fmt.Errorf("range endpoints are of different families: %v-%v", first, last)
+	}
+	if last.Less(first) {
+		return fmt.Errorf("range end is before range start: %v-%v", first, last)
+	}
+	var minLen uint8
+	if first.Is4() {
+		minLen = 96
+	}
+	splitRange(u128From16(first.As16()), u128From16(last.As16()), minLen, fn)
+	return nil
+}
+
+// splitRange calls fn with each key in the minimal list of keys of length at
+// least minLen that exactly covers the values from lo to hi, inclusive, in
+// ascending order. lo must be <= hi, and lo and hi must share their first
+// minLen bits.
+func splitRange(lo, hi uint128, minLen uint8, fn func(key)) {
+	for {
+		// Find the shortest key starting at lo that doesn't extend past hi.
+		n := minLen
+		for lo.bitsClearedFrom(n) != lo || hi.less(lo.bitsSetFrom(n)) {
+			n++
+		}
+		fn(newKey(lo, 0, n))
+		end := lo.bitsSetFrom(n)
+		if end == hi {
+			return
+		}
+		lo = end.addOne()
+	}
+}
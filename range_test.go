@@ -0,0 +1,41 @@
+package netipds
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestRangeKeys(t *testing.T) {
+	addr := netip.MustParseAddr
+	tests := []struct {
+		first   netip.Addr
+		last    netip.Addr
+		want    []netip.Prefix
+		wantErr bool
+	}{
+		{addr("::0"), addr("::0"), pfxs("::0/128"), false},
+		{addr("::0"), addr("::1"), pfxs("::0/127"), false},
+		{addr("::1"), addr("::2"), pfxs("::1/128", "::2/128"), false},
+		{addr("::1"), addr("::6"), pfxs("::1/128", "::2/127", "::4/127", "::6/128"), false},
+		{addr("8000::"), addr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), pfxs("8000::/1"), false},
+		{addr("10.0.0.0"), addr("10.0.0.255"), pfxs("10.0.0.0/24"), false},
+		{addr("10.0.0.1"), addr("10.0.0.4"), pfxs("10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/32"), false},
+		{addr("0.0.0.0"), addr("255.255.255.255"), pfxs("0.0.0.0/0"), false},
+		{addr("255.255.255.255"), addr("255.255.255.255"), pfxs("255.255.255.255/32"), false},
+
+		// Invalid ranges
+		{addr("::1"), addr("::0"), pfxs(), true},
+		{addr("10.0.0.0"), addr("::1"), pfxs(), true},
+		{netip.Addr{}, addr("::1"), pfxs(), true},
+	}
+	for _, tt := range tests {
+		got := []netip.Prefix{}
+		err := rangeKeys(tt.first, tt.last, func(k key) {
+			got = append(got, prefixFromKey(k))
+		})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("rangeKeys(%v, %v) = %v, want error: %v", tt.first, tt.last, err, tt.wantErr)
+		}
+		checkPrefixSlice(t, got, tt.want)
+	}
+}
@@ -0,0 +1,245 @@
+package netipds
+
+import (
+	"net/netip"
+	"sync/atomic"
+)
+
+// rankIndex records the number of entries beneath each node of a tree, so
+// that entries can be found by their position in the order visited by walk,
+// and vice versa, in time proportional to the depth of the tree.
+type rankIndex[T any] struct {
+	// counts holds the number of entries at or below each node, excluding
+	// the root node, which walk never visits.
+	counts map[*tree[T]]int
+
+	// path holds the entries whose keys encompass ::ffff:0:0/96, from the
+	// shortest to the longest. walk visits them first.
+	path []*tree[T]
+
+	// v4 is the topmost node within ::ffff:0:0/96, if any. walk visits v4
+	// and its descendants after path, and before all other nodes.
+	v4 *tree[T]
+}
+
+// rankCache holds the rankIndex of an immutable tree, built on first use.
+// The zero value is ready to use.
+type rankCache[T any] struct {
+	idx atomic.Pointer[rankIndex[T]]
+}
+
+// get returns the cached rankIndex of t, building it if necessary.
+func (c *rankCache[T]) get(t *tree[T]) *rankIndex[T] {
+	if idx := c.idx.Load(); idx != nil {
+		return idx
+	}
+	idx := &rankIndex[T]{counts: make(map[*tree[T]]int), v4: t.v4Root()}
+	idx.count(t, true)
+	if t.key.encompasses4() {
+		for n := t.toward(v4Key); n != nil && n.key.encompasses4(); n = n.toward(v4Key) {
+			if n.hasValue {
+				idx.path = append(idx.path, n)
+			}
+		}
+	}
+	c.idx.Store(idx)
+	return idx
+}
+
+// count records the number of entries at or below t, and returns it.
+func (idx *rankIndex[T]) count(t *tree[T], root bool) int {
+	n := 0
+	if t.hasValue && !root {
+		n = 1
+	}
+	for _, c := range [...]*tree[T]{t.left, t.right} {
+		if c != nil {
+			n += idx.count(c, false)
+		}
+	}
+	idx.counts[t] = n
+	return n
+}
+
+// visible returns the number of entries at or below t that walk visits in
+// the same pass as t. The entries in path and the IPv4 entries are visited
+// in passes of their own, so they are excluded from the counts of their
+// ancestors.
+func (idx *rankIndex[T]) visible(t *tree[T]) int {
+	switch {
+	case t == nil || t == idx.v4:
+		return 0
+	case !t.key.encompasses4():
+		return idx.counts[t]
+	}
+	n := idx.counts[t]
+	if idx.v4 != nil {
+		n -= idx.counts[idx.v4]
+	}
+	for _, p := range idx.path {
+		if t.key.isPrefixOf(p.key) {
+			n--
+		}
+	}
+	return n
+}
+
+// counted reports whether n holds an entry that walk visits in the same pass
+// as n's descendants.
+func counted[T any](root, n *tree[T]) bool {
+	return n.hasValue && n != root && !n.key.encompasses4()
+}
+
+// at returns the node holding the i'th entry visited by root.walk, or nil if
+// there is no such entry.
+func (idx *rankIndex[T]) at(root *tree[T], i int) *tree[T] {
+	if i < 0 {
+		return nil
+	}
+	if i < len(idx.path) {
+		return idx.path[i]
+	}
+	i -= len(idx.path)
+	n := root
+	if idx.v4 != nil {
+		if n4 := idx.counts[idx.v4]; i < n4 {
+			n = idx.v4
+		} else {
+			i -= n4
+		}
+	}
+	for n != nil {
+		if counted(root, n) {
+			if i == 0 {
+				return n
+			}
+			i--
+		}
+		if l := idx.visible(n.left); i < l {
+			n = n.left
+		} else {
+			i -= l
+			n = n.right
+		}
+	}
+	return nil
+}
+
+// indexOf returns the position of the entry with key k in the order visited
+// by root.walk, if there is such an entry.
+func (idx *rankIndex[T]) indexOf(root *tree[T], k key) (int, bool) {
+	if k.encompasses4() {
+		for i, p := range idx.path {
+			if p.key.len == k.len {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+	i := len(idx.path)
+	n := root
+	if idx.v4 != nil {
+		if idx.v4.key.isPrefixOf(k) {
+			n = idx.v4
+		} else {
+			i += idx.counts[idx.v4]
+		}
+	}
+	for n != nil {
+		common := n.key.commonPrefixLen(k)
+		if common < n.key.len {
+			return 0, false
+		}
+		zero, ok := k.hasBitZeroAt(common)
+		if !ok {
+			// n has key k.
+			return i, n.hasValue && n != root
+		}
+		if counted(root, n) {
+			i++
+		}
+		if zero {
+			n = n.left
+		} else {
+			i += idx.visible(n.left)
+			n = n.right
+		}
+	}
+	return 0, false
+}
+
+// lowerBound returns the position in the order visited by root.walk of the
+// first entry whose key is not ordered before k, or the number of entries if
+// there is none.
+func (idx *rankIndex[T]) lowerBound(root *tree[T], k key) int {
+	if k.encompasses4() {
+		// The entries in path are ordered from the shortest to the longest.
+		i := 0
+		for i < len(idx.path) && idx.path[i].key.len < k.len {
+			i++
+		}
+		return i
+	}
+	i := len(idx.path)
+	n := root
+	size := idx.visible
+	if k.is4() {
+		// The IPv4 entries are visited next, in a pass of their own.
+		n = idx.v4
+		size = func(t *tree[T]) int { return idx.counts[t] }
+	} else if idx.v4 != nil {
+		i += idx.counts[idx.v4]
+	}
+	for n != nil {
+		common := n.key.commonPrefixLen(k)
+		zero, ok := k.hasBitZeroAt(common)
+		if !ok {
+			// k is a prefix of n's key, so no entry at or below n is
+			// ordered before k.
+			return i
+		}
+		if common < n.key.len {
+			// k and n's key differ at bit common, so either all of the
+			// entries at or below n are ordered before k, or none is.
+			if zero {
+				return i
+			}
+			return i + size(n)
+		}
+		if counted(root, n) {
+			i++
+		}
+		if zero {
+			n = n.left
+		} else {
+			i += size(n.left)
+			n = n.right
+		}
+	}
+	return i
+}
+
+// At returns the Prefix at index i of s in the order of Prefixes, without
+// building that list. If i is out of range, At returns the zero Prefix and
+// false.
+//
+// The first call to At or IndexOf on s builds an index of the tree in which s
+// is stored, taking time and memory proportional to the size of s.
+// Thereafter, each call takes time proportional to the length of the Prefix
+// found, so a large set can be paged through efficiently.
+func (s *PrefixSet) At(i int) (netip.Prefix, bool) {
+	n := s.rank.get(&s.tree).at(&s.tree, i)
+	if n == nil {
+		return netip.Prefix{}, false
+	}
+	return prefixFromKey(n.key), true
+}
+
+// IndexOf returns the index of p in the order of Prefixes, if p is in s. See
+// At.
+func (s *PrefixSet) IndexOf(p netip.Prefix) (int, bool) {
+	if !p.IsValid() {
+		return 0, false
+	}
+	return s.rank.get(&s.tree).indexOf(&s.tree, keyFromPrefix(p))
+}
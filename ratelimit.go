@@ -0,0 +1,129 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Limit configures a token bucket rate limit attached to a Prefix in a
+// RateLimiter.
+type Limit struct {
+	// Rate is the number of tokens added to the bucket per second.
+	Rate float64
+
+	// Burst is the capacity of the bucket. Buckets start full.
+	Burst float64
+
+	// AggregateBits, if positive, gives each Prefix of this length within
+	// the limited Prefix its own bucket; e.g. 24 limits each IPv4 /24
+	// separately. Otherwise, all addresses within the limited Prefix share a
+	// single bucket. AggregateBits should be no shorter than the limited
+	// Prefix, and is capped at the length of its address family.
+	AggregateBits int
+}
+
+// RateLimiter applies token bucket rate limits to addresses, according to
+// the most specific Prefix with a Limit that encompasses each address.
+//
+// A RateLimiter is safe for concurrent use. Use NewRateLimiter to construct a
+// RateLimiter.
+type RateLimiter struct {
+	limits PrefixMap[*limitState]
+}
+
+// limitState holds the buckets of a single Limit.
+type limitState struct {
+	limit Limit
+
+	mu sync.Mutex
+	// buckets holds the bucket of each aggregation Prefix within the limited
+	// Prefix, or a single bucket keyed by the limited Prefix itself.
+	buckets map[netip.Prefix]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter that enforces the provided limits.
+func NewRateLimiter(limits *PrefixMap[Limit]) *RateLimiter {
+	states := mapTree(&limits.tree, func(l Limit) *limitState {
+		return &limitState{limit: l, buckets: make(map[netip.Prefix]*tokenBucket)}
+	})
+	return &RateLimiter{limits: PrefixMap[*limitState]{tree: *states}}
+}
+
+// Allow is shorthand for AllowN(addr, time.Now(), 1).
+func (r *RateLimiter) Allow(addr netip.Addr) bool {
+	return r.AllowN(addr, time.Now(), 1)
+}
+
+// AllowN reports whether n tokens can be consumed at time now from the
+// bucket that applies to addr, and if so, consumes them. Addresses that are
+// not encompassed by any limited Prefix are always allowed.
+func (r *RateLimiter) AllowN(addr netip.Addr, now time.Time, n float64) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	p, s, ok := r.limits.ParentOf(netip.PrefixFrom(addr, addr.BitLen()))
+	if !ok {
+		return true
+	}
+	if bits := s.limit.AggregateBits; bits > 0 {
+		// AggregateBits is a length in the family of the limited Prefix,
+		// which may differ from addr's: an IPv4-mapped address matches IPv4
+		// Prefixes, and an IPv4 address matches IPv6 Prefixes such as ::/8.
+		if p.Addr().Is4() {
+			addr = addr.Unmap()
+		} else if addr.Is4() {
+			addr = netip.AddrFrom16(addr.As16())
+		}
+		p = netip.PrefixFrom(addr, min(bits, addr.BitLen())).Masked()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[p]
+	if !ok {
+		b = &tokenBucket{tokens: s.limit.Burst, last: now}
+		s.buckets[p] = b
+	}
+	b.refill(s.limit, now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// refill adds the tokens accumulated since b was last refilled.
+func (b *tokenBucket) refill(l Limit, now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(l.Burst, b.tokens+elapsed.Seconds()*l.Rate)
+		b.last = now
+	}
+}
+
+// Prune discards the buckets that would be full at time now. Since a missing
+// bucket behaves as a full one, this does not affect future decisions, but
+// bounds the memory used by limits with AggregateBits set.
+func (r *RateLimiter) Prune(now time.Time) {
+	r.limits.tree.walk(key{}, func(n *tree[*limitState]) bool {
+		if !n.hasValue {
+			return false
+		}
+		s := n.value
+		s.mu.Lock()
+		for p, b := range s.buckets {
+			if b.refill(s.limit, now); b.tokens >= s.limit.Burst {
+				delete(s.buckets, p)
+			}
+		}
+		s.mu.Unlock()
+		return false
+	})
+}
@@ -0,0 +1,99 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	lb := &PrefixMapBuilder[Limit]{}
+	lb.Set(pfx("10.0.0.0/8"), Limit{Rate: 1, Burst: 2, AggregateBits: 24})
+	lb.Set(pfx("10.1.0.0/16"), Limit{Rate: 1, Burst: 1})
+	lb.Set(pfx("2001:db8::/32"), Limit{Rate: 10, Burst: 1, AggregateBits: 64})
+	rl := NewRateLimiter(lb.PrefixMap())
+
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	addr := netip.MustParseAddr
+	steps := []struct {
+		addr string
+		at   time.Duration
+		want bool
+	}{
+		// Each /24 in 10.0.0.0/8 has its own bucket of 2
+		{"10.0.0.1", 0, true},
+		{"10.0.0.2", 0, true},
+		{"10.0.0.3", 0, false},
+		{"10.0.1.1", 0, true},
+		// Refilled at 1 token per second
+		{"10.0.0.1", time.Second, true},
+		{"10.0.0.1", time.Second, false},
+		// The more specific 10.1.0.0/16 shares a single bucket of 1
+		{"10.1.0.1", 0, true},
+		{"10.1.255.1", 0, false},
+		{"10.1.255.1", time.Second, true},
+		// IPv4-mapped addresses share the buckets of the IPv4 addresses they
+		// map
+		{"::ffff:10.0.2.1", 0, true},
+		{"::ffff:10.0.3.1", 0, true},
+		{"::ffff:10.0.4.1", 0, true},
+		{"10.0.2.2", 0, true},
+		{"::ffff:10.0.2.3", 0, false},
+		// Per-/64 buckets
+		{"2001:db8::1", 0, true},
+		{"2001:db8::2", 0, false},
+		{"2001:db8:0:1::1", 0, true},
+		{"2001:db8::2", 100 * time.Millisecond, true},
+		// Unlimited
+		{"192.168.0.1", 0, true},
+		{"192.168.0.1", 0, true},
+	}
+	for i, s := range steps {
+		if got := rl.AllowN(addr(s.addr), t0.Add(s.at), 1); got != s.want {
+			t.Errorf("step %d: AllowN(%s, +%v) = %v, want %v", i, s.addr, s.at, got, s.want)
+		}
+	}
+
+	// After enough time, every bucket is full and can be pruned.
+	rl.Prune(t0.Add(time.Minute))
+	rl.limits.tree.walk(key{}, func(n *tree[*limitState]) bool {
+		if n.hasValue && len(n.value.buckets) != 0 {
+			t.Errorf("%v has %d buckets after Prune", n.key, len(n.value.buckets))
+		}
+		return false
+	})
+	if !rl.AllowN(addr("10.1.0.1"), t0.Add(time.Minute), 1) {
+		t.Errorf("AllowN after Prune = false, want true")
+	}
+}
+
+func TestRateLimiterConcurrent(t *testing.T) {
+	lb := &PrefixMapBuilder[Limit]{}
+	lb.Set(pfx("10.0.0.0/8"), Limit{Rate: 0, Burst: 100})
+	rl := NewRateLimiter(lb.PrefixMap())
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if rl.AllowN(netip.MustParseAddr("10.0.0.1"), now, 1) {
+					mu.Lock()
+					allowed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 100 {
+		t.Errorf("allowed %d of 400 concurrent requests, want 100", allowed)
+	}
+}
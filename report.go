@@ -0,0 +1,159 @@
+package netipds
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// BuildReport summarizes the inputs received by a builder, for auditing data
+// loads. Counts accumulate over the lifetime of the builder.
+type BuildReport struct {
+	// Duplicates is the number of insertions of a Prefix that was already
+	// present. For maps, each such insertion overwrote the previous value.
+	Duplicates int
+
+	// Normalized is the number of Prefixes inserted with non-zero host bits,
+	// which were cleared (as by netip.Prefix.Masked).
+	Normalized int
+
+	// Invalid is the number of inputs rejected with an error.
+	Invalid int
+
+	// V4Mapped is the number of IPv4-mapped IPv6 inputs (those within
+	// ::ffff:0:0/96) that were accepted. Each was stored as the IPv4 Prefix
+	// it maps, so it may have merged with an IPv4 input.
+	V4Mapped int
+
+	// Entries4 and Entries6 are the number of IPv4 and IPv6 entries present
+	// when the report was produced.
+	Entries4 int
+	Entries6 int
+}
+
+// buildStats tracks the counters reported in a BuildReport. The zero value is
+// ready to use.
+type buildStats struct {
+	duplicates int
+	normalized int
+	invalid    int
+	v4Mapped   int
+}
+
+// recordNormalized records whether p will be normalized upon insertion.
+func (st *buildStats) recordNormalized(p netip.Prefix) {
+	if p != p.Masked() {
+		st.normalized++
+	}
+}
+
+// admitV4Mapped records an IPv4-mapped IPv6 input, returning an error (and
+// counting it as invalid) if reject is set.
+func (st *buildStats) admitV4Mapped(reject bool, input any) error {
+	if reject {
+		st.invalid++
+		return fmt.Errorf("IPv4-mapped IPv6 input is not allowed: %v", input)
+	}
+	st.v4Mapped++
+	return nil
+}
+
+// Family identifies an IP address family, e.g. to restrict a builder to
+// Prefixes of one family. IPv4-mapped IPv6 Prefixes belong to IPv4, since
+// they are stored as the IPv4 Prefixes they map.
+type Family uint8
+
+const (
+	// AnyFamily places no restriction on address family.
+	AnyFamily Family = iota
+
+	// IPv4 is the IPv4 address family.
+	IPv4
+
+	// IPv6 is the IPv6 address family.
+	IPv6
+)
+
+func (f Family) String() string {
+	switch f {
+	case AnyFamily:
+		return "any"
+	case IPv4:
+		return "IPv4"
+	case IPv6:
+		return "IPv6"
+	default:
+		return fmt.Sprintf("Family(%d)", uint8(f))
+	}
+}
+
+// admits reports whether f admits inputs of the family given by is4.
+func (f Family) admits(is4 bool) bool {
+	return f == AnyFamily || (f == IPv4) == is4
+}
+
+// rejectFamily returns an error for an input of the family given by is4,
+// which was not admitted by a builder's Family, counting it as invalid.
+func (st *buildStats) rejectFamily(is4 bool, input any) error {
+	st.invalid++
+	if is4 {
+		return fmt.Errorf("IPv4 input is not allowed: %v", input)
+	}
+	return fmt.Errorf("IPv6 input is not allowed: %v", input)
+}
+
+// admitFamilyRange returns an error (counting the input as invalid) if f does
+// not admit the range from first to last. A range that includes both
+// IPv4-mapped and other IPv6 addresses belongs to neither family. Invalid
+// ranges are left for the caller to reject.
+func (st *buildStats) admitFamilyRange(f Family, first, last netip.Addr) error {
+	if f == AnyFamily || !first.IsValid() || !last.IsValid() {
+		return nil
+	}
+	is4 := first.Is4() || (first.Is4In6() && last.Is4In6())
+	if !is4 && isV4MappedRange(first, last) {
+		st.invalid++
+		return fmt.Errorf("range spans IPv4 and IPv6: %v-%v", first, last)
+	}
+	if !f.admits(is4) {
+		return st.rejectFamily(is4, fmt.Sprintf("%v-%v", first, last))
+	}
+	return nil
+}
+
+// isV4Mapped reports whether p is an IPv6 Prefix within ::ffff:0:0/96, which
+// is stored as the IPv4 Prefix it maps.
+func isV4Mapped(p netip.Prefix) bool {
+	return p.Addr().Is4In6() && p.Bits() >= 96
+}
+
+// isV4MappedRange reports whether the range from first to last includes an
+// IPv4-mapped IPv6 address.
+func isV4MappedRange(first, last netip.Addr) bool {
+	return first.Is6() && !last.Less(v4MappedFirst) && !v4MappedLast.Less(first)
+}
+
+var (
+	v4MappedFirst = netip.AddrFrom16([16]byte{10: 0xff, 11: 0xff})
+	v4MappedLast  = netip.AddrFrom16([16]byte{10: 0xff, 11: 0xff, 12: 0xff, 13: 0xff, 14: 0xff, 15: 0xff})
+)
+
+// newBuildReport returns a BuildReport combining st with entry counts from t.
+func newBuildReport[T any](st *buildStats, t *tree[T]) BuildReport {
+	r := BuildReport{
+		Duplicates: st.duplicates,
+		Normalized: st.normalized,
+		Invalid:    st.invalid,
+		V4Mapped:   st.v4Mapped,
+	}
+	t.walk(key{}, func(n *tree[T]) bool {
+		if n.hasValue {
+			if n.key.is4() {
+				r.Entries4++
+			} else {
+				r.Entries6++
+			}
+		}
+		return false
+	})
+	return r
+}
@@ -0,0 +1,185 @@
+package netipds
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPrefixSetBuilderReport(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	psb.Add(pfx("10.0.0.0/8"))
+	psb.Add(pfx("10.0.0.0/8"))
+	psb.Add(pfx("10.1.2.3/16"))
+	psb.Add(netip.Prefix{})
+	psb.AddString("not a prefix")
+	psb.Add(pfx("2001:db8::/32"))
+	psb.AddFromBytes([]byte{10, 1, 0, 0}, 16)
+
+	ps, got := psb.PrefixSetWithReport()
+	want := BuildReport{
+		Duplicates: 2,
+		Normalized: 1,
+		Invalid:    2,
+		Entries4:   2,
+		Entries6:   1,
+	}
+	if got != want {
+		t.Errorf("report = %+v, want %+v", got, want)
+	}
+	checkPrefixSlice(t, ps.Prefixes(), pfxs("10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32"))
+}
+
+func TestPrefixMapBuilderReport(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	pmb.Set(pfx("::1/128"), 1)
+	pmb.Set(pfx("::1/128"), 2)
+	pmb.SetRange(netip.MustParseAddr("10.0.0.0"), netip.MustParseAddr("10.0.0.2"), 3)
+	pmb.SetRange(netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.0"), 3)
+	pmb.Remove(pfx("10.0.0.2/32"))
+
+	_, got := pmb.PrefixMapWithReport()
+	want := BuildReport{
+		Duplicates: 1,
+		Invalid:    1,
+		Entries4:   1,
+		Entries6:   1,
+	}
+	if got != want {
+		t.Errorf("report = %+v, want %+v", got, want)
+	}
+}
+
+func TestBuilderRejectV4Mapped(t *testing.T) {
+	mapped := pfx("::ffff:10.0.0.0/104")
+	mappedBytes := mapped.Addr().AsSlice()
+	first, last := netip.MustParseAddr("::fffe:ffff:ffff"), netip.MustParseAddr("::ffff:0.0.0.1")
+
+	for _, reject := range []bool{false, true} {
+		psb := &PrefixSetBuilder{RejectV4Mapped: reject}
+		errs := []error{
+			psb.Add(mapped),
+			func() error { _, err := psb.AddReporting(mapped); return err }(),
+			psb.AddString(mapped.String()),
+			psb.AddFromBytes(mappedBytes, 104),
+			// Not within ::ffff:0:0/96
+			psb.Add(pfx("::/64")),
+			psb.Add(pfx("10.0.0.0/8")),
+		}
+		_, report := psb.PrefixSetWithReport()
+		checkV4MappedErrs(t, "PrefixSetBuilder", reject, errs, 4)
+		checkV4MappedReport(t, "PrefixSetBuilder", reject, report, 4)
+
+		pmb := &PrefixMapBuilder[int]{RejectV4Mapped: reject}
+		errs = []error{
+			pmb.Set(mapped, 1),
+			func() error { _, err := pmb.SetReporting(mapped, 1); return err }(),
+			pmb.SetString(mapped.String(), 1),
+			pmb.SetFromBytes(mappedBytes, 104, 1),
+			pmb.SetRange(first, last, 1),
+			pmb.Set(pfx("::/64"), 1),
+			pmb.SetRange(netip.MustParseAddr("::"), netip.MustParseAddr("::1"), 1),
+		}
+		_, report = pmb.PrefixMapWithReport()
+		checkV4MappedErrs(t, "PrefixMapBuilder", reject, errs, 5)
+		checkV4MappedReport(t, "PrefixMapBuilder", reject, report, 5)
+	}
+}
+
+func TestBuilderFamily(t *testing.T) {
+	addr := netip.MustParseAddr
+	tests := []struct {
+		family Family
+		p      netip.Prefix
+		ok     bool
+	}{
+		{AnyFamily, pfx("10.0.0.0/8"), true},
+		{AnyFamily, pfx("2001:db8::/32"), true},
+		{IPv4, pfx("10.0.0.0/8"), true},
+		{IPv4, pfx("::ffff:10.0.0.0/104"), true},
+		{IPv4, pfx("2001:db8::/32"), false},
+		{IPv4, pfx("::/0"), false},
+		{IPv6, pfx("2001:db8::/32"), true},
+		{IPv6, pfx("10.0.0.0/8"), false},
+		{IPv6, pfx("::ffff:10.0.0.0/104"), false},
+	}
+	for _, tt := range tests {
+		// AddDisjoint rejects the duplicate even if p is admitted.
+		wantInvalid := 1
+		if !tt.ok {
+			wantInvalid = 4
+		}
+		psb := &PrefixSetBuilder{Family: tt.family}
+		errs := []error{
+			psb.Add(tt.p),
+			func() error { _, err := psb.AddReporting(tt.p); return err }(),
+			psb.AddDisjoint(tt.p),
+			psb.AddFromBytes(tt.p.Addr().AsSlice(), tt.p.Bits()),
+		}
+		ps, report := psb.PrefixSetWithReport()
+		for i, err := range errs {
+			if i != 2 && (err == nil) != tt.ok {
+				t.Errorf("PrefixSetBuilder{Family: %v}: input %d (%v): err = %v, want ok %v", tt.family, i, tt.p, err, tt.ok)
+			}
+		}
+		if report.Invalid != wantInvalid || ps.Contains(tt.p) != tt.ok {
+			t.Errorf("PrefixSetBuilder{Family: %v}: after adding %v, Invalid = %d, Contains = %v", tt.family, tt.p, report.Invalid, ps.Contains(tt.p))
+		}
+
+		pmb := &PrefixMapBuilder[int]{Family: tt.family}
+		errs = []error{
+			pmb.Set(tt.p, 1),
+			func() error { _, err := pmb.SetReporting(tt.p, 1); return err }(),
+			pmb.SetFromBytes(tt.p.Addr().AsSlice(), tt.p.Bits(), 1),
+		}
+		for i, err := range errs {
+			if (err == nil) != tt.ok {
+				t.Errorf("PrefixMapBuilder{Family: %v}: input %d (%v): err = %v, want ok %v", tt.family, i, tt.p, err, tt.ok)
+			}
+		}
+	}
+
+	ranges := []struct {
+		family      Family
+		first, last netip.Addr
+		ok          bool
+	}{
+		{IPv4, addr("10.0.0.0"), addr("10.0.0.5"), true},
+		{IPv4, addr("::ffff:10.0.0.0"), addr("::ffff:10.0.0.5"), true},
+		{IPv4, addr("::1"), addr("::5"), false},
+		{IPv6, addr("::1"), addr("::5"), true},
+		{IPv6, addr("10.0.0.0"), addr("10.0.0.5"), false},
+		// Spans IPv4-mapped and other IPv6 addresses
+		{IPv6, addr("::fffe:ffff:ffff"), addr("::ffff:0.0.0.1"), false},
+		{IPv4, addr("::fffe:ffff:ffff"), addr("::ffff:0.0.0.1"), false},
+		{AnyFamily, addr("::fffe:ffff:ffff"), addr("::ffff:0.0.0.1"), true},
+	}
+	for _, tt := range ranges {
+		pmb := &PrefixMapBuilder[int]{Family: tt.family}
+		if err := pmb.SetRange(tt.first, tt.last, 1); (err == nil) != tt.ok {
+			t.Errorf("PrefixMapBuilder{Family: %v}.SetRange(%v, %v) = %v, want ok %v", tt.family, tt.first, tt.last, err, tt.ok)
+		}
+	}
+}
+
+// checkV4MappedErrs checks that the first n of errs are non-nil if and only
+// if reject is set, and that the rest are nil.
+func checkV4MappedErrs(t *testing.T, name string, reject bool, errs []error, n int) {
+	t.Helper()
+	for i, err := range errs {
+		if wantErr := reject && i < n; (err != nil) != wantErr {
+			t.Errorf("%s{RejectV4Mapped: %v}: input %d: err = %v, want error: %v", name, reject, i, err, wantErr)
+		}
+	}
+}
+
+func checkV4MappedReport(t *testing.T, name string, reject bool, r BuildReport, n int) {
+	t.Helper()
+	wantInvalid, wantMapped := 0, n
+	if reject {
+		wantInvalid, wantMapped = n, 0
+	}
+	if r.Invalid != wantInvalid || r.V4Mapped != wantMapped {
+		t.Errorf("%s{RejectV4Mapped: %v}: Invalid, V4Mapped = %d, %d, want %d, %d",
+			name, reject, r.Invalid, r.V4Mapped, wantInvalid, wantMapped)
+	}
+}
@@ -0,0 +1,64 @@
+//go:build !netipds_core
+
+package netipds
+
+import "net/netip"
+
+// Mismatch describes a query for which a ShadowQuerier's primary and shadow
+// implementations disagreed.
+type Mismatch struct {
+	// Method is the name of the PrefixQuerier method that was called.
+	Method string
+
+	// Prefix is the Prefix passed to Method.
+	Prefix netip.Prefix
+
+	// Primary and Shadow are the results returned by each implementation.
+	Primary bool
+	Shadow  bool
+}
+
+// ShadowQuerier is a PrefixQuerier that answers every query using Primary,
+// while also issuing it to Shadow and reporting any disagreement to
+// OnMismatch. It is intended for validating one implementation against
+// another in production, e.g. during a migration from netipx.IPSet (wrapped
+// in an adapter that implements PrefixQuerier) to PrefixSet.
+//
+// ShadowQuerier is safe for concurrent use if Primary, Shadow and OnMismatch
+// are.
+type ShadowQuerier struct {
+	Primary PrefixQuerier
+	Shadow  PrefixQuerier
+
+	// OnMismatch is called with the details of each disagreement. If nil,
+	// disagreements are ignored.
+	OnMismatch func(Mismatch)
+}
+
+var _ PrefixQuerier = (*ShadowQuerier)(nil)
+
+// compare reports a Mismatch if primary and shadow differ and returns primary.
+func (q *ShadowQuerier) compare(method string, p netip.Prefix, primary, shadow bool) bool {
+	if primary != shadow && q.OnMismatch != nil {
+		q.OnMismatch(Mismatch{method, p, primary, shadow})
+	}
+	return primary
+}
+
+func (q *ShadowQuerier) Contains(p netip.Prefix) bool {
+	return q.compare("Contains", p, q.Primary.Contains(p), q.Shadow.Contains(p))
+}
+
+func (q *ShadowQuerier) Encompasses(p netip.Prefix) bool {
+	return q.compare("Encompasses", p, q.Primary.Encompasses(p), q.Shadow.Encompasses(p))
+}
+
+func (q *ShadowQuerier) EncompassesStrict(p netip.Prefix) bool {
+	return q.compare(
+		"EncompassesStrict", p, q.Primary.EncompassesStrict(p), q.Shadow.EncompassesStrict(p),
+	)
+}
+
+func (q *ShadowQuerier) OverlapsPrefix(p netip.Prefix) bool {
+	return q.compare("OverlapsPrefix", p, q.Primary.OverlapsPrefix(p), q.Shadow.OverlapsPrefix(p))
+}
@@ -0,0 +1,39 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"testing"
+)
+
+func TestShadowQuerier(t *testing.T) {
+	primary := &PrefixSetBuilder{}
+	primary.Add(pfx("10.0.0.0/8"))
+	shadow := &PrefixSetBuilder{}
+	shadow.Add(pfx("10.0.0.0/8"))
+	shadow.Add(pfx("11.0.0.0/8"))
+
+	var got []Mismatch
+	q := &ShadowQuerier{
+		Primary:    primary.PrefixSet(),
+		Shadow:     shadow.PrefixSet(),
+		OnMismatch: func(m Mismatch) { got = append(got, m) },
+	}
+
+	// Agreement
+	if !q.Encompasses(pfx("10.1.0.0/16")) {
+		t.Errorf("q.Encompasses(10.1.0.0/16) = false, want true")
+	}
+	if len(got) != 0 {
+		t.Errorf("got mismatches %v, want none", got)
+	}
+
+	// Disagreement; the primary's result is returned
+	if q.Contains(pfx("11.0.0.0/8")) {
+		t.Errorf("q.Contains(11.0.0.0/8) = true, want false")
+	}
+	want := Mismatch{"Contains", pfx("11.0.0.0/8"), false, true}
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("got mismatches %v, want [%v]", got, want)
+	}
+}
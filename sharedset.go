@@ -0,0 +1,82 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// SharedSetBuilder builds a PrefixSet to which each Prefix may be contributed
+// by any number of owners, of a comparable type O, e.g. the names of services
+// whose allowlists are combined into one effective set. A Prefix remains in
+// the set until every owner that added it has released it.
+//
+// Each owner holds at most one reference to a Prefix: adding a Prefix again
+// for the same owner has no effect, and a single Release retracts it.
+//
+// The zero value is ready to use. Like PrefixSetBuilder, a SharedSetBuilder
+// is not safe for concurrent use.
+type SharedSetBuilder[O comparable] struct {
+	owners PrefixMapBuilder[map[O]struct{}]
+}
+
+// AddRef adds p to s on behalf of owner.
+func (s *SharedSetBuilder[O]) AddRef(owner O, p netip.Prefix) error {
+	if !p.IsValid() {
+		return fmt.Errorf("Prefix is not valid: %v", p)
+	}
+	if owners, ok := s.owners.Get(p); ok {
+		owners[owner] = struct{}{}
+		return nil
+	}
+	return s.owners.Set(p, map[O]struct{}{owner: {}})
+}
+
+// Release retracts owner's reference to p, and removes p from s if no other
+// owner holds one. Release has no effect if owner holds no reference to p.
+func (s *SharedSetBuilder[O]) Release(owner O, p netip.Prefix) error {
+	if !p.IsValid() {
+		return fmt.Errorf("Prefix is not valid: %v", p)
+	}
+	owners, ok := s.owners.Get(p)
+	if !ok {
+		return nil
+	}
+	delete(owners, owner)
+	if len(owners) == 0 {
+		return s.owners.Remove(p)
+	}
+	return nil
+}
+
+// get returns the owners of p, or nil if p is not in s.
+func (s *SharedSetBuilder[O]) get(p netip.Prefix) map[O]struct{} {
+	if !p.IsValid() {
+		return nil
+	}
+	owners, _ := s.owners.Get(p)
+	return owners
+}
+
+// Refs returns the number of owners holding a reference to p.
+func (s *SharedSetBuilder[O]) Refs(p netip.Prefix) int {
+	return len(s.get(p))
+}
+
+// Owners returns the owners holding a reference to p, in no particular order.
+func (s *SharedSetBuilder[O]) Owners(p netip.Prefix) []O {
+	owners := s.get(p)
+	ret := make([]O, 0, len(owners))
+	for o := range owners {
+		ret = append(ret, o)
+	}
+	return ret
+}
+
+// PrefixSet returns an immutable PrefixSet containing the Prefixes to which
+// any owner holds a reference.
+func (s *SharedSetBuilder[O]) PrefixSet() *PrefixSet {
+	t := mapTree(&s.owners.tree, func(map[O]struct{}) uint8 { return 0 })
+	return &PrefixSet{tree: *t.canonicalize(true)}
+}
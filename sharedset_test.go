@@ -0,0 +1,63 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestSharedSetBuilder(t *testing.T) {
+	s := &SharedSetBuilder[string]{}
+	steps := []struct {
+		owner   string
+		p       string
+		release bool
+		want    []string
+	}{
+		{"web", "10.0.0.0/8", false, []string{"10.0.0.0/8"}},
+		{"db", "10.0.0.0/8", false, []string{"10.0.0.0/8"}},
+		{"db", "2001:db8::/32", false, []string{"10.0.0.0/8", "2001:db8::/32"}},
+		// Adding again for the same owner has no effect
+		{"db", "2001:db8::/32", false, []string{"10.0.0.0/8", "2001:db8::/32"}},
+		{"web", "10.0.0.0/8", true, []string{"10.0.0.0/8", "2001:db8::/32"}},
+		// Releasing a reference that is not held has no effect
+		{"web", "10.0.0.0/8", true, []string{"10.0.0.0/8", "2001:db8::/32"}},
+		{"web", "2001:db8::/32", true, []string{"10.0.0.0/8", "2001:db8::/32"}},
+		{"db", "2001:db8::/32", true, []string{"10.0.0.0/8"}},
+		{"db", "10.0.0.0/8", true, []string{}},
+		{"web", "10.1.0.0/16", false, []string{"10.1.0.0/16"}},
+	}
+	for _, st := range steps {
+		var err error
+		if st.release {
+			err = s.Release(st.owner, pfx(st.p))
+		} else {
+			err = s.AddRef(st.owner, pfx(st.p))
+		}
+		if err != nil {
+			t.Fatalf("%s %s (release %v) error = %v", st.owner, st.p, st.release, err)
+		}
+		checkPrefixSlice(t, s.PrefixSet().Prefixes(), pfxs(st.want...))
+	}
+
+	s.AddRef("db", pfx("10.1.0.0/16"))
+	if got := s.Refs(pfx("10.1.0.0/16")); got != 2 {
+		t.Errorf("Refs(10.1.0.0/16) = %d, want 2", got)
+	}
+	owners := s.Owners(pfx("10.1.0.0/16"))
+	slices.Sort(owners)
+	if want := []string{"db", "web"}; !slices.Equal(owners, want) {
+		t.Errorf("Owners(10.1.0.0/16) = %v, want %v", owners, want)
+	}
+	if got := s.Refs(pfx("10.0.0.0/8")); got != 0 {
+		t.Errorf("Refs(10.0.0.0/8) = %d, want 0", got)
+	}
+	if err := s.AddRef("web", netip.Prefix{}); err == nil {
+		t.Errorf("AddRef of invalid Prefix succeeded")
+	}
+	if err := s.Release("web", netip.Prefix{}); err == nil {
+		t.Errorf("Release of invalid Prefix succeeded")
+	}
+}
@@ -0,0 +1,169 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// StrideTable is an immutable, lookup-optimized copy of a PrefixMap, stored as
+// a multi-bit trie in which each node consumes a fixed number of address bits
+// (its stride). A longest-prefix match visits at most 32/stride nodes for
+// IPv4 addresses, and 128/stride for IPv6 addresses, compared with up to one
+// node per bit in a PrefixMap, at the cost of more memory: each node holds
+// 2^stride slots, and each Prefix is expanded to fill every slot it covers.
+//
+// Use NewStrideTable to construct a StrideTable.
+type StrideTable[T any] struct {
+	stride uint8
+	root4  *strideNode
+	root6  *strideNode
+
+	// match4 is one more than the index of the longest IPv6 entry that
+	// encompasses ::ffff:0:0/96, and so every IPv4 address, or 0 if there is
+	// none. It is the match of an IPv4 address with no IPv4 entry of its own.
+	match4 int32
+
+	// entries holds the Prefixes of the source PrefixMap, referenced by
+	// index from the nodes.
+	entries []strideEntry[T]
+}
+
+type strideEntry[T any] struct {
+	prefix netip.Prefix
+	value  T
+}
+
+type strideNode struct {
+	// match[i] is one more than the index of the longest entry matching slot
+	// i at this node, or 0 if there is none.
+	match []int32
+
+	children []*strideNode
+}
+
+// NewStrideTable returns a StrideTable containing the entries of m, using the
+// provided stride, which must be 1, 2, 4 or 8. Unlike the queries of
+// PrefixMap, the StrideTable includes a ::/0 entry of m, which then matches
+// every address not matched by a longer entry.
+func NewStrideTable[T any](m *PrefixMap[T], stride int) (*StrideTable[T], error) {
+	switch stride {
+	case 1, 2, 4, 8:
+	default:
+		return nil, fmt.Errorf("invalid stride %d; must be 1, 2, 4 or 8", stride)
+	}
+	ret := &StrideTable[T]{stride: uint8(stride)}
+	// walk never visits the root node, which holds ::/0 if it has a value.
+	// Like any other IPv6 entry encompassing ::ffff:0:0/96, ::/0 is the
+	// match of an IPv4 address with no IPv4 entry of its own.
+	if m.tree.hasValue {
+		p := netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+		ret.entries = append(ret.entries, strideEntry[T]{p, m.tree.value})
+		ret.match4 = int32(len(ret.entries))
+		ret.insert(p, ret.match4)
+	}
+	// walk visits each entry before the entries it encompasses, so an entry
+	// always overwrites the expansions of shorter entries that overlap it.
+	m.tree.walk(key{}, func(n *tree[T]) bool {
+		if !n.hasValue {
+			return false
+		}
+		p := prefixFromKey(n.key)
+		ret.entries = append(ret.entries, strideEntry[T]{p, n.value})
+		if n.key.encompasses4() {
+			// IPv4 addresses are looked up in root4, so they can't reach
+			// the expansion of n in root6.
+			ret.match4 = int32(len(ret.entries))
+		}
+		ret.insert(p, int32(len(ret.entries)))
+		return false
+	})
+	return ret, nil
+}
+
+// strideBits returns addr's bits, left-aligned in a uint128.
+func strideBits(addr netip.Addr) uint128 {
+	if addr.Is4() {
+		a := addr.As4()
+		return uint128{uint64(beUint32(a[:])) << 32, 0}
+	}
+	return u128From16(addr.As16())
+}
+
+func (t *StrideTable[T]) newNode() *strideNode {
+	return &strideNode{
+		match:    make([]int32, 1<<t.stride),
+		children: make([]*strideNode, 1<<t.stride),
+	}
+}
+
+// slot returns the index of the slot for bits at the node at the provided
+// depth.
+func (t *StrideTable[T]) slot(bits uint128, depth int) int {
+	shifted := bits.shiftRight(uint8(128 - (depth+1)*int(t.stride)))
+	return int(shifted.lo & (1<<t.stride - 1))
+}
+
+// insert records match as the longest match for every slot covered by p.
+func (t *StrideTable[T]) insert(p netip.Prefix, match int32) {
+	root := &t.root6
+	if p.Addr().Is4() {
+		root = &t.root4
+	}
+	if *root == nil {
+		*root = t.newNode()
+	}
+	n, bits, s := *root, strideBits(p.Addr()), int(t.stride)
+	for depth := 0; ; depth++ {
+		i := t.slot(bits, depth)
+		if end := (depth + 1) * s; p.Bits() <= end {
+			// p ends within this node, so it covers 2^(end-p.Bits()) slots
+			// starting at i (whose bits beyond p.Bits() are all zero).
+			for j := 0; j < 1<<(end-p.Bits()); j++ {
+				n.match[i+j] = match
+			}
+			return
+		}
+		if n.children[i] == nil {
+			n.children[i] = t.newNode()
+		}
+		n = n.children[i]
+	}
+}
+
+// Stride returns the stride of t.
+func (t *StrideTable[T]) Stride() int {
+	return int(t.stride)
+}
+
+// Lookup returns the longest Prefix in t that contains addr, along with its
+// value. If there is no such Prefix, Lookup returns zero values and false.
+//
+// As with PrefixMap, an IPv4-mapped IPv6 address is looked up as the IPv4
+// address it maps.
+func (t *StrideTable[T]) Lookup(addr netip.Addr) (netip.Prefix, T, bool) {
+	addr = addr.Unmap()
+	var n *strideNode
+	var match int32
+	switch {
+	case addr.Is4():
+		n, match = t.root4, t.match4
+	case addr.Is6():
+		n = t.root6
+	}
+	bits := strideBits(addr)
+	for depth := 0; n != nil; depth++ {
+		i := t.slot(bits, depth)
+		if m := n.match[i]; m != 0 {
+			match = m
+		}
+		n = n.children[i]
+	}
+	if match == 0 {
+		var zero T
+		return netip.Prefix{}, zero, false
+	}
+	e := t.entries[match-1]
+	return e.prefix, e.value, true
+}
@@ -0,0 +1,156 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"strconv"
+	"testing"
+)
+
+func TestStrideTable(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	for i, p := range pfxs(
+		"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/23", "10.1.2.3/32",
+		"192.168.0.0/17", "2001:db8::/32", "2001:db8:1::/48", "2001:db8:1::1/128",
+	) {
+		pmb.Set(p, i)
+	}
+	pm := pmb.PrefixMap()
+
+	addrs := []string{
+		"1.2.3.4", "10.0.0.1", "10.1.0.1", "10.1.3.255", "10.1.2.3", "10.1.4.0",
+		"192.168.127.1", "192.168.128.1", "::ffff:10.1.2.3",
+		"2001:db8::1", "2001:db8:1::1", "2001:db8:1::2", "2001:db9::", "::1",
+	}
+	for _, stride := range []int{1, 2, 4, 8} {
+		st, err := NewStrideTable(pm, stride)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range addrs {
+			a := netip.MustParseAddr(s)
+			wantP, wantV, wantOK := pm.ParentOf(netip.PrefixFrom(a, a.BitLen()))
+			if gotP, gotV, gotOK := st.Lookup(a); gotP != wantP || gotV != wantV || gotOK != wantOK {
+				t.Errorf("stride %d: Lookup(%v) = (%v, %v, %v), want (%v, %v, %v)",
+					stride, a, gotP, gotV, gotOK, wantP, wantV, wantOK)
+			}
+		}
+		if _, _, ok := st.Lookup(netip.Addr{}); ok {
+			t.Errorf("stride %d: Lookup(invalid) = true, want false", stride)
+		}
+	}
+
+	if _, err := NewStrideTable(pm, 3); err == nil {
+		t.Errorf("NewStrideTable with stride 3 returned nil error")
+	}
+}
+
+func TestStrideTableRandom(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 1))
+	pmb := &PrefixMapBuilder[int]{}
+	for i := 0; i < 2000; i++ {
+		a := netip.AddrFrom4([4]byte{10, byte(r.IntN(4)), byte(r.Uint32()), byte(r.Uint32())})
+		pmb.Set(netip.PrefixFrom(a, 8+r.IntN(25)).Masked(), i)
+	}
+	pm := pmb.PrefixMap()
+	st, err := NewStrideTable(pm, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10000; i++ {
+		a := netip.AddrFrom4([4]byte{10, byte(r.IntN(5)), byte(r.Uint32()), byte(r.Uint32())})
+		wantP, wantV, wantOK := pm.ParentOf(netip.PrefixFrom(a, 32))
+		if gotP, gotV, gotOK := st.Lookup(a); gotP != wantP || gotV != wantV || gotOK != wantOK {
+			t.Fatalf("Lookup(%v) = (%v, %v, %v), want (%v, %v, %v)", a, gotP, gotV, gotOK, wantP, wantV, wantOK)
+		}
+	}
+}
+
+func TestStrideTableMixedFamilies(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	pmb := &PrefixMapBuilder[int]{}
+	// ::/8 and ::fffe:0:0/95 encompass ::ffff:0:0/96, and so the IPv4
+	// addresses not covered by an IPv4 Prefix.
+	for i, p := range pfxs("::/8", "::fffe:0:0/95", "::ffff:0:0/97", "10.0.0.0/8", "2001:db8::/32") {
+		pmb.Set(p, i)
+	}
+	pm := pmb.PrefixMap()
+	for _, stride := range []int{1, 2, 4, 8} {
+		st, err := NewStrideTable(pm, stride)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			var a netip.Addr
+			switch i % 3 {
+			case 0:
+				a = netip.AddrFrom4([4]byte{byte(r.IntN(16)), byte(r.Uint32()), 0, 1})
+			case 1:
+				a = netip.AddrFrom16(netip.AddrFrom4([4]byte{byte(r.Uint32()), 0, 0, 1}).As16())
+			default:
+				a = netip.AddrFrom16([16]byte{byte(r.IntN(2)), 10: 0xff, 11: byte(r.IntN(2)) | 0xfe, 15: 1})
+			}
+			wantP, wantV, wantOK := pm.ParentOf(netip.PrefixFrom(a, a.BitLen()))
+			if gotP, gotV, gotOK := st.Lookup(a); gotP != wantP || gotV != wantV || gotOK != wantOK {
+				t.Fatalf("stride %d: Lookup(%v) = (%v, %v, %v), want (%v, %v, %v)",
+					stride, a, gotP, gotV, gotOK, wantP, wantV, wantOK)
+			}
+		}
+	}
+}
+
+func TestStrideTableRootEntry(t *testing.T) {
+	pmb := &PrefixMapBuilder[int]{}
+	for i, p := range pfxs("::/0", "10.0.0.0/8", "2001:db8::/32") {
+		pmb.Set(p, i+1)
+	}
+	pm := pmb.PrefixMap()
+	tests := []struct {
+		addr    netip.Addr
+		want    netip.Prefix
+		wantVal int
+	}{
+		{netip.MustParseAddr("10.1.2.3"), pfx("10.0.0.0/8"), 2},
+		{netip.MustParseAddr("11.1.2.3"), pfx("::/0"), 1},
+		{netip.MustParseAddr("::ffff:11.1.2.3"), pfx("::/0"), 1},
+		{netip.MustParseAddr("2001:db8::1"), pfx("2001:db8::/32"), 3},
+		{netip.MustParseAddr("2001:db9::1"), pfx("::/0"), 1},
+	}
+	for _, stride := range []int{1, 2, 4, 8} {
+		st, err := NewStrideTable(pm, stride)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			got, val, ok := st.Lookup(tt.addr)
+			if got != tt.want || val != tt.wantVal || !ok {
+				t.Errorf("stride %d: Lookup(%v) = (%v, %v, %v), want %v", stride, tt.addr, got, val, ok, tt.want)
+			}
+		}
+	}
+}
+
+func BenchmarkStrideTableLookup(b *testing.B) {
+	pmb := &PrefixMapBuilder[int]{}
+	for i := 0; i < 1<<16; i++ {
+		pmb.Set(netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 24), i)
+	}
+	pm := pmb.PrefixMap()
+	a := netip.MustParseAddr("10.1.2.3")
+	b.Run("PrefixMap", func(b *testing.B) {
+		p := netip.PrefixFrom(a, 32)
+		for i := 0; i < b.N; i++ {
+			pm.ParentOf(p)
+		}
+	})
+	for _, stride := range []int{4, 8} {
+		st, _ := NewStrideTable(pm, stride)
+		b.Run("StrideTable/"+strconv.Itoa(stride), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				st.Lookup(a)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+//go:build !netipds_core
+
+package netipds
+
+import "net/netip"
+
+// TraceDirection is the way a lookup proceeded from a node, as recorded in a
+// TraceStep.
+type TraceDirection int
+
+const (
+	// TraceLeft means the lookup continued to the node's left child, i.e.
+	// the queried Prefix has a zero at the bit following the node's Prefix.
+	TraceLeft TraceDirection = iota
+
+	// TraceRight means the lookup continued to the node's right child.
+	TraceRight
+
+	// TraceEnd means the lookup reached the end of the queried Prefix: the
+	// node's Prefix is either the queried Prefix or one of its descendants.
+	TraceEnd
+
+	// TraceDiverged means the node's Prefix and the queried Prefix differ
+	// before the end of either, so the lookup went no further.
+	TraceDiverged
+)
+
+func (d TraceDirection) String() string {
+	switch d {
+	case TraceLeft:
+		return "left"
+	case TraceRight:
+		return "right"
+	case TraceEnd:
+		return "end"
+	case TraceDiverged:
+		return "diverged"
+	default:
+		return "unknown"
+	}
+}
+
+// TraceStep describes a node visited by a lookup. See PrefixMap.LookupTrace.
+type TraceStep struct {
+	// Prefix is the node's Prefix. The root node's Prefix is ::/0; nodes
+	// within ::ffff:0:0/96, where IPv4 Prefixes are stored, have IPv4
+	// Prefixes.
+	Prefix netip.Prefix
+
+	// Entry is true if the node holds an entry.
+	Entry bool
+
+	// Next is the way the lookup proceeded from the node.
+	Next TraceDirection
+}
+
+// trace returns the steps of a lookup of k in t.
+func (t *tree[T]) trace(k key) []TraceStep {
+	var ret []TraceStep
+	for n := t; n != nil; {
+		step := TraceStep{Prefix: prefixFromKey(n.key), Entry: n.hasValue}
+		common := n.key.commonPrefixLen(k)
+		zero, ok := k.hasBitZeroAt(common)
+		switch {
+		case !ok:
+			step.Next = TraceEnd
+		case common < n.key.len:
+			step.Next = TraceDiverged
+		case zero:
+			step.Next = TraceLeft
+		default:
+			step.Next = TraceRight
+		}
+		ret = append(ret, step)
+		switch step.Next {
+		case TraceLeft:
+			n = n.left
+		case TraceRight:
+			n = n.right
+		default:
+			n = nil
+		}
+	}
+	return ret
+}
+
+// LookupTrace returns the nodes visited by a lookup of p in m, from the root
+// of the tree in which m is stored down to the last node on p's path. The
+// lookups made by Contains, Encompasses, ParentOf and similar queries follow
+// this path, so LookupTrace helps to diagnose their results, e.g. to see how
+// IPv4-mapped IPv6 Prefixes are interpreted. The entries among the steps
+// that encompass p are exactly the ancestors of p. If the last step's Next
+// is TraceLeft or TraceRight, the node has no child in that direction.
+//
+// LookupTrace is intended for debugging; its results are not optimized for
+// speed. If p is not valid, LookupTrace returns nil.
+func (m *PrefixMap[T]) LookupTrace(p netip.Prefix) []TraceStep {
+	if !p.IsValid() {
+		return nil
+	}
+	return m.tree.trace(keyFromPrefix(p))
+}
+
+// LookupTrace returns the nodes visited by a lookup of p in s. See
+// PrefixMap.LookupTrace.
+func (s *PrefixSet) LookupTrace(p netip.Prefix) []TraceStep {
+	if !p.IsValid() {
+		return nil
+	}
+	return s.tree.trace(keyFromPrefix(p))
+}
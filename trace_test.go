@@ -0,0 +1,75 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPrefixSetLookupTrace(t *testing.T) {
+	psb := &PrefixSetBuilder{}
+	for _, p := range pfxs("10.0.0.0/8", "10.1.0.0/16", "10.2.0.0/16", "2001:db8::/32") {
+		psb.Add(p)
+	}
+	ps := psb.PrefixSet()
+
+	tests := []struct {
+		get  netip.Prefix
+		want []TraceStep
+	}{
+		{pfx("10.1.2.0/24"), []TraceStep{
+			{pfx("::/0"), false, TraceLeft},
+			{pfx("::/2"), false, TraceLeft},
+			{pfx("10.0.0.0/8"), true, TraceLeft},
+			{pfx("10.0.0.0/14"), false, TraceLeft},
+			{pfx("10.1.0.0/16"), true, TraceLeft},
+		}},
+		{pfx("10.0.0.0/8"), []TraceStep{
+			{pfx("::/0"), false, TraceLeft},
+			{pfx("::/2"), false, TraceLeft},
+			{pfx("10.0.0.0/8"), true, TraceEnd},
+		}},
+		// The lookup ends above 10.0.0.0/14, which forks 10.1.0.0/16 and
+		// 10.2.0.0/16.
+		{pfx("10.0.0.0/12"), []TraceStep{
+			{pfx("::/0"), false, TraceLeft},
+			{pfx("::/2"), false, TraceLeft},
+			{pfx("10.0.0.0/8"), true, TraceLeft},
+			{pfx("10.0.0.0/14"), false, TraceEnd},
+		}},
+		{pfx("10.3.0.0/16"), []TraceStep{
+			{pfx("::/0"), false, TraceLeft},
+			{pfx("::/2"), false, TraceLeft},
+			{pfx("10.0.0.0/8"), true, TraceLeft},
+			{pfx("10.0.0.0/14"), false, TraceRight},
+			{pfx("10.2.0.0/16"), true, TraceDiverged},
+		}},
+		// IPv4-mapped IPv6 Prefixes are looked up as IPv4.
+		{pfx("::ffff:10.1.0.0/112"), []TraceStep{
+			{pfx("::/0"), false, TraceLeft},
+			{pfx("::/2"), false, TraceLeft},
+			{pfx("10.0.0.0/8"), true, TraceLeft},
+			{pfx("10.0.0.0/14"), false, TraceLeft},
+			{pfx("10.1.0.0/16"), true, TraceEnd},
+		}},
+		{pfx("2001:db9::/32"), []TraceStep{
+			{pfx("::/0"), false, TraceLeft},
+			{pfx("::/2"), false, TraceRight},
+			{pfx("2001:db8::/32"), true, TraceDiverged},
+		}},
+		{netip.Prefix{}, nil},
+	}
+	for _, tt := range tests {
+		got := ps.LookupTrace(tt.get)
+		if len(got) != len(tt.want) {
+			t.Errorf("ps.LookupTrace(%v) = %v, want %v", tt.get, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ps.LookupTrace(%v)[%d] = %+v, want %+v", tt.get, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
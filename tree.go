@@ -2,6 +2,10 @@ package netipds
 
 import (
 	"fmt"
+	"math/big"
+	"net/netip"
+	"slices"
+	"sync/atomic"
 )
 
 // tree is a binary radix tree with path compression.
@@ -15,6 +19,18 @@ type tree[T any] struct {
 	hasValue bool
 }
 
+// visits, if not nil, counts the nodes visited by the main traversals of the
+// tree, so that tests can check how the work done grows with the size of the
+// input. Tests that set it must not run in parallel with others.
+var visits *int
+
+// visit counts a node visit in visits, if it is set.
+func visit() {
+	if visits != nil {
+		*visits++
+	}
+}
+
 // newTree returns a new tree with the provided key.
 func newTree[T any](k key) *tree[T] {
 	return &tree[T]{key: k}
@@ -97,11 +113,161 @@ func (t *tree[T]) moveChildrenFrom(o *tree[T]) *tree[T] {
 
 // copy returns a copy of t, creating copies of all descendants of t in the
 // process. If t is nil, copy returns nil.
+//
+// The nodes of the copy are allocated in slabs (see nodeSlab).
 func (t *tree[T]) copy() *tree[T] {
 	if t == nil {
 		return nil
 	}
-	return newTree[T](t.key).copyChildrenFrom(t).setValueFrom(t)
+	s := &nodeSlab[T]{remaining: t.nodeCount()}
+	return t.copyInto(s)
+}
+
+// pathCopy returns a copy of t in which only the nodes that an insert or
+// remove of k could modify are copied: the nodes along the path to k, the
+// node at which the path ends, and that node's children. All other nodes are
+// shared with t. This allows k to be inserted into or removed from the copy
+// without affecting t.
+func (t *tree[T]) pathCopy(k key) *tree[T] {
+	c := *t
+	ret := &c
+	for n := ret; ; {
+		if n.key.equalFromRoot(k) {
+			if n.left != nil {
+				l := *n.left
+				n.left = &l
+			}
+			if n.right != nil {
+				r := *n.right
+				n.right = &r
+			}
+			return ret
+		}
+		if !n.key.isPrefixOf(k) {
+			return ret
+		}
+		next := &n.right
+		if zero, _ := k.hasBitZeroAt(n.key.len); zero {
+			next = &n.left
+		}
+		if *next == nil {
+			return ret
+		}
+		c := **next
+		*next = &c
+		n = &c
+	}
+}
+
+// copyInto is like copy, but allocates nodes from s.
+func (t *tree[T]) copyInto(s *nodeSlab[T]) *tree[T] {
+	if t == nil {
+		return nil
+	}
+	return s.newTree(t.key).
+		setChildren(t.left.copyInto(s), t.right.copyInto(s)).
+		setValueFrom(t)
+}
+
+// copyLayout is like copy, but the nodes whose keys hot returns true for are
+// allocated together from a separate slab, so that they are stored
+// contiguously in memory rather than interleaved with the other nodes. At
+// most slabSize nodes are treated as hot, in the order visited by copy.
+func (t *tree[T]) copyLayout(hot func(key) bool) *tree[T] {
+	if t == nil {
+		return nil
+	}
+	n := t.nodeCount()
+	hs := &nodeSlab[T]{remaining: min(t.hotCount(hot), slabSize)}
+	cs := &nodeSlab[T]{remaining: n - hs.remaining}
+	return t.copyLayoutInto(hot, hs, cs)
+}
+
+func (t *tree[T]) copyLayoutInto(hot func(key) bool, hs, cs *nodeSlab[T]) *tree[T] {
+	if t == nil {
+		return nil
+	}
+	s := cs
+	if hs.remaining > 0 && hot(t.key) {
+		s = hs
+	}
+	return s.newTree(t.key).
+		setChildren(t.left.copyLayoutInto(hot, hs, cs), t.right.copyLayoutInto(hot, hs, cs)).
+		setValueFrom(t)
+}
+
+// hotCount returns the number of nodes in t whose keys hot returns true for.
+func (t *tree[T]) hotCount(hot func(key) bool) int {
+	if t == nil {
+		return 0
+	}
+	n := t.left.hotCount(hot) + t.right.hotCount(hot)
+	if hot(t.key) {
+		n++
+	}
+	return n
+}
+
+// nodeCount returns the number of nodes in t, including nodes without values.
+func (t *tree[T]) nodeCount() int {
+	if t == nil {
+		return 0
+	}
+	return 1 + t.left.nodeCount() + t.right.nodeCount()
+}
+
+// slabSize is the maximum number of nodes allocated at once by a nodeSlab.
+const slabSize = 1024
+
+// nodeSlab allocates tree nodes in contiguous chunks of up to slabSize nodes,
+// rather than one at a time. This reduces the number of heap objects, and so
+// the garbage collector's overhead, for large trees.
+//
+// A chunk is only freed once all of its nodes are unreachable, so nodeSlab is
+// used for trees whose nodes share a lifetime, such as immutable copies.
+type nodeSlab[T any] struct {
+	free []tree[T]
+
+	// remaining is the number of nodes expected to be requested from the
+	// slab, used to avoid over-allocating for small trees.
+	remaining int
+}
+
+// newSizedSlab returns a nodeSlab for a tree expected to hold n entries. Such
+// a tree has at most 2n-1 nodes besides its root: one per entry, plus at most
+// one fork per entry after the first.
+func newSizedSlab[T any](n int) *nodeSlab[T] {
+	return &nodeSlab[T]{remaining: max(2*n-1, 0)}
+}
+
+// newTree returns a new tree with the provided key, allocated from s. If s is
+// nil, the tree is allocated individually.
+func (s *nodeSlab[T]) newTree(k key) *tree[T] {
+	if s == nil {
+		return newTree[T](k)
+	}
+	if len(s.free) == 0 {
+		s.free = make([]tree[T], min(max(s.remaining, 1), slabSize))
+	}
+	t := &s.free[0]
+	s.free = s.free[1:]
+	s.remaining--
+	t.key = k
+	return t
+}
+
+// mapTree returns a tree with the same shape as t, in which each value v is
+// replaced by fn(v). Nodes without values remain without values. If t is nil,
+// mapTree returns nil.
+func mapTree[T any, U any](t *tree[T], fn func(T) U) *tree[U] {
+	if t == nil {
+		return nil
+	}
+	ret := newTree[U](t.key).setChildren(mapTree(t.left, fn), mapTree(t.right, fn))
+	if t.hasValue {
+		ret.setValue(fn(t.value))
+	}
+	return ret
 }
 
 // isZero returns true if this node's key is the zero key.
@@ -126,9 +292,11 @@ func (t *tree[T]) String() string {
 	return t.stringHelper("", "", false)
 }
 
+// size returns the number of entries in t that walk visits, so it does not
+// count a ::/0 entry held by the root node, which no query considers.
 func (t *tree[T]) size() int {
 	size := 0
-	if t.hasValue {
+	if t.hasEntry() {
 		size = 1
 	}
 	if t.left != nil {
@@ -140,17 +308,57 @@ func (t *tree[T]) size() int {
 	return size
 }
 
+// sizeCache holds the size of an immutable tree, computed on first use. The
+// zero value is ready to use.
+type sizeCache struct {
+	// n is one more than the size, or zero if it has not been computed.
+	n atomic.Int64
+}
+
+// get returns the cached size, computing it with size if necessary.
+func (c *sizeCache) get(size func() int) int {
+	if n := c.n.Load(); n > 0 {
+		return int(n - 1)
+	}
+	n := size()
+	c.n.Store(int64(n) + 1)
+	return n
+}
+
 func (t *tree[T]) insert(k key, v T) *tree[T] {
+	ret, _ := t.insertFrom(nil, k, v)
+	return ret
+}
+
+// insertion describes the effect of inserting a key, for callers that keep
+// track of what they insert.
+type insertion[T any] struct {
+	// node is the node holding the inserted key.
+	node *tree[T]
+
+	// old is the key's previous value, if existed is set.
+	old     T
+	existed bool
+}
+
+// insertFrom is like insert, but allocates any new nodes from s, and also
+// returns a description of the insertion.
+func (t *tree[T]) insertFrom(s *nodeSlab[T], k key, v T) (*tree[T], insertion[T]) {
+	visit()
 	common := t.key.commonPrefixLen(k)
 	switch {
-	case t.key == k:
-		return t.setValue(v)
+	// Offsets may differ, since k is always rooted.
+	case t.key.equalFromRoot(k):
+		ins := insertion[T]{node: t, old: t.value, existed: t.hasValue}
+		return t.setValue(v), ins
 	case common == t.key.len:
-		return t.insertChild(k, v)
+		return t.insertChild(s, k, v)
 	case common == k.len:
-		return t.insertParent(k, v)
+		n := t.insertParent(s, k, v)
+		return n, insertion[T]{node: n}
 	case common < t.key.len:
-		return t.insertFork(k, v, common)
+		n := t.insertFork(s, k, v, common)
+		return n, insertion[T]{node: n.toward(k)}
 	default:
 		// TODO
 		panic("unreachable")
@@ -158,24 +366,26 @@ func (t *tree[T]) insert(k key, v T) *tree[T] {
 }
 
 // insertChild inserts or updates the appropriate child of t for key k.
-func (t *tree[T]) insertChild(k key, v T) *tree[T] {
+func (t *tree[T]) insertChild(s *nodeSlab[T], k key, v T) (*tree[T], insertion[T]) {
 	var next **tree[T]
 	if zero, _ := k.hasBitZeroAt(t.key.len); zero {
 		next = &t.left
 	} else {
 		next = &t.right
 	}
+	var ins insertion[T]
 	if *next == nil {
-		*next = newTree[T](k.rest(t.key.len)).setValue(v)
+		*next = s.newTree(k.rest(t.key.len)).setValue(v)
+		ins.node = *next
 	} else {
-		*next = (*next).insert(k, v)
+		*next, ins = (*next).insertFrom(s, k, v)
 	}
-	return t
+	return t, ins
 }
 
 // insertParent inserts and returns a new node with t as its sole child.
-func (t *tree[T]) insertParent(k key, v T) *tree[T] {
-	newNode := newTree[T](k).setValue(v)
+func (t *tree[T]) insertParent(s *nodeSlab[T], k key, v T) *tree[T] {
+	newNode := s.newTree(k).setValue(v)
 	if zero, _ := t.key.hasBitZeroAt(k.len); zero {
 		newNode.left = t
 	} else {
@@ -187,10 +397,10 @@ func (t *tree[T]) insertParent(k key, v T) *tree[T] {
 
 // insertFork inserts a new node at the common prefix of t.key and k
 // with value v and t.key and k as children, and returns the new node.
-func (t *tree[T]) insertFork(k key, v T, common uint8) *tree[T] {
-	parent := newTree[T](t.key.truncated(common))
+func (t *tree[T]) insertFork(s *nodeSlab[T], k key, v T, common uint8) *tree[T] {
+	parent := s.newTree(t.key.truncated(common))
 	t.key.offset = common
-	sibling := newTree[T](k.rest(common)).setValue(v)
+	sibling := s.newTree(k.rest(common)).setValue(v)
 	if zero, _ := k.hasBitZeroAt(common); zero {
 		parent.left = sibling
 		parent.right = t
@@ -241,6 +451,67 @@ func (t *tree[T]) remove(k key) *tree[T] {
 	return t
 }
 
+// removeDescendants removes the entries at or below k from the tree, without
+// filling in the rest of their key space as subtract does, and returns the
+// resulting tree. If root is set, t is the root node, which is kept in place
+// even if it becomes empty.
+func (t *tree[T]) removeDescendants(k key, root bool) *tree[T] {
+	switch {
+	case k.isPrefixOf(t.key):
+		if root {
+			*t = tree[T]{}
+			return t
+		}
+		return nil
+	case !t.key.isPrefixOf(k):
+		// t's key diverges from k, so t has no entries below k.
+		return t
+	}
+	if zero, _ := k.hasBitZeroAt(t.key.len); zero {
+		if t.left != nil {
+			t.left = t.left.removeDescendants(k, false)
+		}
+	} else if t.right != nil {
+		t.right = t.right.removeDescendants(k, false)
+	}
+	return t.pruned(root)
+}
+
+// pruned returns t, or, if t is not the root node, holds no entry, and does
+// not join two subtrees, the subtree that replaces it: its only child, or
+// nil.
+func (t *tree[T]) pruned(root bool) *tree[T] {
+	if t.hasValue || root {
+		return t
+	}
+	switch {
+	case t.left == nil && t.right == nil:
+		return nil
+	case t.left == nil:
+		t.right.key.offset = t.key.offset
+		return t.right
+	case t.right == nil:
+		t.left.key.offset = t.key.offset
+		return t.left
+	default:
+		return t
+	}
+}
+
+// canonicalize removes the nodes of t that pruned would, bottom-up, so that
+// the shape of t depends only on its entries, and returns the resulting tree.
+// Other operations, such as remove, may leave such nodes behind. t must own
+// all of its nodes.
+func (t *tree[T]) canonicalize(root bool) *tree[T] {
+	if t.left != nil {
+		t.left = t.left.canonicalize(false)
+	}
+	if t.right != nil {
+		t.right = t.right.canonicalize(false)
+	}
+	return t.pruned(root)
+}
+
 // subtract removes the key and all of its descendants from the tree, leaving
 // the remaining key space behind. New nodes may be created in the process.
 func (t *tree[T]) subtract(k key) *tree[T] {
@@ -250,8 +521,12 @@ func (t *tree[T]) subtract(k key) *tree[T] {
 		return nil
 	case common == 0:
 		return t.subtractChild(k)
-	case common == t.key.len:
+	case common == t.key.len && t.hasValue:
 		return t.insertHole(k, t.value)
+	case common == t.key.len:
+		// t does not hold an entry, so there is nothing to fill in here; the
+		// subtracted key can only affect t's descendants.
+		return t.subtractChild(k)
 	case common == k.len:
 		return nil
 	case common < t.key.len:
@@ -302,43 +577,344 @@ func (t *tree[T]) insertHole(k key, v T) *tree[T] {
 // provided path and calling fn(node) at each visited node.
 //
 // The return value of fn is a boolean indicating whether traversal should
-// stop.
+// stop descending below the node passed to fn. While following path, this
+// stops traversal entirely.
 //
 // If path is the zero key, all descendants of this tree are visited.
 func (t *tree[T]) walk(path key, fn func(*tree[T]) bool) {
-	// Never call fn on root node
-	if !t.isZero() {
-		if fn(t) {
+	// The path-constrained portion of the traversal visits at most one child
+	// per level, so it is done iteratively.
+	for n := t; n != nil; {
+		visit()
+		// Never call fn on root node
+		if !n.isZero() && fn(n) {
+			return
+		}
+
+		common := n.key.commonPrefixLen(path)
+		zero, ok := path.hasBitZeroAt(common)
+
+		// !ok means we've navigated to the end of the path constraint. Visit
+		// all descendants from here on.
+		if !ok {
+			n.walkDescendants(fn)
 			return
 		}
+
+		// n's key diverges from path, so none of its descendants can be on
+		// the path.
+		if common < n.key.len {
+			return
+		}
+
+		// Visit the child that matches the next bit in the path.
+		if zero {
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+}
+
+// walkDescendants calls fn on each descendant of t, excluding t itself. A
+// node is visited before its descendants, and the descendants of its left
+// child before those of its right child, except that the IPv4 keys, which
+// are stored under ::ffff:0:0/96, are visited in a pass of their own. So
+// that their ancestors are still visited first, the nodes whose IPv6 keys
+// encompass ::ffff:0:0/96 (see key.encompasses4) are visited before the IPv4
+// keys, and the other IPv6 keys after them. Within each of the last two
+// passes, the order of the visited keys matches that of
+// netip.Prefix.Compare: by address, then shorter before longer.
+//
+// As in walk, fn returning true stops the traversal from descending below
+// the node passed to fn, including into the IPv4 keys.
+func (t *tree[T]) walkDescendants(fn func(*tree[T]) bool) {
+	if !t.key.encompasses4() {
+		for _, c := range [...]*tree[T]{t.left, t.right} {
+			if c != nil {
+				c.preorder(fn)
+			}
+		}
+		return
+	}
+	// Visit the nodes on the path to ::ffff:0:0/96, up to the topmost IPv4
+	// node, v4, stopping at the first one that fn prunes.
+	var v4, pruned *tree[T]
+	for n := t.toward(v4Key); n != nil; n = n.toward(v4Key) {
+		if !n.key.encompasses4() {
+			if n.key.is4() {
+				v4 = n
+			}
+			break
+		}
+		if fn(n) {
+			pruned = n
+			break
+		}
+	}
+	if v4 != nil && pruned == nil {
+		v4.preorder(fn)
 	}
+	t.offPath(v4, pruned, fn)
+}
 
-	nextPath := path.rest(t.key.len)
-	zero, ok := path.hasBitZeroAt(t.key.commonPrefixLen(path))
+// toward returns the child of t on the path to k, or nil if there is none.
+func (t *tree[T]) toward(k key) *tree[T] {
+	if zero, _ := k.hasBitZeroAt(t.key.len); zero {
+		return t.left
+	}
+	return t.right
+}
 
-	// !ok means we've navigated to the end of the path constraint. Visit all
-	// children from here on.
-	if !ok {
-		if t.left != nil {
-			t.left.walk(nextPath, fn)
+// offPath calls fn in preorder on the descendants of t that walkDescendants
+// did not visit on the path to ::ffff:0:0/96, skipping the subtrees of v4
+// and pruned. t must be on that path.
+func (t *tree[T]) offPath(v4, pruned *tree[T], fn func(*tree[T]) bool) {
+	for _, c := range [...]*tree[T]{t.left, t.right} {
+		switch {
+		case c == nil || c == v4 || c == pruned:
+		case c.key.encompasses4():
+			c.offPath(v4, pruned, fn)
+		default:
+			c.preorder(fn)
 		}
-		if t.right != nil {
-			t.right.walk(nextPath, fn)
+	}
+}
+
+// preorder calls fn on t and then each of its descendants, visiting a node
+// before its descendants and its left child before its right child. fn
+// returning true prunes the descendants of the node passed to it.
+func (t *tree[T]) preorder(fn func(*tree[T]) bool) {
+	visit()
+	if fn(t) {
+		return
+	}
+	if t.left != nil {
+		t.left.preorder(fn)
+	}
+	if t.right != nil {
+		t.right.preorder(fn)
+	}
+}
+
+// walkPostorder calls fn on each descendant of t, excluding t itself, until fn
+// returns true. The IPv4 keys are visited in a pass of their own, followed by
+// the IPv6 keys, each node after its descendants, so the nodes encompassing
+// ::ffff:0:0/96 still come after the IPv4 keys beneath them.
+func (t *tree[T]) walkPostorder(fn func(*tree[T]) bool) {
+	v4 := t.v4Root()
+	if v4 != nil && v4.postorder(nil, fn) {
+		return
+	}
+	for _, c := range [...]*tree[T]{t.left, t.right} {
+		if c != nil && c.postorder(v4, fn) {
+			return
+		}
+	}
+}
+
+// postorder calls fn on the descendants of t and then on t, visiting a node's
+// left child before its right child, and skipping the subtree rooted at skip.
+// It stops and returns true as soon as fn returns true.
+func (t *tree[T]) postorder(skip *tree[T], fn func(*tree[T]) bool) bool {
+	if t == skip {
+		return false
+	}
+	for _, c := range [...]*tree[T]{t.left, t.right} {
+		if c != nil && c.postorder(skip, fn) {
+			return true
+		}
+	}
+	return fn(t)
+}
+
+// v4Root returns the highest node strictly below t whose key is an IPv4 key,
+// if t is a strict ancestor of ::ffff:0:0/96. Otherwise, the IPv4 keys below
+// t (if any) are already visited in order by preorder, and v4Root returns
+// nil.
+func (t *tree[T]) v4Root() *tree[T] {
+	if t.key.is4() {
+		return nil
+	}
+	for n := t; n != nil; {
+		if n.key.is4() {
+			return n
+		}
+		if !n.key.isPrefixOf(v4Key) {
+			return nil
 		}
+		if zero, _ := v4Key.hasBitZeroAt(n.key.len); zero {
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return nil
+}
+
+// coveredBelow returns the number of addresses beneath t that are covered by
+// t's nearest descendant entries.
+func (t *tree[T]) coveredBelow() (n uint128) {
+	for _, c := range [...]*tree[T]{t.left, t.right} {
+		switch {
+		case c == nil:
+		case c.hasValue:
+			n = n.add(c.key.span())
+		default:
+			n = n.add(c.coveredBelow())
+		}
+	}
+	return
+}
+
+// covers reports whether every address within k is covered by some entry in
+// t, whether by a single entry encompassing k or by several beneath it.
+func (t *tree[T]) covers(k key) bool {
+	if k.isZero() {
+		// The span of the zero key is not representable, so check its
+		// halves instead.
+		return t.covers(k.left().rooted()) && t.covers(k.right().rooted())
+	}
+	var (
+		encompassed bool
+		below       *tree[T]
+	)
+	t.walk(k, func(n *tree[T]) bool {
+		if n.hasValue && n.key.isPrefixOf(k) {
+			encompassed = true
+			return true
+		}
+		if k.isPrefixOf(n.key) {
+			// n is the topmost node at or below k.
+			below = n
+			return true
+		}
+		return false
+	})
+	// If the topmost node below k is longer than k, then the entries beneath
+	// it leave the rest of k uncovered.
+	return encompassed || (below != nil && below.key.len == k.len && below.coveredBelow() == k.span())
+}
+
+// gaps calls yield with each of the maximal keys within k that overlap no
+// entry in t, in ascending order, until yield returns false. If k is not
+// within ::ffff:0:0/96, the IPv4 keys beneath that key are not considered
+// part of k, so that gaps are reported per address family.
+func (t *tree[T]) gaps(k key, yield func(key) bool) {
+	if t.encompasses(k, false) {
 		return
 	}
+	// Find the topmost node within k, if any.
+	n := t
+	for n != nil && !k.isPrefixOf(n.key) {
+		if !n.key.isPrefixOf(k) {
+			n = nil
+			break
+		}
+		if zero, _ := k.hasBitZeroAt(n.key.len); zero {
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	gapsBelow(n, k.rooted(), !k.is4(), v4Key, yield)
+}
 
-	// Visit the child that matches the next bit in the path.
-	switch zero {
-	case true:
-		if t.left != nil {
-			t.left.walk(nextPath, fn)
+// gapsBelow implements gaps for the key k and n, the topmost node within k
+// (or nil if there is none). It returns false if yield returned false.
+func gapsBelow[T any](n *tree[T], k key, skip4 bool, v4Key key, yield func(key) bool) bool {
+	if skip4 && k.equalFromRoot(v4Key) {
+		return true
+	}
+	if n == nil && !(skip4 && k.isPrefixOf(v4Key)) {
+		return yield(k)
+	}
+	if n != nil && n.key.len == k.len {
+		if n.hasValue {
+			return true
 		}
-	case false:
-		if t.right != nil {
-			t.right.walk(nextPath, fn)
+		return gapsBelow(n.left, k.left().rooted(), skip4, v4Key, yield) &&
+			gapsBelow(n.right, k.right().rooted(), skip4, v4Key, yield)
+	}
+	// n, if any, lies within one half of k.
+	var left, right *tree[T]
+	if n != nil {
+		if zero, _ := n.key.hasBitZeroAt(k.len); zero {
+			left = n
+		} else {
+			right = n
 		}
 	}
+	return gapsBelow(left, k.left().rooted(), skip4, v4Key, yield) &&
+		gapsBelow(right, k.right().rooted(), skip4, v4Key, yield)
+}
+
+// addressCounts calls yield for each entry in t, in the order visited by
+// walk, along with the number of addresses the entry covers that are not also
+// covered by a more-specific entry. If yield returns false, iteration stops.
+func (t *tree[T]) addressCounts(yield func(*tree[T], *big.Int) bool) {
+	// walk never visits the root node, which holds ::/0 if it has a value.
+	if t.isZero() && t.hasValue && !yield(t, t.uncovered0()) {
+		return
+	}
+	stop := false
+	t.walk(key{}, func(n *tree[T]) bool {
+		if n.hasValue && !stop {
+			stop = !yield(n, n.key.span().sub(n.coveredBelow()).big())
+		}
+		return stop
+	})
+}
+
+// uncovered0 returns the number of addresses not covered by the descendant
+// entries of t, the root node. The span of ::/0, 2^128, is not representable
+// as a uint128, so the uncovered addresses of each half are counted instead.
+func (t *tree[T]) uncovered0() *big.Int {
+	ret := new(big.Int)
+	half := key{len: 1}.span()
+	for _, c := range [...]*tree[T]{t.left, t.right} {
+		switch {
+		case c == nil:
+			ret.Add(ret, half.big())
+		case c.hasValue:
+			ret.Add(ret, half.sub(c.key.span()).big())
+		default:
+			ret.Add(ret, half.sub(c.coveredBelow()).big())
+		}
+	}
+	return ret
+}
+
+// hierarchyEdges calls yield for each pair of entries in t such that parent
+// is the longest entry strictly encompassing child, in pre-order of child.
+// parent is the closest entry above t, or nil. If yield returns false,
+// iteration stops and hierarchyEdges returns false.
+func (t *tree[T]) hierarchyEdges(parent *tree[T], yield func(parent, child *tree[T]) bool) bool {
+	if t.hasValue {
+		if parent != nil && !yield(parent, t) {
+			return false
+		}
+		parent = t
+	}
+	if t.left != nil && !t.left.hierarchyEdges(parent, yield) {
+		return false
+	}
+	if t.right != nil && !t.right.hierarchyEdges(parent, yield) {
+		return false
+	}
+	return true
+}
+
+// nodes calls yield for each node in t, in the order visited by walk, until
+// yield returns false.
+func (t *tree[T]) nodes(yield func(*tree[T]) bool) {
+	stop := false
+	t.walk(key{}, func(n *tree[T]) bool {
+		if !stop {
+			stop = !yield(n)
+		}
+		return stop
+	})
 }
 
 // get returns the value associated with the exact key provided, if it exists.
@@ -371,7 +947,29 @@ func (t *tree[T]) contains(k key) (ret bool) {
 // encompasses the provided key.
 func (t *tree[T]) encompasses(k key, strict bool) (ret bool) {
 	t.walk(k, func(n *tree[T]) bool {
-		if ret = (n.key.isPrefixOf(k) && !(strict && n.key == k) && n.hasValue); ret {
+		if ret = (n.key.isPrefixOf(k) && !(strict && n.key.equalFromRoot(k)) && n.hasValue); ret {
+			return true
+		}
+		return false
+	})
+	return
+}
+
+// window returns whether an entry encompasses w, and if not, the topmost node
+// at or below w, if any, beneath which lie all of the entries that may
+// encompass a key within w.
+func (t *tree[T]) window(w key) (sub *tree[T], covered bool) {
+	if w.len == 0 {
+		// walk never visits the root node.
+		return t, false
+	}
+	t.walk(w, func(n *tree[T]) bool {
+		switch {
+		case n.hasValue && n.key.isPrefixOf(w):
+			covered = true
+			return true
+		case w.isPrefixOf(n.key):
+			sub = n
 			return true
 		}
 		return false
@@ -383,7 +981,7 @@ func (t *tree[T]) encompasses(k key, strict bool) (ret bool) {
 // If strict == true, the key itself is not considered.
 func (t *tree[T]) rootOf(k key, strict bool) (outKey key, val T, ok bool) {
 	t.walk(k, func(n *tree[T]) bool {
-		if n.key.isPrefixOf(k) && !(strict && n.key == k) && n.hasValue {
+		if n.key.isPrefixOf(k) && !(strict && n.key.equalFromRoot(k)) && n.hasValue {
 			outKey, val, ok = n.key, n.value, true
 			return true
 		}
@@ -396,7 +994,7 @@ func (t *tree[T]) rootOf(k key, strict bool) (outKey key, val T, ok bool) {
 // If strict is true, the key itself is not considered.
 func (t *tree[T]) parentOf(k key, strict bool) (outKey key, val T, ok bool) {
 	t.walk(k, func(n *tree[T]) bool {
-		if n.key.isPrefixOf(k) && !(strict && n.key == k) && n.hasValue {
+		if n.key.isPrefixOf(k) && !(strict && n.key.equalFromRoot(k)) && n.hasValue {
 			outKey, val, ok = n.key, n.value, true
 		}
 		return false
@@ -404,6 +1002,207 @@ func (t *tree[T]) parentOf(k key, strict bool) (outKey key, val T, ok bool) {
 	return
 }
 
+// longestMatch returns the node holding the longest entry that encompasses k,
+// or nil if there is none. It is equivalent to parentOf(k, false), but
+// descends the tree directly rather than through walk, so it does not
+// allocate.
+func (t *tree[T]) longestMatch(k key) *tree[T] {
+	var match *tree[T]
+	for n := t; n != nil; {
+		visit()
+		common := n.key.commonPrefixLen(k)
+		if common < n.key.len {
+			break
+		}
+		// As in walk, the root node is never considered.
+		if n.hasValue && !n.isZero() {
+			match = n
+		}
+		zero, ok := k.hasBitZeroAt(common)
+		if !ok {
+			break
+		}
+		if zero {
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return match
+}
+
+// longestMatches calls fn with the index of each of the n keys returned by
+// keyAt and the node holding its longest encompassing entry, for each key that
+// has one. The keys must be sorted by content and then length, so that
+// consecutive keys tend to share a path from the root; the nodes on the path
+// to each key are retained for the next, so the shared portion of the path is
+// only traversed once.
+func (t *tree[T]) longestMatches(n int, keyAt func(i int) key, fn func(i int, n *tree[T])) {
+	// path holds the nodes from t to the deepest node that encompasses the
+	// previous key, and match[i] the longest entry among path[:i+1]. A path
+	// is at most 129 nodes long.
+	var pathBuf, matchBuf [129]*tree[T]
+	path, match := append(pathBuf[:0], t), append(matchBuf[:0], nil)
+	for i := range n {
+		k := keyAt(i)
+		// Retreat to the deepest node on the path that encompasses k. t
+		// encompasses every key.
+		for len(path) > 1 && !path[len(path)-1].key.isPrefixOf(k) {
+			path, match = path[:len(path)-1], match[:len(match)-1]
+		}
+		for n := path[len(path)-1]; ; {
+			zero, ok := k.hasBitZeroAt(n.key.len)
+			if !ok {
+				break
+			}
+			if zero {
+				n = n.left
+			} else {
+				n = n.right
+			}
+			if n == nil || !n.key.isPrefixOf(k) {
+				break
+			}
+			m := match[len(match)-1]
+			if n.hasValue {
+				m = n
+			}
+			path, match = append(path, n), append(match, m)
+		}
+		if m := match[len(match)-1]; m != nil {
+			fn(i, m)
+		}
+	}
+}
+
+// addrQuery is an address to be looked up by addrMatches, along with its
+// index among the addresses provided.
+type addrQuery struct {
+	i int
+	k key
+}
+
+// addrMatches calls fn with the index of each valid address in addrs and the
+// node holding its longest encompassing entry, for each address that has
+// one. Each address is converted to a key once, and the keys are looked up in
+// ascending order by longestMatches, so that the path shared by nearby
+// addresses is only traversed once.
+func (t *tree[T]) addrMatches(addrs []netip.Addr, fn func(i int, n *tree[T])) {
+	qs := make([]addrQuery, 0, len(addrs))
+	for i, a := range addrs {
+		if a.IsValid() {
+			qs = append(qs, addrQuery{i, keyFromAddr(a)})
+		}
+	}
+	// All the keys are of the same length.
+	slices.SortFunc(qs, func(a, b addrQuery) int {
+		switch {
+		case a.k.content.less(b.k.content):
+			return -1
+		case b.k.content.less(a.k.content):
+			return 1
+		}
+		return 0
+	})
+	t.longestMatches(len(qs), func(j int) key { return qs[j].k }, func(j int, n *tree[T]) {
+		fn(qs[j].i, n)
+	})
+}
+
+// nearest returns the node holding the entry that shares the most leading
+// bits with k, considering only entries of the same address family as k. Of
+// entries sharing the same number of bits, an entry that encompasses k is
+// preferred. nearest returns nil if there are no such entries.
+func (t *tree[T]) nearest(k key) *tree[T] {
+	is4 := k.is4()
+	// Follow k as far as possible, recording the nodes that encompass it.
+	var path []*tree[T]
+	for n := t; n != nil; {
+		if n.key.commonPrefixLen(k) < n.key.len {
+			// n diverges from k, so every entry at or below n shares the same
+			// number of bits with k, and more than any entry on the path.
+			if m := n.firstOfFamily(is4); m != nil {
+				return m
+			}
+			break
+		}
+		path = append(path, n)
+		if zero, ok := k.hasBitZeroAt(n.key.len); !ok {
+			break
+		} else if zero {
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	// Back out along the path. At each node, the node itself and the subtree
+	// off the path share the same number of bits with k, and fewer than any
+	// deeper node.
+	for i := len(path) - 1; i >= 0; i-- {
+		n := path[i]
+		if n.hasValue && n.key.is4() == is4 {
+			return n
+		}
+		var other *tree[T]
+		if zero, ok := k.hasBitZeroAt(n.key.len); ok && zero {
+			other = n.right
+		} else if ok {
+			other = n.left
+		}
+		if m := other.firstOfFamily(is4); m != nil {
+			return m
+		}
+	}
+	return nil
+}
+
+// firstOfFamily returns the first node at or below t, in the order visited by
+// walk, that holds an IPv4 entry (if is4) or an IPv6 entry (if !is4).
+func (t *tree[T]) firstOfFamily(is4 bool) (ret *tree[T]) {
+	if t == nil {
+		return nil
+	}
+	t.walk(key{}, func(n *tree[T]) bool {
+		if ret == nil && n.hasValue && n.key.is4() == is4 {
+			ret = n
+		}
+		return ret != nil
+	})
+	return
+}
+
+// strictDescendants returns the Prefixes of the entries below t, in the
+// order visited by walk.
+func strictDescendants[T any](t *tree[T]) (ret []netip.Prefix) {
+	t.walkDescendants(func(n *tree[T]) bool {
+		if n.hasValue {
+			ret = append(ret, prefixFromKey(n.key))
+		}
+		return false
+	})
+	return
+}
+
+// distribution returns the number of entries in t under each key of length
+// level, where level is relative to the start of each entry's address family
+// (i.e. it excludes the 96-bit IPv4 mapping prefix). Entries shorter than
+// level are counted under their own key.
+func (t *tree[T]) distribution(level int) map[key]int {
+	level = max(level, 0)
+	ret := make(map[key]int)
+	t.walk(key{}, func(n *tree[T]) bool {
+		if n.hasValue {
+			l := level
+			if n.key.is4() {
+				l += 96
+			}
+			ret[n.key.rooted().truncated(uint8(min(l, int(n.key.len))))]++
+		}
+		return false
+	})
+	return ret
+}
+
 // descendantsOf returns the sub-tree containing all descendants of the
 // provided key. The key itself will be included if it has an entry in the
 // tree, unless strict. descendantsOf returns the empty tree if the provided
@@ -412,7 +1211,10 @@ func (t *tree[T]) descendantsOf(k key, strict bool) (ret *tree[T]) {
 	ret = &tree[T]{}
 	t.walk(k, func(n *tree[T]) bool {
 		if k.isPrefixOf(n.key) {
-			ret = ret.setKey(n.key.rooted()).setValueFrom(n).setChildrenFrom(n)
+			ret = ret.setKey(n.key.rooted()).setChildrenFrom(n)
+			if !(strict && n.key.equalFromRoot(k)) {
+				ret.setValueFrom(n)
+			}
 			return true
 		}
 		return false
@@ -420,17 +1222,101 @@ func (t *tree[T]) descendantsOf(k key, strict bool) (ret *tree[T]) {
 	return
 }
 
+// entries calls yield for each entry of the family f in t, in the order
+// visited by walk, or by walkPostorder if post is set, until yield returns
+// false.
+func (t *tree[T]) entries(f Family, post bool, yield func(*tree[T]) bool) {
+	if post {
+		t.walkPostorder(func(n *tree[T]) bool {
+			return n.hasValue && f.admits(n.key.is4()) && !yield(n)
+		})
+		return
+	}
+	stop := false
+	t.walk(key{}, func(n *tree[T]) bool {
+		if stop {
+			return true
+		}
+		if !f.admits(n.key.is4()) {
+			// walk visits the IPv4 nodes in a pass of their own, after the
+			// nodes that encompass ::ffff:0:0/96, so any other node of the
+			// other family has no descendants of family f left to visit.
+			return !(f == IPv4 && n.key.encompasses4())
+		}
+		if n.hasValue {
+			stop = !yield(n)
+		}
+		return stop
+	})
+}
+
+// roots calls yield for each entry in t that is not encompassed by another, in
+// the order visited by walk, until yield returns false.
+func (t *tree[T]) roots(yield func(*tree[T]) bool) {
+	stop := false
+	t.walk(key{}, func(n *tree[T]) bool {
+		if stop {
+			return true
+		}
+		if !n.hasValue {
+			return false
+		}
+		stop = !yield(n)
+		// Skip the descendants of n; they're all encompassed by it.
+		return true
+	})
+}
+
+// descendants calls yield for each entry at or below k, in the order visited
+// by walk, until yield returns false.
+func (t *tree[T]) descendants(k key, yield func(*tree[T]) bool) {
+	stop := false
+	t.walk(k, func(n *tree[T]) bool {
+		if !stop && n.hasValue && k.isPrefixOf(n.key) {
+			stop = !yield(n)
+		}
+		return stop
+	})
+}
+
+// ancestors calls yield for each entry at or above k, from the shortest key to
+// the longest, until yield returns false.
+func (t *tree[T]) ancestors(k key, yield func(*tree[T]) bool) {
+	t.walk(k, func(n *tree[T]) bool {
+		if !n.key.isPrefixOf(k) {
+			return true
+		}
+		if n.hasValue && !yield(n) {
+			return true
+		}
+		return n.key.len == k.len
+	})
+}
+
 // ancestorsOf returns the sub-tree containing all ancestors of the provided
 // key. The key itself will be included if it has an entry in the tree, unless
 // strict. ancestorsOf returns an empty tree if key has no ancestors in the
 // tree.
+// filterKeys returns a new tree holding the entries of t whose keys keep
+// returns true for.
+func (t *tree[T]) filterKeys(keep func(key) bool) *tree[T] {
+	ret := &tree[T]{}
+	t.walk(key{}, func(n *tree[T]) bool {
+		if n.hasValue && keep(n.key) {
+			ret = ret.insert(n.key.rooted(), n.value)
+		}
+		return false
+	})
+	return ret
+}
+
 func (t *tree[T]) ancestorsOf(k key, strict bool) (ret *tree[T]) {
 	ret = &tree[T]{}
 	t.walk(k, func(n *tree[T]) bool {
 		if !n.key.isPrefixOf(k) {
 			return true
 		}
-		if n.hasValue {
+		if n.hasValue && !(strict && n.key.equalFromRoot(k)) {
 			ret.insert(n.key, n.value)
 		}
 		return false
@@ -438,13 +1324,58 @@ func (t *tree[T]) ancestorsOf(k key, strict bool) (ret *tree[T]) {
 	return
 }
 
-// filter updates t to include only the keys encompassed by o.
+// childrenOf returns a tree containing the entries of t strictly encompassed
+// by k that are not encompassed by another such entry, i.e. the entries
+// directly beneath k.
+func (t *tree[T]) childrenOf(k key) *tree[T] {
+	ret := &tree[T]{}
+	t.walk(k, func(n *tree[T]) bool {
+		if n.key.len <= k.len || !k.isPrefixOf(n.key) || !n.hasValue {
+			return false
+		}
+		ret = ret.insert(n.key.rooted(), n.value)
+		// Skip the descendants of n; n is between them and k.
+		return true
+	})
+	return ret
+}
+
+// matchesFilter reports whether k is retained when filtering by t using the
+// provided mode.
+func (t *tree[T]) matchesFilter(k key, mode FilterMode) bool {
+	switch mode {
+	case FilterOverlapping:
+		return t.overlapsKey(k)
+	case FilterExact:
+		return t.contains(k)
+	default:
+		return t.encompasses(k, false)
+	}
+}
+
+// filter updates t to include only the keys retained by o under the provided
+// mode.
 // TODO: I think this can be done more efficiently by walking t and o
 // at the same time.
-func (t *tree[T]) filter(o tree[bool]) {
+func (t *tree[T]) filter(o tree[uint8], mode FilterMode) {
 	remove := make([]key, 0)
 	t.walk(key{}, func(n *tree[T]) bool {
-		if !o.encompasses(n.key, false) {
+		if !o.matchesFilter(n.key, mode) {
+			remove = append(remove, n.key)
+		}
+		return false
+	})
+	for _, k := range remove {
+		t.remove(k)
+	}
+}
+
+// removeEncompassed removes the keys of t that are encompassed by a key in o.
+// It is the inverse of filter with FilterEncompassed.
+func (t *tree[T]) removeEncompassed(o tree[uint8]) {
+	remove := make([]key, 0)
+	t.walk(key{}, func(n *tree[T]) bool {
+		if n.hasValue && o.encompasses(n.key, false) {
 			remove = append(remove, n.key)
 		}
 		return false
@@ -455,13 +1386,13 @@ func (t *tree[T]) filter(o tree[bool]) {
 }
 
 // filterCopy returns a new tree containing all entries of t that are
-// encompassed by o.
+// retained by o under the provided mode.
 // TODO: I think this can be done more efficiently by walking t and o
 // at the same time.
-func (t *tree[T]) filterCopy(o tree[bool]) *tree[T] {
+func (t *tree[T]) filterCopy(o tree[uint8], mode FilterMode) *tree[T] {
 	ret := &tree[T]{}
 	t.walk(key{}, func(n *tree[T]) bool {
-		if n.hasValue && o.encompasses(n.key, false) {
+		if n.hasValue && o.matchesFilter(n.key, mode) {
 			ret = ret.insert(n.key, n.value)
 		}
 		return false
@@ -469,6 +1400,157 @@ func (t *tree[T]) filterCopy(o tree[bool]) *tree[T] {
 	return ret
 }
 
+// aggregationCandidates returns a tree containing the keys of the value-less
+// nodes of t whose halves are both completely covered by entries in t. Nodes
+// encompassed by an entry are not included.
+func (t *tree[T]) aggregationCandidates() *tree[bool] {
+	ret := &tree[bool]{}
+	// covered reports whether n's key is completely covered by entries at or
+	// below n, recording candidates along the way.
+	var covered func(n *tree[T]) bool
+	covered = func(n *tree[T]) bool {
+		if n == nil {
+			return false
+		}
+		if n.hasValue {
+			return true
+		}
+		// Visit both children, even if one is not covered, to find all
+		// candidates below n.
+		left, right := covered(n.left), covered(n.right)
+		// A child whose key is longer than n's half cannot cover that half.
+		full := left && right &&
+			n.left.key.len == n.key.len+1 && n.right.key.len == n.key.len+1
+		if full && !n.isZero() {
+			ret = ret.insert(n.key.rooted(), true)
+		}
+		return full
+	}
+	covered(t)
+	return ret
+}
+
+// compacted returns a copy of t containing only the entries of t that are not
+// encompassed by another entry. If merge is not nil, pairs of sibling entries
+// of the same address family are then repeatedly replaced by their parent,
+// with the value returned by merge, wherever merge returns true.
+func (t *tree[T]) compacted(merge func(l, r T) (T, bool)) *tree[T] {
+	ret := &tree[T]{}
+	// walk does not visit the root, which may hold an entry for ::/0.
+	if t.hasValue {
+		return ret.setValue(t.value)
+	}
+	t.walk(key{}, func(n *tree[T]) bool {
+		if n.hasValue {
+			ret = ret.insert(n.key.rooted(), n.value)
+			return true
+		}
+		return false
+	})
+	if merge != nil {
+		ret.mergeSiblings(merge)
+	}
+	return ret
+}
+
+// mergeSiblings replaces each node of t, bottom-up, whose children are
+// entries covering exactly its two halves with an entry holding the merged
+// value of its children. t must own all of its nodes, and no entry of t may
+// have descendants.
+func (t *tree[T]) mergeSiblings(merge func(l, r T) (T, bool)) {
+	if t == nil || t.hasValue {
+		return
+	}
+	t.left.mergeSiblings(merge)
+	t.right.mergeSiblings(merge)
+	l, r := t.left, t.right
+	if t.isZero() || l == nil || r == nil || !l.hasValue || !r.hasValue {
+		return
+	}
+	if l.key.len != t.key.len+1 || r.key.len != t.key.len+1 {
+		return
+	}
+	// Don't merge an IPv4 entry with an IPv6 one.
+	if l.key.is4() != t.key.is4() || r.key.is4() != t.key.is4() {
+		return
+	}
+	if v, ok := merge(l.value, r.value); ok {
+		t.value, t.hasValue = v, true
+		t.left, t.right = nil, nil
+	}
+}
+
+// overlapsTree reports whether any entry of a overlaps any entry of b. It
+// descends both trees together, visiting only the parts of each that share a
+// path with the other, and returns as soon as an overlap is found.
+func overlapsTree[T any, U any](a *tree[T], b *tree[U]) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	visit()
+	if a.key.len > b.key.len {
+		return overlapsTree(b, a)
+	}
+	// a's key is no longer than b's, so they diverge unless a's is a prefix
+	// of b's.
+	if !a.key.isPrefixOf(b.key) {
+		return false
+	}
+	// An entry at a encompasses everything at or below b.
+	if a.hasEntry() && b.anyEntry() {
+		return true
+	}
+	if a.key.len == b.key.len {
+		if b.hasEntry() && a.anyEntry() {
+			return true
+		}
+		return overlapsTree(a.left, b.left) || overlapsTree(a.right, b.right)
+	}
+	// Follow a towards b.
+	if zero, _ := b.key.hasBitZeroAt(a.key.len); zero {
+		return overlapsTree(a.left, b)
+	}
+	return overlapsTree(a.right, b)
+}
+
+// hasEntry reports whether t holds an entry that walk can visit, i.e. t has
+// a value and is not the root node.
+func (t *tree[T]) hasEntry() bool {
+	return t.hasValue && !t.isZero()
+}
+
+// anyEntry reports whether t or any of its descendants holds an entry that
+// walk can visit.
+func (t *tree[T]) anyEntry() bool {
+	if t == nil {
+		return false
+	}
+	visit()
+	return t.hasEntry() || t.left.anyEntry() || t.right.anyEntry()
+}
+
+// intersectOrigins returns a tree containing each entry of a that is
+// encompassed by b, and each entry of b that is encompassed by a. Each value
+// records which of a (OriginReceiver) and b (OriginArgument) contributed the
+// entry.
+func intersectOrigins[T any, U any](a *tree[T], b *tree[U]) *tree[IntersectOrigin] {
+	ret := &tree[IntersectOrigin]{}
+	a.walk(key{}, func(n *tree[T]) bool {
+		if n.hasValue && b.encompasses(n.key, false) {
+			ret = ret.insert(n.key, OriginReceiver)
+		}
+		return false
+	})
+	b.walk(key{}, func(n *tree[U]) bool {
+		if n.hasValue && a.encompasses(n.key, false) {
+			origin, _ := ret.get(n.key)
+			ret = ret.insert(n.key, origin|OriginArgument)
+		}
+		return false
+	})
+	return ret
+}
+
 func (t *tree[T]) overlapsKey(k key) bool {
 	var ret bool
 	t.walk(k, func(n *tree[T]) bool {
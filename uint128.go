@@ -8,6 +8,7 @@ package netipds
 
 import (
 	"encoding/binary"
+	"math/big"
 	"math/bits"
 	"net/netip"
 )
@@ -80,6 +81,29 @@ func (u uint128) addOne() uint128 {
 	return uint128{u.hi + carry, lo}
 }
 
+// less reports whether u < v.
+func (u uint128) less(v uint128) bool {
+	return u.hi < v.hi || (u.hi == v.hi && u.lo < v.lo)
+}
+
+// add returns u + v.
+func (u uint128) add(v uint128) uint128 {
+	lo, carry := bits.Add64(u.lo, v.lo, 0)
+	return uint128{u.hi + v.hi + carry, lo}
+}
+
+// sub returns u - v.
+func (u uint128) sub(v uint128) uint128 {
+	lo, borrow := bits.Sub64(u.lo, v.lo, 0)
+	return uint128{u.hi - v.hi - borrow, lo}
+}
+
+// big returns u as a big.Int.
+func (u uint128) big() *big.Int {
+	b := new(big.Int).SetUint64(u.hi)
+	return b.Lsh(b, 64).Or(b, new(big.Int).SetUint64(u.lo))
+}
+
 func u64CommonPrefixLen(a, b uint64) uint8 {
 	return uint8(bits.LeadingZeros64(a ^ b))
 }
@@ -162,3 +162,25 @@ func TestIsBitZero(t *testing.T) {
 		}
 	}
 }
+
+func TestUint128AddSubUint128(t *testing.T) {
+	tests := []struct {
+		a, b    uint128
+		wantAdd uint128
+		wantSub uint128
+	}{
+		{uint128{0, 0}, uint128{0, 0}, uint128{0, 0}, uint128{0, 0}},
+		{uint128{0, 3}, uint128{0, 1}, uint128{0, 4}, uint128{0, 2}},
+		{uint128{1, 0}, uint128{0, 1}, uint128{1, 1}, uint128{0, ^uint64(0)}},
+		{uint128{0, ^uint64(0)}, uint128{0, 1}, uint128{1, 0}, uint128{0, ^uint64(0) - 1}},
+		{uint128{2, 5}, uint128{1, 7}, uint128{3, 12}, uint128{0, ^uint64(0) - 1}},
+	}
+	for _, tt := range tests {
+		if got := tt.a.add(tt.b); got != tt.wantAdd {
+			t.Errorf("%v.add(%v) = %v, want %v", tt.a, tt.b, got, tt.wantAdd)
+		}
+		if got := tt.a.sub(tt.b); got != tt.wantSub {
+			t.Errorf("%v.sub(%v) = %v, want %v", tt.a, tt.b, got, tt.wantSub)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// MultiVersionPrefixMap records the history of a map of netip.Prefix to T as
+// a series of timestamped versions, and can return the version that was in
+// effect at any point in time.
+//
+// Consecutive versions share all of the tree nodes that were not affected by
+// the changes between them, so retaining many versions of a large map with
+// few changes per version is inexpensive.
+//
+// Changes must be recorded in chronological order. Changes recorded at the
+// same time as the latest version are applied to that version.
+//
+// The zero value is a valid MultiVersionPrefixMap with no versions. It is not
+// safe for concurrent use, but the PrefixMaps returned by AsOf are.
+type MultiVersionPrefixMap[T any] struct {
+	// versions is sorted by at.
+	versions []prefixMapVersion[T]
+}
+
+type prefixMapVersion[T any] struct {
+	at   time.Time
+	tree *tree[T]
+}
+
+// Set records that, as of time at, p is associated with value.
+func (m *MultiVersionPrefixMap[T]) Set(at time.Time, p netip.Prefix, value T) error {
+	if !p.IsValid() {
+		return fmt.Errorf("Prefix is not valid: %v", p)
+	}
+	k := keyFromPrefix(p)
+	return m.update(at, k, func(t *tree[T]) *tree[T] {
+		return t.insert(k, value)
+	})
+}
+
+// Remove records that, as of time at, p is no longer in the map.
+func (m *MultiVersionPrefixMap[T]) Remove(at time.Time, p netip.Prefix) error {
+	if !p.IsValid() {
+		return fmt.Errorf("Prefix is not valid: %v", p)
+	}
+	k := keyFromPrefix(p)
+	return m.update(at, k, func(t *tree[T]) *tree[T] {
+		t.remove(k)
+		return t
+	})
+}
+
+// update records a new version at time at, produced by applying fn to a copy
+// of the latest version that can be modified along the path to k.
+func (m *MultiVersionPrefixMap[T]) update(at time.Time, k key, fn func(*tree[T]) *tree[T]) error {
+	latest := &tree[T]{}
+	if n := len(m.versions); n > 0 {
+		if at.Before(m.versions[n-1].at) {
+			return fmt.Errorf("version time %v is before latest version %v", at, m.versions[n-1].at)
+		}
+		latest = m.versions[n-1].tree
+	}
+	t := fn(latest.pathCopy(k))
+	if n := len(m.versions); n > 0 && at.Equal(m.versions[n-1].at) {
+		m.versions[n-1].tree = t
+	} else {
+		m.versions = append(m.versions, prefixMapVersion[T]{at, t})
+	}
+	return nil
+}
+
+// AsOf returns the version of the map in effect at time at, i.e. the latest
+// version recorded at or before at. If at is before the first version, AsOf
+// returns an empty PrefixMap.
+func (m *MultiVersionPrefixMap[T]) AsOf(at time.Time) *PrefixMap[T] {
+	i := sort.Search(len(m.versions), func(i int) bool {
+		return m.versions[i].at.After(at)
+	})
+	if i == 0 {
+		return &PrefixMap[T]{}
+	}
+	return &PrefixMap[T]{tree: *m.versions[i-1].tree}
+}
+
+// Versions returns the times at which versions were recorded, in ascending
+// order.
+func (m *MultiVersionPrefixMap[T]) Versions() []time.Time {
+	ret := make([]time.Time, len(m.versions))
+	for i, v := range m.versions {
+		ret[i] = v.at
+	}
+	return ret
+}
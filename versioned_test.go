@@ -0,0 +1,73 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestMultiVersionPrefixMap(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return t0.Add(time.Duration(h) * time.Hour) }
+
+	var m MultiVersionPrefixMap[string]
+	m.Set(at(1), pfx("10.0.0.0/8"), "a")
+	m.Set(at(1), pfx("10.1.0.0/16"), "b")
+	m.Set(at(2), pfx("10.0.0.0/8"), "c")
+	m.Set(at(3), pfx("10.1.0.0/17"), "d")
+	m.Remove(at(4), pfx("10.1.0.0/16"))
+	m.Remove(at(5), pfx("10.0.0.0/8"))
+
+	tests := []struct {
+		at   time.Time
+		want map[string]string
+	}{
+		{at(0), map[string]string{}},
+		{at(1), map[string]string{"10.0.0.0/8": "a", "10.1.0.0/16": "b"}},
+		{at(1).Add(time.Minute), map[string]string{"10.0.0.0/8": "a", "10.1.0.0/16": "b"}},
+		{at(2), map[string]string{"10.0.0.0/8": "c", "10.1.0.0/16": "b"}},
+		{at(3), map[string]string{"10.0.0.0/8": "c", "10.1.0.0/16": "b", "10.1.0.0/17": "d"}},
+		{at(4), map[string]string{"10.0.0.0/8": "c", "10.1.0.0/17": "d"}},
+		{at(5), map[string]string{"10.1.0.0/17": "d"}},
+		{at(100), map[string]string{"10.1.0.0/17": "d"}},
+	}
+	for _, tt := range tests {
+		want := make(map[netip.Prefix]string)
+		for p, v := range tt.want {
+			want[pfx(p)] = v
+		}
+		checkMap(t, want, m.AsOf(tt.at).ToMap())
+	}
+
+	if got := len(m.Versions()); got != 5 {
+		t.Errorf("len(m.Versions()) = %d, want 5", got)
+	}
+	if err := m.Set(at(3), pfx("10.0.0.0/8"), "e"); err == nil {
+		t.Errorf("m.Set before latest version returned nil error")
+	}
+}
+
+func TestMultiVersionPrefixMapSharing(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var m MultiVersionPrefixMap[int]
+	m.Set(t0, pfx("10.0.0.0/8"), 1)
+	m.Set(t0, pfx("192.168.0.0/16"), 2)
+	m.Set(t0.Add(time.Hour), pfx("10.1.0.0/16"), 3)
+
+	v0, v1 := m.versions[0].tree, m.versions[1].tree
+	// The 192.168.0.0/16 subtree is unaffected by the change, so it is shared.
+	var n0, n1 *tree[int]
+	v0.walk(keyFromPrefix(pfx("192.168.0.0/16")), func(n *tree[int]) bool {
+		n0 = n
+		return false
+	})
+	v1.walk(keyFromPrefix(pfx("192.168.0.0/16")), func(n *tree[int]) bool {
+		n1 = n
+		return false
+	})
+	if n0 == nil || n0 != n1 {
+		t.Errorf("192.168.0.0/16 node not shared between versions: %p, %p", n0, n1)
+	}
+}
@@ -0,0 +1,117 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"net/netip"
+)
+
+// PrefixMapView is a read-only view of the entries of a PrefixMap that are
+// encompassed by a particular Prefix (including the Prefix itself). Unlike
+// DescendantsOf, creating a view does not copy any part of the PrefixMap;
+// queries on the view are answered directly from the underlying tree.
+//
+// Use PrefixMap.ViewOf to obtain a PrefixMapView.
+type PrefixMapView[T any] struct {
+	prefix netip.Prefix
+
+	// root is the topmost node of the underlying tree that is encompassed by
+	// prefix, or nil if there is none.
+	root *tree[T]
+}
+
+// ViewOf returns a read-only view of the entries of m that are encompassed by
+// p, including p itself.
+func (m *PrefixMap[T]) ViewOf(p netip.Prefix) *PrefixMapView[T] {
+	v := &PrefixMapView[T]{prefix: p}
+	if !p.IsValid() {
+		return v
+	}
+	// Follow the path to k down to the first node that it encompasses. For
+	// ::/0, that is the root of m, which holds the entries of both halves.
+	k := keyFromPrefix(p)
+	for n := &m.tree; n != nil; n = n.toward(k) {
+		if k.isPrefixOf(n.key) {
+			v.root = n
+			break
+		}
+		if !n.key.isPrefixOf(k) {
+			break
+		}
+	}
+	return v
+}
+
+// Prefix returns the Prefix the view is bound to.
+func (v *PrefixMapView[T]) Prefix() netip.Prefix {
+	return v.prefix
+}
+
+// Size returns the number of entries in the view. It is computed on each call
+// by traversing the view.
+func (v *PrefixMapView[T]) Size() int {
+	if v.root == nil {
+		return 0
+	}
+	return v.root.size()
+}
+
+// Get returns the value associated with the exact Prefix provided, if it is
+// in the view.
+func (v *PrefixMapView[T]) Get(p netip.Prefix) (val T, ok bool) {
+	if v.root == nil {
+		return val, false
+	}
+	return v.root.get(keyFromPrefix(p))
+}
+
+// Contains returns true if the view includes the exact Prefix provided.
+func (v *PrefixMapView[T]) Contains(p netip.Prefix) bool {
+	return v.root != nil && v.root.contains(keyFromPrefix(p))
+}
+
+// Encompasses returns true if the view includes a Prefix which completely
+// encompasses the provided Prefix.
+func (v *PrefixMapView[T]) Encompasses(p netip.Prefix) bool {
+	return v.root != nil && v.root.encompasses(keyFromPrefix(p), false)
+}
+
+// ParentOf returns the longest-prefix ancestor of the Prefix provided within
+// the view, if any.
+func (v *PrefixMapView[T]) ParentOf(p netip.Prefix) (outPfx netip.Prefix, val T, ok bool) {
+	if v.root == nil {
+		return outPfx, val, false
+	}
+	k, val, ok := v.root.parentOf(keyFromPrefix(p), false)
+	if !ok {
+		return outPfx, val, false
+	}
+	return prefixFromKey(k), val, true
+}
+
+// ParentOfStrict is like ParentOf, but excludes the Prefix itself.
+func (v *PrefixMapView[T]) ParentOfStrict(p netip.Prefix) (outPfx netip.Prefix, val T, ok bool) {
+	if v.root == nil {
+		return outPfx, val, false
+	}
+	k, val, ok := v.root.parentOf(keyFromPrefix(p), true)
+	if !ok {
+		return outPfx, val, false
+	}
+	return prefixFromKey(k), val, true
+}
+
+// ToMap returns a map of all Prefixes in the view to their associated values.
+func (v *PrefixMapView[T]) ToMap() map[netip.Prefix]T {
+	res := make(map[netip.Prefix]T)
+	if v.root == nil {
+		return res
+	}
+	v.root.walk(key{}, func(n *tree[T]) bool {
+		if n.hasValue {
+			res[prefixFromKey(n.key)] = n.value
+		}
+		return false
+	})
+	return res
+}
@@ -0,0 +1,91 @@
+//go:build !netipds_core
+
+package netipds
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPrefixMapViewOf(t *testing.T) {
+	pmb := &PrefixMapBuilder[bool]{}
+	for _, p := range pfxs("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.0.0/16", "11.0.0.0/8", "2001:db8::/32", "fd00::/8") {
+		pmb.Set(p, true)
+	}
+	pm := pmb.PrefixMap()
+
+	tests := []struct {
+		view        netip.Prefix
+		want        map[netip.Prefix]bool
+		get         netip.Prefix
+		wantGet     bool
+		encompasses netip.Prefix
+		wantEnc     bool
+		parentOf    netip.Prefix
+		wantParent  netip.Prefix
+	}{
+		{
+			view:        pfx("10.1.0.0/16"),
+			want:        wantMap(true, "10.1.0.0/16", "10.1.2.0/24"),
+			get:         pfx("10.1.2.0/24"),
+			wantGet:     true,
+			encompasses: pfx("10.1.3.0/24"),
+			wantEnc:     true,
+			parentOf:    pfx("10.1.2.3/32"),
+			wantParent:  pfx("10.1.2.0/24"),
+		},
+		// Entries outside the view are not visible
+		{
+			view:        pfx("10.1.2.0/23"),
+			want:        wantMap(true, "10.1.2.0/24"),
+			get:         pfx("10.0.0.0/8"),
+			wantGet:     false,
+			encompasses: pfx("10.1.3.0/24"),
+			wantEnc:     false,
+			parentOf:    pfx("10.1.3.0/32"),
+			wantParent:  netip.Prefix{},
+		},
+		// Both halves of the address space
+		{
+			view:        pfx("::/0"),
+			want:        wantMap(true, "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.0.0/16", "11.0.0.0/8", "2001:db8::/32", "fd00::/8"),
+			get:         pfx("2001:db8::/32"),
+			wantGet:     true,
+			encompasses: pfx("10.1.3.0/24"),
+			wantEnc:     true,
+			parentOf:    pfx("10.1.2.3/32"),
+			wantParent:  pfx("10.1.2.0/24"),
+		},
+		// Empty view
+		{
+			view:        pfx("12.0.0.0/8"),
+			want:        wantMap(true),
+			get:         pfx("12.0.0.0/8"),
+			encompasses: pfx("12.0.0.0/8"),
+			parentOf:    pfx("12.0.0.0/8"),
+		},
+	}
+	for _, tt := range tests {
+		v := pm.ViewOf(tt.view)
+		checkMap(t, tt.want, v.ToMap())
+		if got := v.Size(); got != len(tt.want) {
+			t.Errorf("ViewOf(%v).Size() = %d, want %d", tt.view, got, len(tt.want))
+		}
+		if _, ok := v.Get(tt.get); ok != tt.wantGet {
+			t.Errorf("ViewOf(%v).Get(%v) = %v, want %v", tt.view, tt.get, ok, tt.wantGet)
+		}
+		if got := v.Contains(tt.get); got != tt.wantGet {
+			t.Errorf("ViewOf(%v).Contains(%v) = %v, want %v", tt.view, tt.get, got, tt.wantGet)
+		}
+		if got := v.Encompasses(tt.encompasses); got != tt.wantEnc {
+			t.Errorf("ViewOf(%v).Encompasses(%v) = %v, want %v", tt.view, tt.encompasses, got, tt.wantEnc)
+		}
+		if got, _, _ := v.ParentOf(tt.parentOf); got != tt.wantParent {
+			t.Errorf("ViewOf(%v).ParentOf(%v) = %v, want %v", tt.view, tt.parentOf, got, tt.wantParent)
+		}
+		// parentOf is never an entry itself, so the strict variant agrees.
+		if got, _, _ := v.ParentOfStrict(tt.parentOf); got != tt.wantParent {
+			t.Errorf("ViewOf(%v).ParentOfStrict(%v) = %v, want %v", tt.view, tt.parentOf, got, tt.wantParent)
+		}
+	}
+}